@@ -0,0 +1,169 @@
+package concurrentlimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// LimitSetter is implemented by limiters whose limit can be changed while they are running,
+// including the limiters returned by New, NewQueued, and NewWeighted.
+type LimitSetter interface {
+	// SetLimit changes the limit. Lowering it does not stop running operations: new operations are
+	// rejected until enough of them complete. It will panic if limit <= 0.
+	SetLimit(limit int)
+}
+
+func checkLimit(limit int) {
+	if limit <= 0 {
+		panic(fmt.Sprintf("limit must be > 0: %d", limit))
+	}
+}
+
+// SetLimit changes the maximum number of concurrent operations.
+func (s *syncLimiter) SetLimit(limit int) {
+	checkLimit(limit)
+	s.mu.Lock()
+	s.max = limit
+	s.storeApprox(s.current, s.max)
+	s.mu.Unlock()
+}
+
+// SetLimit changes the maximum number of concurrent operations. If it is raised, queued
+// operations start immediately.
+func (q *QueuedLimiter) SetLimit(limit int) {
+	checkLimit(limit)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.max = limit
+	for q.current < q.max && q.waiters.Len() > 0 {
+		w := q.waiters.Remove(q.waiters.Front()).(*queueWaiter)
+		w.granted = true
+		close(w.ready)
+		q.startLocked()
+	}
+	q.storeApprox(q.current, q.max)
+}
+
+// SetLimit changes the capacity.
+func (w *WeightedLimiter) SetLimit(limit int) {
+	checkLimit(limit)
+	w.mu.Lock()
+	w.max = limit
+	w.storeApprox(w.current, w.max)
+	w.mu.Unlock()
+}
+
+// unwrap returns the limiter wrapped by a MetricsLimiter, RolloutLimiter, BreakerLimiter, or
+// CompositeLimiter, or nil if limiter does not wrap another limiter.
+func unwrap(limiter Limiter) Limiter {
+	switch l := limiter.(type) {
+	case *MetricsLimiter:
+		return l.limiter
+	case *RolloutLimiter:
+		return l.limiter
+	case *BreakerLimiter:
+		return l.limiter
+	case *CompositeLimiter:
+		return l.limiter
+	}
+	return nil
+}
+
+// limitSetter returns the LimitSetter that changes limiter's limit: limiter, or the first limiter
+// it wraps that implements LimitSetter. Wrappers such as MetricsLimiter do not implement
+// LimitSetter, since they can only change the limit if the limiter they wrap can.
+func limitSetter(limiter Limiter) (LimitSetter, bool) {
+	for limiter != nil {
+		if setter, ok := limiter.(LimitSetter); ok {
+			return setter, true
+		}
+		limiter = unwrap(limiter)
+	}
+	return nil, false
+}
+
+// findWrapped returns the first limiter of type T that is limiter or is wrapped by it.
+func findWrapped[T Limiter](limiter Limiter) (T, bool) {
+	for limiter != nil {
+		if found, ok := limiter.(T); ok {
+			return found, true
+		}
+		limiter = unwrap(limiter)
+	}
+	var zero T
+	return zero, false
+}
+
+// limitStatus is the state of a limiter reported by AdminHandler.
+type limitStatus struct {
+	Current int `json:"current"`
+	Limit   int `json:"limit"`
+	Peak    int `json:"peak"`
+	Queued  int `json:"queued"`
+	// Breaker is the state of a BreakerLimiter's circuit breaker, if there is one
+	Breaker string `json:"breaker,omitempty"`
+	// Signals are the values of a CompositeLimiter's signals, if there is one
+	Signals map[string]float64 `json:"signals,omitempty"`
+}
+
+// AdminHandler returns an http.Handler that reports the state of limiter as JSON, and changes its
+// limit on POST requests with the form value limit, e.g. curl -d limit=10. The limiter must
+// implement LimitSetter to be changed, or wrap one (see MetricsLimiter), and StatsReporter to
+// report its state. If it is or wraps a BreakerLimiter or CompositeLimiter, it also reports the
+// breaker's state or the signals' values. The handler does not authenticate requests, so it should
+// only be served on a private address, and it should not be limited by limiter, so the limit can be
+// raised while the server is overloaded.
+func AdminHandler(limiter Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			setter, ok := limitSetter(limiter)
+			if !ok {
+				http.Error(w, "the limit cannot be changed", http.StatusNotImplemented)
+				return
+			}
+			limit, err := strconv.Atoi(r.FormValue("limit"))
+			if err != nil || limit <= 0 {
+				http.Error(w, fmt.Sprintf("limit=%#v must be an integer > 0", r.FormValue("limit")),
+					http.StatusBadRequest)
+				return
+			}
+			setter.SetLimit(limit)
+			log.Printf("admin: changed the limit to %d", limit)
+		}
+
+		writeJSON(w, statusOf(limiter))
+	})
+}
+
+// statusOf returns the state of limiter reported by AdminHandler.
+func statusOf(limiter Limiter) limitStatus {
+	status := limitStatus{}
+	if reporter, ok := limiter.(StatsReporter); ok {
+		stats := reporter.Stats()
+		status = limitStatus{Current: stats.Current, Limit: stats.Limit, Peak: stats.Peak, Queued: stats.Queued}
+	}
+	if breaker, ok := findWrapped[*BreakerLimiter](limiter); ok {
+		status.Breaker = breaker.BreakerState().String()
+	}
+	if composite, ok := findWrapped[*CompositeLimiter](limiter); ok {
+		status.Signals = composite.Values()
+	}
+	return status
+}
+
+// writeJSON writes value as an uncacheable JSON response.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	// ignore the error: there is nothing we can do if writing the response fails
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,175 @@
+package concurrentlimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdmissionRecord is one admission decision recorded by an AuditLog.
+type AdmissionRecord struct {
+	Time     time.Time `json:"time"`
+	Admitted bool      `json:"admitted"`
+	// Current, Limit, and Queued are the limiter's Stats just after the decision, so Current
+	// includes an admitted operation. They are 0 if the limiter does not implement StatsReporter.
+	Current int `json:"current"`
+	Limit   int `json:"limit"`
+	Queued  int `json:"queued"`
+	// Route is the HTTP path or gRPC method of the request.
+	Route string `json:"route"`
+	// Key identifies the caller, such as an API key, or is empty.
+	Key string `json:"key,omitempty"`
+	// RequestID is the request's ID (see RequestIDHandler), or is empty.
+	RequestID string `json:"request_id,omitempty"`
+	// Error is the reason the request was rejected, or empty if it was admitted.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditLog keeps a sample of admission decisions in a fixed size ring buffer, to answer what was
+// happening at a point in time during an incident review, which aggregate metrics cannot. Handler
+// serves the records. A nil *AuditLog records nothing, so it can be passed to AuditHandler when
+// auditing is disabled.
+type AuditLog struct {
+	fraction float64
+	clock    Clock
+
+	mu      sync.Mutex
+	records []AdmissionRecord
+	// next is the index in records that the next record replaces, once records is full
+	next int
+}
+
+// NewAuditLog returns an AuditLog that records fraction of the admission decisions, and keeps the
+// most recent size records. It panics if size <= 0 or fraction is not in (0, 1].
+func NewAuditLog(size int, fraction float64) *AuditLog {
+	if size <= 0 {
+		panic(fmt.Sprintf("NewAuditLog: size=%d must be > 0", size))
+	}
+	if !(0 < fraction && fraction <= 1) {
+		panic(fmt.Sprintf("NewAuditLog: fraction=%f must be in (0, 1]", fraction))
+	}
+	return &AuditLog{fraction: fraction, clock: systemClock{}, records: make([]AdmissionRecord, 0, size)}
+}
+
+// SetClock replaces the clock used to timestamp records, which is the system clock by default. It
+// must be called before the log is used.
+func (a *AuditLog) SetClock(clock Clock) {
+	a.clock = clock
+}
+
+// Record samples the decision limiter made for a request to route from key, where err is the
+// error returned by its Start method, or nil if the request was admitted.
+func (a *AuditLog) Record(limiter Limiter, route string, key string, err error) {
+	a.RecordContext(context.Background(), limiter, route, key, err)
+}
+
+// RecordContext is a version of Record that also records the request ID in ctx, the request's
+// context (see RequestIDFromContext).
+func (a *AuditLog) RecordContext(ctx context.Context, limiter Limiter, route string, key string, err error) {
+	if a == nil || (a.fraction < 1 && rand.Float64() >= a.fraction) {
+		return
+	}
+
+	record := AdmissionRecord{
+		Time: a.clock.Now(), Admitted: err == nil, Route: route, Key: key, RequestID: RequestIDFromContext(ctx),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if reporter, ok := limiter.(StatsReporter); ok {
+		stats := reporter.Stats()
+		record.Current = stats.Current
+		record.Limit = stats.Limit
+		record.Queued = stats.Queued
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.records) < cap(a.records) {
+		a.records = append(a.records, record)
+		return
+	}
+	a.records[a.next] = record
+	a.next = (a.next + 1) % len(a.records)
+}
+
+// Records returns the kept records from since to until, oldest first. The zero time does not
+// limit the range.
+func (a *AuditLog) Records(since time.Time, until time.Time) []AdmissionRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	records := []AdmissionRecord{}
+	for i := range a.records {
+		record := a.records[(a.next+i)%len(a.records)]
+		if (!since.IsZero() && record.Time.Before(since)) || (!until.IsZero() && record.Time.After(until)) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// Handler returns an http.Handler that reports the kept records as a JSON array, oldest first.
+// The optional since and until query parameters are RFC 3339 times that limit the range, e.g.
+// ?since=2024-05-01T14:30:00Z&until=2024-05-01T14:35:00Z. Like AdminHandler, it should only be
+// served on a private address, since the records contain the keys of callers.
+func (a *AuditLog) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		var times [2]time.Time
+		for i, name := range []string{"since", "until"} {
+			value := r.FormValue(name)
+			if value == "" {
+				continue
+			}
+			var err error
+			times[i], err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s=%#v must be an RFC 3339 time", name, value), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, a.Records(times[0], times[1]))
+	})
+}
+
+// AuditHandler is a version of Handler that records its admission decisions in audit, with the
+// request's path as the route, the key returned by keyFunc, such as HeaderKey, and the request ID
+// if it is wrapped by RequestIDHandler. keyFunc may be nil to not record keys. If audit is nil, it
+// is equivalent to Handler.
+func AuditHandler(
+	audit *AuditLog, limiter Limiter, keyFunc func(*http.Request) string, handler http.Handler,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		end, err := limiter.Start()
+		if audit != nil {
+			key := ""
+			if keyFunc != nil {
+				key = keyFunc(r)
+			}
+			audit.RecordContext(r.Context(), limiter, r.URL.Path, key, err)
+		}
+		if err == ErrLimited {
+			WriteLimiterRejection(w, limiter, ShedCapacity, err)
+			return
+		}
+		if err != nil {
+			// this should not happen, but if it does return a very generic 500 error
+			log.Println("concurrentlimit.Handler BUG: unexpected error: " + err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// permitted: start the operation and end it, unless it was detached
+		ctx, release := WithOperation(r.Context(), end)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+		release()
+	})
+}
@@ -0,0 +1,56 @@
+package concurrentlimit
+
+// Default memory estimates used by AutoSize. The connection estimate is for gRPC, which uses much
+// more memory per connection than HTTP (~230 KiB versus ~40 KiB).
+const defaultAutoRequestBytes = 1 << 20
+const defaultAutoConnectionBytes = 256 << 10
+const defaultAutoReservedFraction = 0.5
+
+// AutoOptions describes the memory available to a server and used by its requests and
+// connections, so AutoSize can compute its limits.
+type AutoOptions struct {
+	// MemoryBytes is the memory available to the server, e.g. its container's memory limit.
+	MemoryBytes int64
+	// RequestBytes is the peak memory used by one request. If <= 0, it is 1 MiB.
+	RequestBytes int64
+	// ConnectionBytes is the memory used by one open connection. If <= 0, it is 256 KiB.
+	ConnectionBytes int64
+	// ReservedFraction is the fraction of MemoryBytes reserved for the rest of the process and
+	// garbage collection overhead. If <= 0, it is 0.5.
+	ReservedFraction float64
+}
+
+// AutoLimits are the limits computed by AutoSize.
+type AutoLimits struct {
+	Requests    int
+	Connections int
+}
+
+// AutoSize computes request and connection limits that fit in the memory described by options.
+// It permits two connections per request, so some idle connections do not block busy clients,
+// and always permits at least one request.
+func AutoSize(options AutoOptions) AutoLimits {
+	if options.RequestBytes <= 0 {
+		options.RequestBytes = defaultAutoRequestBytes
+	}
+	if options.ConnectionBytes <= 0 {
+		options.ConnectionBytes = defaultAutoConnectionBytes
+	}
+	if options.ReservedFraction <= 0 {
+		options.ReservedFraction = defaultAutoReservedFraction
+	}
+
+	available := float64(options.MemoryBytes) * (1 - options.ReservedFraction)
+	perRequest := float64(options.RequestBytes + 2*options.ConnectionBytes)
+	requests := int(available / perRequest)
+	if requests < 1 {
+		requests = 1
+	}
+	return AutoLimits{Requests: requests, Connections: 2 * requests}
+}
+
+// NewAuto returns a Limiter that permits the number of concurrent operations computed by
+// AutoSize.
+func NewAuto(options AutoOptions) Limiter {
+	return New(AutoSize(options).Requests)
+}
@@ -0,0 +1,163 @@
+package concurrentlimit
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// bandwidthWriteChunk is the maximum bytes a throttled connection writes at once, so large writes
+// are spread out instead of sent in a burst after a long delay.
+const bandwidthWriteChunk = 16 * 1024
+
+// BandwidthLimiter limits the rate that connections read and write bytes, for all connections
+// together and for each connection. Overload is not always caused by too many requests: a few
+// clients sending or receiving large bodies can fill buffers and use all the network bandwidth.
+// Connections wait after reading and before writing until the rates permit it, so clients that
+// send too fast are slowed down by TCP flow control. Pass it to ListenWithOptions or
+// LimitListener with ListenOptions.Bandwidth.
+type BandwidthLimiter struct {
+	connBytesPerSecond int64
+
+	mu        sync.Mutex
+	aggregate *tokenBucket
+	stats     BandwidthStats
+}
+
+// BandwidthStats counts the bytes transferred by the connections of a BandwidthLimiter.
+type BandwidthStats struct {
+	// Bytes is the total bytes read and written.
+	Bytes int64
+	// ThrottledBytes is the bytes that had to wait because a rate was exceeded.
+	ThrottledBytes int64
+	// ThrottledDelay is the total time connections waited.
+	ThrottledDelay time.Duration
+}
+
+// NewBandwidthLimiter returns a BandwidthLimiter that permits bytesPerSecond for all connections,
+// and connBytesPerSecond for each connection. Reads and writes are counted together. Either can
+// be 0 for no limit. Each rate permits a burst of one second of bytes. It will panic if either is
+// < 0.
+func NewBandwidthLimiter(bytesPerSecond int64, connBytesPerSecond int64) *BandwidthLimiter {
+	if bytesPerSecond < 0 || connBytesPerSecond < 0 {
+		panic(fmt.Sprintf("bytesPerSecond=%d and connBytesPerSecond=%d must be >= 0",
+			bytesPerSecond, connBytesPerSecond))
+	}
+	b := &BandwidthLimiter{connBytesPerSecond: connBytesPerSecond}
+	if bytesPerSecond > 0 {
+		b.aggregate = newTokenBucket(bytesPerSecond, time.Now())
+	}
+	return b
+}
+
+// Stats returns the bytes transferred so far.
+func (b *BandwidthLimiter) Stats() BandwidthStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// Conn returns a net.Conn that limits the bytes conn reads and writes.
+func (b *BandwidthLimiter) Conn(conn net.Conn) net.Conn {
+	c := &bandwidthConn{Conn: conn, limiter: b}
+	if b.connBytesPerSecond > 0 {
+		c.bucket = newTokenBucket(b.connBytesPerSecond, time.Now())
+	}
+	return c
+}
+
+// take counts n bytes transferred by a connection with bucket, which may be nil, and waits until
+// the rates permit them.
+func (b *BandwidthLimiter) take(bucket *tokenBucket, n int) {
+	now := time.Now()
+	b.mu.Lock()
+	var delay time.Duration
+	if b.aggregate != nil {
+		delay = b.aggregate.take(now, n)
+	}
+	if bucket != nil {
+		// each connection is only used by one reader and one writer, but they can run concurrently
+		if connDelay := bucket.take(now, n); connDelay > delay {
+			delay = connDelay
+		}
+	}
+	b.stats.Bytes += int64(n)
+	if delay > 0 {
+		b.stats.ThrottledBytes += int64(n)
+		b.stats.ThrottledDelay += delay
+	}
+	b.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type bandwidthConn struct {
+	net.Conn
+	limiter *BandwidthLimiter
+	// bucket limits this connection, or is nil if connections are not limited separately
+	bucket *tokenBucket
+}
+
+func (c *bandwidthConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limiter.take(c.bucket, n)
+	}
+	return n, err
+}
+
+func (c *bandwidthConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > bandwidthWriteChunk {
+			chunk = chunk[:bandwidthWriteChunk]
+		}
+		c.limiter.take(c.bucket, len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// tokenBucket permits bytesPerSecond, with a burst of one second. It is not safe for concurrent
+// use.
+type tokenBucket struct {
+	bytesPerSecond float64
+	// tokens is the bytes that can be transferred without waiting; negative if callers must wait
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		bytesPerSecond: float64(bytesPerSecond),
+		tokens:         float64(bytesPerSecond),
+		last:           now,
+	}
+}
+
+// take removes n tokens at now, and returns how long the caller must wait until they are
+// available. Callers that take tokens while others are waiting wait after them.
+func (t *tokenBucket) take(now time.Time, n int) time.Duration {
+	if elapsed := now.Sub(t.last); elapsed > 0 {
+		t.tokens += elapsed.Seconds() * t.bytesPerSecond
+		if t.tokens > t.bytesPerSecond {
+			t.tokens = t.bytesPerSecond
+		}
+		t.last = now
+	}
+
+	t.tokens -= float64(n)
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / t.bytesPerSecond * float64(time.Second))
+}
@@ -0,0 +1,109 @@
+package concurrentlimit
+
+import "fmt"
+
+// BatchStarter is implemented by limiters that can start several operations at once.
+type BatchStarter interface {
+	// StartBatch begins n operations if all of them are permitted, or none of them. It returns
+	// one completion function for each operation, or ErrLimited.
+	StartBatch(n int) ([]func(), error)
+}
+
+// StartBatch begins n operations with limiter if all of them are permitted, or none of them. It
+// returns one completion function for each operation, which must each be called when that
+// operation completes. This is intended for handlers that split a request into n parallel
+// sub-operations: starting them one at a time can deadlock if several handlers each start some
+// and wait for the rest. If limiter does not implement BatchStarter, this starts operations one
+// at a time, and ends them if one is rejected. It will panic if n <= 0.
+func StartBatch(limiter Limiter, n int) ([]func(), error) {
+	checkBatch(n)
+	if batcher, ok := limiter.(BatchStarter); ok {
+		return batcher.StartBatch(n)
+	}
+
+	ends := make([]func(), 0, n)
+	for i := 0; i < n; i++ {
+		end, err := limiter.Start()
+		if err != nil {
+			for _, end := range ends {
+				end()
+			}
+			return nil, err
+		}
+		ends = append(ends, end)
+	}
+	return ends, nil
+}
+
+func checkBatch(n int) {
+	if n <= 0 {
+		panic(fmt.Sprintf("n must be > 0: %d", n))
+	}
+}
+
+// repeatEnd returns a slice containing end n times.
+func repeatEnd(end func(), n int) []func() {
+	ends := make([]func(), n)
+	for i := range ends {
+		ends[i] = end
+	}
+	return ends
+}
+
+func (s *syncLimiter) StartBatch(n int) ([]func(), error) {
+	checkBatch(n)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.current + n
+	if next > s.max {
+		return nil, ErrLimited
+	}
+	s.current = next
+	if s.current > s.peak {
+		s.peak = s.current
+	}
+	s.storeApprox(s.current, s.max)
+	return repeatEnd(s.end, n), nil
+}
+
+// StartBatch begins n operations without waiting, if all of them are permitted. It implements
+// BatchStarter.
+func (q *QueuedLimiter) StartBatch(n int) ([]func(), error) {
+	checkBatch(n)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.current+n > q.max {
+		return nil, ErrLimited
+	}
+	for i := 0; i < n; i++ {
+		q.startLocked()
+	}
+	return repeatEnd(q.end, n), nil
+}
+
+// StartBatch begins n operations with a cost of 1, if all of them are permitted. It implements
+// BatchStarter.
+func (w *WeightedLimiter) StartBatch(n int) ([]func(), error) {
+	checkBatch(n)
+	// reserve the total cost at once, then end each operation separately
+	if _, err := w.StartN(n); err != nil {
+		return nil, err
+	}
+	return repeatEnd(func() { w.end(1) }, n), nil
+}
+
+// StartBatch begins n operations with the wrapped limiter, using its StartBatch method if it has
+// one. It implements BatchStarter.
+func (m *MetricsLimiter) StartBatch(n int) ([]func(), error) {
+	ends, err := StartBatch(m.limiter, n)
+	if err != nil {
+		_, err = m.record(nil, err, 0)
+		return nil, err
+	}
+	for i, end := range ends {
+		ends[i], _ = m.record(end, nil, 0)
+	}
+	return ends, nil
+}
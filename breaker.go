@@ -0,0 +1,158 @@
+package concurrentlimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed means the protected dependency is healthy, so operations are permitted.
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen means the breaker is testing if the dependency recovered, so only a trickle
+	// of operations are permitted.
+	BreakerHalfOpen
+	// BreakerOpen means the dependency is failing, so no operations are permitted.
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// Breaker reports the state of a circuit breaker, such as github.com/sony/gobreaker or a custom
+// one. Implementations must be safe for concurrent use, and should be fast: BreakerLimiter calls
+// it for every operation.
+type Breaker interface {
+	BreakerState() BreakerState
+}
+
+// BreakerFunc adapts a function to a Breaker. For example, with gobreaker:
+//
+//	concurrentlimit.BreakerFunc(func() concurrentlimit.BreakerState {
+//	    switch cb.State() {
+//	    case gobreaker.StateOpen:
+//	        return concurrentlimit.BreakerOpen
+//	    case gobreaker.StateHalfOpen:
+//	        return concurrentlimit.BreakerHalfOpen
+//	    }
+//	    return concurrentlimit.BreakerClosed
+//	})
+type BreakerFunc func() BreakerState
+
+// BreakerState calls f.
+func (f BreakerFunc) BreakerState() BreakerState {
+	return f()
+}
+
+// BreakerLimiter wraps a Limiter so a circuit breaker can stop admitting operations. When the
+// breaker is open, it rejects every operation with ErrLimited. When it is half-open, it permits
+// only a trickle of concurrent operations, so the breaker can find out if the dependency
+// recovered without overloading it again. When it is closed, only the wrapped limiter applies.
+// AdminHandler reports the breaker's state.
+type BreakerLimiter struct {
+	limiter       Limiter
+	breaker       Breaker
+	halfOpenLimit int
+
+	mu sync.Mutex
+	// halfOpenCurrent is the number of running operations started while half-open
+	halfOpenCurrent int
+	// rejected counts the operations rejected by the breaker, not the wrapped limiter
+	rejected atomic.Int64
+}
+
+// NewBreakerLimiter returns a BreakerLimiter that starts operations with limiter while breaker is
+// closed, and permits halfOpenLimit concurrent operations while it is half-open. It will panic if
+// halfOpenLimit < 0.
+func NewBreakerLimiter(limiter Limiter, breaker Breaker, halfOpenLimit int) *BreakerLimiter {
+	if halfOpenLimit < 0 {
+		panic(fmt.Sprintf("halfOpenLimit must be >= 0: %d", halfOpenLimit))
+	}
+	return &BreakerLimiter{limiter: limiter, breaker: breaker, halfOpenLimit: halfOpenLimit}
+}
+
+// BreakerState returns the breaker's current state.
+func (b *BreakerLimiter) BreakerState() BreakerState {
+	return b.breaker.BreakerState()
+}
+
+// Rejected returns the number of operations rejected because the breaker was open or half-open.
+func (b *BreakerLimiter) Rejected() int64 {
+	return b.rejected.Load()
+}
+
+// Start begins an operation with the wrapped limiter if the breaker permits it. It implements
+// Limiter.
+func (b *BreakerLimiter) Start() (func(), error) {
+	return b.start(func() (func(), error) { return b.limiter.Start() })
+}
+
+// StartContext is a version of Start that calls the wrapped limiter's StartContext. It implements
+// ContextLimiter.
+func (b *BreakerLimiter) StartContext(ctx context.Context) (func(), error) {
+	return b.start(func() (func(), error) { return WithContext(b.limiter).StartContext(ctx) })
+}
+
+func (b *BreakerLimiter) start(startLimiter func() (func(), error)) (func(), error) {
+	switch b.breaker.BreakerState() {
+	case BreakerClosed:
+		return startLimiter()
+	case BreakerHalfOpen:
+		// handled below
+	default:
+		b.rejected.Add(1)
+		return nil, ErrLimited
+	}
+
+	b.mu.Lock()
+	if b.halfOpenCurrent >= b.halfOpenLimit {
+		b.mu.Unlock()
+		b.rejected.Add(1)
+		return nil, ErrLimited
+	}
+	b.halfOpenCurrent++
+	b.mu.Unlock()
+
+	end, err := startLimiter()
+	if err != nil {
+		b.endHalfOpen()
+		return nil, err
+	}
+	return func() {
+		end()
+		b.endHalfOpen()
+	}, nil
+}
+
+func (b *BreakerLimiter) endHalfOpen() {
+	b.mu.Lock()
+	b.halfOpenCurrent--
+	b.mu.Unlock()
+}
+
+// Stats returns the wrapped limiter's state if it implements StatsReporter.
+func (b *BreakerLimiter) Stats() Stats {
+	if reporter, ok := b.limiter.(StatsReporter); ok {
+		return reporter.Stats()
+	}
+	return Stats{}
+}
+
+// CurrentApprox returns the wrapped limiter's running operations and limit without locking, if it
+// implements ApproxReporter. It implements ApproxReporter.
+func (b *BreakerLimiter) CurrentApprox() (int, int) {
+	return currentApprox(b.limiter)
+}
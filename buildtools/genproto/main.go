@@ -0,0 +1,88 @@
+// Genproto regenerates the Go code for this repository's protocol buffer files with the protoc and
+// plugins installed by make tools, then checks that the generated packages compile. Run it from
+// the repository root:
+//
+//	go run ./buildtools/genproto
+//	go run ./buildtools/genproto sleepymemory/sleepymemory.proto
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// defaultProtos are the protocol buffer files generated if none are passed as arguments.
+var defaultProtos = []string{
+	"sleepymemory/sleepymemory.proto",
+	"loadclient/loadworker/loadworker.proto",
+}
+
+func main() {
+	buildDir := flag.String("buildDir", "build", "Directory containing bin/protoc, include/, and the protoc plugins")
+	check := flag.Bool("check", true, "Check that the generated packages compile")
+	flag.Parse()
+
+	protos := flag.Args()
+	if len(protos) == 0 {
+		protos = defaultProtos
+	}
+	err := generate(*buildDir, protos, *check)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate runs protoc for each of protos with the tools in buildDir, then builds the generated
+// packages if check is true.
+func generate(buildDir string, protos []string, check bool) error {
+	protoc := filepath.Join(buildDir, "bin", "protoc")
+	protocGenGo := filepath.Join(buildDir, "protoc-gen-go")
+	protocGenGoGRPC := filepath.Join(buildDir, "protoc-gen-go-grpc")
+	for _, tool := range []string{protoc, protocGenGo, protocGenGoGRPC} {
+		if _, err := os.Stat(tool); err != nil {
+			return fmt.Errorf("missing tool %s: run make tools: %w", tool, err)
+		}
+	}
+
+	packages := []string{}
+	for _, proto := range protos {
+		args := []string{
+			// the repository root, so imports and output paths are relative to it
+			"--proto_path=.",
+			// the well-known types, such as google/protobuf/duration.proto
+			"--proto_path=" + filepath.Join(buildDir, "include"),
+			"--plugin=" + protocGenGo,
+			"--plugin=" + protocGenGoGRPC,
+			"--go_out=paths=source_relative:.",
+			"--go-grpc_out=paths=source_relative:.",
+			proto,
+		}
+		err := run(protoc, args...)
+		if err != nil {
+			return err
+		}
+		packages = append(packages, "./"+filepath.Dir(proto))
+	}
+
+	if !check {
+		return nil
+	}
+	return run("go", append([]string{"build"}, packages...)...)
+}
+
+// run runs a command, printing it and its output.
+func run(name string, args ...string) error {
+	log.Println(name, args)
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package concurrentlimit
+
+import "time"
+
+// Clock returns the current time. QueuedLimiter and MetricsLimiter use it to measure how long
+// operations wait and run, so tests can replace it with a fake clock, such as limittest.Clock,
+// instead of sleeping. Waiting itself is controlled by contexts, which tests can cancel.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the default Clock, which uses time.Now.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
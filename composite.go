@@ -0,0 +1,283 @@
+package concurrentlimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Memory metrics read by MemorySignal. Their difference is the memory mapped by the Go runtime
+// and not returned to the operating system, like OverloadStatus.MemoryBytes.
+const memoryTotalMetric = "/memory/classes/total:bytes"
+const memoryReleasedMetric = "/memory/classes/heap/released:bytes"
+
+// defaultCPUInterval is how often CPUSignal measures CPU use if its interval is not set.
+const defaultCPUInterval = time.Second
+
+// procStatPath contains the process's CPU time on Linux.
+const procStatPath = "/proc/self/stat"
+
+// userHZ is the unit of the CPU times in procStatPath. It is part of the Linux ABI.
+const userHZ = 100
+
+// Signal is one measurement of load for a CompositeLimiter.
+type Signal struct {
+	// Name identifies the signal in AdminHandler and CompositeLimiter.Values.
+	Name string
+	// Value returns the current load: 0 is idle and 1 is the threshold where operations should
+	// be rejected. Values over 1 are over the threshold. It is called for every operation, so it
+	// must be fast.
+	Value func() float64
+	// Weight is the signal's weight for WeightedScore. If <= 0, it is 1.
+	Weight float64
+}
+
+// OccupancySignal returns a Signal that is the fraction of limiter's limit that is in use, or 0
+// if limiter does not report its state. It is 1 when the limit is reached, so with AnyExceeds it
+// rejects the operations a QueuedLimiter would queue: use QueueDelaySignal for queued limiters.
+func OccupancySignal(limiter Limiter) Signal {
+	return Signal{Name: "occupancy", Value: func() float64 {
+		current, limit := currentApprox(limiter)
+		if limit <= 0 {
+			return 0
+		}
+		return float64(current) / float64(limit)
+	}}
+}
+
+// QueueDelaySignal returns a Signal that is limiter's queue delay (see Stats.QueueDelay) as a
+// fraction of maxDelay. It panics if maxDelay <= 0.
+func QueueDelaySignal(limiter StatsReporter, maxDelay time.Duration) Signal {
+	if maxDelay <= 0 {
+		panic(fmt.Sprintf("QueueDelaySignal: maxDelay=%s must be > 0", maxDelay))
+	}
+	return Signal{Name: "queue_delay", Value: func() float64 {
+		return float64(limiter.Stats().QueueDelay) / float64(maxDelay)
+	}}
+}
+
+// MemorySignal returns a Signal that is the memory used by the process as a fraction of
+// limitBytes. If limitBytes <= 0, the Go runtime's memory limit is used (see
+// debug.SetMemoryLimit), and if neither is set the signal is always 0. The Go runtime collects
+// garbage harder as it approaches its memory limit, so rejecting operations before the limit,
+// with a threshold below 1 or a smaller limitBytes, avoids spending the CPU on collections.
+func MemorySignal(limitBytes int64) Signal {
+	if limitBytes <= 0 {
+		// returns math.MaxInt64 if the limit is not set
+		limitBytes = debug.SetMemoryLimit(-1)
+	}
+	if limitBytes == math.MaxInt64 {
+		return Signal{Name: "memory", Value: func() float64 { return 0 }}
+	}
+	return Signal{Name: "memory", Value: func() float64 {
+		samples := []metrics.Sample{{Name: memoryTotalMetric}, {Name: memoryReleasedMetric}}
+		metrics.Read(samples)
+		if samples[0].Value.Kind() != metrics.KindUint64 || samples[1].Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+		used := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+		return float64(used) / float64(limitBytes)
+	}}
+}
+
+// CPUSignal returns a Signal that is the process's CPU use over the last interval, as a fraction
+// of GOMAXPROCS CPUs. If interval <= 0, it is one second. CPU use is read from /proc, so the
+// signal is always 0 on operating systems other than Linux.
+func CPUSignal(interval time.Duration) Signal {
+	if interval <= 0 {
+		interval = defaultCPUInterval
+	}
+	cpu := &cpuUsage{interval: interval, clock: systemClock{}}
+	cpu.lastTime = cpu.clock.Now()
+	cpu.lastCPU, _ = readProcessCPU()
+	return Signal{Name: "cpu", Value: cpu.value}
+}
+
+// cpuUsage measures the process's CPU use every interval.
+type cpuUsage struct {
+	interval time.Duration
+	clock    Clock
+
+	mu       sync.Mutex
+	lastTime time.Time
+	lastCPU  time.Duration
+	usage    float64
+}
+
+func (c *cpuUsage) value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	elapsed := now.Sub(c.lastTime)
+	if elapsed < c.interval {
+		return c.usage
+	}
+	cpu, err := readProcessCPU()
+	if err != nil {
+		return 0
+	}
+	c.usage = float64(cpu-c.lastCPU) / float64(elapsed) / float64(runtime.GOMAXPROCS(0))
+	c.lastTime = now
+	c.lastCPU = cpu
+	return c.usage
+}
+
+// readProcessCPU returns the user and system CPU time used by the process.
+func readProcessCPU() (time.Duration, error) {
+	data, err := os.ReadFile(procStatPath)
+	if err != nil {
+		return 0, err
+	}
+	// the command in parentheses may contain spaces; utime and stime are fields 14 and 15
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("concurrentlimit: unexpected %s: %#v", procStatPath, stat)
+	}
+	var ticks int64
+	for _, field := range fields[11:13] {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		ticks += value
+	}
+	return time.Duration(ticks) * time.Second / userHZ, nil
+}
+
+// CompositePolicy decides whether a CompositeLimiter admits an operation, given the current
+// value of each of its signals. It returns true to admit the operation.
+type CompositePolicy func(signals []Signal, values []float64) bool
+
+// AnyExceeds is a CompositePolicy that rejects operations while any signal is at least 1.
+func AnyExceeds(signals []Signal, values []float64) bool {
+	for _, value := range values {
+		if value >= 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// WeightedScore returns a CompositePolicy that rejects operations while the weighted average of
+// the signals is at least threshold. Unlike AnyExceeds, several signals that are each close to
+// their threshold can reject operations together, and one signal over its threshold can be
+// outweighed. It panics if threshold <= 0.
+func WeightedScore(threshold float64) CompositePolicy {
+	if threshold <= 0 {
+		panic(fmt.Sprintf("WeightedScore: threshold=%f must be > 0", threshold))
+	}
+	return func(signals []Signal, values []float64) bool {
+		score := 0.0
+		total := 0.0
+		for i, value := range values {
+			weight := signals[i].Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			score += weight * value
+			total += weight
+		}
+		return total == 0 || score/total < threshold
+	}
+}
+
+// CompositeLimiter wraps a Limiter so several signals of load, such as occupancy, memory, CPU,
+// and queue delay, decide together whether to admit operations, instead of stacking a wrapper
+// for each one. The policy, such as AnyExceeds or WeightedScore, decides from the signals'
+// current values; admitted operations then start on the wrapped limiter, which can still reject
+// them. AdminHandler reports the signals' values.
+type CompositeLimiter struct {
+	limiter Limiter
+	policy  CompositePolicy
+	signals []Signal
+
+	// rejected counts the operations rejected by the policy, not the wrapped limiter
+	rejected atomic.Int64
+}
+
+// NewComposite returns a CompositeLimiter that starts the operations policy admits with limiter.
+// limiter may be NoLimit() to only limit with the signals. It panics if there are no signals or
+// two signals have the same name.
+func NewComposite(limiter Limiter, policy CompositePolicy, signals ...Signal) *CompositeLimiter {
+	if len(signals) == 0 {
+		panic("NewComposite: signals must not be empty")
+	}
+	names := map[string]bool{}
+	for _, signal := range signals {
+		if names[signal.Name] {
+			panic(fmt.Sprintf("NewComposite: duplicate signal name %#v", signal.Name))
+		}
+		names[signal.Name] = true
+	}
+	return &CompositeLimiter{limiter: limiter, policy: policy, signals: signals}
+}
+
+// Values returns the current value of each signal by name.
+func (c *CompositeLimiter) Values() map[string]float64 {
+	values := map[string]float64{}
+	for _, signal := range c.signals {
+		values[signal.Name] = signal.Value()
+	}
+	return values
+}
+
+// Rejected returns the number of operations rejected by the policy.
+func (c *CompositeLimiter) Rejected() int64 {
+	return c.rejected.Load()
+}
+
+// admit returns true if the policy admits an operation.
+func (c *CompositeLimiter) admit() bool {
+	values := make([]float64, len(c.signals))
+	for i, signal := range c.signals {
+		values[i] = signal.Value()
+	}
+	if !c.policy(c.signals, values) {
+		c.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// Start begins an operation with the wrapped limiter if the policy admits it. It implements
+// Limiter.
+func (c *CompositeLimiter) Start() (func(), error) {
+	if !c.admit() {
+		return nil, ErrLimited
+	}
+	return c.limiter.Start()
+}
+
+// StartContext is a version of Start that calls the wrapped limiter's StartContext. It implements
+// ContextLimiter. The policy decides before the operation waits, so it does not wait if the
+// signals are over their thresholds.
+func (c *CompositeLimiter) StartContext(ctx context.Context) (func(), error) {
+	if !c.admit() {
+		return nil, ErrLimited
+	}
+	return WithContext(c.limiter).StartContext(ctx)
+}
+
+// Stats returns the wrapped limiter's state if it implements StatsReporter.
+func (c *CompositeLimiter) Stats() Stats {
+	if reporter, ok := c.limiter.(StatsReporter); ok {
+		return reporter.Stats()
+	}
+	return Stats{}
+}
+
+// CurrentApprox returns the wrapped limiter's running operations and limit without locking, if it
+// implements ApproxReporter. It implements ApproxReporter.
+func (c *CompositeLimiter) CurrentApprox() (int, int) {
+	return currentApprox(c.limiter)
+}
@@ -0,0 +1,164 @@
+package concurrentlimit
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultDisableCompressionAbove is the occupancy at which CompressHandler stops compressing if
+// CompressOptions.DisableAbove is not set.
+const defaultDisableCompressionAbove = 0.8
+
+// CompressOptions configures CompressHandler.
+type CompressOptions struct {
+	// DisableAbove stops compressing responses when the limiter's occupancy (Current / Limit) is at
+	// least this fraction. If <= 0, it is 0.8.
+	DisableAbove float64
+	// EnableBelow starts compressing again when the occupancy drops below this fraction, so the
+	// decision does not flip on every request. If <= 0, it is half of DisableAbove.
+	EnableBelow float64
+	// ServerTiming adds the decision to the Server-Timing response header as "compression", with
+	// the description "gzip" or "overloaded", for requests that accept gzip.
+	ServerTiming bool
+}
+
+// CompressHandler returns an http.Handler that compresses responses with gzip for clients that
+// accept it, unless the server is busy. Compression only costs CPU, which an overloaded server
+// needs for requests, so it stops when limiter's occupancy reaches options.DisableAbove, and
+// starts again when it drops below options.EnableBelow. limiter must implement ApproxReporter or
+// StatsReporter; otherwise, responses are always compressed. It does not start operations with limiter, so it
+// should wrap a handler that does, such as Handler.
+func CompressHandler(limiter Limiter, options CompressOptions, handler http.Handler) http.Handler {
+	if options.DisableAbove <= 0 {
+		options.DisableAbove = defaultDisableCompressionAbove
+	}
+	if options.EnableBelow <= 0 {
+		options.EnableBelow = options.DisableAbove / 2
+	}
+	var disabled atomic.Bool
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		current, limit := currentApprox(limiter)
+		if limit > 0 {
+			occupancy := float64(current) / float64(limit)
+			if occupancy >= options.DisableAbove {
+				disabled.Store(true)
+			} else if occupancy < options.EnableBelow {
+				disabled.Store(false)
+			}
+		}
+		if disabled.Load() {
+			if options.ServerTiming {
+				w.Header().Add("Server-Timing", `compression;desc="overloaded"`)
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if options.ServerTiming {
+			w.Header().Add("Server-Timing", `compression;desc="gzip"`)
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(gw, r)
+		gw.close()
+	})
+}
+
+// acceptsGzip returns true if the Accept-Encoding header value includes gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		// a quality of 0 means the client does not accept it
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				q, err := strconv.ParseFloat(value, 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// gzipResponseWriter compresses the response body, unless the handler set its own
+// Content-Encoding.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	// gzip is nil if the response is not compressed
+	gzip *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(statusCode int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	header := g.Header()
+	if header.Get("Content-Encoding") == "" && statusCode != http.StatusNoContent &&
+		statusCode != http.StatusNotModified {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		g.gzip = gzipWriterPool.Get().(*gzip.Writer)
+		g.gzip.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.Header().Get("Content-Type") == "" {
+			// detect the type of the uncompressed body, as net/http would
+			g.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gzip == nil {
+		return g.ResponseWriter.Write(p)
+	}
+	return g.gzip.Write(p)
+}
+
+// Flush sends the compressed bytes written so far, if the ResponseWriter supports flushing.
+func (g *gzipResponseWriter) Flush() {
+	if g.gzip != nil {
+		// ignore the error: it will be returned by the next Write
+		_ = g.gzip.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close finishes the compressed response.
+func (g *gzipResponseWriter) close() {
+	if g.gzip == nil {
+		return
+	}
+	// ignore the error: the client will see a truncated response
+	_ = g.gzip.Close()
+	g.gzip.Reset(nil)
+	gzipWriterPool.Put(g.gzip)
+	g.gzip = nil
+}
@@ -2,12 +2,14 @@
 package concurrentlimit
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/netutil"
@@ -55,13 +57,17 @@ func New(limit int) Limiter {
 	if limit <= 0 {
 		panic(fmt.Sprintf("limit must be > 0: %d", limit))
 	}
-	return &syncLimiter{sync.Mutex{}, limit, 0}
+	s := &syncLimiter{max: limit}
+	s.storeApprox(0, limit)
+	return s
 }
 
 type syncLimiter struct {
+	approxStats
 	mu      sync.Mutex
 	max     int
 	current int
+	peak    int
 }
 
 func (s *syncLimiter) Start() (func(), error) {
@@ -73,6 +79,10 @@ func (s *syncLimiter) Start() (func(), error) {
 		return nil, ErrLimited
 	}
 	s.current = next
+	if s.current > s.peak {
+		s.peak = s.current
+	}
+	s.storeApprox(s.current, s.max)
 
 	// TODO: Return a closure that can only be called once? More expensive but harder to abuse.
 	// Maybe think about a "debug mode" that enables this sort of check?
@@ -85,6 +95,7 @@ func (s *syncLimiter) end() {
 	if s.current < 0 {
 		panic("bug: mismatched calls to start/end")
 	}
+	s.storeApprox(s.current, s.max)
 	s.mu.Unlock()
 }
 
@@ -116,6 +127,36 @@ func limitListenerForServer(srv *http.Server, requestLimit int, connectionLimit
 			connectionLimit, requestLimit)
 	}
 
+	return ListenForServer(srv, New(requestLimit), connectionLimit)
+}
+
+// ListenForServer is a version of ListenAndServe that uses limiter to limit concurrent requests,
+// so it can be shared or changed while the server is running. It configures srv, and returns a
+// listener for srv.Addr that limits concurrent connections, which must be passed to srv.Serve or
+// srv.ServeTLS. See ListenAndServe's documentation for the remaining details.
+func ListenForServer(srv *http.Server, limiter Limiter, connectionLimit int) (net.Listener, error) {
+	if connectionLimit <= 0 {
+		return nil, fmt.Errorf("ListenForServer: connectionLimit=%d must be > 0", connectionLimit)
+	}
+
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return ListenerForServer(srv, listener, limiter, connectionLimit)
+}
+
+// ListenerForServer is a version of ListenForServer that limits the connections accepted by
+// listener instead of listening on srv.Addr. This permits serving any listener, such as an
+// in-memory listener in tests (e.g. google.golang.org/grpc/test/bufconn), or one from systemd
+// socket activation.
+func ListenerForServer(
+	srv *http.Server, listener net.Listener, limiter Limiter, connectionLimit int,
+) (net.Listener, error) {
+	if connectionLimit <= 0 {
+		return nil, fmt.Errorf("ListenerForServer: connectionLimit=%d must be > 0", connectionLimit)
+	}
+
 	// prevent idle/slow connections using all available connections. See also:
 	// https://blog.gopheracademy.com/advent-2016/exposing-go-on-the-internet/
 	if srv.ReadHeaderTimeout <= 0 {
@@ -126,10 +167,9 @@ func limitListenerForServer(srv *http.Server, requestLimit int, connectionLimit
 	}
 
 	// configure the request limit
-	limiter := New(requestLimit)
 	srv.Handler = Handler(limiter, srv.Handler)
 
-	return Listen("tcp", srv.Addr, connectionLimit)
+	return netutil.LimitListener(listener, connectionLimit), nil
 }
 
 // ListenAndServeTLS listens for HTTP requests with a limited number of concurrent requests
@@ -145,7 +185,8 @@ func ListenAndServeTLS(
 	return srv.ServeTLS(limitedListener, certFile, keyFile)
 }
 
-// Listen wraps net.Listen with netutil.LimitListener to limit concurrent connections.
+// Listen wraps net.Listen with netutil.LimitListener to limit concurrent connections. See
+// ListenWithOptions to configure more than the connection limit.
 func Listen(network string, address string, connectionLimit int) (net.Listener, error) {
 	unlimitedListener, err := net.Listen(network, address)
 	if err != nil {
@@ -155,23 +196,100 @@ func Listen(network string, address string, connectionLimit int) (net.Listener,
 }
 
 // Handler returns an http.Handler that uses limiter to only permit a limited number of concurrent
-// requests to be processed.
+// requests to be processed. Each request is one operation until the handler returns, unless the
+// handler calls Detach with the request's context. Rejected requests are ShedCapacity: see
+// WriteRejection.
 func Handler(limiter Limiter, handler http.Handler) http.Handler {
+	return AuditHandler(nil, limiter, nil, handler)
+}
+
+// QueueOptions configures QueuedHandler.
+type QueueOptions struct {
+	// MaxWait is the maximum time a request waits to start before it is rejected.
+	MaxWait time.Duration
+	// ServerTiming adds the time the request waited to the Server-Timing response header as
+	// "queue", so clients and dashboards can see the queue delay separately from the handler.
+	ServerTiming bool
+	// Clock measures how long requests wait, for QueueWait and ServerTiming. If nil, it is the
+	// system clock. MaxWait is a context timeout, so it always uses the system clock.
+	Clock Clock
+}
+
+type queueWaitContextKey struct{}
+
+// QueueWait returns how long the request with ctx waited to start in QueuedHandler, or 0. Handlers
+// can subtract it from their deadline budgets.
+func QueueWait(ctx context.Context) time.Duration {
+	wait, _ := ctx.Value(queueWaitContextKey{}).(time.Duration)
+	return wait
+}
+
+// QueuedHandler is a version of Handler that waits up to options.MaxWait for a running request
+// to complete, using limiter's StartContext, such as QueuedLimiter. Requests that wait longer, or
+// that limiter rejects, are ShedCapacity: see WriteRejection. The time each request waited is
+// available to the handler with QueueWait.
+func QueuedHandler(limiter ContextLimiter, options QueueOptions, handler http.Handler) http.Handler {
+	if options.Clock == nil {
+		options.Clock = systemClock{}
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		end, err := limiter.Start()
+		waitCtx, cancel := context.WithTimeout(r.Context(), options.MaxWait)
+		start := options.Clock.Now()
+		end, err := limiter.StartContext(waitCtx)
+		wait := options.Clock.Now().Sub(start)
+		cancel()
+		if err == context.DeadlineExceeded && r.Context().Err() == nil {
+			// waited for MaxWait: reject as if the queue was full
+			err = ErrLimited
+		}
 		if err == ErrLimited {
-			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			WriteLimiterRejection(w, limiter, ShedCapacity, err)
+			return
+		}
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			// the client stopped waiting for the response
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 			return
 		}
 		if err != nil {
-			// this should not happen, but if it does return a very generic 500 error
-			log.Println("concurrentlimit.Handler BUG: unexpected error: " + err.Error())
+			log.Println("concurrentlimit.QueuedHandler BUG: unexpected error: " + err.Error())
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		// permitted: start the operation and end it
-		handler.ServeHTTP(w, r)
-		end()
+		if options.ServerTiming {
+			w.Header().Add("Server-Timing", fmt.Sprintf("queue;dur=%.3f", wait.Seconds()*1000))
+		}
+		ctx := context.WithValue(r.Context(), queueWaitContextKey{}, wait)
+		ctx, release := WithOperation(ctx, end)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+		release()
 	})
 }
+
+// timeoutMessage is the body of responses to requests that exceed the TimeoutHandler timeout.
+const timeoutMessage = "request exceeded its timeout"
+
+// TimeoutHandler is a version of Handler that also limits each request to timeout, with the
+// semantics of http.TimeoutHandler: when the timeout expires, it responds with 503 Service
+// Unavailable, and the request's context is cancelled. The limiter's slot is released when the
+// timeout expires, so slow requests cannot hold slots longer than timeout. The handler keeps
+// running until it returns, so it should stop when its context is done. Use a separate
+// TimeoutHandler for each route with a different timeout. If limiter is a MetricsLimiter, it
+// counts the requests that timed out.
+func TimeoutHandler(limiter Limiter, timeout time.Duration, handler http.Handler) http.Handler {
+	metrics, _ := limiter.(*MetricsLimiter)
+	return Handler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var finished atomic.Bool
+		timeoutHandler := http.TimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer finished.Store(true)
+			handler.ServeHTTP(w, r)
+		}), timeout, timeoutMessage)
+		timeoutHandler.ServeHTTP(w, r)
+
+		// http.TimeoutHandler returns before the handler finishes only if the timeout expired
+		if !finished.Load() && metrics != nil {
+			metrics.recordTimeout()
+		}
+	}))
+}
@@ -1,15 +1,31 @@
 package concurrentlimit
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
-	"strconv"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"google.golang.org/grpc/test/bufconn"
 )
 
 func TestNoLimit(t *testing.T) {
@@ -88,55 +104,39 @@ func TestHTTP(t *testing.T) {
 	// set up a rate limited HTTP server
 	const permitted = 3
 
-	// pick a random port that should be available
-	listener, err := net.Listen("tcp", "localhost:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	port := listener.Addr().(*net.TCPAddr).Port
-	err = listener.Close()
+	// serve an in-memory listener, so requests cannot race with the server listening on a port
+	memListener := bufconn.Listen(64 * 1024)
+	handler := &blockForConcurrent{make(chan struct{})}
+	testServer := &http.Server{Handler: handler}
+	// must allow more connections than requests, otherwise it waits for the connection to close
+	listener, err := ListenerForServer(testServer, memListener, New(permitted), permitted*2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	httpAddr := "localhost:" + strconv.Itoa(port)
-
-	// start the server
-	handler := &blockForConcurrent{make(chan struct{})}
-	testServer := &http.Server{
-		Addr:    httpAddr,
-		Handler: handler,
-	}
 	go func() {
-		// must allow more connections than requests, otherwise it waits for the connection to close
-		err := ListenAndServe(testServer, permitted, permitted*2)
+		err := testServer.Serve(listener)
 		if err != http.ErrServerClosed {
 			t.Error("expected HTTP server to be shutdown; err:", err)
 		}
 	}()
 	defer testServer.Shutdown(context.Background())
 
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return memListener.DialContext(ctx)
+		},
+	}}
 	responses := make(chan int)
 	for i := 0; i < permitted+1; i++ {
 		go func() {
-			const attempts = 3
-			for i := 0; i < attempts; i++ {
-				resp, err := http.Get("http://" + httpAddr)
-				if err != nil {
-					var syscallErr syscall.Errno
-					if errors.As(err, &syscallErr) && syscallErr == syscall.ECONNREFUSED {
-						// race with the server starting up: try again
-						time.Sleep(10 * time.Millisecond)
-						continue
-					}
-					close(responses)
-					t.Error(err)
-
-				}
-				resp.Body.Close()
-				responses <- resp.StatusCode
+			resp, err := client.Get("http://bufconn/")
+			if err != nil {
+				t.Error(err)
+				responses <- 0
 				return
 			}
-			t.Error("failed after too many attempts")
+			resp.Body.Close()
+			responses <- resp.StatusCode
 		}()
 	}
 
@@ -151,7 +151,7 @@ func TestHTTP(t *testing.T) {
 
 		if response == http.StatusOK {
 			okCount++
-		} else if response == http.StatusTooManyRequests {
+		} else if response == http.StatusServiceUnavailable {
 			rateLimitedCount++
 		} else {
 			t.Fatal("unexpected HTTP status code:", response)
@@ -162,3 +162,2585 @@ func TestHTTP(t *testing.T) {
 		t.Error("unexpected OK and rate limited response counts:", okCount, rateLimitedCount)
 	}
 }
+
+func TestQueued(t *testing.T) {
+	limiter := NewQueued(1, 1)
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start never waits
+	_, err = limiter.Start()
+	if err != ErrLimited {
+		t.Fatal("expected ErrLimited:", err)
+	}
+
+	// a cancelled context fails without waiting
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = limiter.StartContext(cancelledCtx)
+	if err != context.Canceled {
+		t.Fatal("expected Canceled:", err)
+	}
+
+	// the first StartContext waits; the second exceeds the queue
+	started := make(chan func())
+	go func() {
+		queuedEnd, err := limiter.StartContext(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		started <- queuedEnd
+	}()
+	for {
+		limiter.mu.Lock()
+		queued := limiter.waiters.Len()
+		limiter.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, err = limiter.StartContext(context.Background())
+	if err != ErrLimited {
+		t.Fatal("expected ErrLimited:", err)
+	}
+
+	// ending the first operation hands the slot to the waiter, not a new Start
+	end()
+	queuedEnd := <-started
+	_, err = limiter.Start()
+	if err != ErrLimited {
+		t.Fatal("expected ErrLimited:", err)
+	}
+	queuedEnd()
+
+	end, err = limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	end()
+}
+
+func TestConsume(t *testing.T) {
+	// NewQueued(2, 0) and NewMetricsLimiter are ContextLimiters that reject without waiting
+	for _, limiter := range []Limiter{New(2), NewQueued(2, 1), NewQueued(2, 0), NewMetricsLimiter(New(2))} {
+		const messages = 20
+		next := 0
+		fetch := func(ctx context.Context) (int, error) {
+			if next == messages {
+				return 0, io.EOF
+			}
+			next++
+			return next, nil
+		}
+
+		var mu sync.Mutex
+		current := 0
+		handled := 0
+		handle := func(ctx context.Context, msg int) error {
+			mu.Lock()
+			current++
+			if current > 2 {
+				t.Error("too many concurrent handlers:", current)
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			current--
+			handled++
+			mu.Unlock()
+			return nil
+		}
+
+		err := Consume(context.Background(), limiter, fetch, handle)
+		if err != io.EOF {
+			t.Error("expected the fetch error:", err)
+		}
+		if handled != messages {
+			t.Error("expected all messages to be handled:", handled)
+		}
+	}
+
+	// a handler error stops consuming
+	handleErr := errors.New("handle error")
+	err := Consume(context.Background(), New(1),
+		func(ctx context.Context) (int, error) { return 1, nil },
+		func(ctx context.Context, msg int) error { return handleErr })
+	if err != handleErr {
+		t.Error("expected the handler error:", err)
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	limiter := NewKeyed(1)
+	endA, err := limiter.Start("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = limiter.Start("a")
+	if err != ErrLimited {
+		t.Fatal("expected ErrLimited:", err)
+	}
+
+	// other keys are not limited
+	endB, err := limiter.Start("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endB()
+
+	endA()
+	endA, err = limiter.Start("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endA()
+	if len(limiter.current) != 0 {
+		t.Error("keys without operations must be removed:", limiter.current)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	keyFunc := HeaderKey("X-API-Key")
+	if key := keyFunc(r); key != "" {
+		t.Error("requests without the header must return the empty key:", key)
+	}
+	r.Header.Set("x-api-key", "tenant")
+	if key := keyFunc(r); key != "tenant" {
+		t.Error("expected the header value:", key)
+	}
+}
+
+func TestKeyedShared(t *testing.T) {
+	limiter := NewKeyedShared(1, 3, 4)
+	start := func(key string) error {
+		_, err := limiter.Start(key)
+		return err
+	}
+
+	// a busy key borrows unused capacity up to the ceiling
+	for i := 0; i < 3; i++ {
+		if err := start("busy"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := start("busy"); err != ErrLimited {
+		t.Error("expected ErrLimited above the ceiling:", err)
+	}
+
+	// other keys always get their limit, but cannot borrow without unused capacity
+	endA, err := limiter.Start("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := start("b"); err != nil {
+		t.Error("expected a key to always get its limit:", err)
+	}
+	if err := start("a"); err != ErrLimited {
+		t.Error("expected ErrLimited without unused capacity:", err)
+	}
+	endA()
+	if limiter.total != 4 {
+		t.Error("expected 4 running operations:", limiter.total)
+	}
+}
+
+func TestKeyedMaxKeys(t *testing.T) {
+	for _, overflow := range []KeyedOverflow{OverflowReject, OverflowShared} {
+		limiter := NewKeyed(1)
+		limiter.SetMaxKeys(2, overflow)
+		endA, err := limiter.Start("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = limiter.Start("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// new keys overflow; tracked keys do not
+		endC, errC := limiter.Start("c")
+		_, errD := limiter.Start("d")
+		if _, err := limiter.Start("a"); err != ErrLimited {
+			t.Error("expected tracked keys to use their own limit:", err)
+		}
+		if overflow == OverflowReject {
+			if errC != ErrLimited || errD != ErrLimited {
+				t.Error("expected new keys to be rejected:", errC, errD)
+			}
+		} else {
+			if errC != nil || errD != ErrLimited {
+				t.Error("expected new keys to share one limit:", errC, errD)
+			}
+			endC()
+		}
+		if len(limiter.current) != 2 {
+			t.Error("expected 2 tracked keys:", limiter.current)
+		}
+
+		// idle keys are forgotten, so new keys can be tracked
+		endA()
+		endC, err = limiter.Start("c")
+		if err != nil {
+			t.Error("expected a new key after another became idle:", err)
+		}
+		endC()
+	}
+}
+
+func TestKeyedKeyLimit(t *testing.T) {
+	limiter := NewKeyedShared(1, 3, 10)
+	limiter.SetMaxKeys(1, OverflowReject)
+	limiter.SetKeyLimit("small", 1)
+	limiter.SetKeyLimit("big", 2)
+
+	// keys with a limit are tracked over the maximum, and do not borrow
+	endOther, err := limiter.Start("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"big", "big", "small"} {
+		if _, err := limiter.Start(key); err != nil {
+			t.Fatal(key, err)
+		}
+	}
+	if _, err := limiter.Start("big"); err != ErrLimited {
+		t.Error("expected big to be limited to 2:", err)
+	}
+	if _, err := limiter.Start("small"); err != ErrLimited {
+		t.Error("expected small to not borrow capacity:", err)
+	}
+	endOther()
+
+	// removing the limit returns the key to the default
+	limiter.SetKeyLimit("small", 0)
+	if limits := limiter.KeyLimits(); len(limits) != 1 || limits["big"] != 2 {
+		t.Errorf("unexpected key limits: %#v", limits)
+	}
+	if _, err := limiter.Start("small"); err != nil {
+		t.Error("expected small to borrow up to the ceiling:", err)
+	}
+}
+
+func TestKeyedRejectionBudget(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	limiter := NewKeyed(1)
+	limiter.SetClock(clock)
+	limiter.SetRejectionBudget(RejectionBudget{Rejections: 1, Window: time.Hour, MaxWait: 20 * time.Millisecond})
+	end, err := limiter.Start("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first rejection is immediate, then operations wait
+	start := time.Now()
+	if _, err := limiter.Start("a"); err != ErrLimited {
+		t.Error("expected ErrLimited:", err)
+	}
+	if _, err := limiter.Start("a"); err != ErrLimited {
+		t.Error("expected ErrLimited after waiting:", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Error("expected the operation over the budget to wait:", elapsed)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.StartContext(ctx, "a"); err != context.Canceled {
+		t.Error("expected the context's error:", err)
+	}
+
+	// waiting operations start when an operation ends
+	limiter.budget.MaxWait = time.Minute
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		end()
+	}()
+	end, err = limiter.Start("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the budget is restored after the window, measured with the limiter's clock
+	clock.advance(time.Hour)
+	start = time.Now()
+	if _, err := limiter.Start("a"); err != ErrLimited {
+		t.Error("expected ErrLimited:", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Minute {
+		t.Error("expected an immediate rejection after the window:", elapsed)
+	}
+	end()
+}
+
+func TestKeyedRejectionBudgetMaxKeys(t *testing.T) {
+	limiter := NewKeyed(1)
+	limiter.SetMaxKeys(1, OverflowReject)
+	limiter.SetRejectionBudget(RejectionBudget{Rejections: 1, Window: time.Hour, MaxWait: time.Minute})
+	end, err := limiter.Start("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+
+	// keys rejected by SetMaxKeys are rejected immediately, and their rejections are not tracked
+	for i := 0; i < 100; i++ {
+		if _, err := limiter.Start(fmt.Sprint(i)); err != ErrLimited {
+			t.Fatal("expected ErrLimited:", err)
+		}
+	}
+	if len(limiter.rejections) != 0 {
+		t.Error("expected no rejections to be tracked:", len(limiter.rejections))
+	}
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client.example.com"}}
+	if id := CertificateIdentity(cert); id != "client.example.com" {
+		t.Error("expected the common name:", id)
+	}
+
+	spiffeID, err := url.Parse("spiffe://example.com/service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherURI, err := url.Parse("https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.URIs = []*url.URL{otherURI, spiffeID}
+	if id := CertificateIdentity(cert); id != "spiffe://example.com/service" {
+		t.Error("expected the SPIFFE ID:", id)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if key := ClientCertKey(r); key != "" {
+		t.Error("requests without TLS must return the empty key:", key)
+	}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if key := ClientCertKey(r); key != "spiffe://example.com/service" {
+		t.Error("expected the SPIFFE ID:", key)
+	}
+}
+
+func TestAutoSize(t *testing.T) {
+	// 1 GiB: half is reserved, and each request uses 1 MiB plus two 256 KiB connections
+	limits := AutoSize(AutoOptions{MemoryBytes: 1 << 30})
+	if limits.Requests != 341 || limits.Connections != 682 {
+		t.Errorf("unexpected limits: %#v", limits)
+	}
+	limits = AutoSize(AutoOptions{MemoryBytes: 1 << 30, RequestBytes: 100 << 10, ConnectionBytes: 50 << 10,
+		ReservedFraction: 0.75})
+	if limits.Requests != 1310 || limits.Connections != 2620 {
+		t.Errorf("unexpected limits: %#v", limits)
+	}
+	// too little memory still permits one request
+	limits = AutoSize(AutoOptions{MemoryBytes: 1024})
+	if limits.Requests != 1 || limits.Connections != 2 {
+		t.Errorf("unexpected limits: %#v", limits)
+	}
+
+	limiter := NewAuto(AutoOptions{MemoryBytes: 4 << 20})
+	if stats := limiter.(StatsReporter).Stats(); stats.Limit != 1 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	limiter := NewWeighted(3)
+	policy := CostPolicy{Max: 2}
+	var handlerRequests []*http.Request
+	unblock := make(chan struct{})
+	handler := WeightedHandler(limiter, policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerRequests = append(handlerRequests, r)
+		<-unblock
+	}))
+
+	serve := func(cost string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cost != "" {
+			r.Header.Set(DefaultCostHeader, cost)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve("abc"); code != http.StatusBadRequest {
+		t.Error("invalid costs must be rejected:", code)
+	}
+	if code := serve("0"); code != http.StatusBadRequest {
+		t.Error("invalid costs must be rejected:", code)
+	}
+
+	// the declared cost of 100 is reduced to 2, leaving 1 unit
+	end, err := limiter.StartN(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serve("100"); code != http.StatusServiceUnavailable {
+		t.Error("expected the cost to be limited to 2 and rejected:", code)
+	}
+	close(unblock)
+	// requests without a cost use the default cost of 1
+	if code := serve(""); code != http.StatusOK {
+		t.Error("expected the default cost to be permitted:", code)
+	}
+	end()
+	if code := serve("100"); code != http.StatusOK {
+		t.Error("expected the maximum cost to be permitted:", code)
+	}
+	if len(handlerRequests) != 2 {
+		t.Error("unexpected handler requests:", len(handlerRequests))
+	}
+}
+
+func TestOverloadHandler(t *testing.T) {
+	limiter := NewQueued(4, 1)
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+
+	status := ComputeOverloadStatus(limiter, OverloadOptions{MemoryLimit: math.MaxInt64 / 2})
+	if status.OccupancyPercent != 25 || status.QueueDelayPercent != 0 || status.Score != 25 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+
+	// memory use above the limit is fully overloaded
+	handler := OverloadHandler(limiter, OverloadOptions{MemoryLimit: 1})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?format=agent", nil))
+	if w.Body.String() != "drain\n" {
+		t.Errorf("unexpected agent response: %#v", w.Body.String())
+	}
+
+	handler = OverloadHandler(limiter, OverloadOptions{MemoryLimit: math.MaxInt64 / 2})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?format=agent", nil))
+	if w.Body.String() != "up 75%\n" {
+		t.Errorf("unexpected agent response: %#v", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	decoded := OverloadStatus{}
+	err = json.Unmarshal(w.Body.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Score != 25 {
+		t.Errorf("unexpected JSON status: %s", w.Body.String())
+	}
+}
+
+func TestHealthReporter(t *testing.T) {
+	limiter := New(1)
+	health := NewHealthReporter(limiter, OverloadOptions{MemoryLimit: math.MaxInt64 / 2})
+	checkStatus := func(handler http.Handler, expected int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != expected {
+			t.Errorf("expected status %d: %d %s", expected, w.Code, w.Body.String())
+		}
+	}
+	checkStatus(health.ReadinessHandler(), http.StatusOK)
+
+	// fully occupied: not ready, but still alive
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(health.ReadinessHandler(), http.StatusServiceUnavailable)
+	checkStatus(health.LivenessHandler(), http.StatusOK)
+	end()
+	checkStatus(health.ReadinessHandler(), http.StatusOK)
+
+	health.SetDraining()
+	if health.Ready() != errDraining {
+		t.Error("expected errDraining:", health.Ready())
+	}
+	checkStatus(health.LivenessHandler(), http.StatusOK)
+}
+
+func TestConnCounter(t *testing.T) {
+	listenerCounter := &ConnCounter{}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	countedListener := listenerCounter.Listener(listener)
+	defer countedListener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := countedListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listenerCounter.Open() != 1 {
+		t.Error("expected 1 open connection:", listenerCounter.Open())
+	}
+	// closing twice only counts once
+	conn.Close()
+	conn.Close()
+	if listenerCounter.Open() != 0 {
+		t.Error("expected 0 open connections:", listenerCounter.Open())
+	}
+
+	stateCounter := &ConnCounter{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stateCounter.Open() != 1 {
+			t.Error("expected 1 open connection while handling a request:", stateCounter.Open())
+		}
+	}))
+	server.Config.ConnState = stateCounter.ConnState
+	server.Start()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	server.Close()
+	if stateCounter.Open() != 0 {
+		t.Error("expected 0 open connections after closing the server:", stateCounter.Open())
+	}
+}
+
+func TestRegisterListener(t *testing.T) {
+	// two listeners with independent connection limits
+	listeners := map[string]net.Listener{}
+	for name, limit := range map[string]int{"http": 1, "grpc": 2} {
+		listener, err := ListenWithOptions("tcp", "localhost:0", ListenOptions{ConnectionLimit: limit, Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		listeners[name] = listener
+	}
+
+	client, err := net.Dial("tcp", listeners["grpc"].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listeners["grpc"].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := ListenerStats()
+	expected := map[string]ConnStats{
+		"http": {Limit: 1},
+		"grpc": {Open: 1, Peak: 1, Limit: 2, Accepted: 1},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("ListenerStats()=%#v; expected %#v", stats, expected)
+	}
+	conn.Close()
+	if stats := ListenerStats()["grpc"]; stats.Open != 0 || stats.Peak != 1 {
+		t.Errorf("unexpected stats after closing: %#v", stats)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("registering a duplicate name must panic")
+			}
+		}()
+		RegisterListener("http", listeners["http"], 0)
+	}()
+
+	// closing unregisters the name, so it can be reused
+	listeners["http"].Close()
+	if _, ok := ListenerStats()["http"]; ok {
+		t.Error("closed listener must not be registered")
+	}
+	RegisterListener("http", listeners["http"], 0).Close()
+}
+
+// remoteAddrConn is a net.Conn with a fake remote address.
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// sliceListener accepts the connections in conns, then returns net.ErrClosed.
+type sliceListener struct {
+	net.Listener
+	conns []net.Conn
+}
+
+func (l *sliceListener) Accept() (net.Conn, error) {
+	if len(l.conns) == 0 {
+		return nil, net.ErrClosed
+	}
+	conn := l.conns[0]
+	l.conns = l.conns[1:]
+	return conn, nil
+}
+
+func TestIPFilter(t *testing.T) {
+	_, err := NewIPFilter([]string{"10.0.0.0/33"}, nil)
+	if err == nil {
+		t.Error("expected an error for an invalid network")
+	}
+
+	filter, err := NewIPFilter([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "10.2.3.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		addr     net.Addr
+		expected bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("10.2.3.4"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}, false},
+		{&net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, false},
+	} {
+		if permitted := filter.Permits(test.addr); permitted != test.expected {
+			t.Errorf("Permits(%s)=%t; expected %t", test.addr, permitted, test.expected)
+		}
+	}
+
+	// the listener closes rejected connections, and only returns permitted ones
+	denied, deniedPeer := net.Pipe()
+	defer deniedPeer.Close()
+	permitted, permittedPeer := net.Pipe()
+	defer permittedPeer.Close()
+	listener := filter.Listener(&sliceListener{conns: []net.Conn{
+		&remoteAddrConn{denied, &net.TCPAddr{IP: net.ParseIP("10.1.0.1"), Port: 1}},
+		&remoteAddrConn{permitted, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}},
+	}})
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "10.0.0.1:1" {
+		t.Error("expected the permitted connection:", conn.RemoteAddr())
+	}
+	if _, err := deniedPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("expected the denied connection to be closed:", err)
+	}
+	if filter.Rejected() != 1 {
+		t.Error("expected 1 rejected connection:", filter.Rejected())
+	}
+	if _, err := listener.Accept(); err != net.ErrClosed {
+		t.Error("expected the listener's error:", err)
+	}
+}
+
+func TestListenWithOptions(t *testing.T) {
+	listener, err := ListenWithOptions("tcp", "localhost:0", ListenOptions{
+		ConnectionLimit: 1,
+		ReadDeadline:    50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a later deadline, or no deadline, cannot extend the absolute deadline
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Error("expected a timeout:", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("expected the read to time out at the absolute deadline:", elapsed)
+	}
+
+	// earlier deadlines are permitted
+	if deadline := earliestDeadline(start, start.Add(time.Second)); !deadline.Equal(start) {
+		t.Error("expected the earlier deadline:", deadline)
+	}
+	if deadline := earliestDeadline(start, time.Time{}); !deadline.Equal(start) {
+		t.Error("expected the deadline without a limit:", deadline)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(1000, now)
+	if delay := bucket.take(now, 1000); delay != 0 {
+		t.Error("expected the burst to be permitted:", delay)
+	}
+	if delay := bucket.take(now, 500); delay != 500*time.Millisecond {
+		t.Error("expected to wait for 500 bytes at 1000 bytes/second:", delay)
+	}
+	// later callers wait after the earlier ones
+	if delay := bucket.take(now.Add(250*time.Millisecond), 250); delay != 500*time.Millisecond {
+		t.Error("expected to wait after the previous caller:", delay)
+	}
+	// the burst is limited to one second
+	if delay := bucket.take(now.Add(time.Hour), 1001); delay != time.Millisecond {
+		t.Error("expected to wait for 1 byte more than the burst:", delay)
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	limiter := NewBandwidthLimiter(0, 100*1024)
+	listener, err := ListenWithOptions("tcp", "localhost:0", ListenOptions{Bandwidth: limiter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// write the burst plus 5 kiB more, which must wait about 50 ms
+	go func() {
+		_, err := conn.Write(make([]byte, 105*1024))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	start := time.Now()
+	_, err = io.ReadFull(client, make([]byte, 105*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Error("expected writing more than the burst to be throttled:", elapsed)
+	}
+	stats := limiter.Stats()
+	if stats.Bytes != 105*1024 || stats.ThrottledBytes == 0 || stats.ThrottledDelay == 0 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+}
+
+func TestHeaderLimiter(t *testing.T) {
+	limiter := NewHeaderLimiter(1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stats := limiter.Stats(); stats.Current != 0 {
+			t.Errorf("expected no connections reading headers in the handler: %#v", stats)
+		}
+	}))
+	server.Config.ConnState = limiter.ConnState
+	server.Start()
+	defer server.Close()
+
+	// a slow client sends part of the headers
+	slow, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	_, err = slow.Write([]byte("GET / HTTP/1.1\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for limiter.Stats().Current != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// another connection is closed
+	rejected, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection over the limit to be closed")
+	}
+	if limiter.Rejected() != 1 {
+		t.Error("expected 1 rejected connection:", limiter.Rejected())
+	}
+
+	// finishing the request, then closing the connection, permits other requests
+	_, err = slow.Write([]byte("Host: example.com\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(slow), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	slow.Close()
+	for limiter.Stats().Current != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	resp, err = server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if stats := limiter.Stats(); resp.StatusCode != http.StatusOK || stats.Peak != 1 {
+		t.Errorf("unexpected status %d or stats %#v", resp.StatusCode, stats)
+	}
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	MaxConnectionAge(server.Config, 50*time.Millisecond)
+	server.Start()
+	defer server.Close()
+	client := server.Client()
+
+	get := func() bool {
+		t.Helper()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Close
+	}
+	if get() {
+		t.Error("expected a new connection to be kept open")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !get() {
+		t.Error("expected an old connection to be closed")
+	}
+	if get() {
+		t.Error("expected the replacement connection to be kept open")
+	}
+}
+
+func TestMetricsLimiter(t *testing.T) {
+	limiter := NewMetricsLimiter(New(1))
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = limiter.Start()
+	if err != ErrLimited {
+		t.Fatal("expected ErrLimited:", err)
+	}
+	if stats := limiter.Stats(); stats.Current != 1 || stats.Limit != 1 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+	end()
+
+	w := httptest.NewRecorder()
+	MetricsHandler(limiter).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{
+		"concurrentlimit_started_total 1\n",
+		"concurrentlimit_rejected_total 1\n",
+		"concurrentlimit_current 0\n",
+		"concurrentlimit_peak 1\n",
+		"concurrentlimit_limit 1\n",
+		"concurrentlimit_operation_duration_seconds_bucket{le=\"0.001\"} 1\n",
+		"concurrentlimit_operation_duration_seconds_bucket{le=\"+Inf\"} 1\n",
+		"concurrentlimit_operation_duration_seconds_count 1\n",
+		"# TYPE go_memstats_heap_alloc_bytes gauge\n",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("missing %#v in metrics:\n%s", expected, w.Body.String())
+		}
+	}
+
+	// without a StatsReporter, the current operations are counted
+	unlimited := NewMetricsLimiter(NoLimit())
+	end, err = unlimited.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := unlimited.Stats(); stats.Current != 1 || stats.Limit != 0 || stats.Peak != 1 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+	end()
+
+	// StartContext and SetLimit are forwarded to a QueuedLimiter
+	queued := NewMetricsLimiter(NewQueued(1, 1))
+	end, err = queued.StartContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = queued.StartContext(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatal("expected DeadlineExceeded:", err)
+	}
+	started := make(chan error)
+	go func() {
+		end, err := queued.StartContext(context.Background())
+		if err == nil {
+			end()
+		}
+		started <- err
+	}()
+	for queued.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	setter, ok := limitSetter(queued)
+	if !ok {
+		t.Fatal("expected the wrapped limit to be changeable")
+	}
+	setter.SetLimit(2)
+	err = <-started
+	if err != nil {
+		t.Fatal(err)
+	}
+	end()
+	w = httptest.NewRecorder()
+	MetricsHandler(queued).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{
+		"concurrentlimit_started_total 2\n",
+		"concurrentlimit_wait_cancelled_total 1\n",
+		"concurrentlimit_limit 2\n",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("missing %#v in metrics:\n%s", expected, w.Body.String())
+		}
+	}
+
+	// AdminHandler can only change the limit if the wrapped limiter can
+	w = httptest.NewRecorder()
+	AdminHandler(queued).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/limit?limit=3", nil))
+	if w.Code != http.StatusOK || queued.Stats().Limit != 3 {
+		t.Errorf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	AdminHandler(unlimited).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/limit?limit=3", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501: %d %s", w.Code, w.Body.String())
+	}
+}
+
+// fakeClock is a Clock that only changes when advance is called.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+}
+
+func TestAuditLog(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0).UTC()}
+	audit := NewAuditLog(3, 1)
+	audit.SetClock(clock)
+	limiter := New(1)
+	handler := AuditHandler(audit, limiter, HeaderKey("X-API-Key"), http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// a nested request while this one is running must be rejected
+			nested := httptest.NewRecorder()
+			audit.Record(limiter, "/manual", "", nil)
+			clock.advance(time.Second)
+			limiterHandler := AuditHandler(audit, limiter, nil, http.NotFoundHandler())
+			limiterHandler.ServeHTTP(nested, httptest.NewRequest(http.MethodGet, "/nested", nil))
+			if nested.Code != http.StatusServiceUnavailable {
+				t.Errorf("expected 503: %d", nested.Code)
+			}
+		}))
+
+	r := httptest.NewRequest(http.MethodGet, "/path", nil)
+	r.Header.Set("X-API-Key", "tenant")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	clock.advance(time.Second)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	// the ring keeps the 3 most recent of 6 records
+	records := audit.Records(time.Time{}, time.Time{})
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records: %#v", records)
+	}
+	expected := []AdmissionRecord{
+		{Time: time.Unix(1002, 0).UTC(), Admitted: true, Current: 1, Limit: 1, Route: "/path", Key: "tenant"},
+		{Time: time.Unix(1002, 0).UTC(), Admitted: true, Current: 1, Limit: 1, Route: "/manual"},
+		{Time: time.Unix(1003, 0).UTC(), Current: 1, Limit: 1, Route: "/nested", Error: ErrLimited.Error()},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("records=%#v; expected %#v", records, expected)
+	}
+	if records := audit.Records(time.Unix(1003, 0), time.Time{}); len(records) != 1 || records[0].Admitted {
+		t.Errorf("unexpected records since 1003: %#v", records)
+	}
+
+	w := httptest.NewRecorder()
+	audit.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit?until=1970-01-01T00:16:42Z", nil))
+	var served []AdmissionRecord
+	err := json.Unmarshal(w.Body.Bytes(), &served)
+	if err != nil || len(served) != 2 {
+		t.Errorf("unexpected response: %s %v", w.Body.String(), err)
+	}
+	w = httptest.NewRecorder()
+	audit.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400: %d", w.Code)
+	}
+}
+
+func TestLatencyTarget(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	limiter := NewLatencyTarget(LatencyTargetOptions{
+		Target: 100 * time.Millisecond, MinLimit: 2, MaxLimit: 20, InitialLimit: 10})
+	limiter.SetClock(clock)
+
+	// runInterval runs operations with duration, concurrent at a time, for one interval
+	runInterval := func(concurrent int, duration time.Duration) {
+		for i := 0; i < 30/concurrent; i++ {
+			var ends []func()
+			for j := 0; j < concurrent; j++ {
+				end, err := limiter.Start()
+				if err != nil {
+					break
+				}
+				ends = append(ends, end)
+			}
+			clock.advance(duration)
+			for _, end := range ends {
+				end()
+			}
+		}
+		clock.advance(time.Second)
+		end, err := limiter.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		end()
+	}
+	expectLimit := func(expected int) {
+		t.Helper()
+		if limit := limiter.Stats().Limit; limit != expected {
+			t.Errorf("limit=%d; expected %d", limit, expected)
+		}
+	}
+
+	// under the target but the limit was not reached: not changed
+	runInterval(5, 10*time.Millisecond)
+	expectLimit(10)
+	if limiter.Observed() != 10*time.Millisecond {
+		t.Errorf("Observed()=%s", limiter.Observed())
+	}
+	// under the target at the limit: raised by 10%
+	runInterval(15, 10*time.Millisecond)
+	expectLimit(11)
+	// over the target: lowered by 25%, but not below MinLimit
+	runInterval(15, 200*time.Millisecond)
+	expectLimit(9)
+	for i := 0; i < 10; i++ {
+		runInterval(1, 200*time.Millisecond)
+	}
+	expectLimit(2)
+
+	// raised up to MaxLimit
+	for i := 0; i < 50; i++ {
+		runInterval(30, time.Millisecond)
+	}
+	expectLimit(20)
+}
+
+func TestCheckLimits(t *testing.T) {
+	for _, test := range []struct {
+		limits   Limits
+		warnings []string
+	}{
+		{Limits{RequestLimit: 10, ConnectionLimit: 20, HTTP1: true}, nil},
+		{Limits{RequestLimit: 10, ConnectionLimit: 5, HTTP1: true}, []string{"ConnectionLimit=5 < RequestLimit=10"}},
+		// gRPC with the stream limit set like grpclimit.NewServer
+		{Limits{RequestLimit: 10, ConnectionLimit: 5, StreamLimit: 10, HTTP2: true}, nil},
+		{Limits{RequestLimit: 10, HTTP2: true}, []string{"StreamLimit=0 (0 is unlimited) > RequestLimit=10"}},
+		{Limits{RequestLimit: 10, ConnectionLimit: 2, StreamLimit: 4, HTTP1: true, HTTP2: true}, []string{
+			"ConnectionLimit=2 < RequestLimit=10", "ConnectionLimit=2 * StreamLimit=4 < RequestLimit=10",
+			"StreamLimit=4 < RequestLimit=10"}},
+	} {
+		warnings, err := CheckLimits(test.limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(warnings) != len(test.warnings) {
+			t.Errorf("CheckLimits(%#v)=%#v; expected %#v", test.limits, warnings, test.warnings)
+			continue
+		}
+		for i, warning := range warnings {
+			if !strings.HasPrefix(warning, test.warnings[i]) {
+				t.Errorf("CheckLimits(%#v) warning %d=%#v; expected %#v", test.limits, i, warning, test.warnings[i])
+			}
+		}
+	}
+
+	for _, invalid := range []Limits{{HTTP1: true}, {RequestLimit: 1, StreamLimit: -1, HTTP2: true}, {RequestLimit: 1}} {
+		_, err := CheckLimits(invalid)
+		if err == nil {
+			t.Errorf("CheckLimits(%#v) must fail", invalid)
+		}
+	}
+
+	srv := &http.Server{Addr: "localhost:0"}
+	listener, warnings, err := ListenWithLimits(srv, Limits{RequestLimit: 10, ConnectionLimit: 20, HTTP2: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	if len(warnings) != 0 || srv.TLSNextProto["h2"] == nil {
+		t.Errorf("warnings=%#v; HTTP/2 must be configured", warnings)
+	}
+}
+
+func TestCurrentApprox(t *testing.T) {
+	for _, limiter := range []Limiter{
+		New(2),
+		NewQueued(2, 1),
+		NewWeighted(2),
+		NewMetricsLimiter(NewRollout(NewBreakerLimiter(New(2), BreakerFunc(func() BreakerState { return BreakerClosed }), 1), 1)),
+		NewLatencyTarget(LatencyTargetOptions{Target: time.Second, MaxLimit: 2}),
+	} {
+		approx := limiter.(ApproxReporter)
+		check := func(expectedCurrent int, expectedLimit int) {
+			t.Helper()
+			current, limit := approx.CurrentApprox()
+			stats := limiter.(StatsReporter).Stats()
+			if current != expectedCurrent || limit != expectedLimit || current != stats.Current || limit != stats.Limit {
+				t.Errorf("%T: CurrentApprox()=%d, %d; Stats()=%#v; expected %d, %d",
+					limiter, current, limit, stats, expectedCurrent, expectedLimit)
+			}
+		}
+
+		check(0, 2)
+		if batcher, ok := limiter.(BatchStarter); ok {
+			ends, err := batcher.StartBatch(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(2, 2)
+			for _, end := range ends {
+				end()
+			}
+			check(0, 2)
+		}
+		end, err := limiter.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(1, 2)
+		if setter, ok := limitSetter(limiter); ok {
+			setter.SetLimit(3)
+			check(1, 3)
+		}
+		end()
+		current, _ := approx.CurrentApprox()
+		if current != 0 {
+			t.Errorf("%T: current=%d after the operation ended", limiter, current)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	queued := NewQueued(1, 1)
+	queued.SetClock(clock)
+	end, err := queued.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queuedErr := make(chan error)
+	go func() {
+		end, err := queued.StartContext(context.Background())
+		if err == nil {
+			end()
+		}
+		queuedErr <- err
+	}()
+	for queued.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.advance(2 * time.Second)
+	if stats := queued.Stats(); stats.QueueDelay != 2*time.Second {
+		t.Error("expected QueueDelay of exactly 2s:", stats.QueueDelay)
+	}
+	end()
+	err = <-queuedErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewMetricsLimiter(New(1))
+	metrics.SetClock(clock)
+	end, err = metrics.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(300 * time.Millisecond)
+	end()
+	w := httptest.NewRecorder()
+	MetricsHandler(metrics).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{
+		"concurrentlimit_operation_duration_seconds_bucket{le=\"0.1\"} 0\n",
+		"concurrentlimit_operation_duration_seconds_bucket{le=\"0.5\"} 1\n",
+		"concurrentlimit_operation_duration_seconds_sum 0.3\n",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("missing %#v in metrics:\n%s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	limiter := New(2)
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = Drain(ctx, limiter.(StatsReporter))
+	if err != context.DeadlineExceeded {
+		t.Error("expected DeadlineExceeded with a running operation:", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		end()
+	}()
+	err = Drain(context.Background(), limiter.(StatsReporter))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStartBatch(t *testing.T) {
+	limiters := []struct {
+		name    string
+		limiter Limiter
+	}{
+		{"New", New(3)},
+		{"Queued", NewQueued(3, 1)},
+		{"Weighted", NewWeighted(3)},
+		{"Metrics", NewMetricsLimiter(New(3))},
+		// does not implement BatchStarter
+		{"fallback", struct{ Limiter }{New(3)}},
+	}
+	for _, l := range limiters {
+		t.Run(l.name, func(t *testing.T) {
+			end, err := l.limiter.Start()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the batch does not fit: nothing starts
+			_, err = StartBatch(l.limiter, 3)
+			if err != ErrLimited {
+				t.Error("expected ErrLimited:", err)
+			}
+			ends, err := StartBatch(l.limiter, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ends) != 2 {
+				t.Fatal("expected 2 completion functions:", len(ends))
+			}
+			if _, err := l.limiter.Start(); err != ErrLimited {
+				t.Error("expected the batch to use the limit:", err)
+			}
+
+			// each operation in the batch ends separately
+			ends[0]()
+			end()
+			ends, err = StartBatch(l.limiter, 2)
+			if err != nil {
+				t.Error("expected ended operations to release the limit:", err)
+			}
+		})
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	var _ ContextLimiter = NewQueued(1, 1)
+	var _ ContextLimiter = NewMetricsLimiter(New(1))
+
+	queued := NewQueued(1, 1)
+	if WithContext(queued) != ContextLimiter(queued) {
+		t.Error("expected WithContext to return a ContextLimiter unchanged")
+	}
+
+	limiter := WithContext(New(1))
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.StartContext(cancelled); err != context.Canceled {
+		t.Error("expected a done context to not start:", err)
+	}
+	end, err := limiter.StartContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the adapter does not wait
+	if _, err := limiter.StartContext(context.Background()); err != ErrLimited {
+		t.Error("expected ErrLimited:", err)
+	}
+	end()
+}
+
+func TestRollout(t *testing.T) {
+	rollout := NewRollout(New(1), 0)
+	end, err := rollout.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing is enforced: operations over the limit run anyway
+	unenforcedEnd, err := rollout.Start()
+	if err != nil {
+		t.Fatal("expected the rejection to not be enforced:", err)
+	}
+	if rollout.Unenforced() != 1 {
+		t.Errorf("expected 1 unenforced operation: %d", rollout.Unenforced())
+	}
+	if stats := rollout.Stats(); stats.Current != 2 || stats.Limit != 1 {
+		t.Errorf("expected unenforced operations to be counted as running: %#v", stats)
+	}
+	unenforcedEnd()
+	if stats := rollout.Stats(); stats.Current != 1 {
+		t.Errorf("expected 1 running operation: %#v", stats)
+	}
+
+	// everything is enforced
+	rollout.SetFraction(1)
+	if _, err := rollout.StartContext(context.Background()); err != ErrLimited {
+		t.Error("expected ErrLimited:", err)
+	}
+	end()
+
+	// the limit can only be changed if the wrapped limiter permits it
+	if _, ok := limitSetter(NewMetricsLimiter(rollout)); !ok {
+		t.Error("expected the rollout limit to be changeable")
+	}
+	if _, ok := limitSetter(NewRollout(NoLimit(), 1)); ok {
+		t.Error("expected NoLimit to not be changeable")
+	}
+	if _, ok := Limiter(NewRollout(New(1), 1)).(LimitSetter); ok {
+		t.Error("expected wrappers to not implement LimitSetter")
+	}
+}
+
+func TestBreakerLimiter(t *testing.T) {
+	state := BreakerClosed
+	breaker := NewBreakerLimiter(New(2), BreakerFunc(func() BreakerState { return state }), 1)
+
+	end, err := breaker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	end()
+
+	state = BreakerOpen
+	if _, err := breaker.Start(); err != ErrLimited {
+		t.Error("expected an open breaker to reject:", err)
+	}
+
+	// half-open permits a trickle of operations
+	state = BreakerHalfOpen
+	end, err = breaker.StartContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := breaker.Start(); err != ErrLimited {
+		t.Error("expected half-open to permit one operation:", err)
+	}
+	if breaker.Rejected() != 2 {
+		t.Errorf("expected 2 operations rejected by the breaker: %d", breaker.Rejected())
+	}
+
+	// the admin handler reports the breaker state through other limiters
+	w := httptest.NewRecorder()
+	AdminHandler(NewMetricsLimiter(breaker)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	expected := `{"current":1,"limit":2,"peak":1,"queued":0,"breaker":"half-open"}` + "\n"
+	if w.Body.String() != expected {
+		t.Errorf("unexpected status: %s", w.Body.String())
+	}
+	end()
+
+	end, err = breaker.Start()
+	if err != nil {
+		t.Fatal("expected the ended operation to permit another:", err)
+	}
+	end()
+}
+
+func TestCompositeLimiter(t *testing.T) {
+	memory := 0.5
+	limiter := New(2)
+	memorySignal := Signal{Name: "memory", Value: func() float64 { return memory }, Weight: 3}
+	composite := NewComposite(limiter, AnyExceeds, OccupancySignal(limiter), memorySignal)
+
+	end, err := composite.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the admin handler reports the signals' values
+	w := httptest.NewRecorder()
+	AdminHandler(composite).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	expected := `{"current":1,"limit":2,"peak":1,"queued":0,"signals":{"memory":0.5,"occupancy":0.5}}` + "\n"
+	if w.Body.String() != expected {
+		t.Errorf("unexpected status: %s", w.Body.String())
+	}
+
+	// any signal over its threshold rejects
+	memory = 1.2
+	if _, err := composite.StartContext(context.Background()); err != ErrLimited {
+		t.Error("expected the memory signal to reject:", err)
+	}
+	if composite.Rejected() != 1 {
+		t.Errorf("expected 1 operation rejected by the policy: %d", composite.Rejected())
+	}
+	end()
+
+	// a weighted score of signals under their thresholds can reject: (3*0.8 + 0.5)/4 >= 0.7
+	memory = 0.8
+	composite = NewComposite(limiter, WeightedScore(0.7), OccupancySignal(limiter), memorySignal)
+	end, err = composite.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := composite.Start(); err != ErrLimited {
+		t.Error("expected the weighted score to reject:", err)
+	}
+	end()
+
+	// the CPU signal measures the CPU used between intervals
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	cpu := &cpuUsage{interval: time.Second, clock: clock, lastTime: clock.Now()}
+	cpu.lastCPU, err = readProcessCPU()
+	if err != nil {
+		t.Skip("CPU use is not available:", err)
+	}
+	for start := time.Now(); time.Since(start) < 50*time.Millisecond; {
+	}
+	if usage := cpu.value(); usage != 0 {
+		t.Errorf("expected no usage before the interval: %f", usage)
+	}
+	clock.advance(time.Second)
+	if usage := cpu.value(); !(0 < usage && usage <= 1) {
+		t.Errorf("expected usage in (0, 1]: %f", usage)
+	}
+}
+
+func TestHedgeHandler(t *testing.T) {
+	for _, rejectAtUtilization := range []float64{0, 1} {
+		limiter := New(1)
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		handler := NewHedgeHandler(limiter, HedgeOptions{RejectAtUtilization: rejectAtUtilization},
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-unblock
+			}))
+		newRequest := func(id string) *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(RequestIDHeader, id)
+			return r
+		}
+
+		done := make(chan int)
+		serve := func(r *http.Request) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			done <- w.Code
+		}
+		go serve(newRequest("a"))
+		<-started
+
+		// another request uses another slot and is rejected
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("b"))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("rejectAtUtilization=%f: expected a new request to be rejected: %d", rejectAtUtilization, w.Code)
+		}
+
+		if rejectAtUtilization == 0 {
+			// the duplicate shares the slot
+			go serve(newRequest("a"))
+			<-started
+			if stats := limiter.(StatsReporter).Stats(); stats.Current != 1 {
+				t.Errorf("expected the duplicate to share the slot: %#v", stats)
+			}
+			unblock <- struct{}{}
+			unblock <- struct{}{}
+			for i := 0; i < 2; i++ {
+				if code := <-done; code != http.StatusOK {
+					t.Errorf("expected OK: %d", code)
+				}
+			}
+		} else {
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, newRequest("a"))
+			if w.Code != http.StatusTooManyRequests || handler.Rejected() != 1 {
+				t.Errorf("expected the duplicate to be rejected: %d rejected=%d", w.Code, handler.Rejected())
+			}
+			unblock <- struct{}{}
+			<-done
+		}
+		if handler.Duplicates() != 1 {
+			t.Errorf("rejectAtUtilization=%f: expected 1 duplicate: %d", rejectAtUtilization, handler.Duplicates())
+		}
+		if stats := limiter.(StatsReporter).Stats(); stats.Current != 0 {
+			t.Errorf("rejectAtUtilization=%f: expected the slot to be released: %#v", rejectAtUtilization, stats)
+		}
+	}
+}
+
+func TestHedgeHandlerMaxDuplicates(t *testing.T) {
+	const requests = 10
+	var running atomic.Int64
+	var peak atomic.Int64
+	started := make(chan struct{}, requests)
+	unblock := make(chan struct{})
+	handler := NewHedgeHandler(New(1), HedgeOptions{}, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			current := running.Add(1)
+			for {
+				old := peak.Load()
+				if current <= old || peak.CompareAndSwap(old, current) {
+					break
+				}
+			}
+			started <- struct{}{}
+			<-unblock
+			running.Add(-1)
+		}))
+
+	// many concurrent requests with one ID only run the first and one duplicate
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(RequestIDHeader, "same")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			codes <- w.Code
+		}()
+	}
+	<-started
+	<-started
+	rejected := 0
+	for rejected < requests-2 {
+		if code := <-codes; code != http.StatusTooManyRequests {
+			t.Fatalf("expected the extra duplicates to be rejected: %d", code)
+		}
+		rejected++
+	}
+	close(unblock)
+	wg.Wait()
+	if peak.Load() != 2 {
+		t.Errorf("expected at most 2 concurrent handlers: %d", peak.Load())
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	limiter := New(4)
+	body := strings.Repeat("hello world ", 100)
+	handler := CompressHandler(limiter, CompressOptions{ServerTiming: true},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}))
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	decompress := func(w *httptest.ResponseRecorder) string {
+		reader, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+
+	w := get("deflate, gzip;q=0.5")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Server-Timing") != `compression;desc="gzip"` {
+		t.Errorf("expected a compressed response: %#v", w.Header())
+	}
+	if decompress(w) != body {
+		t.Error("unexpected body")
+	}
+	for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0"} {
+		w = get(acceptEncoding)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+			t.Errorf("Accept-Encoding=%#v: expected an uncompressed response: %#v", acceptEncoding, w.Header())
+		}
+	}
+
+	// 3 of 4 running is below 80%: still compressing
+	ends := []func(){}
+	for i := 0; i < 4; i++ {
+		end, err := limiter.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, end)
+		w = get("gzip")
+		compressed := w.Header().Get("Content-Encoding") == "gzip"
+		if compressed != (i < 3) {
+			t.Errorf("%d running: unexpected compression: %#v", i+1, w.Header())
+		}
+	}
+	if w.Header().Get("Server-Timing") != `compression;desc="overloaded"` || w.Body.String() != body {
+		t.Errorf("unexpected overloaded response: %#v", w.Header())
+	}
+
+	// compression only starts again below half of 80%
+	ends[3]()
+	ends[2]()
+	if w = get("gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Error("expected compression to stay disabled at 50% occupancy")
+	}
+	ends[1]()
+	if w = get("gzip"); w.Header().Get("Content-Encoding") != "gzip" {
+		t.Error("expected compression to be enabled at 25% occupancy")
+	}
+	ends[0]()
+}
+
+func TestCheckOrder(t *testing.T) {
+	recovery := Layer{Name: "recovery", Kind: LayerCheap}
+	auth := Layer{Name: "auth", Kind: LayerExpensive}
+	limit := Layer{Name: "limit", Kind: LayerLimit}
+	if err := CheckOrder(recovery, limit, auth); err != nil {
+		t.Error(err)
+	}
+	err := CheckOrder(recovery, auth, limit)
+	if err == nil || !strings.Contains(err.Error(), `"auth"`) {
+		t.Error("expected an error naming the expensive layer:", err)
+	}
+	if err := CheckOrder(recovery, auth); err == nil {
+		t.Error("expected an error without a limit")
+	}
+
+	calls := []string{}
+	record := func(layer Layer) Middleware {
+		return Middleware{Layer: layer, Wrap: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, layer.Name)
+				next.ServeHTTP(w, r)
+			})
+		}}
+	}
+	_, err = Chain(http.NotFoundHandler(), record(auth), LimitMiddleware(New(1)))
+	if err == nil {
+		t.Error("expected Chain to check the order")
+	}
+	handler, err := Chain(http.NotFoundHandler(), record(recovery), LimitMiddleware(New(1)), record(auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if fmt.Sprint(calls) != "[recovery auth]" {
+		t.Errorf("unexpected order: %v", calls)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	metrics := NewMetricsLimiter(New(2))
+	Register("test-metrics", metrics)
+	defer Unregister("test-metrics")
+	Register("test-plain", New(3))
+	defer Unregister("test-plain")
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected registering a duplicate name to panic")
+			}
+		}()
+		Register("test-plain", New(1))
+	}()
+	if limiter, ok := Lookup("test-metrics"); !ok || limiter != Limiter(metrics) {
+		t.Error("expected Lookup to find the limiter")
+	}
+
+	handler := RegistryHandler("/limit/")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/limit/test-metrics?limit=1", nil))
+	if w.Code != http.StatusOK || metrics.Stats().Limit != 1 {
+		t.Errorf("expected the limit to be changed: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/limit/", nil))
+	statuses := map[string]limitStatus{}
+	err := json.Unmarshal(w.Body.Bytes(), &statuses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses["test-metrics"].Limit != 1 || statuses["test-plain"].Limit != 3 {
+		t.Errorf("unexpected statuses: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/limit/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected not found: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	RegistryMetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{
+		"concurrentlimit_started_total{limiter=\"test-metrics\"} 0\n",
+		"concurrentlimit_limit{limiter=\"test-metrics\"} 1\n",
+		"concurrentlimit_limit{limiter=\"test-plain\"} 3\n",
+		"concurrentlimit_operation_duration_seconds_bucket{limiter=\"test-metrics\",le=\"+Inf\"} 0\n",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("expected metrics to contain %#v:\n%s", expected, w.Body.String())
+		}
+	}
+	if strings.Contains(w.Body.String(), "concurrentlimit_started_total{limiter=\"test-plain\"}") {
+		t.Error("expected no counters for limiters without metrics")
+	}
+	if strings.Count(w.Body.String(), "# TYPE concurrentlimit_current gauge") != 1 {
+		t.Error("expected each metric to be described once")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	queued := NewQueued(2, 3)
+	Register("test-queued", NewMetricsLimiter(queued))
+	defer Unregister("test-queued")
+	rollout := NewRollout(New(4), 0.5)
+	Register("test-rollout", rollout)
+	defer Unregister("test-rollout")
+	Register("test-nolimit", NoLimit())
+	defer Unregister("test-nolimit")
+	// reports a limit that cannot be set
+	Register("test-target", NewMetricsLimiter(NewLatencyTarget(LatencyTargetOptions{Target: time.Second, MaxLimit: 2})))
+	defer Unregister("test-target")
+	keyed := NewKeyed(1)
+	keyed.SetKeyLimit("big", 3)
+	RegisterKeyed("test-keyed", keyed)
+	defer Unregister("test-keyed")
+
+	config := SnapshotConfig()
+	out, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"test-keyed":{"key_limits":{"big":3}},"test-nolimit":{},` +
+		`"test-queued":{"limit":2,"max_queued":3},"test-rollout":{"limit":4,"enforce_fraction":0.5},` +
+		`"test-target":{}}`
+	if string(out) != expected {
+		t.Errorf("unexpected config: %s", out)
+	}
+	// the snapshot can be applied
+	if err := ApplyConfig(config); err != nil {
+		t.Error("expected the snapshot to apply:", err)
+	}
+
+	// invalid configs do not change anything
+	for _, invalid := range []string{
+		`{"test-missing":{"limit":1}}`,
+		`{"test-queued":{"limit":1},"test-nolimit":{"limit":1}}`,
+		`{"test-queued":{"limit":1},"test-rollout":{"max_queued":1}}`,
+		`{"test-rollout":{"limit":1,"enforce_fraction":2}}`,
+		`{"test-queued":{"limit":1},"test-keyed":{"key_limits":{"a":0}}}`,
+		`{"test-queued":{"key_limits":{"a":1}}}`,
+		`{"test-keyed":{"limit":1}}`,
+	} {
+		config := Config{}
+		err := json.Unmarshal([]byte(invalid), &config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyConfig(config); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+	if queued.Stats().Limit != 2 || rollout.Stats().Limit != 4 || len(keyed.KeyLimits()) != 1 {
+		t.Error("expected invalid configs to not change the limiters")
+	}
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"test-queued":{"limit":5,"max_queued":0},"test-rollout":{"enforce_fraction":1},` +
+		`"test-keyed":{"key_limits":{"small":1}}}`)
+	ConfigHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/config", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	if queued.Stats().Limit != 5 || queued.MaxQueued() != 0 || rollout.Fraction() != 1 || rollout.Stats().Limit != 4 {
+		t.Errorf("expected the config to be applied: %s", w.Body.String())
+	}
+	if limits := keyed.KeyLimits(); len(limits) != 1 || limits["small"] != 1 {
+		t.Errorf("expected the key limits to be replaced: %#v", limits)
+	}
+}
+
+func TestWriteRejection(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteRejection(w, ShedCapacity, ErrLimited)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("unexpected capacity response: %d %#v", w.Code, w.Header())
+	}
+	w = httptest.NewRecorder()
+	WriteRejection(w, ShedClient, ErrLimited)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "" {
+		t.Errorf("unexpected client response: %d %#v", w.Code, w.Header())
+	}
+
+	SetRejectPolicy(RejectPolicy{CapacityStatus: http.StatusTooManyRequests, RetryAfter: 1500 * time.Millisecond})
+	defer SetRejectPolicy(RejectPolicy{})
+	w = httptest.NewRecorder()
+	WriteRejection(w, ShedCapacity, ErrLimited)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("unexpected configured response: %d %#v", w.Code, w.Header())
+	}
+
+	// the JSON body reports the limiter's queue
+	queued := NewQueued(1, 2)
+	end, err := queued.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+	go queued.StartContext(context.Background())
+	for queued.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	SetRejectPolicy(RejectPolicy{JSON: true})
+	w = httptest.NewRecorder()
+	w.Header().Set(RequestIDHeader, "abc")
+	WriteLimiterRejection(w, queued, ShedCapacity, ErrLimited)
+	expected := `{"code":"capacity","reason":"exceeded max concurrent operations limit","retry_after_ms":1000,` +
+		`"queue_depth":1,"request_id":"abc"}` + "\n"
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Content-Type") != "application/json" ||
+		w.Body.String() != expected {
+		t.Errorf("unexpected JSON response: %d %#v %s", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	audit := NewAuditLog(10, 1)
+	limiter := New(1)
+	var nested *httptest.ResponseRecorder
+	var handler http.Handler
+	handler = RequestIDHandler(AuditHandler(audit, limiter, nil, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if id := RequestIDFromContext(r.Context()); id != w.Header().Get(RequestIDHeader) {
+				t.Errorf("context request ID=%#v; expected the response header %#v", id, w.Header().Get(RequestIDHeader))
+			}
+			if nested == nil {
+				// a nested request while this one is running is rejected
+				nested = httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/nested", nil)
+				r.Header.Set(RequestIDHeader, "client-id")
+				handler.ServeHTTP(nested, r)
+			}
+		})))
+
+	r := httptest.NewRequest(http.MethodGet, "/path", nil)
+	// invalid IDs are replaced
+	r.Header.Set(RequestIDHeader, "bad\nid")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	generated := w.Header().Get(RequestIDHeader)
+	if w.Code != http.StatusOK || len(generated) != 32 {
+		t.Errorf("expected a generated request ID: %d %#v", w.Code, generated)
+	}
+	if nested.Code != http.StatusServiceUnavailable || nested.Header().Get(RequestIDHeader) != "client-id" ||
+		!strings.Contains(nested.Body.String(), "request_id=client-id") {
+		t.Errorf("unexpected rejection: %d %#v %#v", nested.Code, nested.Header(), nested.Body.String())
+	}
+
+	records := audit.Records(time.Time{}, time.Time{})
+	if len(records) != 2 || records[0].RequestID != generated || records[1].RequestID != "client-id" {
+		t.Errorf("unexpected records: %#v", records)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	limiter := New(1)
+	detached := make(chan func(), 1)
+	handler := Handler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/detach" {
+			end, ok := Detach(r.Context())
+			if !ok {
+				t.Error("expected to detach the request's operation")
+			}
+			detached <- end
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/detach", nil))
+	end := <-detached
+	if stats := limiter.(StatsReporter).Stats(); stats.Current != 1 {
+		t.Errorf("expected the detached operation to keep running: %#v", stats)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("expected the detached operation to use the limit:", w.Code)
+	}
+
+	// extra calls to end are ignored, unless debugging
+	end()
+	end()
+	if stats := limiter.(StatsReporter).Stats(); stats.Current != 0 {
+		t.Errorf("expected the detached operation to end once: %#v", stats)
+	}
+	if _, ok := Detach(context.Background()); ok {
+		t.Error("expected Detach to fail without an operation")
+	}
+
+	SetDebug(true)
+	defer SetDebug(false)
+	ctx, release := WithOperation(context.Background(), doNothing)
+	end, _ = Detach(ctx)
+	release()
+	end()
+	for _, misuse := range []func(){end, func() { Detach(ctx) }} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic in debug mode")
+				}
+			}()
+			misuse()
+		}()
+	}
+}
+
+func TestQueuedHandler(t *testing.T) {
+	limiter := NewQueued(1, 1)
+	waits := make(chan time.Duration, 1)
+	handler := QueuedHandler(limiter, QueueOptions{MaxWait: time.Minute, ServerTiming: true},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			waits <- QueueWait(r.Context())
+		}))
+
+	// the request waits for a running operation to end
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for limiter.Stats().Queued != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		end()
+	}()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if wait := <-waits; w.Code != http.StatusOK || wait < 10*time.Millisecond {
+		t.Errorf("expected the request to wait: %d %s", w.Code, wait)
+	}
+	if timing := w.Header().Get("Server-Timing"); !strings.HasPrefix(timing, "queue;dur=") {
+		t.Errorf("unexpected Server-Timing: %#v", timing)
+	}
+
+	// requests that wait longer than MaxWait are rejected
+	end, err = limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+	handler = QueuedHandler(limiter, QueueOptions{MaxWait: 10 * time.Millisecond}, http.NotFoundHandler())
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Server-Timing") != "" {
+		t.Errorf("expected a rejection without Server-Timing: %d %#v", w.Code, w.Header())
+	}
+	if QueueWait(context.Background()) != 0 {
+		t.Error("expected no wait without QueuedHandler")
+	}
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	limiter := NewMetricsLimiter(New(1))
+	unblock := make(chan struct{})
+	handler := TimeoutHandler(limiter, 20*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			<-unblock
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != timeoutMessage {
+		t.Errorf("expected a timeout response: %d %#v", w.Code, w.Body.String())
+	}
+
+	// the slow handler is still running, but its slot was released
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	close(unblock)
+	if w.Code != http.StatusOK {
+		t.Error("expected the request after the timeout to succeed:", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	MetricsHandler(limiter).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "concurrentlimit_timed_out_total 1\n") {
+		t.Errorf("expected 1 timed out request in metrics:\n%s", w.Body.String())
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	limiter := NewQueued(2, 1)
+	end1, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	end2, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lowering the limit does not stop running operations, and does not start queued operations
+	// until the running operations are below the new limit
+	limiter.SetLimit(1)
+	queuedErr := make(chan error)
+	go func() {
+		end, err := limiter.StartContext(context.Background())
+		if err == nil {
+			end()
+		}
+		queuedErr <- err
+	}()
+	for limiter.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	end1()
+	if stats := limiter.Stats(); stats.Current != 1 || stats.Queued != 1 {
+		t.Errorf("expected 1 running and 1 queued: %#v", stats)
+	}
+
+	// raising the limit starts the queued operation
+	limiter.SetLimit(2)
+	err = <-queuedErr
+	if err != nil {
+		t.Error(err)
+	}
+	end2()
+	if stats := limiter.Stats(); stats.Current != 0 || stats.Limit != 2 || stats.Peak != 2 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	limiter := New(2)
+	handler := AdminHandler(limiter)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?limit=1", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"current":0,"limit":1,"peak":0,"queued":0}`+"\n" {
+		t.Errorf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+	_, err = limiter.Start()
+	if err != ErrLimited {
+		t.Error("expected ErrLimited with the lowered limit:", err)
+	}
+
+	for _, limit := range []string{"", "0", "x"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?limit="+limit, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("limit=%#v: expected bad request: %d", limit, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	AdminHandler(NoLimit()).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?limit=1", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("expected not implemented: %d", w.Code)
+	}
+}
+
+// benchmarkGoroutines are the numbers of goroutines that start operations concurrently.
+var benchmarkGoroutines = []int{1, 8, 64, 512}
+
+// benchmarkLimit is larger than any of benchmarkGoroutines, so operations are never rejected.
+const benchmarkLimit = 1024
+
+// startFunc adapts a function to the Limiter interface.
+type startFunc func() (func(), error)
+
+func (f startFunc) Start() (func(), error) {
+	return f()
+}
+
+// runConcurrently calls op b.N times in total, divided between goroutines.
+func runConcurrently(b *testing.B, goroutines int, op func()) {
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for g := 0; g < goroutines; g++ {
+		n := b.N / goroutines
+		if g < b.N%goroutines {
+			n++
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				op()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkLimiters measures the cost of starting and ending an operation with each limiter.
+func BenchmarkLimiters(b *testing.B) {
+	limiters := []struct {
+		name       string
+		newLimiter func() Limiter
+	}{
+		{"NoLimit", NoLimit},
+		{"New", func() Limiter { return New(benchmarkLimit) }},
+		{"Queued", func() Limiter { return NewQueued(benchmarkLimit, 0) }},
+		{"Weighted", func() Limiter { return NewWeighted(benchmarkLimit) }},
+		{"Keyed", func() Limiter {
+			keyed := NewKeyed(benchmarkLimit)
+			return startFunc(func() (func(), error) { return keyed.Start("key") })
+		}},
+		{"Metrics", func() Limiter { return NewMetricsLimiter(New(benchmarkLimit)) }},
+	}
+	for _, l := range limiters {
+		for _, goroutines := range benchmarkGoroutines {
+			b.Run(fmt.Sprintf("%s/goroutines=%d", l.name, goroutines), func(b *testing.B) {
+				limiter := l.newLimiter()
+				runConcurrently(b, goroutines, func() {
+					end, err := limiter.Start()
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					end()
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkHandler measures the overhead of Handler, compared to calling the handler directly.
+func BenchmarkHandler(b *testing.B) {
+	noop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handlers := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{"unlimited", noop},
+		{"Handler", Handler(New(benchmarkLimit), noop)},
+	}
+	for _, h := range handlers {
+		for _, goroutines := range benchmarkGoroutines {
+			b.Run(fmt.Sprintf("%s/goroutines=%d", h.name, goroutines), func(b *testing.B) {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				runConcurrently(b, goroutines, func() {
+					h.handler.ServeHTTP(httptest.NewRecorder(), r)
+				})
+			})
+		}
+	}
+}
+
+// invariantLimiter is a limiter whose invariants are checked by the randomized tests.
+type invariantLimiter interface {
+	Limiter
+	StatsReporter
+	LimitSetter
+}
+
+// settableMetrics is a MetricsLimiter that changes the limit of the limiter it wraps, as
+// AdminHandler does.
+type settableMetrics struct {
+	*MetricsLimiter
+	LimitSetter
+}
+
+// invariantLimiters returns a new limiter of each kind that permits limit operations.
+func invariantLimiters(limit int) map[string]invariantLimiter {
+	metrics := NewMetricsLimiter(New(limit))
+	setter, _ := limitSetter(metrics)
+	return map[string]invariantLimiter{
+		"New":      New(limit).(invariantLimiter),
+		"Queued":   NewQueued(limit, limit),
+		"Weighted": NewWeighted(limit),
+		"Metrics":  settableMetrics{metrics, setter},
+	}
+}
+
+// checkSequentialInvariants applies ops to limiter one at a time, and checks that it matches a
+// simple model: Start only succeeds below the limit, and Stats reports the running operations,
+// the current limit, and their peak. Each op starts an operation, ends the oldest operation, or
+// changes the limit to a value from 1 to 8.
+func checkSequentialInvariants(t *testing.T, name string, limiter invariantLimiter, limit int, ops []byte) {
+	var ends []func()
+	peak := 0
+	for i, op := range ops {
+		switch op % 3 {
+		case 0:
+			end, err := limiter.Start()
+			if len(ends) < limit {
+				if err != nil {
+					t.Fatalf("%s: op %d: Start must succeed below the limit: %s", name, i, err)
+				}
+				ends = append(ends, end)
+			} else if err != ErrLimited {
+				t.Fatalf("%s: op %d: Start must return ErrLimited at the limit: %v", name, i, err)
+			}
+		case 1:
+			if len(ends) > 0 {
+				ends[0]()
+				ends = ends[1:]
+			}
+		case 2:
+			limit = int(op/3)%8 + 1
+			limiter.SetLimit(limit)
+		}
+		if len(ends) > peak {
+			peak = len(ends)
+		}
+
+		stats := limiter.Stats()
+		if stats.Current != len(ends) || stats.Limit != limit || stats.Peak != peak || stats.Queued != 0 {
+			t.Fatalf("%s: op %d: stats=%#v; expected Current=%d Limit=%d Peak=%d",
+				name, i, stats, len(ends), limit, peak)
+		}
+	}
+
+	for _, end := range ends {
+		end()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := Drain(ctx, limiter)
+	if err != nil {
+		t.Fatalf("%s: Drain must return after all operations end: %s", name, err)
+	}
+}
+
+func FuzzLimiterInvariants(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 1, 0, 1, 1, 1})
+	// lower the limit below the running operations, then raise it
+	f.Add([]byte{0, 0, 0, 2, 0, 1, 1, 0, 0, 23, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		for name, limiter := range invariantLimiters(3) {
+			checkSequentialInvariants(t, name, limiter, 3, ops)
+		}
+	})
+}
+
+// TestLimiterInvariantsConcurrent starts and ends operations on each limiter from many goroutines
+// while changing its limit, and checks that the running operations never exceed the largest
+// limit, that Stats is consistent, and that the limiter is idle after all operations end.
+func TestLimiterInvariantsConcurrent(t *testing.T) {
+	const goroutines = 32
+	const iterations = 200
+	const maxLimit = 8
+
+	for name, limiter := range invariantLimiters(maxLimit) {
+		limiter := limiter
+		t.Run(name, func(t *testing.T) {
+			checkStats := func() {
+				stats := limiter.Stats()
+				if stats.Current < 0 || stats.Queued < 0 || stats.Peak < stats.Current || stats.Peak > maxLimit {
+					t.Errorf("inconsistent stats: %#v", stats)
+				}
+			}
+
+			// change the limit while operations are running
+			done := make(chan struct{})
+			var setterWG sync.WaitGroup
+			setterWG.Add(1)
+			go func() {
+				defer setterWG.Done()
+				rng := rand.New(rand.NewSource(0))
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					limiter.SetLimit(rng.Intn(maxLimit) + 1)
+					checkStats()
+					time.Sleep(100 * time.Microsecond)
+				}
+			}()
+
+			var running atomic.Int64
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(seed))
+					for i := 0; i < iterations; i++ {
+						var end func()
+						var err error
+						waiter, ok := limiter.(interface {
+							StartContext(context.Context) (func(), error)
+						})
+						if ok && rng.Intn(2) == 0 {
+							timeout := time.Duration(rng.Intn(100)) * time.Microsecond
+							ctx, cancel := context.WithTimeout(context.Background(), timeout)
+							end, err = waiter.StartContext(ctx)
+							cancel()
+						} else {
+							end, err = limiter.Start()
+						}
+						if err == ErrLimited || err == context.DeadlineExceeded {
+							continue
+						}
+						if err != nil {
+							t.Error(err)
+							return
+						}
+
+						if n := running.Add(1); n > maxLimit {
+							t.Errorf("running operations=%d exceeds the largest limit=%d", n, maxLimit)
+						}
+						if rng.Intn(4) == 0 {
+							runtime.Gosched()
+						}
+						running.Add(-1)
+						end()
+					}
+				}(int64(g))
+			}
+			wg.Wait()
+			close(done)
+			setterWG.Wait()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err := Drain(ctx, limiter)
+			if err != nil {
+				t.Fatal("Drain must return after all operations end:", err)
+			}
+			checkStats()
+		})
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0).UTC()}
+	profiler := NewProfiler(ProfileOptions{Warmup: time.Minute, MemoryBytes: 1 << 40})
+	profiler.SetClock(clock)
+
+	// operations that start during the warmup are ignored
+	profiler.Start("/warmup")()
+	if report := profiler.Report(); report.Ready || len(report.Operations) != 0 {
+		t.Errorf("expected no operations during the warmup: %#v", report)
+	}
+	clock.advance(time.Minute)
+
+	// two /a operations and one /b operation run at the same time
+	endA1 := profiler.Start("/a")
+	endA2 := profiler.Start("/a")
+	endB := profiler.Start("/b")
+	clock.advance(10 * time.Millisecond)
+	endA1()
+	endA2()
+	clock.advance(10 * time.Millisecond)
+	endB()
+
+	report := profiler.Report()
+	if !report.Ready || report.Total.Operations != 3 || report.Total.PeakConcurrent != 3 {
+		t.Errorf("unexpected report: %#v", report)
+	}
+	if len(report.Operations) != 2 {
+		t.Fatalf("expected 2 operations: %#v", report.Operations)
+	}
+	a, b := report.Operations[0], report.Operations[1]
+	if a.Label != "/a" || a.Operations != 2 || a.PeakConcurrent != 2 || a.P99Concurrent != 2 ||
+		a.P99MS != 10 || a.SuggestedLimit != 3 || a.LimitedBy != "concurrency" {
+		t.Errorf("unexpected /a: %#v", a)
+	}
+	if b.Label != "/b" || b.Operations != 1 || b.P50MS != 20 || b.SuggestedLimit != 2 {
+		t.Errorf("unexpected /b: %#v", b)
+	}
+
+	// an operation that allocates much of the available memory is limited by memory
+	small := NewProfiler(ProfileOptions{Warmup: time.Nanosecond, MemoryBytes: 8 << 20, ReservedFraction: 0.5})
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 10; i++ {
+		end := small.Start("/big")
+		sink = make([]byte, 2<<20)
+		end()
+	}
+	big := small.Report().Operations[0]
+	if big.AllocatedBytes < 2<<20 || big.SuggestedLimit != 1 || big.LimitedBy != "memory" {
+		t.Errorf("unexpected /big: %#v", big)
+	}
+}
+
+// sink keeps allocations from being optimized away.
+var sink []byte
+
+func TestTrustedCallers(t *testing.T) {
+	key := []byte("secret")
+	identityFunc := SignedHeaderIdentity("X-Identity", key)
+	request := func(identity string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if identity != "" {
+			r.Header.Set("X-Identity", identity)
+		}
+		return r
+	}
+
+	// signed identities are verified
+	signed := SignIdentity(key, "control.plane")
+	if identity := identityFunc(request(signed)); identity != "control.plane" {
+		t.Errorf("identity=%#v; expected control.plane", identity)
+	}
+	for _, value := range []string{"control.plane", signed + "x", SignIdentity([]byte("other"), "control.plane"), ""} {
+		if identity := identityFunc(request(value)); identity != "" {
+			t.Errorf("value=%#v: identity=%#v; expected empty", value, identity)
+		}
+	}
+	if _, ok := VerifySignedIdentity(nil, SignIdentity(nil, "control.plane")); ok {
+		t.Error("an empty key must not verify")
+	}
+
+	for _, reserve := range []int{0, 1} {
+		limiter := New(1)
+		trusted := NewTrustedCallers([]string{"control.plane"}, reserve)
+		// each request sends a nested request while it runs, so all but the first are over the limit
+		identities := []string{"", signed, signed, ""}
+		codes := make([]int, len(identities))
+		depth := 0
+		var handler http.Handler
+		handler = TrustedHandler(trusted, identityFunc, limiter, http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				depth++
+				if nested := depth; nested < len(identities) {
+					w := httptest.NewRecorder()
+					handler.ServeHTTP(w, request(identities[nested]))
+					codes[nested] = w.Code
+				}
+			}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request(identities[0]))
+		codes[0] = w.Code
+
+		// the untrusted request over the limit is rejected. Without a reserve, both trusted requests
+		// run; with a reserve of 1, the second is rejected, so the last is never sent.
+		expected := []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusServiceUnavailable}
+		if reserve == 1 {
+			expected = []int{http.StatusOK, http.StatusOK, http.StatusServiceUnavailable, 0}
+		}
+		if !reflect.DeepEqual(codes, expected) {
+			t.Errorf("reserve=%d: codes=%v; expected %v", reserve, codes, expected)
+		}
+		if stats := trusted.Stats(); stats.Current != 0 || stats.Limit != reserve {
+			t.Errorf("reserve=%d: stats=%#v", reserve, stats)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	limiter := New(2).(*syncLimiter)
+	health := NewHealthReporter(limiter, OverloadOptions{})
+	// an operation that outlives the server's requests, which ends after the servers stop
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const delay = 50 * time.Millisecond
+	start := time.Now()
+	steps := make(chan string, 10)
+	err = Shutdown(context.Background(), ShutdownOptions{
+		Health:              health,
+		DeregistrationDelay: delay,
+		Stops: []func(context.Context) error{func(ctx context.Context) error {
+			// readiness must fail before the servers stop, and for the whole delay
+			if health.Ready() == nil || time.Since(start) < delay {
+				steps <- "stopped early"
+			}
+			steps <- "stop"
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				steps <- "end"
+				end()
+			}()
+			return nil
+		}},
+		Limiters: []StatsReporter{limiter},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(steps)
+	ordered := []string{}
+	for step := range steps {
+		ordered = append(ordered, step)
+	}
+	if !reflect.DeepEqual(ordered, []string{"stop", "end"}) || limiter.Stats().Current != 0 {
+		t.Errorf("steps=%v; expected stop then end, and a drained limiter", ordered)
+	}
+
+	// if the operations do not complete, it returns the stop and drain errors
+	_, err = limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	stopErr := errors.New("stop failed")
+	err = Shutdown(ctx, ShutdownOptions{
+		DeregistrationDelay: time.Minute,
+		Stops: []func(context.Context) error{func(ctx context.Context) error {
+			return stopErr
+		}},
+		Limiters: []StatsReporter{limiter},
+	})
+	if !errors.Is(err, stopErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err=%v; expected the stop error and DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,201 @@
+package concurrentlimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// LimiterConfig is the configuration of a limiter that can be changed while it is running. Fields
+// that do not apply to the limiter, or that are not set when applying, are omitted.
+type LimiterConfig struct {
+	// Limit is the limiter's limit, changed with LimitSetter. It is omitted for limiters whose
+	// limit cannot be changed.
+	Limit int `json:"limit,omitempty"`
+	// MaxQueued is the maximum number of waiting operations of a QueuedLimiter.
+	MaxQueued *int `json:"max_queued,omitempty"`
+	// EnforceFraction is the fraction of rejections enforced by a RolloutLimiter.
+	EnforceFraction *float64 `json:"enforce_fraction,omitempty"`
+	// KeyLimits are the per-key limits of a KeyedLimiter registered with RegisterKeyed (see
+	// KeyedLimiter.SetKeyLimit). Applying them replaces all of the limiter's key limits.
+	KeyLimits map[string]int `json:"key_limits,omitempty"`
+}
+
+// Config is the configuration of the registered limiters, by name. It can be saved as JSON and
+// applied to another process, or to the same process after a restart, or compared between
+// processes to find configuration drift.
+type Config map[string]LimiterConfig
+
+// SnapshotConfig returns the current configuration of the registered limiters (see Register and
+// RegisterKeyed). Limiters, and the limiters they wrap, are found through MetricsLimiter,
+// RolloutLimiter, BreakerLimiter, and CompositeLimiter. Applying it with ApplyConfig does not
+// change anything.
+func SnapshotConfig() Config {
+	config := Config{}
+	for _, name := range RegisteredNames() {
+		limiter, ok := Lookup(name)
+		if !ok {
+			continue
+		}
+		limiterConfig := LimiterConfig{}
+		// only limits that can be changed, so applying the snapshot does not fail
+		if _, ok := limitSetter(limiter); ok {
+			if reporter, ok := limiter.(StatsReporter); ok {
+				limiterConfig.Limit = reporter.Stats().Limit
+			}
+		}
+		if queued, ok := findWrapped[*QueuedLimiter](limiter); ok {
+			maxQueued := queued.MaxQueued()
+			limiterConfig.MaxQueued = &maxQueued
+		}
+		if rollout, ok := findWrapped[*RolloutLimiter](limiter); ok {
+			fraction := rollout.Fraction()
+			limiterConfig.EnforceFraction = &fraction
+		}
+		config[name] = limiterConfig
+	}
+	for _, name := range registeredKeyedNames() {
+		if keyed, ok := LookupKeyed(name); ok {
+			config[name] = LimiterConfig{KeyLimits: keyed.KeyLimits()}
+		}
+	}
+	return config
+}
+
+// ApplyConfig changes the registered limiters to config. Limiters that are not in config are
+// not changed. It checks the whole config before changing anything, and returns an error without
+// changing any limiter if a name is not registered, a value is invalid, or a limiter cannot be
+// changed.
+func ApplyConfig(config Config) error {
+	changes := []func(){}
+
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		limiterConfig := config[name]
+		if keyed, ok := LookupKeyed(name); ok {
+			change, err := keyLimitsChange(name, keyed, limiterConfig)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, change)
+			continue
+		}
+		limiter, ok := Lookup(name)
+		if !ok {
+			return fmt.Errorf("concurrentlimit: config for unregistered limiter %#v", name)
+		}
+
+		if limiterConfig.Limit < 0 {
+			return fmt.Errorf("concurrentlimit: limiter %#v: limit=%d must be > 0, or 0 to not change it", name, limiterConfig.Limit)
+		}
+		if limiterConfig.Limit > 0 {
+			setter, ok := limitSetter(limiter)
+			if !ok {
+				return fmt.Errorf("concurrentlimit: limiter %#v: the limit cannot be changed", name)
+			}
+			limit := limiterConfig.Limit
+			changes = append(changes, func() { setter.SetLimit(limit) })
+		}
+
+		if limiterConfig.MaxQueued != nil {
+			queued, ok := findWrapped[*QueuedLimiter](limiter)
+			if !ok {
+				return fmt.Errorf("concurrentlimit: limiter %#v: max_queued requires a QueuedLimiter", name)
+			}
+			maxQueued := *limiterConfig.MaxQueued
+			if maxQueued < 0 {
+				return fmt.Errorf("concurrentlimit: limiter %#v: max_queued=%d must be >= 0", name, maxQueued)
+			}
+			changes = append(changes, func() { queued.SetMaxQueued(maxQueued) })
+		}
+
+		if limiterConfig.EnforceFraction != nil {
+			rollout, ok := findWrapped[*RolloutLimiter](limiter)
+			if !ok {
+				return fmt.Errorf("concurrentlimit: limiter %#v: enforce_fraction requires a RolloutLimiter", name)
+			}
+			fraction := *limiterConfig.EnforceFraction
+			if !(0 <= fraction && fraction <= 1) {
+				return fmt.Errorf("concurrentlimit: limiter %#v: enforce_fraction=%f must be between 0 and 1",
+					name, fraction)
+			}
+			changes = append(changes, func() { rollout.SetFraction(fraction) })
+		}
+
+		if limiterConfig.KeyLimits != nil {
+			return fmt.Errorf("concurrentlimit: limiter %#v: key_limits requires a KeyedLimiter", name)
+		}
+	}
+
+	for _, change := range changes {
+		change()
+	}
+	return nil
+}
+
+// keyLimitsChange returns the function that applies the config of the KeyedLimiter keyed, or an
+// error if it is invalid.
+func keyLimitsChange(name string, keyed *KeyedLimiter, limiterConfig LimiterConfig) (func(), error) {
+	if limiterConfig.Limit != 0 || limiterConfig.MaxQueued != nil || limiterConfig.EnforceFraction != nil {
+		return nil, fmt.Errorf("concurrentlimit: limiter %#v: a KeyedLimiter only supports key_limits", name)
+	}
+	if limiterConfig.KeyLimits == nil {
+		return func() {}, nil
+	}
+	for key, limit := range limiterConfig.KeyLimits {
+		if limit <= 0 {
+			return nil, fmt.Errorf("concurrentlimit: limiter %#v: key_limits[%#v]=%d must be > 0", name, key, limit)
+		}
+	}
+	return func() {
+		for key := range keyed.KeyLimits() {
+			if _, ok := limiterConfig.KeyLimits[key]; !ok {
+				keyed.SetKeyLimit(key, 0)
+			}
+		}
+		for key, limit := range limiterConfig.KeyLimits {
+			keyed.SetKeyLimit(key, limit)
+		}
+	}, nil
+}
+
+// ConfigHandler returns an http.Handler that reports SnapshotConfig as JSON, and applies a JSON
+// Config in the body of PUT requests with ApplyConfig. For example, to copy the configuration of
+// one process to another:
+//
+//	curl http://a/config | curl -X PUT --data-binary @- http://b/config
+//
+// See AdminHandler for the security considerations.
+func ConfigHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPut {
+			http.Error(w, "only GET and PUT are supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			config := Config{}
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			err := decoder.Decode(&config)
+			if err != nil {
+				http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = ApplyConfig(config)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("admin: applied the config of %d limiters", len(config))
+		}
+
+		writeJSON(w, SnapshotConfig())
+	})
+}
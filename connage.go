@@ -0,0 +1,38 @@
+package concurrentlimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+type connStartContextKey struct{}
+
+// MaxConnectionAge configures srv to close connections after they have been open for age. This
+// encourages clients to reconnect, which rebalances them across servers, and keeps a few
+// long-lived connections from using connection slots forever. The first response on a connection
+// after age has the "Connection: close" header, which closes HTTP/1 connections after the
+// response, and gracefully shuts down HTTP/2 connections with GOAWAY. Idle connections are closed
+// by srv.IdleTimeout. It must be called before srv starts serving, after srv.Handler is set.
+func MaxConnectionAge(srv *http.Server, age time.Duration) {
+	connContext := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, conn)
+		}
+		return context.WithValue(ctx, connStartContextKey{}, time.Now())
+	}
+
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connStart, ok := r.Context().Value(connStartContextKey{}).(time.Time)
+		if ok && time.Since(connStart) >= age {
+			w.Header().Set("Connection", "close")
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,155 @@
+package concurrentlimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnCounter counts open connections, to make connection limits observable. The zero value is
+// ready to use.
+type ConnCounter struct {
+	open atomic.Int64
+}
+
+// Open returns the number of open connections.
+func (c *ConnCounter) Open() int64 {
+	return c.open.Load()
+}
+
+// Listener returns a net.Listener that counts the connections accepted from listener until they
+// are closed.
+func (c *ConnCounter) Listener(listener net.Listener) net.Listener {
+	return &countingListener{listener, c}
+}
+
+// ConnState counts the connections of an http.Server when used as its ConnState hook.
+func (c *ConnCounter) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		c.open.Add(1)
+	case http.StateClosed, http.StateHijacked:
+		c.open.Add(-1)
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	counter *ConnCounter
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.counter.open.Add(1)
+	return &countedConn{Conn: conn, counter: l.counter}, nil
+}
+
+// countedConn decrements the count when it is closed the first time.
+type countedConn struct {
+	net.Conn
+	counter   *ConnCounter
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() { c.counter.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// ConnStats are the connection statistics of a listener registered with RegisterListener.
+type ConnStats struct {
+	Open int64 `json:"open"`
+	Peak int64 `json:"peak"`
+	// Limit is the listener's connection limit, or 0 if it is not limited.
+	Limit    int   `json:"limit"`
+	Accepted int64 `json:"accepted"`
+}
+
+// listenerRegistry is the process-wide set of named listeners.
+var listenerRegistry = struct {
+	mu        sync.Mutex
+	listeners map[string]*namedListener
+}{listeners: map[string]*namedListener{}}
+
+// RegisterListener returns a listener that counts the connections accepted from listener, and
+// adds it to the process-wide registry with name until it is closed, so ListenerStats reports
+// it. connectionLimit is only reported: listener must already enforce it, e.g. with
+// LimitListener. A process that serves several ports, such as HTTP and gRPC, can register each
+// listener with its own connection limit while its requests share one Limiter. Like Register, it
+// panics if name is empty or already registered.
+func RegisterListener(name string, listener net.Listener, connectionLimit int) net.Listener {
+	listenerRegistry.mu.Lock()
+	defer listenerRegistry.mu.Unlock()
+	if name == "" {
+		panic("concurrentlimit: RegisterListener: name must not be empty")
+	}
+	if _, exists := listenerRegistry.listeners[name]; exists {
+		panic(fmt.Sprintf("concurrentlimit: RegisterListener: name %#v is already registered", name))
+	}
+	l := &namedListener{Listener: listener, name: name, limit: connectionLimit}
+	listenerRegistry.listeners[name] = l
+	return l
+}
+
+// ListenerStats returns the connection statistics of each listener registered with
+// RegisterListener, by name.
+func ListenerStats() map[string]ConnStats {
+	listenerRegistry.mu.Lock()
+	defer listenerRegistry.mu.Unlock()
+	stats := make(map[string]ConnStats, len(listenerRegistry.listeners))
+	for name, l := range listenerRegistry.listeners {
+		stats[name] = l.stats()
+	}
+	return stats
+}
+
+// namedListener counts its connections like ConnCounter, and also records the peak and total.
+type namedListener struct {
+	net.Listener
+	name      string
+	limit     int
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	counter  ConnCounter
+	peak     int64
+	accepted int64
+}
+
+func (l *namedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	open := l.counter.open.Add(1)
+	if open > l.peak {
+		l.peak = open
+	}
+	l.accepted++
+	l.mu.Unlock()
+	return &countedConn{Conn: conn, counter: &l.counter}, nil
+}
+
+// Close closes the listener and removes it from the registry, so its name can be reused.
+func (l *namedListener) Close() error {
+	l.closeOnce.Do(func() {
+		listenerRegistry.mu.Lock()
+		defer listenerRegistry.mu.Unlock()
+		if listenerRegistry.listeners[l.name] == l {
+			delete(listenerRegistry.listeners, l.name)
+		}
+	})
+	return l.Listener.Close()
+}
+
+func (l *namedListener) stats() ConnStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ConnStats{Open: l.counter.Open(), Peak: l.peak, Limit: l.limit, Accepted: l.accepted}
+}
@@ -0,0 +1,93 @@
+package concurrentlimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// consumeRetryDelay is how long Consume waits before trying again when a Limiter that cannot wait
+// rejects an operation.
+const consumeRetryDelay = 10 * time.Millisecond
+
+// Consume fetches messages and handles each one on a separate goroutine, using limiter to limit the
+// number of messages that are handled concurrently. This is intended for message consumers (e.g.
+// Kafka, Pub/Sub, or SQS), so message processing is protected the same way as request serving.
+// Consume waits for capacity before calling fetch, so messages are not fetched until they can be
+// handled. If limiter is a ContextLimiter, such as QueuedLimiter, Consume uses it to wait. When
+// limiter rejects an operation with ErrLimited, it retries after a short delay.
+//
+// Consume returns when ctx is done, fetch returns an error, or handle returns an error, after
+// waiting for all running handlers to return. The context passed to handle is cancelled when
+// Consume is stopping. It returns the first error from fetch or handle, or ctx.Err().
+func Consume[T any](
+	ctx context.Context, limiter Limiter, fetch func(context.Context) (T, error),
+	handle func(context.Context, T) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var errOnce sync.Once
+	var firstErr error
+	setErr := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	for {
+		end, err := startWaiting(ctx, limiter)
+		if err != nil {
+			setErr(err)
+			break
+		}
+
+		msg, err := fetch(ctx)
+		if err != nil {
+			end()
+			setErr(err)
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer end()
+			if err := handle(ctx, msg); err != nil {
+				setErr(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// startWaiting starts an operation, waiting until limiter permits it or ctx is done. A
+// ContextLimiter can still return ErrLimited without waiting, such as a QueuedLimiter with a full
+// queue or a wrapper around a Limiter that cannot wait, so it is retried the same way.
+func startWaiting(ctx context.Context, limiter Limiter) (func(), error) {
+	start := limiter.Start
+	if waiter, ok := limiter.(ContextLimiter); ok {
+		start = func() (func(), error) { return waiter.StartContext(ctx) }
+	}
+
+	for {
+		end, err := start()
+		if err != ErrLimited {
+			return end, err
+		}
+
+		timer := time.NewTimer(consumeRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package concurrentlimit
+
+import "context"
+
+// ContextLimiter is a Limiter that can start operations with a context, for operations that
+// should wait for capacity until the context is done, or should not start if it is already done.
+// QueuedLimiter and MetricsLimiter implement it. Use WithContext to adapt any Limiter.
+type ContextLimiter interface {
+	Limiter
+	// StartContext begins a new operation like Start, but may wait until ctx is done for a running
+	// operation to complete. It returns ctx.Err() if ctx is done before the operation starts.
+	StartContext(ctx context.Context) (func(), error)
+}
+
+// WithContext returns limiter if it implements ContextLimiter. Otherwise, it returns a
+// ContextLimiter whose StartContext returns ctx.Err() if ctx is done, and otherwise calls
+// limiter.Start without waiting. The adapter does not implement limiter's other interfaces, such
+// as StatsReporter.
+func WithContext(limiter Limiter) ContextLimiter {
+	if contextLimiter, ok := limiter.(ContextLimiter); ok {
+		return contextLimiter
+	}
+	return contextAdapter{limiter}
+}
+
+type contextAdapter struct {
+	Limiter
+}
+
+func (c contextAdapter) StartContext(ctx context.Context) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Start()
+}
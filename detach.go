@@ -0,0 +1,88 @@
+package concurrentlimit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// debugEnabled enables extra checks of Detach and its end functions. See SetDebug.
+var debugEnabled atomic.Bool
+
+// SetDebug enables or disables extra checks for bugs in the use of operations. When enabled,
+// calling the end function returned by Detach more than once, or calling Detach when the
+// operation was already detached or ended, panics. When disabled, extra calls to end are ignored
+// and Detach returns false. This is intended for tests.
+func SetDebug(enabled bool) {
+	debugEnabled.Store(enabled)
+}
+
+type operationState int
+
+const (
+	operationRunning operationState = iota
+	operationDetached
+	operationEnded
+)
+
+// operation is an operation started by Handler or UnaryInterceptor, which can be detached from
+// the request that started it.
+type operation struct {
+	mu    sync.Mutex
+	end   func()
+	state operationState
+}
+
+type operationContextKey struct{}
+
+// WithOperation returns a context that permits Detach to take over the operation ended by end,
+// and a function that ends the operation unless it was detached. Handler and
+// grpclimit.UnaryInterceptor call it for each request, and call the returned function when the
+// request's handler returns.
+func WithOperation(ctx context.Context, end func()) (context.Context, func()) {
+	op := &operation{end: end}
+	return context.WithValue(ctx, operationContextKey{}, op), op.release
+}
+
+func (op *operation) release() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.state != operationRunning {
+		return
+	}
+	op.state = operationEnded
+	op.end()
+}
+
+// Detach takes over the operation started for the request with ctx, so it keeps using the limit
+// after the request's handler returns. This permits handlers to pass work to another goroutine
+// and return early, without ending the operation while the work is running. The caller must call
+// the returned function exactly once when the work is done. It returns false if ctx has no
+// operation, or if it was already detached or ended.
+func Detach(ctx context.Context) (func(), bool) {
+	op, ok := ctx.Value(operationContextKey{}).(*operation)
+	if !ok {
+		return doNothing, false
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.state != operationRunning {
+		if debugEnabled.Load() {
+			panic("bug: Detach called after the operation was detached or ended")
+		}
+		return doNothing, false
+	}
+	op.state = operationDetached
+
+	var ended atomic.Bool
+	return func() {
+		if ended.Swap(true) {
+			if debugEnabled.Load() {
+				panic("bug: detached operation ended more than once")
+			}
+			return
+		}
+		op.end()
+	}, true
+}
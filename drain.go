@@ -0,0 +1,28 @@
+package concurrentlimit
+
+import (
+	"context"
+	"time"
+)
+
+// drainPollInterval is the time between checks for running operations in Drain.
+const drainPollInterval = 10 * time.Millisecond
+
+// Drain waits until limiter has no running or queued operations, which is useful during shutdown
+// after new operations have stopped arriving. It returns ctx.Err() if ctx is done first.
+func Drain(ctx context.Context, limiter StatsReporter) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		stats := limiter.Stats()
+		if stats.Current == 0 && stats.Queued == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -4,6 +4,7 @@ go 1.20
 
 require (
 	golang.org/x/net v0.7.0
+	google.golang.org/genproto v0.0.0-20230216225411-c8e22ba71e44
 	google.golang.org/grpc v1.53.0
 	google.golang.org/protobuf v1.28.1
 )
@@ -12,5 +13,4 @@ require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
-	google.golang.org/genproto v0.0.0-20230216225411-c8e22ba71e44 // indirect
 )
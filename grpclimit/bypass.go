@@ -0,0 +1,77 @@
+package grpclimit
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// BypassFunc returns true for requests that should not be limited, such as health checks,
+// reflection, or requests from administrators, so they work while the server is overloaded. It
+// is called for every request, so it should be fast. For streams, info only has FullMethod and
+// Server set.
+type BypassFunc func(ctx context.Context, info *grpc.UnaryServerInfo) bool
+
+// BypassMethods returns a BypassFunc that exempts the listed methods, either full method names
+// ("/package.Service/Method") or service names ending in a slash ("/package.Service/") to exempt
+// all their methods.
+func BypassMethods(methods ...string) BypassFunc {
+	exact := map[string]bool{}
+	services := []string{}
+	for _, method := range methods {
+		if strings.HasSuffix(method, "/") {
+			services = append(services, method)
+		} else {
+			exact[method] = true
+		}
+	}
+
+	return func(ctx context.Context, info *grpc.UnaryServerInfo) bool {
+		if exact[info.FullMethod] {
+			return true
+		}
+		for _, service := range services {
+			if strings.HasPrefix(info.FullMethod, service) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// BypassUnary returns a grpc.UnaryServerInterceptor that calls interceptor, which limits
+// requests, unless bypass returns true for the request. In both cases next is called afterwards,
+// if it is not nil. interceptor should be created with a nil next interceptor, such as
+// UnaryInterceptor(limiter, nil). This mirrors HTTP servers, which exempt paths by serving them
+// with handlers that are not limited.
+func BypassUnary(
+	bypass BypassFunc, interceptor grpc.UnaryServerInterceptor, next grpc.UnaryServerInterceptor,
+) grpc.UnaryServerInterceptor {
+	limited := ChainUnary(interceptor, next)
+	unlimited := ChainUnary(next)
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if bypass(ctx, info) {
+			return unlimited(ctx, req, info, handler)
+		}
+		return limited(ctx, req, info, handler)
+	}
+}
+
+// BypassStream is the grpc.StreamServerInterceptor version of BypassUnary.
+func BypassStream(
+	bypass BypassFunc, interceptor grpc.StreamServerInterceptor, next grpc.StreamServerInterceptor,
+) grpc.StreamServerInterceptor {
+	limited := ChainStream(interceptor, next)
+	unlimited := ChainStream(next)
+	return func(
+		srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		if bypass(stream.Context(), &grpc.UnaryServerInfo{Server: srv, FullMethod: info.FullMethod}) {
+			return unlimited(srv, stream, info, handler)
+		}
+		return limited(srv, stream, info, handler)
+	}
+}
@@ -0,0 +1,119 @@
+package grpclimit
+
+import (
+	"context"
+
+	"github.com/evanj/concurrentlimit"
+	"google.golang.org/grpc"
+)
+
+// ChainUnary returns a grpc.UnaryServerInterceptor that calls interceptors in order: the first is
+// the outermost, so it runs first on the request and last on the response. Nil interceptors are
+// skipped. The order is the same as grpc.ChainUnaryInterceptor, but the result is an interceptor,
+// so it can be passed as next to this package's interceptors or to NewServerWithLimiter, which
+// run next after their limiter permits the request.
+//
+// A predictable order is: recovery first, so it catches panics in the others; then telemetry, so
+// it records rejected requests; then UnaryInterceptor, so overload is rejected before any
+// expensive work; then authentication; then interceptors that limit by the authenticated caller,
+// such as KeyedUnaryInterceptor.
+func ChainUnary(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	chain := make([]grpc.UnaryServerInterceptor, 0, len(interceptors))
+	for _, interceptor := range interceptors {
+		if interceptor != nil {
+			chain = append(chain, interceptor)
+		}
+	}
+
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		return callUnary(ctx, chain, req, info, handler)
+	}
+}
+
+// callUnary calls the first interceptor in chain, with a handler that calls the rest.
+func callUnary(
+	ctx context.Context, chain []grpc.UnaryServerInterceptor, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if len(chain) == 0 {
+		return handler(ctx, req)
+	}
+	return chain[0](ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return callUnary(ctx, chain[1:], req, info, handler)
+	})
+}
+
+// ChainStream is the grpc.StreamServerInterceptor version of ChainUnary, with the same order.
+func ChainStream(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	chain := make([]grpc.StreamServerInterceptor, 0, len(interceptors))
+	for _, interceptor := range interceptors {
+		if interceptor != nil {
+			chain = append(chain, interceptor)
+		}
+	}
+
+	return func(
+		srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		return callStream(chain, srv, stream, info, handler)
+	}
+}
+
+// callStream calls the first interceptor in chain, with a handler that calls the rest.
+func callStream(
+	chain []grpc.StreamServerInterceptor,
+	srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+) error {
+	if len(chain) == 0 {
+		return handler(srv, stream)
+	}
+	return chain[0](srv, stream, info, func(srv interface{}, stream grpc.ServerStream) error {
+		return callStream(chain[1:], srv, stream, info, handler)
+	})
+}
+
+// UnaryLayer is a unary interceptor for ChainUnaryChecked, described for
+// concurrentlimit.CheckOrder.
+type UnaryLayer struct {
+	concurrentlimit.Layer
+	Interceptor grpc.UnaryServerInterceptor
+}
+
+// ChainUnaryChecked is a version of ChainUnary that first checks the order of layers with
+// concurrentlimit.CheckOrder, and returns its error if a limit does not run before the expensive
+// interceptors.
+func ChainUnaryChecked(layers ...UnaryLayer) (grpc.UnaryServerInterceptor, error) {
+	descriptions := make([]concurrentlimit.Layer, len(layers))
+	interceptors := make([]grpc.UnaryServerInterceptor, len(layers))
+	for i, layer := range layers {
+		descriptions[i] = layer.Layer
+		interceptors[i] = layer.Interceptor
+	}
+	err := concurrentlimit.CheckOrder(descriptions...)
+	if err != nil {
+		return nil, err
+	}
+	return ChainUnary(interceptors...), nil
+}
+
+// StreamLayer is the stream version of UnaryLayer.
+type StreamLayer struct {
+	concurrentlimit.Layer
+	Interceptor grpc.StreamServerInterceptor
+}
+
+// ChainStreamChecked is the stream version of ChainUnaryChecked.
+func ChainStreamChecked(layers ...StreamLayer) (grpc.StreamServerInterceptor, error) {
+	descriptions := make([]concurrentlimit.Layer, len(layers))
+	interceptors := make([]grpc.StreamServerInterceptor, len(layers))
+	for i, layer := range layers {
+		descriptions[i] = layer.Layer
+		interceptors[i] = layer.Interceptor
+	}
+	err := concurrentlimit.CheckOrder(descriptions...)
+	if err != nil {
+		return nil, err
+	}
+	return ChainStream(interceptors...), nil
+}
@@ -5,13 +5,23 @@ package grpclimit
 import (
 	"context"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/evanj/concurrentlimit"
+	"golang.org/x/net/netutil"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 // ResourceExhausted seems slightly better than Unavailable, since
@@ -24,6 +34,39 @@ import (
 // limiting"
 const rateLimitStatus = codes.ResourceExhausted
 
+// ErrorInfoDomain is the Domain of the errdetails.ErrorInfo in the status details of rejected
+// requests. Its Reason is the concurrentlimit.Rejection Code in upper case, e.g. "CAPACITY", and
+// its Metadata has the other fields of the Rejection, e.g. "queue_depth".
+const ErrorInfoDomain = "concurrentlimit.evanj.github.com"
+
+// rejectionError returns the status for a request rejected because of cause with err by limiter:
+// codes.ResourceExhausted, with the concurrentlimit.Rejection in its details as an
+// errdetails.ErrorInfo, and an errdetails.RetryInfo if the client should retry after a delay.
+// limiter may be nil. The limitclient package parses the details.
+func rejectionError(cause concurrentlimit.ShedCause, err error, limiter concurrentlimit.Limiter) error {
+	rejection := concurrentlimit.NewRejection(cause, err, limiter)
+	details := []protoiface.MessageV1{&errdetails.ErrorInfo{
+		Reason: strings.ToUpper(rejection.Code),
+		Domain: ErrorInfoDomain,
+		Metadata: map[string]string{
+			"reason":         rejection.Reason,
+			"retry_after_ms": strconv.FormatInt(rejection.RetryAfterMS, 10),
+			"queue_depth":    strconv.Itoa(rejection.QueueDepth),
+		},
+	}}
+	if rejection.RetryAfterMS > 0 {
+		details = append(details, &errdetails.RetryInfo{
+			RetryDelay: durationpb.New(time.Duration(rejection.RetryAfterMS) * time.Millisecond),
+		})
+	}
+	st, detailsErr := status.New(rateLimitStatus, rejection.Reason).WithDetails(details...)
+	if detailsErr != nil {
+		// only fails if the details cannot be marshalled, which should not happen
+		return status.Error(rateLimitStatus, rejection.Reason)
+	}
+	return st.Err()
+}
+
 // Set to the value recommended by the Google Cloud Load Balancer:
 // https://cloud.google.com/load-balancing/docs/https#timeouts_and_retries
 const idleConnectionTimeout = 620 * time.Second
@@ -34,19 +77,19 @@ const keepaliveTimeout = time.Minute
 // requests to block on the client if a single client sends too many requests. You should also use
 // Serve() with this server to protect against too many idle connections.
 //
-// NOTE: options must not contain any interceptors, since this function relies on adding our
-// own interceptor to limit the requests. Use NewServerWithInterceptors if you need interceptors.
+// Streams count as one request for as long as they are open.
 //
-// TODO: Implement stream interceptors
+// NOTE: options must not contain any interceptors, since this function relies on adding our
+// own interceptors to limit the requests. Use NewServerWithInterceptors if you need interceptors.
 func NewServer(
 	addr string, requestLimit int, options ...grpc.ServerOption,
 ) (*grpc.Server, error) {
 	return NewServerWithInterceptors(addr, requestLimit, nil, options...)
 }
 
-// NewServerWithInterceptors is a version of NewServer that permits customizing the interceptors.
-// The passed in interceptor will be called after the operation limiter permits the request. See
-// NewServer's documentation for the remaining details.
+// NewServerWithInterceptors is a version of NewServer that permits customizing the unary
+// interceptors. The passed in interceptor will be called after the operation limiter permits the
+// request. See NewServer's documentation for the remaining details.
 func NewServerWithInterceptors(
 	addr string, requestLimit int, unaryInterceptor grpc.UnaryServerInterceptor,
 	options ...grpc.ServerOption,
@@ -55,18 +98,61 @@ func NewServerWithInterceptors(
 		return nil, fmt.Errorf("NewServer: requestLimit=%d must be > 0", requestLimit)
 	}
 
-	requestLimiter := concurrentlimit.New(requestLimit)
-	limitedUnaryInterceptorChain := UnaryInterceptor(requestLimiter, unaryInterceptor)
-
 	options = append(options, grpc.MaxConcurrentStreams(uint32(requestLimit)))
+	return NewServerWithLimiter(concurrentlimit.New(requestLimit), unaryInterceptor, options...), nil
+}
+
+// NewServerWithLimiter is a version of NewServerWithInterceptors that uses limiter to limit
+// concurrent requests, so it can be shared or changed while the server is running. It does not
+// set MaxConcurrentStreams, since the limit can change. Interceptors run in this order: the
+// limiter, unaryInterceptor (use ChainUnary to pass several), then interceptors added to options
+// with grpc.ChainUnaryInterceptor or grpc.ChainStreamInterceptor. See NewServer's documentation
+// for the remaining details.
+func NewServerWithLimiter(
+	limiter concurrentlimit.Limiter, unaryInterceptor grpc.UnaryServerInterceptor,
+	options ...grpc.ServerOption,
+) *grpc.Server {
+	return NewServerWithBypass(limiter, nil, unaryInterceptor, options...)
+}
+
+// NewServerWithBypass is a version of NewServerWithLimiter that does not limit requests for which
+// bypass returns true, such as health checks. unaryInterceptor is still called for them. If bypass
+// is nil, all requests are limited.
+func NewServerWithBypass(
+	limiter concurrentlimit.Limiter, bypass BypassFunc, unaryInterceptor grpc.UnaryServerInterceptor,
+	options ...grpc.ServerOption,
+) *grpc.Server {
+	limitedUnaryInterceptorChain := UnaryInterceptor(limiter, unaryInterceptor)
+	limitedStreamInterceptor := StreamInterceptor(limiter, nil)
+	if bypass != nil {
+		limitedUnaryInterceptorChain = BypassUnary(bypass, UnaryInterceptor(limiter, nil), unaryInterceptor)
+		limitedStreamInterceptor = BypassStream(bypass, limitedStreamInterceptor, nil)
+	}
+
+	// the default keepalive parameters are first so options can replace them (e.g. MaxConnectionAge)
+	options = append([]grpc.ServerOption{grpc.KeepaliveParams(defaultKeepaliveParams())}, options...)
 	options = append(options, grpc.UnaryInterceptor(limitedUnaryInterceptorChain))
-	options = append(options, grpc.KeepaliveParams(keepalive.ServerParameters{
+	options = append(options, grpc.StreamInterceptor(limitedStreamInterceptor))
+	return grpc.NewServer(options...)
+}
+
+func defaultKeepaliveParams() keepalive.ServerParameters {
+	return keepalive.ServerParameters{
 		MaxConnectionIdle: idleConnectionTimeout,
 		Time:              keepaliveTimeout,
-	}))
-	server := grpc.NewServer(options...)
+	}
+}
 
-	return server, nil
+// MaxConnectionAge returns a grpc.ServerOption for NewServer that closes connections after they
+// have been open for age, plus or minus 10%. This encourages clients to reconnect, which
+// rebalances them across servers, and keeps a few long-lived connections from using connection
+// slots forever. Running requests have grace to complete before the connection is closed. It
+// keeps NewServer's other keepalive parameters.
+func MaxConnectionAge(age time.Duration, grace time.Duration) grpc.ServerOption {
+	params := defaultKeepaliveParams()
+	params.MaxConnectionAge = age
+	params.MaxConnectionAgeGrace = grace
+	return grpc.KeepaliveParams(params)
 }
 
 // Serve listens on addr but only accepts a maximum of connectionLimit conenctions at one
@@ -77,24 +163,279 @@ func Serve(server *grpc.Server, addr string, connectionLimit int) error {
 		return fmt.Errorf("NewServer: connectionLimit=%d must be >= 0", connectionLimit)
 	}
 
-	listener, err := concurrentlimit.Listen("tcp", addr, connectionLimit)
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	return server.Serve(listener)
+	return ServeListener(server, listener, connectionLimit)
+}
+
+// ServeListener is a version of Serve that accepts connections from listener, such as an
+// in-memory listener in tests (e.g. google.golang.org/grpc/test/bufconn).
+func ServeListener(server *grpc.Server, listener net.Listener, connectionLimit int) error {
+	if connectionLimit <= 0 {
+		return fmt.Errorf("ServeListener: connectionLimit=%d must be > 0", connectionLimit)
+	}
+	return server.Serve(netutil.LimitListener(listener, connectionLimit))
+}
+
+// GracefulStop stops server from accepting new connections and requests, and waits for running
+// requests to complete. If ctx is done first, it stops the server immediately, cancelling the
+// remaining requests.
+func GracefulStop(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+		<-stopped
+	}
 }
 
 // UnaryInterceptor returns a grpc.UnaryServerInterceptor that uses limiter to limit the
 // concurrent requests. It will return codes.ResourceExhausted if the limiter rejects an operation.
 // If next is not nil, it will be called to chain the request handlers. If it is nil, this will
-// invoke the operation directly.
+// invoke the operation directly. Each request is one operation until the handler returns, unless
+// the handler calls concurrentlimit.Detach with the request's context.
 func UnaryInterceptor(limiter concurrentlimit.Limiter, next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return AuditUnaryInterceptor(nil, limiter, nil, next)
+}
+
+// AuditUnaryInterceptor is a version of UnaryInterceptor that records its admission decisions in
+// audit, with the full method name as the route, and the key returned by keyFunc, such as
+// MetadataKey. keyFunc may be nil to not record keys. If audit is nil, it is equivalent to
+// UnaryInterceptor.
+func AuditUnaryInterceptor(
+	audit *concurrentlimit.AuditLog, limiter concurrentlimit.Limiter, keyFunc func(context.Context) string,
+	next grpc.UnaryServerInterceptor,
+) grpc.UnaryServerInterceptor {
 	return func(
 		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
 	) (interface{}, error) {
 		end, err := limiter.Start()
+		if audit != nil {
+			recordDecision(audit, limiter, ctx, info.FullMethod, keyFunc, err)
+		}
+		if err == concurrentlimit.ErrLimited {
+			return nil, rejectionError(concurrentlimit.ShedCapacity, err, limiter)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ctx, release := concurrentlimit.WithOperation(ctx, end)
+		defer release()
+
+		if next != nil {
+			return next(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor returns a grpc.StreamServerInterceptor that uses limiter to limit the
+// concurrent streams. Each stream is one operation until the handler returns. It will return
+// codes.ResourceExhausted if the limiter rejects an operation. If next is not nil, it will be
+// called to chain the stream handlers. If it is nil, this will invoke the handler directly.
+func StreamInterceptor(limiter concurrentlimit.Limiter, next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return AuditStreamInterceptor(nil, limiter, nil, next)
+}
+
+// AuditStreamInterceptor is the grpc.StreamServerInterceptor version of AuditUnaryInterceptor.
+func AuditStreamInterceptor(
+	audit *concurrentlimit.AuditLog, limiter concurrentlimit.Limiter, keyFunc func(context.Context) string,
+	next grpc.StreamServerInterceptor,
+) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		end, err := limiter.Start()
+		if audit != nil {
+			recordDecision(audit, limiter, stream.Context(), info.FullMethod, keyFunc, err)
+		}
+		if err == concurrentlimit.ErrLimited {
+			return rejectionError(concurrentlimit.ShedCapacity, err, limiter)
+		}
+		if err != nil {
+			return err
+		}
+		defer end()
+
+		if next != nil {
+			return next(srv, stream, info, handler)
+		}
+		return handler(srv, stream)
+	}
+}
+
+// recordDecision records the admission decision for a request in audit.
+func recordDecision(
+	audit *concurrentlimit.AuditLog, limiter concurrentlimit.Limiter, ctx context.Context, fullMethod string,
+	keyFunc func(context.Context) string, err error,
+) {
+	key := ""
+	if keyFunc != nil {
+		key = keyFunc(ctx)
+	}
+	audit.RecordContext(ctx, limiter, fullMethod, key, err)
+}
+
+// KeyedUnaryInterceptor returns a grpc.UnaryServerInterceptor that uses limiter to limit the
+// concurrent requests for each key returned by keyFunc. It will return codes.ResourceExhausted if
+// the limiter rejects an operation. If next is not nil, it will be called to chain the request
+// handlers.
+func KeyedUnaryInterceptor(
+	limiter *concurrentlimit.KeyedLimiter, keyFunc func(context.Context) string,
+	next grpc.UnaryServerInterceptor,
+) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		end, err := limiter.StartContext(ctx, keyFunc(ctx))
+		if err == concurrentlimit.ErrLimited {
+			return nil, rejectionError(concurrentlimit.ShedClient, err, nil)
+		}
+		if err != nil {
+			return nil, status.FromContextError(err).Err()
+		}
+		defer end()
+
+		if next != nil {
+			return next(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// KeyedStreamInterceptor returns a grpc.StreamServerInterceptor that uses limiter to limit the
+// concurrent streams for each key returned by keyFunc from the stream's context. It will return
+// codes.ResourceExhausted if the limiter rejects an operation. If next is not nil, it will be
+// called to chain the stream handlers.
+func KeyedStreamInterceptor(
+	limiter *concurrentlimit.KeyedLimiter, keyFunc func(context.Context) string,
+	next grpc.StreamServerInterceptor,
+) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		end, err := limiter.StartContext(stream.Context(), keyFunc(stream.Context()))
+		if err == concurrentlimit.ErrLimited {
+			return rejectionError(concurrentlimit.ShedClient, err, nil)
+		}
+		if err != nil {
+			return status.FromContextError(err).Err()
+		}
+		defer end()
+
+		if next != nil {
+			return next(srv, stream, info, handler)
+		}
+		return handler(srv, stream)
+	}
+}
+
+// MetadataKey returns a key function for KeyedUnaryInterceptor that uses the first value of the
+// request metadata name, such as an API key. See concurrentlimit.HeaderKey. Requests without the
+// metadata return the empty string, so they share a single key.
+func MetadataKey(name string) func(context.Context) string {
+	name = strings.ToLower(name)
+	return func(ctx context.Context) string {
+		values := metadata.ValueFromIncomingContext(ctx, name)
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+}
+
+// LoadTrailerKey is the trailer metadata key where LoadReportingUnaryInterceptor reports the
+// server's utilization, which the grpclimit/leastloaded balancer uses to choose servers.
+const LoadTrailerKey = "x-concurrentlimit-utilization"
+
+// LoadReportingUnaryInterceptor returns a grpc.UnaryServerInterceptor that reports the utilization
+// of limiter in the LoadTrailerKey trailer of each response: its running operations divided by its
+// limit, from 0 to 1. Pass it as the interceptor of NewServerWithLimiter, so it includes the
+// request being reported. It reads the utilization with concurrentlimit.ApproxReporter if limiter
+// implements it, so it does not contend with starting requests. It does not report anything if
+// limiter implements neither it nor concurrentlimit.StatsReporter, or is not limited. If next is
+// not nil, it will be called to chain the request handlers.
+func LoadReportingUnaryInterceptor(
+	limiter concurrentlimit.Limiter, next grpc.UnaryServerInterceptor,
+) grpc.UnaryServerInterceptor {
+	reporter, _ := limiter.(concurrentlimit.StatsReporter)
+	approx, _ := limiter.(concurrentlimit.ApproxReporter)
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		current, limit := 0, 0
+		if approx != nil {
+			// read on every request, so avoid contending with the limiter's mutex
+			current, limit = approx.CurrentApprox()
+		} else if reporter != nil {
+			stats := reporter.Stats()
+			current, limit = stats.Current, stats.Limit
+		}
+		if limit > 0 {
+			utilization := float64(current) / float64(limit)
+			// ignore the error: it only fails if the response was already sent
+			_ = grpc.SetTrailer(ctx, metadata.Pairs(LoadTrailerKey, strconv.FormatFloat(utilization, 'g', 3, 64)))
+		}
+
+		if next != nil {
+			return next(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// ClientCertKey returns the identity of the verified TLS client certificate for the request in
+// ctx, for use with KeyedUnaryInterceptor. See concurrentlimit.CertificateIdentity. Requests
+// without a verified client certificate return the empty string, so they share a single key.
+func ClientCertKey(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return ""
+	}
+	return concurrentlimit.CertificateIdentity(chains[0][0])
+}
+
+// WeightedUnaryInterceptor returns a grpc.UnaryServerInterceptor that starts an operation on
+// limiter with the cost declared in each request's metadata, as described by policy. It will
+// return codes.InvalidArgument if the declared cost is invalid, and codes.ResourceExhausted if the
+// limiter rejects an operation. If next is not nil, it will be called to chain the request
+// handlers.
+func WeightedUnaryInterceptor(
+	limiter *concurrentlimit.WeightedLimiter, policy concurrentlimit.CostPolicy,
+	next grpc.UnaryServerInterceptor,
+) grpc.UnaryServerInterceptor {
+	key := strings.ToLower(policy.HeaderName())
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		value := ""
+		if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 {
+			value = values[0]
+		}
+		cost, err := policy.Cost(value)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		end, err := limiter.StartN(cost)
 		if err == concurrentlimit.ErrLimited {
-			return nil, status.Error(rateLimitStatus, err.Error())
+			return nil, rejectionError(concurrentlimit.ShedCapacity, err, limiter)
 		}
 		if err != nil {
 			return nil, err
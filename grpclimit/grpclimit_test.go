@@ -1,18 +1,29 @@
 package grpclimit
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
 	"net"
-	"strconv"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/evanj/concurrentlimit"
 	"github.com/evanj/concurrentlimit/sleepymemory"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 type blockSleeper struct {
@@ -31,27 +42,16 @@ func (b *blockSleeper) Sleep(
 func TestGRPC(t *testing.T) {
 	const permitted = 3
 
-	// pick a random port that should be avaliable
-	listener, err := net.Listen("tcp", "localhost:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	port := listener.Addr().(*net.TCPAddr).Port
-	err = listener.Close()
+	// serve an in-memory listener, so clients cannot race with the server listening on a port
+	listener := bufconn.Listen(64 * 1024)
+	grpcServer, err := NewServer("bufconn", permitted)
 	if err != nil {
 		t.Fatal(err)
 	}
-	grpcAddr := "localhost:" + strconv.Itoa(port)
-
-	// start the server
-	grpcServer, err := NewServer(grpcAddr, permitted)
-	if err != nil {
-		panic(err)
-	}
 	handler := &blockSleeper{unblock: make(chan struct{})}
 	sleepymemory.RegisterSleeperServer(grpcServer, handler)
 	go func() {
-		err = Serve(grpcServer, grpcAddr, permitted*2)
+		err := ServeListener(grpcServer, listener, permitted*2)
 		if err != nil {
 			t.Error(err)
 		}
@@ -63,17 +63,15 @@ func TestGRPC(t *testing.T) {
 	for i := 0; i < permitted+1; i++ {
 		go func() {
 			// need separate clients per goroutine otherwise the client back pressure prevents rejection
-			// Sleep for at least 2 seconds due to gRPC's default connection backoff:
-			// https://github.com/grpc/grpc/blob/master/doc/connection-backoff.md
-			dialCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-			conn, err := grpc.DialContext(dialCtx, grpcAddr,
-				grpc.WithTransportCredentials(insecure.NewCredentials()),
-				grpc.WithBlock())
-			cancel()
+			conn, err := grpc.Dial("bufconn",
+				grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+					return listener.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(insecure.NewCredentials()))
 			if err != nil {
-				log.Println("Dial:", err)
-				close(responses)
 				t.Error(err)
+				responses <- codes.Unknown
+				return
 			}
 			defer conn.Close()
 			client := sleepymemory.NewSleeperClient(conn)
@@ -104,3 +102,663 @@ func TestGRPC(t *testing.T) {
 		t.Error("unexpected OK and rate limited response counts:", okCount, rateLimitedCount)
 	}
 }
+
+func TestKeyedUnaryInterceptor(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+	tlsCtx := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}},
+	})
+	if key := ClientCertKey(tlsCtx); key != "client" {
+		t.Fatal("expected the certificate common name:", key)
+	}
+	if key := ClientCertKey(context.Background()); key != "" {
+		t.Fatal("expected the empty key without a peer:", key)
+	}
+
+	interceptor := KeyedUnaryInterceptor(concurrentlimit.NewKeyed(1), ClientCertKey, nil)
+	info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+	// the handler makes a nested request with the same key, which must be rejected
+	var nestedErr error
+	_, err := interceptor(tlsCtx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, nestedErr = interceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+
+		// a different key is permitted
+		return interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Code(nestedErr) != codes.ResourceExhausted {
+		t.Error("expected ResourceExhausted:", nestedErr)
+	}
+
+	keyFunc := MetadataKey("X-API-Key")
+	if key := keyFunc(context.Background()); key != "" {
+		t.Error("expected the empty key without metadata:", key)
+	}
+	mdCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "tenant"))
+	if key := keyFunc(mdCtx); key != "tenant" {
+		t.Error("expected the metadata value:", key)
+	}
+}
+
+func TestWeightedUnaryInterceptor(t *testing.T) {
+	limiter := concurrentlimit.NewWeighted(2)
+	interceptor := WeightedUnaryInterceptor(limiter, concurrentlimit.CostPolicy{}, nil)
+	info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	withCost := func(cost string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-cost", cost))
+	}
+
+	_, err := interceptor(withCost("x"), nil, info, handler)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Error("expected InvalidArgument:", err)
+	}
+	_, err = interceptor(withCost("3"), nil, info, handler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected ResourceExhausted:", err)
+	}
+	_, err = interceptor(withCost("2"), nil, info, handler)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = interceptor(context.Background(), nil, info, handler)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditUnaryInterceptor(t *testing.T) {
+	audit := concurrentlimit.NewAuditLog(10, 1)
+	limiter := concurrentlimit.New(1)
+	interceptor := AuditUnaryInterceptor(audit, limiter, MetadataKey("x-api-key"), nil)
+	info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "tenant"))
+
+	// the handler sends a nested request while the first is running, which must be rejected
+	_, err := interceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return interceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected ResourceExhausted:", err)
+	}
+
+	records := audit.Records(time.Time{}, time.Time{})
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records: %#v", records)
+	}
+	for i, admitted := range []bool{true, false} {
+		record := records[i]
+		if record.Admitted != admitted || record.Route != "/test/Method" || record.Key != "tenant" ||
+			record.Current != 1 || record.Limit != 1 {
+			t.Errorf("records[%d]=%#v", i, record)
+		}
+	}
+}
+
+func TestRequestIDUnaryInterceptor(t *testing.T) {
+	audit := concurrentlimit.NewAuditLog(10, 1)
+	limiter := concurrentlimit.New(1)
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+	interceptor := RequestIDUnaryInterceptor(AuditUnaryInterceptor(audit, limiter, nil, nil))
+	info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "client-id"))
+
+	_, err = interceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	if status.Code(err) != codes.ResourceExhausted || !strings.Contains(err.Error(), "request_id=client-id") {
+		t.Error("expected ResourceExhausted with the request ID:", err)
+	}
+	records := audit.Records(time.Time{}, time.Time{})
+	if len(records) != 1 || records[0].RequestID != "client-id" {
+		t.Errorf("unexpected records: %#v", records)
+	}
+
+	// requests without an ID get one, and other errors are not changed
+	interceptor = RequestIDUnaryInterceptor(nil)
+	handlerErr := status.Error(codes.NotFound, "not found")
+	_, err = interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if id := concurrentlimit.RequestIDFromContext(ctx); len(id) != 32 {
+			t.Errorf("expected a generated request ID: %#v", id)
+		}
+		return nil, handlerErr
+	})
+	if err != handlerErr {
+		t.Errorf("err=%v; expected %v", err, handlerErr)
+	}
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	interceptor := StreamInterceptor(concurrentlimit.New(1), nil)
+	info := &grpc.StreamServerInfo{FullMethod: "/test/Stream", IsServerStream: true}
+	// the handler opens a nested stream while the first is open, which must be rejected
+	var nestedErr error
+	err := interceptor(nil, nil, info, func(srv interface{}, stream grpc.ServerStream) error {
+		nestedErr = interceptor(nil, nil, info, func(srv interface{}, stream grpc.ServerStream) error {
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Code(nestedErr) != codes.ResourceExhausted {
+		t.Error("expected ResourceExhausted:", nestedErr)
+	}
+
+	// the stream ended, so the slot is available
+	err = interceptor(nil, nil, info, func(srv interface{}, stream grpc.ServerStream) error {
+		return nil
+	})
+	if err != nil {
+		t.Error("expected the stream to be permitted after the first ended:", err)
+	}
+}
+
+func TestMethodLimiter(t *testing.T) {
+	server := grpc.NewServer()
+	sleepymemory.RegisterSleeperServer(server, &blockSleeper{})
+	configs := MethodConfigs(server)
+	expected := []MethodConfig{
+		{Method: "/sleepymemory.Sleeper/Sleep"},
+		{Method: "/sleepymemory.Sleeper/SleepStream", ServerStreaming: true},
+	}
+	if fmt.Sprint(configs) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected configs: %#v", configs)
+	}
+
+	// operators fill in the skeleton
+	buf := &bytes.Buffer{}
+	err := WriteMethodConfigs(buf, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Replace(buf.String(), `"limit": 0`, `"limit": 1`, 1)
+	configs, err = ReadMethodConfigs(strings.NewReader(edited))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMethodConfigs(strings.NewReader(`[{"method": "/x/Y", "limits": 1}]`)); err == nil {
+		t.Error("expected unknown fields to be an error")
+	}
+	if _, err := NewMethodLimiter(append(configs, configs[0]), nil); err == nil {
+		t.Error("expected duplicate methods to be an error")
+	}
+
+	weighted := concurrentlimit.NewWeighted(2)
+	configs[1].Cost = 2
+	limiter, err := NewMethodLimiter(configs, weighted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interceptor := limiter.UnaryInterceptor(nil)
+	sleep := &grpc.UnaryServerInfo{FullMethod: "/sleepymemory.Sleeper/Sleep"}
+	var nestedErr error
+	_, err = interceptor(context.Background(), nil, sleep, func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, nestedErr = interceptor(ctx, nil, sleep, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Code(nestedErr) != codes.ResourceExhausted {
+		t.Error("expected the method limit to reject:", nestedErr)
+	}
+
+	// the stream uses the whole weighted capacity
+	stream := &grpc.StreamServerInfo{FullMethod: "/sleepymemory.Sleeper/SleepStream", IsServerStream: true}
+	err = limiter.StreamInterceptor(nil)(nil, nil, stream, func(srv interface{}, ss grpc.ServerStream) error {
+		_, nestedErr = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/other/Method"},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Code(nestedErr) != codes.ResourceExhausted {
+		t.Error("expected the weighted limit to reject:", nestedErr)
+	}
+}
+
+func TestServiceLimiter(t *testing.T) {
+	server := grpc.NewServer()
+	sleepymemory.RegisterSleeperServer(server, &blockSleeper{})
+	configs := ServiceConfigs(server)
+	if fmt.Sprint(configs) != fmt.Sprint([]MethodConfig{{Method: "/sleepymemory.Sleeper/"}}) {
+		t.Fatalf("unexpected configs: %#v", configs)
+	}
+
+	// the service limit is shared by its methods; SleepStream overrides the service's cost
+	configs[0].Limit = 2
+	configs[0].Cost = 2
+	configs = append(configs, MethodConfig{Method: "/sleepymemory.Sleeper/SleepStream", Cost: 1})
+	if _, err := NewMethodLimiter(append(configs, configs[0]), nil); err == nil {
+		t.Error("expected duplicate services to be an error")
+	}
+	weighted := concurrentlimit.NewWeighted(3)
+	limiter, err := NewMethodLimiter(configs, weighted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endSleep, err := limiter.start("/sleepymemory.Sleeper/Sleep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endStream, err := limiter.start("/sleepymemory.Sleeper/SleepStream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weighted.Stats().Current != 3 {
+		t.Errorf("expected costs 2 and 1: current=%d", weighted.Stats().Current)
+	}
+	// the weighted limit is full; after it has room, the service limit rejects
+	endStream()
+	_, err = limiter.start("/other.Service/Method")
+	if err != nil {
+		t.Fatal("other services use the default cost:", err)
+	}
+	_, err = limiter.start("/sleepymemory.Sleeper/SleepStream")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected the weighted limit to reject:", err)
+	}
+	endSleep()
+	if weighted.Stats().Current != 1 {
+		t.Errorf("rejected requests must not use capacity: current=%d", weighted.Stats().Current)
+	}
+
+	// without a weighted limit, the service limit rejects the third request to any of its methods
+	limiter, err = NewMethodLimiter(configs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"/sleepymemory.Sleeper/Sleep", "/sleepymemory.Sleeper/SleepStream"} {
+		_, err = limiter.start(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = limiter.start("/sleepymemory.Sleeper/Sleep")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected the service limit to reject:", err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	calls := []string{}
+	unary := func(name string) grpc.UnaryServerInterceptor {
+		return func(
+			ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+		) (interface{}, error) {
+			calls = append(calls, name)
+			resp, err := handler(ctx, req)
+			calls = append(calls, name+" done")
+			return resp, err
+		}
+	}
+	chain := ChainUnary(unary("recovery"), nil, UnaryInterceptor(concurrentlimit.New(1), nil), unary("auth"))
+	resp, err := chain(context.Background(), "req", &grpc.UnaryServerInfo{},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			calls = append(calls, "handler")
+			return req, nil
+		})
+	if err != nil || resp != "req" {
+		t.Fatal(resp, err)
+	}
+	expected := "[recovery auth handler auth done recovery done]"
+	if fmt.Sprint(calls) != expected {
+		t.Errorf("unexpected order: %v", calls)
+	}
+
+	stream := func(name string) grpc.StreamServerInterceptor {
+		return func(
+			srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+		) error {
+			calls = append(calls, name)
+			return handler(srv, ss)
+		}
+	}
+	calls = nil
+	// the limiter rejects the stream, so later interceptors are not called
+	limiter := concurrentlimit.New(1)
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+	err = ChainStream(stream("telemetry"), StreamInterceptor(limiter, nil), stream("auth"))(
+		nil, nil, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+			calls = append(calls, "handler")
+			return nil
+		})
+	if status.Code(err) != codes.ResourceExhausted || fmt.Sprint(calls) != "[telemetry]" {
+		t.Errorf("expected only telemetry before the rejection: %v %v", err, calls)
+	}
+}
+
+func TestBypass(t *testing.T) {
+	limiter := concurrentlimit.New(1)
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+
+	bypass := BypassMethods("/grpc.health.v1.Health/", "/test/Admin")
+	nextCalls := 0
+	next := func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		nextCalls++
+		return handler(ctx, req)
+	}
+	interceptor := BypassUnary(bypass, UnaryInterceptor(limiter, nil), next)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	for _, method := range []string{"/grpc.health.v1.Health/Check", "/test/Admin"} {
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		if err != nil {
+			t.Errorf("%s: expected the request to bypass the limit: %s", method, err)
+		}
+	}
+	_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test/AdminOther"}, handler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected ResourceExhausted:", err)
+	}
+	if nextCalls != 2 {
+		t.Errorf("expected next to be called for the bypassed requests: %d", nextCalls)
+	}
+
+	stream := BypassStream(bypass, StreamInterceptor(limiter, nil), nil)
+	streamHandler := func(srv interface{}, ss grpc.ServerStream) error {
+		return nil
+	}
+	ss := &contextStream{ctx: context.Background()}
+	err = stream(nil, ss, &grpc.StreamServerInfo{FullMethod: "/grpc.health.v1.Health/Watch"}, streamHandler)
+	if err != nil {
+		t.Error("expected the stream to bypass the limit:", err)
+	}
+	err = stream(nil, ss, &grpc.StreamServerInfo{FullMethod: "/test/Stream"}, streamHandler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected ResourceExhausted:", err)
+	}
+}
+
+// contextStream is a grpc.ServerStream that only implements Context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (c *contextStream) Context() context.Context {
+	return c.ctx
+}
+
+// startedSleeper signals started when Sleep is called, then waits for unblock.
+type startedSleeper struct {
+	sleepymemory.UnimplementedSleeperServer
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (s *startedSleeper) Sleep(
+	ctx context.Context, request *sleepymemory.SleepRequest,
+) (*sleepymemory.SleepResponse, error) {
+	s.started <- struct{}{}
+	<-s.unblock
+	return &sleepymemory.SleepResponse{}, nil
+}
+
+func TestSlowStart(t *testing.T) {
+	slowStart := NewSlowStart(1, 2)
+	listener := bufconn.Listen(64 * 1024)
+	grpcServer := grpc.NewServer(slowStart.ServerOptions()...)
+	handler := &startedSleeper{started: make(chan struct{}), unblock: make(chan struct{})}
+	sleepymemory.RegisterSleeperServer(grpcServer, handler)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := sleepymemory.NewSleeperClient(conn)
+
+	responses := make(chan error)
+	sleep := func() {
+		_, err := client.Sleep(context.Background(), &sleepymemory.SleepRequest{})
+		responses <- err
+	}
+
+	// the new connection is permitted one stream
+	go sleep()
+	<-handler.started
+	_, err = client.Sleep(context.Background(), &sleepymemory.SleepRequest{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected the second stream to be rejected:", err)
+	}
+	handler.unblock <- struct{}{}
+	if err := <-responses; err != nil {
+		t.Fatal(err)
+	}
+
+	// the completed stream raised the limit to the maximum of 2
+	go sleep()
+	go sleep()
+	<-handler.started
+	<-handler.started
+	_, err = client.Sleep(context.Background(), &sleepymemory.SleepRequest{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected the third stream to be rejected:", err)
+	}
+	for i := 0; i < 2; i++ {
+		handler.unblock <- struct{}{}
+		if err := <-responses; err != nil {
+			t.Error(err)
+		}
+	}
+	if slowStart.Rejected() != 2 {
+		t.Errorf("expected 2 rejected streams: %d", slowStart.Rejected())
+	}
+}
+
+func TestChainChecked(t *testing.T) {
+	auth := concurrentlimit.Layer{Name: "auth", Kind: concurrentlimit.LayerExpensive}
+	limit := concurrentlimit.Layer{Name: "limit", Kind: concurrentlimit.LayerLimit}
+	limiter := concurrentlimit.New(1)
+
+	_, err := ChainUnaryChecked(UnaryLayer{auth, nil}, UnaryLayer{limit, UnaryInterceptor(limiter, nil)})
+	if err == nil {
+		t.Error("expected an error for auth before the limit")
+	}
+	interceptor, err := ChainUnaryChecked(UnaryLayer{limit, UnaryInterceptor(limiter, nil)}, UnaryLayer{auth, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ChainStreamChecked(StreamLayer{auth, nil})
+	if err == nil {
+		t.Error("expected an error without a limit")
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		close(started)
+		return handler(ctx, req)
+	}))
+	handler := &blockSleeper{unblock: make(chan struct{})}
+	sleepymemory.RegisterSleeperServer(grpcServer, handler)
+	go grpcServer.Serve(listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := sleepymemory.NewSleeperClient(conn)
+	requestErr := make(chan error)
+	go func() {
+		_, err := client.Sleep(context.Background(), &sleepymemory.SleepRequest{})
+		requestErr <- err
+	}()
+	<-started
+
+	// the request blocks forever: GracefulStop must stop the server when the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	GracefulStop(ctx, grpcServer)
+	err = <-requestErr
+	if status.Code(err) != codes.Unavailable {
+		t.Error("expected the running request to fail with Unavailable:", err)
+	}
+}
+
+// BenchmarkUnaryInterceptor measures the overhead of UnaryInterceptor, compared to calling the
+// handler directly.
+func BenchmarkUnaryInterceptor(b *testing.B) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	unlimited := func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		return handler(ctx, req)
+	}
+	interceptors := []struct {
+		name        string
+		interceptor grpc.UnaryServerInterceptor
+	}{
+		{"unlimited", unlimited},
+		{"UnaryInterceptor", UnaryInterceptor(concurrentlimit.New(1024), nil)},
+	}
+	for _, i := range interceptors {
+		for _, goroutines := range []int{1, 8, 64, 512} {
+			b.Run(fmt.Sprintf("%s/goroutines=%d", i.name, goroutines), func(b *testing.B) {
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for g := 0; g < goroutines; g++ {
+					n := b.N / goroutines
+					if g < b.N%goroutines {
+						n++
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for j := 0; j < n; j++ {
+							_, err := i.interceptor(context.Background(), nil, info, handler)
+							if err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+func TestProfileInterceptor(t *testing.T) {
+	profiler := concurrentlimit.NewProfiler(concurrentlimit.ProfileOptions{Warmup: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+	unary := ProfileUnaryInterceptor(profiler, nil)
+	stream := ProfileStreamInterceptor(profiler, nil)
+	_, err := unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test.Service/Unary"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream(nil, nil, &grpc.StreamServerInfo{FullMethod: "/test.Service/Stream"},
+		func(srv interface{}, stream grpc.ServerStream) error {
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// labels that are not methods, such as HTTP paths, are skipped
+	profiler.Start("/")()
+
+	configs := SuggestedMethodConfigs(profiler.Report())
+	expected := []MethodConfig{
+		{Method: "/test.Service/Stream", Limit: 2},
+		{Method: "/test.Service/Unary", Limit: 2},
+	}
+	if !reflect.DeepEqual(configs, expected) {
+		t.Errorf("SuggestedMethodConfigs=%#v; expected %#v", configs, expected)
+	}
+}
+
+func TestTrustedUnaryInterceptor(t *testing.T) {
+	key := []byte("secret")
+	trusted := concurrentlimit.NewTrustedCallers([]string{"control-plane"}, 0)
+	interceptor := TrustedUnaryInterceptor(trusted, SignedMetadataIdentity("X-Trusted-Identity", key),
+		concurrentlimit.New(1), nil)
+	info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+	contextFor := func(value string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-trusted-identity", value))
+	}
+
+	// nested requests while the first is running are over the limit: only the trusted one runs
+	for _, test := range []struct {
+		value    string
+		expected codes.Code
+	}{
+		{concurrentlimit.SignIdentity(key, "control-plane"), codes.OK},
+		{concurrentlimit.SignIdentity(key, "other"), codes.ResourceExhausted},
+		{"control-plane", codes.ResourceExhausted},
+	} {
+		_, err := interceptor(contextFor(""), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(contextFor(test.value), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			})
+		})
+		if status.Code(err) != test.expected {
+			t.Errorf("value=%#v: err=%v; expected %s", test.value, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Package leastloaded implements a gRPC client load balancing policy that prefers the servers
+// reporting the lowest utilization with grpclimit.LoadReportingUnaryInterceptor. This completes
+// the loop where overloaded servers tell clients to send their requests elsewhere, instead of
+// only rejecting them. Importing this package registers the policy, which clients select with a
+// service config:
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"concurrentlimit_least_loaded": {}}]}`)
+//
+// Each request picks two random ready servers and uses the one that reported the lower
+// utilization in its last response ("the power of two choices"), which avoids sending every
+// request to the single least loaded server between reports. Servers that have not reported are
+// treated as idle.
+//
+// The config can also limit the concurrent requests to each server, rather than to the service as
+// a whole:
+//
+//	{"loadBalancingConfig": [{"concurrentlimit_least_loaded": {"maxRequestsPerServer": 10}}]}
+//
+// Each address returned by the resolver, such as each IP address of a DNS name, is a separate
+// server. A degraded server responds slowly, so its requests reach the limit, and new requests go
+// to the other servers, instead of waiting behind it. If every server is at the limit, requests
+// fail immediately with codes.ResourceExhausted, so the client does not add to the overload.
+package leastloaded
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	"github.com/evanj/concurrentlimit/grpclimit"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+// Name is the name of the load balancing policy, for use in service configs.
+const Name = "concurrentlimit_least_loaded"
+
+func init() {
+	balancer.Register(builder{})
+}
+
+// builder creates a balancer with separate utilization reports for each ClientConn.
+type builder struct{}
+
+func (builder) Name() string {
+	return Name
+}
+
+func (builder) Build(cc balancer.ClientConn, options balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{utilization: map[balancer.SubConn]float64{}, outstanding: map[balancer.SubConn]int{}}
+	return &configBalancer{Balancer: base.NewBalancerBuilder(Name, pb, base.Config{}).Build(cc, options), pb: pb}
+}
+
+// Config is the load balancing config of the policy.
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// MaxRequestsPerServer is the maximum number of concurrent requests to each server, or 0 for
+	// no limit.
+	MaxRequestsPerServer int `json:"maxRequestsPerServer"`
+}
+
+func (builder) ParseConfig(configJSON json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := &Config{}
+	err := json.Unmarshal(configJSON, config)
+	if err != nil {
+		return nil, fmt.Errorf("leastloaded: invalid config: %w", err)
+	}
+	if config.MaxRequestsPerServer < 0 {
+		return nil, fmt.Errorf("leastloaded: maxRequestsPerServer=%d must be >= 0", config.MaxRequestsPerServer)
+	}
+	return config, nil
+}
+
+// configBalancer is the base balancer, which ignores the config, with the config applied to pb.
+type configBalancer struct {
+	balancer.Balancer
+	pb *pickerBuilder
+}
+
+func (c *configBalancer) UpdateClientConnState(state balancer.ClientConnState) error {
+	if config, ok := state.BalancerConfig.(*Config); ok {
+		c.pb.mu.Lock()
+		c.pb.maxRequests = config.MaxRequestsPerServer
+		c.pb.mu.Unlock()
+	}
+	return c.Balancer.UpdateClientConnState(state)
+}
+
+// pickerBuilder records the utilization reported by each server and its running requests, which
+// are shared by the pickers it builds as servers become ready or fail.
+type pickerBuilder struct {
+	mu          sync.Mutex
+	utilization map[balancer.SubConn]float64
+	// outstanding only contains servers with running requests, which may no longer be ready
+	outstanding map[balancer.SubConn]int
+	// maxRequests is 0 if the requests to each server are not limited
+	maxRequests int
+}
+
+func (p *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	subConns := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	for subConn := range info.ReadySCs {
+		subConns = append(subConns, subConn)
+	}
+	// forget servers that are no longer ready: they report again when they reconnect
+	p.mu.Lock()
+	for subConn := range p.utilization {
+		if _, ok := info.ReadySCs[subConn]; !ok {
+			delete(p.utilization, subConn)
+		}
+	}
+	p.mu.Unlock()
+	return &picker{builder: p, subConns: subConns}
+}
+
+// fullLocked returns true if subConn is running the maximum requests. p.mu must be held.
+func (p *pickerBuilder) fullLocked(subConn balancer.SubConn) bool {
+	return p.maxRequests > 0 && p.outstanding[subConn] >= p.maxRequests
+}
+
+// start picks the less loaded of chosen and other that is not full, or any server in subConns
+// that is not full, and counts a request to it. It returns false if all servers are full.
+func (p *pickerBuilder) start(
+	chosen balancer.SubConn, other balancer.SubConn, subConns []balancer.SubConn,
+) (balancer.SubConn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fullLocked(chosen) || (!p.fullLocked(other) && p.utilization[other] < p.utilization[chosen]) {
+		chosen = other
+	}
+	if p.fullLocked(chosen) {
+		// both random choices are full: use the first server that is not, from a random offset
+		offset := rand.Intn(len(subConns))
+		found := false
+		for i := range subConns {
+			chosen = subConns[(offset+i)%len(subConns)]
+			if !p.fullLocked(chosen) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	p.outstanding[chosen]++
+	return chosen, true
+}
+
+// end counts the end of a request to subConn, and saves the utilization reported in its response,
+// if there is one.
+func (p *pickerBuilder) end(subConn balancer.SubConn, done balancer.DoneInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outstanding[subConn]--
+	if p.outstanding[subConn] <= 0 {
+		delete(p.outstanding, subConn)
+	}
+
+	values := done.Trailer.Get(grpclimit.LoadTrailerKey)
+	if len(values) == 0 {
+		return
+	}
+	utilization, err := strconv.ParseFloat(values[0], 64)
+	if err != nil {
+		return
+	}
+	p.utilization[subConn] = utilization
+}
+
+type picker struct {
+	builder  *pickerBuilder
+	subConns []balancer.SubConn
+}
+
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	// the global rand functions are safe to use from multiple goroutines
+	chosen, ok := p.builder.start(p.subConns[rand.Intn(len(p.subConns))],
+		p.subConns[rand.Intn(len(p.subConns))], p.subConns)
+	if !ok {
+		return balancer.PickResult{}, status.Error(codes.ResourceExhausted,
+			"leastloaded: every server is running maxRequestsPerServer requests")
+	}
+	return balancer.PickResult{
+		SubConn: chosen,
+		Done: func(done balancer.DoneInfo) {
+			p.builder.end(chosen, done)
+		},
+	}, nil
+}
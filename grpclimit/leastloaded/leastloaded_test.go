@@ -0,0 +1,194 @@
+package leastloaded
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit"
+	"github.com/evanj/concurrentlimit/grpclimit"
+	"github.com/evanj/concurrentlimit/sleepymemory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// countingSleeper counts the requests it serves.
+type countingSleeper struct {
+	sleepymemory.UnimplementedSleeperServer
+	requests atomic.Int64
+}
+
+func (c *countingSleeper) Sleep(
+	ctx context.Context, request *sleepymemory.SleepRequest,
+) (*sleepymemory.SleepResponse, error) {
+	c.requests.Add(1)
+	return &sleepymemory.SleepResponse{}, nil
+}
+
+// startServer serves a limiter with limit 10 and busy running operations on an in-memory listener.
+func startServer(t *testing.T, busy int) (*bufconn.Listener, *countingSleeper) {
+	limiter := concurrentlimit.New(10)
+	for i := 0; i < busy; i++ {
+		// never ended: the server appears busy for the whole test
+		_, err := limiter.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := grpclimit.NewServerWithLimiter(limiter, grpclimit.LoadReportingUnaryInterceptor(limiter, nil))
+	sleeper := &countingSleeper{}
+	sleepymemory.RegisterSleeperServer(server, sleeper)
+	listener := bufconn.Listen(64 * 1024)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener, sleeper
+}
+
+func TestLeastLoaded(t *testing.T) {
+	busyListener, busy := startServer(t, 8)
+	idleListener, idle := startServer(t, 0)
+	listeners := map[string]*bufconn.Listener{"busy": busyListener, "idle": idleListener}
+
+	r := manual.NewBuilderWithScheme("leastloadedtest")
+	r.InitialState(resolver.State{Addresses: []resolver.Address{{Addr: "busy"}, {Addr: "idle"}}})
+	conn, err := grpc.Dial(r.Scheme()+":///test",
+		grpc.WithResolvers(r),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return listeners[addr].DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"`+Name+`": {}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := sleepymemory.NewSleeperClient(conn)
+	const requests = 200
+	for i := 0; i < requests; i++ {
+		_, err := client.Sleep(context.Background(), &sleepymemory.SleepRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the busy server is only picked if it is both random choices: about 1/4 of requests
+	if idle.requests.Load() < requests*6/10 {
+		t.Errorf("expected most requests to use the idle server: idle=%d busy=%d",
+			idle.requests.Load(), busy.requests.Load())
+	}
+}
+
+// blockingSleeper counts the requests it is running. Requests with a sleep duration wait until
+// release is closed, instead of sleeping.
+type blockingSleeper struct {
+	sleepymemory.UnimplementedSleeperServer
+	release chan struct{}
+	running atomic.Int64
+	served  atomic.Int64
+}
+
+func (b *blockingSleeper) Sleep(
+	ctx context.Context, request *sleepymemory.SleepRequest,
+) (*sleepymemory.SleepResponse, error) {
+	b.running.Add(1)
+	defer b.running.Add(-1)
+	b.served.Add(1)
+	if request.SleepDuration != nil {
+		<-b.release
+	}
+	return &sleepymemory.SleepResponse{}, nil
+}
+
+func TestMaxRequestsPerServer(t *testing.T) {
+	release := make(chan struct{})
+	sleepers := map[string]*blockingSleeper{}
+	listeners := map[string]*bufconn.Listener{}
+	addresses := []resolver.Address{}
+	for _, addr := range []string{"a", "b"} {
+		sleepers[addr] = &blockingSleeper{release: release}
+		server := grpc.NewServer()
+		sleepymemory.RegisterSleeperServer(server, sleepers[addr])
+		listeners[addr] = bufconn.Listen(64 * 1024)
+		go server.Serve(listeners[addr])
+		t.Cleanup(server.Stop)
+		addresses = append(addresses, resolver.Address{Addr: addr})
+	}
+
+	r := manual.NewBuilderWithScheme("leastloadedtest")
+	r.InitialState(resolver.State{Addresses: addresses})
+	conn, err := grpc.Dial(r.Scheme()+":///test",
+		grpc.WithResolvers(r),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return listeners[addr].DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"`+Name+`": {"maxRequestsPerServer": 2}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := sleepymemory.NewSleeperClient(conn)
+
+	// wait until both servers are ready, so the picker uses both
+	for i := 0; sleepers["a"].served.Load() == 0 || sleepers["b"].served.Load() == 0; i++ {
+		if i == 1000 {
+			t.Fatal("both servers did not serve requests")
+		}
+		_, err := client.Sleep(context.Background(), &sleepymemory.SleepRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// four blocking requests fill both servers: each one runs exactly two
+	blocking := &sleepymemory.SleepRequest{SleepDuration: sleepymemory.Duration(time.Second)}
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Sleep(context.Background(), blocking)
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for sleepers["a"].running.Load()+sleepers["b"].running.Load() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatal("requests did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if sleepers["a"].running.Load() != 2 || sleepers["b"].running.Load() != 2 {
+		t.Errorf("running a=%d b=%d; expected 2 each", sleepers["a"].running.Load(), sleepers["b"].running.Load())
+	}
+
+	// every server is full: the next request fails without being sent
+	_, err = client.Sleep(context.Background(), blocking)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected ResourceExhausted:", err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	// the limit applies to running requests: completed requests free their slots
+	_, err = client.Sleep(context.Background(), blocking)
+	if err != nil {
+		t.Error(err)
+	}
+}
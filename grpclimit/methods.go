@@ -0,0 +1,265 @@
+package grpclimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/evanj/concurrentlimit"
+	"google.golang.org/grpc"
+)
+
+// MethodConfig configures the limits of one gRPC method or service for MethodLimiter.
+type MethodConfig struct {
+	// Method is the full method name, as in grpc.UnaryServerInfo.FullMethod:
+	// "/package.Service/Method", or a service name ending in a slash ("/package.Service/") to
+	// configure all its methods. A service's Limit is shared by all its methods, and its Cost is
+	// the default for its methods. Configs for its methods override the Cost, and their Limit
+	// applies in addition to the service's Limit.
+	Method string `json:"method"`
+	// ClientStreaming and ServerStreaming describe the method. They are informational: streams
+	// count as one request for as long as they are open.
+	ClientStreaming bool `json:"client_streaming"`
+	ServerStreaming bool `json:"server_streaming"`
+	// Limit is the maximum number of concurrent requests for this method, or 0 for no separate
+	// limit.
+	Limit int `json:"limit"`
+	// Cost is the capacity each request uses in the MethodLimiter's WeightedLimiter, or 0 for the
+	// default of 1.
+	Cost int `json:"cost"`
+}
+
+// MethodConfigs returns a MethodConfig for each method registered with server, sorted by name,
+// with no limits. It is a skeleton for operators to fill in, which is easier than listing the
+// methods of a large API by hand: write it as JSON with WriteMethodConfigs after registering the
+// services, set limits and costs, then read it with ReadMethodConfigs when starting the server.
+func MethodConfigs(server *grpc.Server) []MethodConfig {
+	configs := []MethodConfig{}
+	for serviceName, info := range server.GetServiceInfo() {
+		for _, method := range info.Methods {
+			configs = append(configs, MethodConfig{
+				Method:          "/" + serviceName + "/" + method.Name,
+				ClientStreaming: method.IsClientStream,
+				ServerStreaming: method.IsServerStream,
+			})
+		}
+	}
+	sort.Slice(configs, func(i int, j int) bool {
+		return configs[i].Method < configs[j].Method
+	})
+	return configs
+}
+
+// ServiceConfigs is like MethodConfigs, but returns one MethodConfig for each service, which is
+// smaller for servers with large APIs. Configs for individual methods can be added to override
+// the service's settings.
+func ServiceConfigs(server *grpc.Server) []MethodConfig {
+	configs := []MethodConfig{}
+	for serviceName := range server.GetServiceInfo() {
+		configs = append(configs, MethodConfig{Method: "/" + serviceName + "/"})
+	}
+	sort.Slice(configs, func(i int, j int) bool {
+		return configs[i].Method < configs[j].Method
+	})
+	return configs
+}
+
+// WriteMethodConfigs writes configs to w as indented JSON.
+func WriteMethodConfigs(w io.Writer, configs []MethodConfig) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(configs)
+}
+
+// ReadMethodConfigs reads configs written by WriteMethodConfigs.
+func ReadMethodConfigs(r io.Reader) ([]MethodConfig, error) {
+	configs := []MethodConfig{}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("grpclimit: invalid method configs: %w", err)
+	}
+	return configs, nil
+}
+
+// methodLimit is the limits of one method or service.
+type methodLimit struct {
+	// limiter is nil if the method or service has no separate limit
+	limiter concurrentlimit.Limiter
+	// cost is 0 if it is not set
+	cost int
+}
+
+// MethodLimiter limits gRPC requests for each method and service, as configured by MethodConfigs
+// or ServiceConfigs.
+type MethodLimiter struct {
+	weighted *concurrentlimit.WeightedLimiter
+	methods  map[string]methodLimit
+	// services is keyed by the service name ending in a slash
+	services map[string]methodLimit
+}
+
+// NewMethodLimiter returns a MethodLimiter that limits each method and service in configs to its
+// Limit, and starts an operation with the method's Cost on weighted. If weighted is nil, costs are
+// ignored. Methods that are not in configs have no separate limit, and the cost of their service,
+// or 1.
+func NewMethodLimiter(
+	configs []MethodConfig, weighted *concurrentlimit.WeightedLimiter,
+) (*MethodLimiter, error) {
+	m := &MethodLimiter{weighted: weighted, methods: map[string]methodLimit{}, services: map[string]methodLimit{}}
+	for _, config := range configs {
+		limits := m.methods
+		if strings.HasSuffix(config.Method, "/") {
+			limits = m.services
+		}
+		if _, exists := limits[config.Method]; exists {
+			return nil, fmt.Errorf("grpclimit: duplicate method config: %s", config.Method)
+		}
+		if config.Limit < 0 || config.Cost < 0 {
+			return nil, fmt.Errorf("grpclimit: method %s: limit=%d and cost=%d must be >= 0",
+				config.Method, config.Limit, config.Cost)
+		}
+		limit := methodLimit{cost: config.Cost}
+		if config.Limit > 0 {
+			limit.limiter = concurrentlimit.New(config.Limit)
+		}
+		limits[config.Method] = limit
+	}
+	return m, nil
+}
+
+// start begins an operation for fullMethod, or returns an error with a gRPC status.
+func (m *MethodLimiter) start(fullMethod string) (func(), error) {
+	service := m.services[fullMethod[:strings.LastIndex(fullMethod, "/")+1]]
+	method := m.methods[fullMethod]
+	cost := method.cost
+	if cost == 0 {
+		cost = service.cost
+	}
+	if cost == 0 {
+		cost = 1
+	}
+
+	var ends []func()
+	end := func() {
+		for i := len(ends) - 1; i >= 0; i-- {
+			ends[i]()
+		}
+	}
+	for _, limiter := range []concurrentlimit.Limiter{service.limiter, method.limiter} {
+		if limiter == nil {
+			continue
+		}
+		endLimiter, err := limiter.Start()
+		if err != nil {
+			end()
+			return nil, rejectionError(concurrentlimit.ShedCapacity, err, limiter)
+		}
+		ends = append(ends, endLimiter)
+	}
+	if m.weighted != nil {
+		endWeighted, err := m.weighted.StartN(cost)
+		if err != nil {
+			end()
+			return nil, rejectionError(concurrentlimit.ShedCapacity, err, nil)
+		}
+		ends = append(ends, endWeighted)
+	}
+	return end, nil
+}
+
+// UnaryInterceptor returns a grpc.UnaryServerInterceptor that applies the method limits. It will
+// return codes.ResourceExhausted if a limit rejects the request. If next is not nil, it will be
+// called to chain the request handlers.
+func (m *MethodLimiter) UnaryInterceptor(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		end, err := m.start(info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+
+		if next != nil {
+			return next(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor is the grpc.StreamServerInterceptor version of UnaryInterceptor. Streams count
+// against the limits for as long as they are open.
+func (m *MethodLimiter) StreamInterceptor(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		end, err := m.start(info.FullMethod)
+		if err != nil {
+			return err
+		}
+		defer end()
+
+		if next != nil {
+			return next(srv, ss, info, handler)
+		}
+		return handler(srv, ss)
+	}
+}
+
+// SuggestedMethodConfigs returns a MethodConfig for each method profiled in report, with the
+// limit the profiler suggests, sorted by name. It bootstraps the configs of a server profiled with
+// ProfileUnaryInterceptor and ProfileStreamInterceptor: write them with WriteMethodConfigs, then
+// review them before using them. The streaming fields are not known, so they are false. Labels
+// that are not full method names ("/package.Service/Method") are skipped.
+func SuggestedMethodConfigs(report concurrentlimit.ProfileReport) []MethodConfig {
+	configs := []MethodConfig{}
+	for _, operation := range report.Operations {
+		if !strings.HasPrefix(operation.Label, "/") || strings.Count(operation.Label, "/") != 2 {
+			continue
+		}
+		configs = append(configs, MethodConfig{Method: operation.Label, Limit: operation.SuggestedLimit})
+	}
+	return configs
+}
+
+// ProfileUnaryInterceptor returns a grpc.UnaryServerInterceptor that records each request with
+// profiler, labeled by its full method name. If next is not nil, it will be called to chain the
+// request handlers.
+func ProfileUnaryInterceptor(
+	profiler *concurrentlimit.Profiler, next grpc.UnaryServerInterceptor,
+) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		end := profiler.Start(info.FullMethod)
+		defer end()
+
+		if next != nil {
+			return next(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// ProfileStreamInterceptor is the grpc.StreamServerInterceptor version of
+// ProfileUnaryInterceptor. Each stream is one operation until the handler returns.
+func ProfileStreamInterceptor(
+	profiler *concurrentlimit.Profiler, next grpc.StreamServerInterceptor,
+) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		end := profiler.Start(info.FullMethod)
+		defer end()
+
+		if next != nil {
+			return next(srv, ss, info, handler)
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,91 @@
+package grpclimit
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/evanj/concurrentlimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDKey is the metadata key of the request ID. Metadata keys are lower case.
+var requestIDKey = strings.ToLower(concurrentlimit.RequestIDHeader)
+
+// RequestIDUnaryInterceptor returns a grpc.UnaryServerInterceptor that gives each request an ID,
+// like concurrentlimit.RequestIDHandler: the client's x-request-id metadata if it is valid, or a
+// new ID. The ID is added to the request's context for concurrentlimit.RequestIDFromContext and
+// AuditUnaryInterceptor, and is returned in the x-request-id header metadata. Requests that next
+// rejects with codes.ResourceExhausted have the ID added to the status message, and are logged if
+// the reject policy has LogRejections (see concurrentlimit.RejectionMessage). next should be the
+// limiting interceptor, such as UnaryInterceptor(limiter, nil). Since NewServer installs its
+// limiter as the first interceptor, use NewServerWithBypass with concurrentlimit.NoLimit, and pass
+// the limiter's interceptor as next.
+func RequestIDUnaryInterceptor(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		ctx, id := requestIDContext(ctx)
+		// only fails if this is not called by a grpc.Server, or the header was already sent
+		_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+
+		var resp interface{}
+		var err error
+		if next != nil {
+			resp, err = next(ctx, req, info, handler)
+		} else {
+			resp, err = handler(ctx, req)
+		}
+		return resp, withRequestID(id, err)
+	}
+}
+
+// RequestIDStreamInterceptor is the grpc.StreamServerInterceptor version of
+// RequestIDUnaryInterceptor.
+func RequestIDStreamInterceptor(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		ctx, id := requestIDContext(stream.Context())
+		// only fails if the header was already sent
+		_ = stream.SetHeader(metadata.Pairs(requestIDKey, id))
+		stream = &requestIDStream{stream, ctx}
+
+		var err error
+		if next != nil {
+			err = next(srv, stream, info, handler)
+		} else {
+			err = handler(srv, stream)
+		}
+		return withRequestID(id, err)
+	}
+}
+
+// requestIDContext returns a copy of ctx with the request's ID, and the ID.
+func requestIDContext(ctx context.Context) (context.Context, string) {
+	id := concurrentlimit.AcceptRequestID(MetadataKey(requestIDKey)(ctx))
+	return concurrentlimit.WithRequestID(ctx, id), id
+}
+
+// withRequestID adds the request ID id to err if it rejected the request.
+func withRequestID(id string, err error) error {
+	if status.Code(err) != rateLimitStatus {
+		return err
+	}
+	// keep the status's details
+	proto := status.Convert(err).Proto()
+	proto.Message = concurrentlimit.RejectionMessage(id, errors.New(proto.Message))
+	return status.ErrorProto(proto)
+}
+
+// requestIDStream is a grpc.ServerStream with the request ID in its context.
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,143 @@
+package grpclimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/evanj/concurrentlimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+// SlowStart limits the concurrent streams of each new gRPC connection to a few at first, and
+// raises the limit as the connection's streams complete, like TCP slow start. This stops a new
+// client from instantly using MaxConcurrentStreams worth of the server's capacity, while clients
+// that behave quickly reach the full limit. Streams over a connection's limit fail with
+// codes.ResourceExhausted. Add it to a server with ServerOptions.
+type SlowStart struct {
+	initial int
+	max     int
+	// rejected counts the streams rejected because their connection was over its limit
+	rejected atomic.Int64
+}
+
+// slowStartConnKey is the context key for a connection's *slowStartConn.
+type slowStartConnKey struct{}
+
+// slowStartConn is the state of one connection.
+type slowStartConn struct {
+	mu      sync.Mutex
+	limit   int
+	current int
+}
+
+// NewSlowStart returns a SlowStart that permits initial concurrent streams on each new
+// connection, and raises the limit by one each time a stream completes, up to max. If max is 0,
+// the limit is only capped by MaxConcurrentStreams. It will panic if initial <= 0, or max is not
+// 0 and is < initial.
+func NewSlowStart(initial int, max int) *SlowStart {
+	if initial <= 0 || (max != 0 && max < initial) {
+		panic(fmt.Sprintf("initial=%d must be > 0 and max=%d must be 0 or >= initial", initial, max))
+	}
+	return &SlowStart{initial: initial, max: max}
+}
+
+// ServerOptions returns the options that add s to a grpc.Server: a stats.Handler that tracks
+// connections, and interceptors that limit their streams. The interceptors are chained, so they
+// run after the ones passed to grpc.UnaryInterceptor, such as NewServer's limiter.
+func (s *SlowStart) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.StatsHandler(slowStartStatsHandler{s}),
+		grpc.ChainUnaryInterceptor(s.UnaryInterceptor(nil)),
+		grpc.ChainStreamInterceptor(s.StreamInterceptor(nil)),
+	}
+}
+
+// Rejected returns the number of streams rejected because their connection was over its limit.
+func (s *SlowStart) Rejected() int64 {
+	return s.rejected.Load()
+}
+
+// start begins a stream on the connection of ctx. It permits streams if the server was not
+// created with ServerOptions.
+func (s *SlowStart) start(ctx context.Context) (func(), error) {
+	conn, ok := ctx.Value(slowStartConnKey{}).(*slowStartConn)
+	if !ok {
+		return func() {}, nil
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.current >= conn.limit {
+		s.rejected.Add(1)
+		return nil, rejectionError(concurrentlimit.ShedCapacity,
+			fmt.Errorf("new connection exceeded its slow start limit of %d concurrent streams", conn.limit), nil)
+	}
+	conn.current++
+	return func() {
+		conn.mu.Lock()
+		conn.current--
+		if s.max == 0 || conn.limit < s.max {
+			conn.limit++
+		}
+		conn.mu.Unlock()
+	}, nil
+}
+
+// UnaryInterceptor returns a grpc.UnaryServerInterceptor that applies the slow start limits. It
+// only works on servers created with the stats.Handler from ServerOptions. If next is not nil, it
+// will be called to chain the request handlers.
+func (s *SlowStart) UnaryInterceptor(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		end, err := s.start(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+
+		if next != nil {
+			return next(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor is the grpc.StreamServerInterceptor version of UnaryInterceptor.
+func (s *SlowStart) StreamInterceptor(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		end, err := s.start(stream.Context())
+		if err != nil {
+			return err
+		}
+		defer end()
+
+		if next != nil {
+			return next(srv, stream, info, handler)
+		}
+		return handler(srv, stream)
+	}
+}
+
+// slowStartStatsHandler adds the state of each connection to its context, which gRPC uses as the
+// parent of the context of each of its streams.
+type slowStartStatsHandler struct {
+	s *SlowStart
+}
+
+func (h slowStartStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, slowStartConnKey{}, &slowStartConn{limit: h.s.initial})
+}
+
+func (h slowStartStatsHandler) HandleConn(ctx context.Context, connStats stats.ConnStats) {}
+
+func (h slowStartStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h slowStartStatsHandler) HandleRPC(ctx context.Context, rpcStats stats.RPCStats) {}
@@ -0,0 +1,72 @@
+package grpclimit
+
+import (
+	"context"
+
+	"github.com/evanj/concurrentlimit"
+	"google.golang.org/grpc"
+)
+
+// TrustedUnaryInterceptor is a version of UnaryInterceptor that lets requests from the trusted
+// identities returned by identityFunc, such as ClientCertKey or SignedMetadataIdentity, exceed the
+// limit. See concurrentlimit.TrustedCallers. Unlike BypassUnary, trusted requests count toward the
+// limiter's occupancy while it has capacity, and can be limited by a reserve.
+func TrustedUnaryInterceptor(
+	trusted *concurrentlimit.TrustedCallers, identityFunc func(context.Context) string,
+	limiter concurrentlimit.Limiter, next grpc.UnaryServerInterceptor,
+) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		end, err := trusted.Start(limiter, identityFunc(ctx))
+		if err == concurrentlimit.ErrLimited {
+			return nil, rejectionError(concurrentlimit.ShedCapacity, err, limiter)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ctx, release := concurrentlimit.WithOperation(ctx, end)
+		defer release()
+
+		if next != nil {
+			return next(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// TrustedStreamInterceptor is the grpc.StreamServerInterceptor version of
+// TrustedUnaryInterceptor. Each stream is one operation until the handler returns.
+func TrustedStreamInterceptor(
+	trusted *concurrentlimit.TrustedCallers, identityFunc func(context.Context) string,
+	limiter concurrentlimit.Limiter, next grpc.StreamServerInterceptor,
+) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		end, err := trusted.Start(limiter, identityFunc(stream.Context()))
+		if err == concurrentlimit.ErrLimited {
+			return rejectionError(concurrentlimit.ShedCapacity, err, limiter)
+		}
+		if err != nil {
+			return err
+		}
+		defer end()
+
+		if next != nil {
+			return next(srv, stream, info, handler)
+		}
+		return handler(srv, stream)
+	}
+}
+
+// SignedMetadataIdentity returns an identity function for TrustedUnaryInterceptor that returns
+// the identity in the request metadata name, if it was signed with key by
+// concurrentlimit.SignIdentity. Requests without a valid signature return the empty string.
+func SignedMetadataIdentity(name string, key []byte) func(context.Context) string {
+	metadataKey := MetadataKey(name)
+	return func(ctx context.Context) string {
+		identity, _ := concurrentlimit.VerifySignedIdentity(key, metadataKey(ctx))
+		return identity
+	}
+}
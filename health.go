@@ -0,0 +1,69 @@
+package concurrentlimit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// errDraining is returned by HealthReporter.Ready after SetDraining.
+var errDraining = errors.New("server is shutting down")
+
+// HealthReporter reports the liveness and readiness of a server for health checks, such as
+// Kubernetes probes. Liveness only means the process is running: it must not fail when overloaded,
+// since restarting an overloaded server only moves its load to other servers. Readiness fails when
+// the server is fully overloaded (see ComputeOverloadStatus) or shutting down, so load balancers
+// send requests elsewhere, while the limiter rejects the requests that arrive before they notice.
+type HealthReporter struct {
+	limiter  Limiter
+	options  OverloadOptions
+	draining atomic.Bool
+}
+
+// NewHealthReporter returns a HealthReporter for a server that uses limiter.
+func NewHealthReporter(limiter Limiter, options OverloadOptions) *HealthReporter {
+	return &HealthReporter{limiter: limiter, options: options}
+}
+
+// SetDraining marks the server as shutting down, so it is no longer ready.
+func (h *HealthReporter) SetDraining() {
+	h.draining.Store(true)
+}
+
+// Ready returns nil if the server should receive requests, or an error describing why not.
+func (h *HealthReporter) Ready() error {
+	if h.draining.Load() {
+		return errDraining
+	}
+	status := ComputeOverloadStatus(h.limiter, h.options)
+	if status.Score >= 100 {
+		return fmt.Errorf("server is overloaded: occupancy=%.0f%% queue_delay=%.0f%% memory=%.0f%%",
+			status.OccupancyPercent, status.QueueDelayPercent, status.MemoryPercent)
+	}
+	return nil
+}
+
+// LivenessHandler returns an http.Handler that always reports the server is alive.
+func (h *HealthReporter) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// ReadinessHandler returns an http.Handler that reports whether the server is ready. It returns
+// 503 Service Unavailable if it is not.
+func (h *HealthReporter) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		err := h.Ready()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+}
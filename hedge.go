@@ -0,0 +1,147 @@
+package concurrentlimit
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrDuplicateRequest is the error for duplicate requests rejected by HedgeHandler.
+var ErrDuplicateRequest = errors.New("too many duplicate requests, or duplicate request while overloaded")
+
+// HedgeOptions configures HedgeHandler.
+type HedgeOptions struct {
+	// Header contains the client-supplied request ID. Requests with the same ID that run at the
+	// same time are duplicates. If empty, it is RequestIDHeader.
+	Header string
+	// RejectAtUtilization rejects duplicates while the limiter's Current is at least this fraction
+	// of its Limit, as reported by StatsReporter. If 0, or the limiter does not implement
+	// StatsReporter, duplicates are never rejected.
+	RejectAtUtilization float64
+	// MaxDuplicates is the number of duplicates of a request that can run at the same time, in
+	// addition to the first. Others are rejected, so a client cannot run any number of requests in
+	// one slot by sending them with the same ID. If <= 0, it is 1.
+	MaxDuplicates int
+}
+
+// HedgeHandler is a version of Handler for clients that hedge: they send the same request again
+// if the first is slow, with the same request ID header. Without it, hedging doubles the load on
+// a server that is slow because it is overloaded. Duplicates of a running request do not use
+// another slot: they share the first request's slot, which is released when all of them complete.
+// Duplicates over HedgeOptions.MaxDuplicates, and duplicates while the server is busy, are
+// rejected as ShedClient: see WriteRejection.
+// Requests without the header are limited like Handler.
+type HedgeHandler struct {
+	limiter Limiter
+	options HedgeOptions
+	handler http.Handler
+
+	mu       sync.Mutex
+	inflight map[string]*hedgedRequest
+	// duplicates counts the requests with the ID of a running request
+	duplicates atomic.Int64
+	// rejected counts the duplicates that were rejected
+	rejected atomic.Int64
+}
+
+// hedgedRequest is the slot shared by the requests with the same ID.
+type hedgedRequest struct {
+	// refs is the number of running requests with this ID, protected by HedgeHandler.mu
+	refs int
+	end  func()
+}
+
+// NewHedgeHandler returns a HedgeHandler that limits requests with limiter and passes them to
+// handler.
+func NewHedgeHandler(limiter Limiter, options HedgeOptions, handler http.Handler) *HedgeHandler {
+	if options.Header == "" {
+		options.Header = RequestIDHeader
+	}
+	if options.MaxDuplicates <= 0 {
+		options.MaxDuplicates = 1
+	}
+	return &HedgeHandler{
+		limiter:  limiter,
+		options:  options,
+		handler:  handler,
+		inflight: map[string]*hedgedRequest{},
+	}
+}
+
+// Duplicates returns the number of requests that had the ID of a running request.
+func (h *HedgeHandler) Duplicates() int64 {
+	return h.duplicates.Load()
+}
+
+// Rejected returns the number of duplicates that were rejected.
+func (h *HedgeHandler) Rejected() int64 {
+	return h.rejected.Load()
+}
+
+func (h *HedgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(h.options.Header)
+	if id == "" {
+		Handler(h.limiter, h.handler).ServeHTTP(w, r)
+		return
+	}
+
+	// Limiter.Start does not wait, so it can be called with the lock held: this ensures only one
+	// request with each ID uses a slot
+	h.mu.Lock()
+	request := h.inflight[id]
+	if request != nil {
+		h.duplicates.Add(1)
+		if request.refs > h.options.MaxDuplicates || h.underPressure() {
+			h.mu.Unlock()
+			h.rejected.Add(1)
+			WriteRejection(w, ShedClient, ErrDuplicateRequest)
+			return
+		}
+		request.refs++
+	} else {
+		end, err := h.limiter.Start()
+		if err != nil {
+			h.mu.Unlock()
+			if err == ErrLimited {
+				WriteLimiterRejection(w, h.limiter, ShedCapacity, err)
+				return
+			}
+			log.Println("concurrentlimit.HedgeHandler BUG: unexpected error: " + err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		request = &hedgedRequest{refs: 1, end: end}
+		h.inflight[id] = request
+	}
+	h.mu.Unlock()
+
+	ctx, release := WithOperation(r.Context(), func() { h.release(id, request) })
+	h.handler.ServeHTTP(w, r.WithContext(ctx))
+	release()
+}
+
+// underPressure returns true if duplicates should be rejected.
+func (h *HedgeHandler) underPressure() bool {
+	if h.options.RejectAtUtilization <= 0 {
+		return false
+	}
+	current, limit := currentApprox(h.limiter)
+	return limit > 0 && float64(current) >= h.options.RejectAtUtilization*float64(limit)
+}
+
+// release ends one request with id, and releases the slot when it was the last one.
+func (h *HedgeHandler) release(id string, request *hedgedRequest) {
+	h.mu.Lock()
+	request.refs--
+	last := request.refs == 0
+	if last {
+		delete(h.inflight, id)
+	}
+	h.mu.Unlock()
+
+	if last {
+		request.end()
+	}
+}
@@ -0,0 +1,118 @@
+package demoserver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultCgroupRoot is where Linux mounts the cgroup filesystem, including in containers.
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+
+// cgroup v1 reports no memory limit as a huge number rounded to the page size.
+const cgroupV1Unlimited = 1 << 62
+
+// CgroupLimits are the resource limits of the cgroup (e.g. container) the process runs in.
+type CgroupLimits struct {
+	// MemoryBytes is 0 if memory is not limited.
+	MemoryBytes int64
+	// CPUs is the CPU quota as a number of CPUs, or 0 if CPU is not limited.
+	CPUs float64
+}
+
+// ReadCgroupLimits reads the memory and CPU limits of the cgroup mounted at root, using the
+// cgroup v2 files if they exist, and otherwise the cgroup v1 files. Missing files mean there is
+// no limit, so it returns zero limits outside a container.
+func ReadCgroupLimits(root string) (CgroupLimits, error) {
+	limits := CgroupLimits{}
+
+	// cgroup v2: memory.max is "max" or bytes; cpu.max is "$QUOTA $PERIOD" where quota may be "max"
+	memoryMax, err := readCgroupFile(filepath.Join(root, "memory.max"))
+	if err != nil {
+		return CgroupLimits{}, err
+	}
+	if memoryMax != "" {
+		if memoryMax != "max" {
+			limits.MemoryBytes, err = strconv.ParseInt(memoryMax, 10, 64)
+			if err != nil {
+				return CgroupLimits{}, fmt.Errorf("invalid memory.max=%#v: %w", memoryMax, err)
+			}
+		}
+
+		cpuMax, err := readCgroupFile(filepath.Join(root, "cpu.max"))
+		if err != nil {
+			return CgroupLimits{}, err
+		}
+		fields := strings.Fields(cpuMax)
+		if len(fields) == 2 && fields[0] != "max" {
+			limits.CPUs, err = parseCPUQuota(fields[0], fields[1])
+			if err != nil {
+				return CgroupLimits{}, fmt.Errorf("invalid cpu.max=%#v: %w", cpuMax, err)
+			}
+		}
+		return limits, nil
+	}
+
+	// cgroup v1: separate hierarchies for each controller
+	memoryLimit, err := readCgroupFile(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+	if err != nil {
+		return CgroupLimits{}, err
+	}
+	if memoryLimit != "" {
+		limits.MemoryBytes, err = strconv.ParseInt(memoryLimit, 10, 64)
+		if err != nil {
+			return CgroupLimits{}, fmt.Errorf("invalid memory.limit_in_bytes=%#v: %w", memoryLimit, err)
+		}
+		if limits.MemoryBytes >= cgroupV1Unlimited {
+			limits.MemoryBytes = 0
+		}
+	}
+	quota, err := readCgroupFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return CgroupLimits{}, err
+	}
+	period, err := readCgroupFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return CgroupLimits{}, err
+	}
+	if quota != "" && quota != "-1" && period != "" {
+		limits.CPUs, err = parseCPUQuota(quota, period)
+		if err != nil {
+			return CgroupLimits{}, fmt.Errorf("invalid cpu.cfs_quota_us=%#v: %w", quota, err)
+		}
+	}
+	return limits, nil
+}
+
+// readCgroupFile returns the contents of path without surrounding whitespace, or the empty string
+// if it does not exist.
+func readCgroupFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// parseCPUQuota returns the number of CPUs permitted by quota microseconds per period.
+func parseCPUQuota(quota string, period string) (float64, error) {
+	quotaMicros, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	periodMicros, err := strconv.ParseInt(period, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if quotaMicros <= 0 || periodMicros <= 0 {
+		return 0, fmt.Errorf("quota=%d and period=%d must be > 0", quotaMicros, periodMicros)
+	}
+	return float64(quotaMicros) / float64(periodMicros), nil
+}
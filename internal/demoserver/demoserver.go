@@ -0,0 +1,252 @@
+// Package demoserver implements the sleepyserver demo: HTTP and gRPC handlers that sleep and waste
+// resources, reporting the server's memory and request statistics, configuring the Go runtime,
+// TLS, fault injection, and graceful shutdown.
+package demoserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/evanj/concurrentlimit"
+	"github.com/evanj/concurrentlimit/grpclimit"
+	"github.com/evanj/concurrentlimit/sleepymemory"
+	"google.golang.org/grpc"
+)
+
+// HumanBytes formats bytes as megabytes.
+func HumanBytes(bytes uint64) string {
+	megabytes := float64(bytes) / float64(1024*1024)
+	return fmt.Sprintf("%.1f", megabytes)
+}
+
+// Stats is the state of the server reported by /stats.
+type Stats struct {
+	Sys             uint64        `json:"sys_bytes"`
+	HeapAlloc       uint64        `json:"heap_alloc_bytes"`
+	NextGC          uint64        `json:"next_gc_bytes"`
+	NumGoroutine    int           `json:"goroutines"`
+	NumGC           uint32        `json:"gc_count"`
+	GCPauseTotal    time.Duration `json:"gc_pause_total_ns"`
+	LastGCPause     time.Duration `json:"last_gc_pause_ns"`
+	HTTPConnections int64         `json:"http_connections"`
+	GRPCConnections int64         `json:"grpc_connections"`
+	// Listeners are the connections of each listener registered with
+	// concurrentlimit.RegisterListener, by name.
+	Listeners map[string]concurrentlimit.ConnStats `json:"listeners"`
+	// Requests and MaxRequests are the sums of each limiter's current and peak requests.
+	Requests    int   `json:"requests"`
+	MaxRequests int   `json:"max_requests"`
+	LeakedBytes int64 `json:"leaked_bytes"`
+	WastedFiles int64 `json:"wasted_files"`
+	// RequestLimit is 0 if requests are not limited.
+	RequestLimit int `json:"request_limit"`
+	// the bytes read and written by all connections, and the ones that waited for the bandwidth
+	// limit; 0 if bandwidth is not limited
+	Bytes          int64         `json:"bytes"`
+	ThrottledBytes int64         `json:"throttled_bytes"`
+	ThrottledDelay time.Duration `json:"throttled_delay_ns"`
+}
+
+// Server serves the Sleeper gRPC service, and the same requests over HTTP with RootHandler. The
+// zero value is not usable: Health and Faults must be set, and Limiters must be set to report the
+// requests and wait for them at shutdown.
+type Server struct {
+	sleepymemory.UnimplementedSleeperServer
+	// RequestLimiter limits requests in the handlers. It is nil if requests are limited before
+	// they reach the handlers, e.g. by concurrentlimit.ListenForServer and grpclimit.
+	RequestLimiter concurrentlimit.Limiter
+	// QueueTimeout is the maximum time requests wait for RequestLimiter, if it can queue requests
+	// like concurrentlimit.QueuedLimiter. If it is zero, requests do not wait.
+	QueueTimeout   time.Duration
+	LogAllRequests bool
+	Faults         *FaultInjector
+
+	HTTPConns concurrentlimit.ConnCounter
+	GRPCConns concurrentlimit.ConnCounter
+	Health    *concurrentlimit.HealthReporter
+	// Bandwidth limits the bytes read and written by connections, or is nil if they are not limited
+	Bandwidth *concurrentlimit.BandwidthLimiter
+	Leaks     Leaker
+	// wastedFiles is the number of files held open by WasteFiles
+	wastedFiles atomic.Int64
+	// Limiters limit the requests of each protocol. The stats of the StatsReporters are summed.
+	Limiters []concurrentlimit.Limiter
+}
+
+// Stats returns the server's current statistics.
+func (s *Server) Stats() Stats {
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	_, leakedBytes := s.Leaks.Load()
+	stats := Stats{
+		Sys:          memStats.Sys,
+		HeapAlloc:    memStats.HeapAlloc,
+		NextGC:       memStats.NextGC,
+		NumGoroutine: runtime.NumGoroutine(),
+		NumGC:        memStats.NumGC,
+		GCPauseTotal: time.Duration(memStats.PauseTotalNs),
+		// PauseNs is a circular buffer of recent pauses
+		LastGCPause:     time.Duration(memStats.PauseNs[(memStats.NumGC+255)%256]),
+		HTTPConnections: s.HTTPConns.Open(),
+		GRPCConnections: s.GRPCConns.Open(),
+		Listeners:       concurrentlimit.ListenerStats(),
+		LeakedBytes:     leakedBytes,
+		WastedFiles:     s.wastedFiles.Load(),
+	}
+	for _, limiter := range s.Limiters {
+		if reporter, ok := limiter.(concurrentlimit.StatsReporter); ok {
+			limiterStats := reporter.Stats()
+			stats.Requests += limiterStats.Current
+			stats.MaxRequests += limiterStats.Peak
+			stats.RequestLimit += limiterStats.Limit
+		}
+	}
+	if s.Bandwidth != nil {
+		bandwidthStats := s.Bandwidth.Stats()
+		stats.Bytes = bandwidthStats.Bytes
+		stats.ThrottledBytes = bandwidthStats.ThrottledBytes
+		stats.ThrottledDelay = bandwidthStats.ThrottledDelay
+	}
+	return stats
+}
+
+// StatsHandler reports Stats as text, or as JSON if the client accepts it.
+func (s *Server) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := s.Stats()
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		// ignore the error: there is nothing we can do if writing the response fails
+		_ = json.NewEncoder(w).Encode(stats)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	fmt.Fprintf(w, "total bytes of memory obtained from the OS Sys=%d %s\n",
+		stats.Sys, HumanBytes(stats.Sys))
+	fmt.Fprintf(w, "bytes of allocated heap objects HeapAlloc=%d %s\n",
+		stats.HeapAlloc, HumanBytes(stats.HeapAlloc))
+	fmt.Fprintf(w, "heap size that triggers the next GC NextGC=%d %s\n",
+		stats.NextGC, HumanBytes(stats.NextGC))
+	fmt.Fprintf(w, "goroutines NumGoroutine=%d\n", stats.NumGoroutine)
+	fmt.Fprintf(w, "completed GC cycles NumGC=%d\n", stats.NumGC)
+	fmt.Fprintf(w, "GC pauses GCPauseTotal=%s LastGCPause=%s\n", stats.GCPauseTotal, stats.LastGCPause)
+	fmt.Fprintf(w, "open connections HTTPConnections=%d GRPCConnections=%d\n",
+		stats.HTTPConnections, stats.GRPCConnections)
+	names := make([]string, 0, len(stats.Listeners))
+	for name := range stats.Listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		listener := stats.Listeners[name]
+		fmt.Fprintf(w, "listener %s connections Open=%d Peak=%d Limit=%d Accepted=%d\n",
+			name, listener.Open, listener.Peak, listener.Limit, listener.Accepted)
+	}
+	fmt.Fprintf(w, "concurrent requests Requests=%d MaxRequests=%d RequestLimit=%d\n",
+		stats.Requests, stats.MaxRequests, stats.RequestLimit)
+	fmt.Fprintf(w, "memory kept by requests with leak LeakedBytes=%d %s\n",
+		stats.LeakedBytes, HumanBytes(uint64(stats.LeakedBytes)))
+	fmt.Fprintf(w, "files held open by requests WastedFiles=%d\n", stats.WastedFiles)
+	fmt.Fprintf(w, "bytes read and written Bytes=%d ThrottledBytes=%d ThrottledDelay=%s\n",
+		stats.Bytes, stats.ThrottledBytes, stats.ThrottledDelay)
+}
+
+// WasteFiles opens count file descriptors, which are held until the returned function is called.
+// If the process runs out of file descriptors, it closes the ones it opened and returns the
+// error, which is what a real server would do with a request that needs a file or a connection.
+func (s *Server) WasteFiles(count int64) (func(), error) {
+	if count < 0 {
+		return nil, fmt.Errorf("waste_files=%d must be >= 0", count)
+	}
+	files := make([]*os.File, 0, count)
+	closeAll := func() {
+		for _, f := range files {
+			// ignore the error: /dev/null was only opened for reading
+			_ = f.Close()
+		}
+		s.wastedFiles.Add(-int64(len(files)))
+	}
+	for i := int64(0); i < count; i++ {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+		s.wastedFiles.Add(1)
+	}
+	return closeAll, nil
+}
+
+// Shutdown fails readiness probes, waits deregistrationDelay for load balancers to stop sending
+// requests, stops the servers from accepting new requests, waits up to timeout in total for
+// running requests to complete, then logs the final stats.
+func (s *Server) Shutdown(
+	httpServer *http.Server, grpcServer *grpc.Server, deregistrationDelay time.Duration, timeout time.Duration,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if deregistrationDelay > 0 {
+		log.Printf("failing readiness; waiting deregistrationDelay=%s before stopping ...", deregistrationDelay)
+	}
+	options := concurrentlimit.ShutdownOptions{
+		Health:              s.Health,
+		DeregistrationDelay: deregistrationDelay,
+		Stops: []func(context.Context) error{
+			httpServer.Shutdown,
+			func(ctx context.Context) error {
+				grpclimit.GracefulStop(ctx, grpcServer)
+				return nil
+			},
+		},
+	}
+	for _, limiter := range s.Limiters {
+		if reporter, ok := limiter.(concurrentlimit.StatsReporter); ok {
+			options.Limiters = append(options.Limiters, reporter)
+		}
+	}
+	err := concurrentlimit.Shutdown(ctx, options)
+	if err != nil {
+		log.Printf("shutdown did not complete: %s", err.Error())
+	}
+
+	stats := s.Stats()
+	log.Printf("final stats: MaxRequests=%d Sys=%s HeapAlloc=%s NumGC=%d GCPauseTotal=%s",
+		stats.MaxRequests, HumanBytes(stats.Sys), HumanBytes(stats.HeapAlloc), stats.NumGC,
+		stats.GCPauseTotal)
+}
+
+// ConfigureRuntime sets the Go runtime's memory limit if memLimit > 0, and its GC percent if
+// gcPercent is not empty. gcPercent is an integer or "off", like the GOGC environment variable.
+func ConfigureRuntime(memLimit int64, gcPercent string) error {
+	if memLimit > 0 {
+		log.Printf("setting the Go runtime memory limit to %d bytes (%s MiB)", memLimit, HumanBytes(uint64(memLimit)))
+		debug.SetMemoryLimit(memLimit)
+	}
+	if gcPercent != "" {
+		percent := -1
+		if gcPercent != "off" {
+			var err error
+			percent, err = strconv.Atoi(gcPercent)
+			if err != nil || percent < 0 {
+				return fmt.Errorf("invalid gcPercent=%#v: must be an integer >= 0 or off", gcPercent)
+			}
+		}
+		log.Printf("setting the Go runtime GC percent to %s", gcPercent)
+		debug.SetGCPercent(percent)
+	}
+	return nil
+}
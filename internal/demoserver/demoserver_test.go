@@ -0,0 +1,260 @@
+package demoserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit"
+)
+
+func TestLoadTLSConfig(t *testing.T) {
+	config, err := LoadTLSConfig("", "", false)
+	if err != nil || config != nil {
+		t.Error("expected no TLS without flags:", config, err)
+	}
+	config, err = LoadTLSConfig("", "", true)
+	if err != nil || len(config.Certificates) != 1 {
+		t.Error("expected a self-signed certificate:", config, err)
+	}
+	for _, files := range [][2]string{{"cert.pem", ""}, {"", "key.pem"}} {
+		_, err = LoadTLSConfig(files[0], files[1], false)
+		if err == nil {
+			t.Errorf("LoadTLSConfig(%#v, %#v) must fail", files[0], files[1])
+		}
+	}
+	_, err = LoadTLSConfig("cert.pem", "key.pem", true)
+	if err == nil {
+		t.Error("--tlsSelfSigned with --tlsCert must fail")
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	faults, err := NewFaultInjector(1, time.Millisecond, JitterExponential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !faults.Fail() {
+		t.Error("errorRate=1 must always fail")
+	}
+	faults, err = NewFaultInjector(0, time.Millisecond, JitterUniform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if faults.Fail() {
+			t.Fatal("errorRate=0 must never fail")
+		}
+		if latency := faults.ExtraLatency(); latency < 0 || latency >= 2*time.Millisecond {
+			t.Fatal("uniform latency out of range:", latency)
+		}
+	}
+
+	for _, invalid := range []struct {
+		errorRate    float64
+		jitter       time.Duration
+		distribution string
+	}{{-1, 0, JitterUniform}, {2, 0, JitterUniform}, {0, -1, JitterUniform}, {0, 0, "normal"}} {
+		_, err := NewFaultInjector(invalid.errorRate, invalid.jitter, invalid.distribution)
+		if err == nil {
+			t.Errorf("NewFaultInjector(%#v) must fail", invalid)
+		}
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	limiter := concurrentlimit.New(1)
+	s := &Server{Limiters: []concurrentlimit.Limiter{limiter, concurrentlimit.New(2)}}
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+
+	stats := s.Stats()
+	if stats.Requests != 1 || stats.MaxRequests != 1 || stats.RequestLimit != 3 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+
+	w := httptest.NewRecorder()
+	s.StatsHandler(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if !strings.Contains(w.Body.String(), "Requests=1 MaxRequests=1 RequestLimit=3\n") {
+		t.Error("unexpected text stats:", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	r.Header.Set("Accept", "application/json")
+	s.StatsHandler(w, r)
+	if !strings.Contains(w.Body.String(), `"request_limit":3`) {
+		t.Error("unexpected JSON stats:", w.Body.String())
+	}
+}
+
+func TestLeaker(t *testing.T) {
+	s := &Server{}
+	s.Leaks.Keep(make([]byte, 100))
+	s.Leaks.Keep(make([]byte, 200))
+	if stats := s.Stats(); stats.LeakedBytes != 300 {
+		t.Error("unexpected leaked bytes:", stats.LeakedBytes)
+	}
+
+	w := httptest.NewRecorder()
+	s.Leaks.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/leak", nil))
+	if !strings.Contains(w.Body.String(), "LeakedBytes=300 0.0 LeakedAllocations=2\n") {
+		t.Error("unexpected response:", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.Leaks.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/leak", nil))
+	if !strings.Contains(w.Body.String(), "LeakedBytes=0 0.0 LeakedAllocations=0\n") {
+		t.Error("unexpected response:", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.Leaks.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/leak", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Error("unexpected status:", w.Code)
+	}
+}
+
+func TestWasteFiles(t *testing.T) {
+	s := &Server{}
+	closeFiles, err := s.WasteFiles(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.WastedFiles != 3 {
+		t.Error("unexpected wasted files:", stats.WastedFiles)
+	}
+	closeFiles()
+	if stats := s.Stats(); stats.WastedFiles != 0 {
+		t.Error("expected files to be closed:", stats.WastedFiles)
+	}
+
+	_, err = s.WasteFiles(-1)
+	if err == nil {
+		t.Error("expected error for a negative count")
+	}
+}
+
+func TestRootHandler(t *testing.T) {
+	faults, err := NewFaultInjector(0, 0, JitterUniform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := concurrentlimit.New(1)
+	s := &Server{RequestLimiter: limiter, Faults: faults, Limiters: []concurrentlimit.Limiter{limiter}}
+
+	w := httptest.NewRecorder()
+	s.RootHandler(w, httptest.NewRequest(http.MethodGet, "/?sleep=1ms&waste=4096&leak=true&files=2", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "held 2 files") {
+		t.Errorf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	if stats := s.Stats(); stats.LeakedBytes != 4096 || stats.WastedFiles != 0 || stats.MaxRequests != 1 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+
+	// requests over the limit are rejected
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	s.RootHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After: %d %s", w.Code, w.Body.String())
+	}
+	end()
+
+	for _, invalid := range []string{"/?sleep=x", "/?waste=x", "/?leak=x", "/?files=-1"} {
+		w = httptest.NewRecorder()
+		s.RootHandler(w, httptest.NewRequest(http.MethodGet, invalid, nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected 500: %d %s", invalid, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	faults, err := NewFaultInjector(0, 0, JitterUniform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := concurrentlimit.NewQueued(1, 1)
+	s := &Server{RequestLimiter: limiter, QueueTimeout: time.Millisecond, Faults: faults}
+
+	// a request that waits longer than QueueTimeout is rejected like a full queue
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.RootHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503: %d %s", w.Code, w.Body.String())
+	}
+
+	// a request that waits less than QueueTimeout succeeds
+	s.QueueTimeout = time.Minute
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		end()
+	}()
+	w = httptest.NewRecorder()
+	s.RootHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func writeCgroupFiles(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for path, contents := range files {
+		path = filepath.Join(root, path)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(contents+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestReadCgroupLimits(t *testing.T) {
+	for _, test := range []struct {
+		files    map[string]string
+		expected CgroupLimits
+	}{
+		{map[string]string{}, CgroupLimits{}},
+		{map[string]string{"memory.max": "max", "cpu.max": "max 100000"}, CgroupLimits{}},
+		{map[string]string{"memory.max": "134217728", "cpu.max": "150000 100000"}, CgroupLimits{134217728, 1.5}},
+		{map[string]string{
+			"memory/memory.limit_in_bytes": "9223372036854771712",
+			"cpu/cpu.cfs_quota_us":         "-1",
+			"cpu/cpu.cfs_period_us":        "100000",
+		}, CgroupLimits{}},
+		{map[string]string{
+			"memory/memory.limit_in_bytes": "268435456",
+			"cpu/cpu.cfs_quota_us":         "200000",
+			"cpu/cpu.cfs_period_us":        "100000",
+		}, CgroupLimits{268435456, 2}},
+	} {
+		limits, err := ReadCgroupLimits(writeCgroupFiles(t, test.files))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limits != test.expected {
+			t.Errorf("ReadCgroupLimits(%v)=%#v; expected %#v", test.files, limits, test.expected)
+		}
+	}
+
+	_, err := ReadCgroupLimits(writeCgroupFiles(t, map[string]string{"memory.max": "lots"}))
+	if err == nil {
+		t.Error("expected error for an invalid memory.max")
+	}
+}
@@ -0,0 +1,62 @@
+package demoserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// ErrInjected is the error of requests that fail due to --errorRate.
+var ErrInjected = errors.New("injected failure (see --errorRate)")
+
+// JitterUniform and JitterExponential are the distributions of the latency added by FaultInjector.
+const JitterUniform = "uniform"
+const JitterExponential = "exponential"
+
+// FaultInjector adds artificial errors and latency to requests, to emulate a noisy backend.
+type FaultInjector struct {
+	// errorRate is the fraction of requests that fail, from 0 to 1
+	errorRate float64
+	// jitter is the mean extra latency added to each request
+	jitter             time.Duration
+	jitterDistribution string
+}
+
+// NewFaultInjector returns a FaultInjector that fails errorRate of requests, and adds latency with
+// mean jitter using jitterDistribution.
+func NewFaultInjector(errorRate float64, jitter time.Duration, jitterDistribution string) (*FaultInjector, error) {
+	if errorRate < 0 || errorRate > 1 {
+		return nil, fmt.Errorf("--errorRate=%f must be between 0 and 1", errorRate)
+	}
+	if jitter < 0 {
+		return nil, fmt.Errorf("--jitter=%s must be >= 0", jitter)
+	}
+	if jitterDistribution != JitterUniform && jitterDistribution != JitterExponential {
+		return nil, fmt.Errorf("--jitterDistribution=%#v must be %s or %s",
+			jitterDistribution, JitterUniform, JitterExponential)
+	}
+	if errorRate > 0 || jitter > 0 {
+		log.Printf("injecting faults errorRate=%f jitter=%s jitterDistribution=%s",
+			errorRate, jitter, jitterDistribution)
+	}
+	return &FaultInjector{errorRate, jitter, jitterDistribution}, nil
+}
+
+// Fail returns true if a request should fail.
+func (f *FaultInjector) Fail() bool {
+	return f.errorRate > 0 && rand.Float64() < f.errorRate
+}
+
+// ExtraLatency returns the latency to add to a request.
+func (f *FaultInjector) ExtraLatency() time.Duration {
+	if f.jitter == 0 {
+		return 0
+	}
+	if f.jitterDistribution == JitterExponential {
+		// a long tail: a few requests are much slower than the mean
+		return time.Duration(rand.ExpFloat64() * float64(f.jitter))
+	}
+	return time.Duration(rand.Int63n(int64(2 * f.jitter)))
+}
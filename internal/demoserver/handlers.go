@@ -0,0 +1,284 @@
+package demoserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/evanj/concurrentlimit"
+	"github.com/evanj/concurrentlimit/sleepymemory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const sleepHTTPKey = "sleep"
+const wasteHTTPKey = "waste"
+const leakHTTPKey = "leak"
+const filesHTTPKey = "files"
+
+// RootHandler serves the Sleep request described by the URL's query parameters, e.g.
+// /?sleep=1s&waste=1048576.
+func (s *Server) RootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := s.rootHandler(w, r)
+	if err == concurrentlimit.ErrLimited {
+		concurrentlimit.WriteLimiterRejection(w, s.RequestLimiter, concurrentlimit.ShedCapacity, err)
+	} else if err != nil {
+		statusCode := http.StatusInternalServerError
+		if err == ErrInjected {
+			statusCode = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), statusCode)
+	}
+}
+
+func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) error {
+	// buffer the entire body in memory, like many servers do when parsing requests
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	req := &sleepymemory.SleepRequest{}
+
+	sleepValue := r.FormValue(sleepHTTPKey)
+	if sleepValue != "" {
+		var sleepDuration time.Duration
+		// try to parse as integer seconds first
+		seconds, err := strconv.Atoi(sleepValue)
+		if err == nil {
+			// SUCCESS!
+			sleepDuration = time.Duration(seconds) * time.Second
+		} else {
+			// fall back to parsing duration, and return that error if it fails
+			sleepDuration, err = time.ParseDuration(sleepValue)
+			if err != nil {
+				return err
+			}
+		}
+		req.SleepDuration = sleepymemory.Duration(sleepDuration)
+	}
+
+	wasteValue := r.FormValue(wasteHTTPKey)
+	if wasteValue != "" {
+		bytes, err := strconv.Atoi(wasteValue)
+		if err != nil {
+			return err
+		}
+		req.WasteBytes = int64(bytes)
+	}
+
+	filesValue := r.FormValue(filesHTTPKey)
+	if filesValue != "" {
+		files, err := strconv.Atoi(filesValue)
+		if err != nil {
+			return err
+		}
+		req.WasteFiles = int64(files)
+	}
+
+	leakValue := r.FormValue(leakHTTPKey)
+	if leakValue != "" {
+		req.Leak, err = strconv.ParseBool(leakValue)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.sleepImplementation(r.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	fmt.Fprintf(w, "slept for %s (pass ?sleep=x)\nwasted %d bytes (pass ?waste=y)\nleaked=%t (pass ?leak=true)\nheld %d files (pass ?files=z)\nread %d body bytes\nignored response=%d\n",
+		req.SleepDuration.String(), req.WasteBytes, req.Leak, req.WasteFiles, len(body), resp.Ignored)
+	return nil
+}
+
+// Sleep implements the Sleeper service.
+func (s *Server) Sleep(ctx context.Context, request *sleepymemory.SleepRequest) (*sleepymemory.SleepResponse, error) {
+	resp, err := s.sleepImplementation(ctx, request)
+	if err == concurrentlimit.ErrLimited {
+		err = status.Error(codes.ResourceExhausted, err.Error())
+	} else if err == ErrInjected {
+		err = status.Error(codes.Unavailable, err.Error())
+	} else if err == context.Canceled || err == context.DeadlineExceeded {
+		err = status.FromContextError(err).Err()
+	}
+	return resp, err
+}
+
+// startRequest starts a request with RequestLimiter, if it is set. If QueueTimeout is set and the
+// limiter can queue requests, it waits up to QueueTimeout for a running request to complete, then
+// returns ErrLimited as if the queue was full.
+func (s *Server) startRequest(ctx context.Context) (func(), error) {
+	if s.RequestLimiter == nil {
+		return func() {}, nil
+	}
+	waiter, ok := s.RequestLimiter.(concurrentlimit.ContextLimiter)
+	if !ok || s.QueueTimeout <= 0 {
+		return s.RequestLimiter.Start()
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, s.QueueTimeout)
+	defer cancel()
+	end, err := waiter.StartContext(waitCtx)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, concurrentlimit.ErrLimited
+	}
+	return end, err
+}
+
+func (s *Server) sleepImplementation(ctx context.Context, request *sleepymemory.SleepRequest) (*sleepymemory.SleepResponse, error) {
+	// limit concurrent requests, unless they are limited before reaching the handlers
+	end, err := s.startRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	if s.LogAllRequests {
+		md, ok := metadata.FromIncomingContext(ctx)
+		log.Printf("starting Sleep request=%s md=%v ok=%v", request.String(), md, ok)
+	}
+
+	wasteSlice := make([]byte, request.WasteBytes)
+	// touch each page in the slice to ensure it is actually allocated
+	const pageSize = 4096
+	for i := 0; i < len(wasteSlice); i += pageSize {
+		// stop if the client gave up
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		wasteSlice[i] = 0xff
+	}
+
+	// hold file descriptors while sleeping, like a request with open files or connections
+	closeFiles, err := s.WasteFiles(request.WasteFiles)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles()
+
+	duration, err := sleepymemory.AsDuration(request.SleepDuration)
+	if err != nil {
+		return nil, err
+	}
+	duration += s.Faults.ExtraLatency()
+	// stop sleeping if the client gave up, so it does not use a slot for the full duration
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+	// fail after using the resources, like a backend that fails internally
+	if s.Faults.Fail() {
+		return nil, ErrInjected
+	}
+
+	// read some of the memory and return it so it doesn't get garbage collected
+	total := 0
+	for i := 0; i < len(wasteSlice); i += 10 * pageSize {
+		total += int(wasteSlice[i])
+	}
+	if request.Leak {
+		s.Leaks.Keep(wasteSlice)
+	}
+
+	return &sleepymemory.SleepResponse{Ignored: int64(total)}, nil
+}
+
+// defaultTickInterval is the time between SleepStream responses if the request does not set it.
+const defaultTickInterval = time.Second
+
+// SleepStream implements the Sleeper service.
+func (s *Server) SleepStream(
+	request *sleepymemory.SleepStreamRequest, stream sleepymemory.Sleeper_SleepStreamServer,
+) error {
+	// limit concurrent streams for as long as they are open
+	end, err := s.startRequest(stream.Context())
+	if err == concurrentlimit.ErrLimited {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return status.FromContextError(err).Err()
+	}
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	if s.LogAllRequests {
+		md, ok := metadata.FromIncomingContext(stream.Context())
+		log.Printf("starting SleepStream request=%s md=%v ok=%v", request.String(), md, ok)
+	}
+
+	duration, err := sleepymemory.AsDuration(request.SleepDuration)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	tickInterval, err := sleepymemory.AsDuration(request.TickInterval)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if tickInterval <= 0 {
+		tickInterval = defaultTickInterval
+	}
+
+	// waste memory for the life of the stream and touch each page to ensure it is allocated
+	wasteSlice := make([]byte, request.WasteBytes)
+	const pageSize = 4096
+	for i := 0; i < len(wasteSlice); i += pageSize {
+		wasteSlice[i] = 0xff
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	for {
+		finished := false
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-ticker.C:
+		case <-timer.C:
+			finished = true
+		}
+
+		// read some of the memory and return it so it doesn't get garbage collected
+		total := 0
+		for i := 0; i < len(wasteSlice); i += 10 * pageSize {
+			total += int(wasteSlice[i])
+		}
+		err := stream.Send(&sleepymemory.SleepStreamResponse{
+			Elapsed: sleepymemory.Duration(time.Since(start)),
+			Ignored: int64(total),
+		})
+		if err != nil {
+			return err
+		}
+		if finished {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package demoserver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+// Leaker keeps the memory wasted by requests that set leak, to simulate a slow memory leak.
+type Leaker struct {
+	mu          sync.Mutex
+	leaked      [][]byte
+	leakedBytes int64
+}
+
+// Keep retains b until Clear is called.
+func (l *Leaker) Keep(b []byte) {
+	l.mu.Lock()
+	l.leaked = append(l.leaked, b)
+	l.leakedBytes += int64(len(b))
+	l.mu.Unlock()
+}
+
+// Load returns the number of allocations and bytes retained by Keep.
+func (l *Leaker) Load() (int, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.leaked), l.leakedBytes
+}
+
+// Clear releases the retained memory, and returns it to the OS so the server's memory use drops
+// immediately, instead of after the next garbage collection.
+func (l *Leaker) Clear() {
+	l.mu.Lock()
+	l.leaked = nil
+	l.leakedBytes = 0
+	l.mu.Unlock()
+	debug.FreeOSMemory()
+}
+
+// Handler returns an http.Handler that reports the leaked memory, and clears it on POST or
+// DELETE requests.
+func (l *Leaker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodDelete:
+			allocations, bytes := l.Load()
+			l.Clear()
+			log.Printf("cleared %d leaked bytes in %d allocations", bytes, allocations)
+		default:
+			http.Error(w, "only GET, POST, and DELETE are supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		allocations, bytes := l.Load()
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		fmt.Fprintf(w, "leaked bytes LeakedBytes=%d %s LeakedAllocations=%d\n",
+			bytes, HumanBytes(uint64(bytes)), allocations)
+	})
+}
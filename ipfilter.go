@@ -0,0 +1,110 @@
+package concurrentlimit
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// IPFilter rejects connections based on the remote IP address, using lists of allowed and denied
+// networks. During an attack, this rejects connections from known bad sources before they use
+// any connection or request limits.
+type IPFilter struct {
+	allow    []netip.Prefix
+	deny     []netip.Prefix
+	rejected atomic.Int64
+}
+
+// NewIPFilter returns an IPFilter that permits addresses in allow, or any address if allow is
+// empty, except for addresses in deny. Each entry is a network in CIDR notation (e.g.
+// "10.0.0.0/8") or a single IP address.
+func NewIPFilter(allow []string, deny []string) (*IPFilter, error) {
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyPrefixes, err := parsePrefixes(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &IPFilter{allow: allowPrefixes, deny: denyPrefixes}, nil
+}
+
+func parsePrefixes(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			addr, err := netip.ParseAddr(network)
+			if err != nil {
+				return nil, fmt.Errorf("concurrentlimit: invalid IP address %#v: %w", network, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("concurrentlimit: invalid network %#v: %w", network, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Permits returns true if connections from addr are permitted. Addresses that are not IP
+// addresses, such as Unix sockets, are only permitted if the allow list is empty.
+func (f *IPFilter) Permits(addr net.Addr) bool {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return len(f.allow) == 0
+	}
+	ip := addrPort.Addr().Unmap()
+
+	for _, prefix := range f.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejected returns the number of connections the filter's listeners have closed.
+func (f *IPFilter) Rejected() int64 {
+	return f.rejected.Load()
+}
+
+// Listener returns a net.Listener that closes the connections accepted from listener that the
+// filter does not permit. Wrap the result with a connection limit (e.g. ListenerForServer or
+// netutil.LimitListener), so rejected connections never count against the limit.
+func (f *IPFilter) Listener(listener net.Listener) net.Listener {
+	return &filteredListener{listener, f}
+}
+
+type filteredListener struct {
+	net.Listener
+	filter *IPFilter
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter.Permits(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		l.filter.rejected.Add(1)
+		conn.Close()
+	}
+}
@@ -0,0 +1,353 @@
+package concurrentlimit
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KeyedLimiter limits the number of concurrent operations for each key separately, such as for
+// each caller. This prevents a single caller from using all of a server's capacity. It only
+// tracks keys with running operations, so memory is proportional to the number of operations, and
+// keys are forgotten as soon as they are idle. To also limit the number of keys, see SetMaxKeys.
+type KeyedLimiter struct {
+	mu      sync.Mutex
+	max     int
+	ceiling int
+	// capacity is the total operations below which keys can borrow capacity above max
+	capacity int
+	total    int
+	current  map[string]int
+	// maxKeys is the maximum number of keys in current, or 0 for no limit
+	maxKeys  int
+	overflow KeyedOverflow
+	// overflowCurrent counts the running operations for keys that exceeded maxKeys
+	overflowCurrent int
+	// overrides contains the keys whose limit was changed with SetKeyLimit
+	overrides map[string]int
+
+	clock  Clock
+	budget RejectionBudget
+	// rejections contains the recent rejections of each key, if budget is set
+	rejections map[string]*keyRejections
+	// nextSweep is when to remove expired entries from rejections
+	nextSweep time.Time
+	// changed is closed when an operation ends, if operations are waiting
+	changed chan struct{}
+}
+
+// RejectionBudget is a KeyedLimiter policy that makes operations wait for keys that were
+// rejected too often recently. Clients that are rejected usually retry. When many are rejected
+// at the same time, their retries arrive at the same time, and are rejected again. Making the
+// retries wait spreads them out, and slows down clients that retry too quickly.
+type RejectionBudget struct {
+	// Rejections is the number of operations rejected immediately for each key in each Window.
+	// After that, operations wait up to MaxWait for the key to be permitted.
+	Rejections int
+	Window     time.Duration
+	MaxWait    time.Duration
+}
+
+type keyRejections struct {
+	count     int
+	windowEnd time.Time
+}
+
+// KeyedOverflow is what a KeyedLimiter does with operations for new keys when it is already
+// tracking the maximum number of keys.
+type KeyedOverflow int
+
+const (
+	// OverflowReject rejects operations for new keys.
+	OverflowReject KeyedOverflow = iota
+	// OverflowShared permits operations for all new keys up to a single shared limit, as if they
+	// had the same key.
+	OverflowShared
+)
+
+// NewKeyed returns a KeyedLimiter that permits limit concurrent operations for each key. It will
+// panic if limit <= 0.
+func NewKeyed(limit int) *KeyedLimiter {
+	if limit <= 0 {
+		panic(fmt.Sprintf("limit must be > 0: %d", limit))
+	}
+	return &KeyedLimiter{max: limit, ceiling: limit, current: map[string]int{}, clock: systemClock{}}
+}
+
+// NewKeyedShared returns a work-conserving KeyedLimiter that shares unused capacity between keys.
+// Each key can always run limit concurrent operations. While fewer than capacity operations are
+// running for all keys, a busy key can borrow the unused capacity, up to ceiling operations. This
+// keeps the server busy when only a few keys are sending requests, without letting one key use
+// more than ceiling. Borrowed capacity is returned when the operations end, so a key that becomes
+// busy later gets its limit back as soon as the borrowing operations complete. It will panic if
+// limit <= 0 or ceiling < limit.
+func NewKeyedShared(limit int, ceiling int, capacity int) *KeyedLimiter {
+	if ceiling < limit {
+		panic(fmt.Sprintf("ceiling=%d must be >= limit=%d", ceiling, limit))
+	}
+	k := NewKeyed(limit)
+	k.ceiling = ceiling
+	k.capacity = capacity
+	return k
+}
+
+// SetMaxKeys limits the number of keys with running operations to maxKeys, so callers that send
+// random keys cannot use unlimited memory, or get a separate limit for each key. Operations for
+// new keys after the maximum are handled according to overflow. It must be called before the
+// limiter is used. It will panic if maxKeys <= 0.
+func (k *KeyedLimiter) SetMaxKeys(maxKeys int, overflow KeyedOverflow) {
+	if maxKeys <= 0 {
+		panic(fmt.Sprintf("maxKeys must be > 0: %d", maxKeys))
+	}
+	k.maxKeys = maxKeys
+	k.overflow = overflow
+}
+
+// SetKeyLimit changes the limit of key to limit, such as to give a large caller more capacity,
+// or to stop a misbehaving one. Keys with a limit do not borrow capacity from NewKeyedShared, and
+// are tracked even when the limiter has SetMaxKeys keys. If limit <= 0, key returns to the default
+// limit. It can be called while the limiter is used; running operations are not affected.
+func (k *KeyedLimiter) SetKeyLimit(key string, limit int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if limit <= 0 {
+		delete(k.overrides, key)
+		return
+	}
+	if k.overrides == nil {
+		k.overrides = map[string]int{}
+	}
+	k.overrides[key] = limit
+	k.notifyLocked()
+}
+
+// KeyLimits returns the limits set with SetKeyLimit, by key.
+func (k *KeyedLimiter) KeyLimits() map[string]int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	limits := make(map[string]int, len(k.overrides))
+	for key, limit := range k.overrides {
+		limits[key] = limit
+	}
+	return limits
+}
+
+// SetClock replaces the clock used to measure the RejectionBudget window, which is the system
+// clock by default. It must be called before the limiter is used.
+func (k *KeyedLimiter) SetClock(clock Clock) {
+	k.clock = clock
+}
+
+// SetRejectionBudget makes operations over the limit wait, instead of being rejected, for keys
+// that were rejected more than budget.Rejections times in the last budget.Window. It must be
+// called before the limiter is used. It will panic if budget.Rejections < 0 or budget.Window <= 0.
+func (k *KeyedLimiter) SetRejectionBudget(budget RejectionBudget) {
+	if budget.Rejections < 0 || budget.Window <= 0 {
+		panic(fmt.Sprintf("Rejections=%d must be >= 0 and Window=%s must be > 0",
+			budget.Rejections, budget.Window))
+	}
+	k.budget = budget
+	k.rejections = map[string]*keyRejections{}
+}
+
+// Start begins a new operation for key. It returns a completion function that must be called when
+// the operation completes, or it returns ErrLimited if key has too many concurrent operations.
+// With a RejectionBudget, it may wait; see StartContext.
+func (k *KeyedLimiter) Start(key string) (func(), error) {
+	return k.StartContext(context.Background(), key)
+}
+
+// StartContext is a version of Start that stops waiting if ctx is done, and returns ctx.Err().
+// Operations only wait if the limiter has a RejectionBudget, and key has used it.
+func (k *KeyedLimiter) StartContext(ctx context.Context, key string) (func(), error) {
+	k.mu.Lock()
+	end, err := k.startLocked(key)
+	wait := err == ErrLimited && k.overBudgetLocked(key, k.clock.Now())
+	k.mu.Unlock()
+	if !wait {
+		return end, err
+	}
+
+	timer := time.NewTimer(k.budget.MaxWait)
+	defer timer.Stop()
+	for {
+		k.mu.Lock()
+		end, err := k.startLocked(key)
+		if err != ErrLimited {
+			k.mu.Unlock()
+			return end, err
+		}
+		if k.changed == nil {
+			k.changed = make(chan struct{})
+		}
+		changed := k.changed
+		k.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, ErrLimited
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// overBudgetLocked counts a rejection for key, and returns true if the key has used its
+// RejectionBudget, so the operation should wait. Keys rejected because the limiter has SetMaxKeys
+// keys are not counted, so clients sending random keys cannot grow k.rejections. k.mu must be held.
+func (k *KeyedLimiter) overBudgetLocked(key string, now time.Time) bool {
+	if k.rejections == nil {
+		return false
+	}
+	if _, tracked := k.current[key]; !tracked {
+		// rejected by SetMaxKeys: keys over their limit have running operations
+		return false
+	}
+	if now.After(k.nextSweep) {
+		for key, rejections := range k.rejections {
+			if !now.Before(rejections.windowEnd) {
+				delete(k.rejections, key)
+			}
+		}
+		k.nextSweep = now.Add(k.budget.Window)
+	}
+
+	rejections := k.rejections[key]
+	if rejections == nil || !now.Before(rejections.windowEnd) {
+		rejections = &keyRejections{windowEnd: now.Add(k.budget.Window)}
+		k.rejections[key] = rejections
+	}
+	if rejections.count < k.budget.Rejections {
+		rejections.count++
+		return false
+	}
+	return true
+}
+
+// startLocked begins a new operation for key, or returns ErrLimited. k.mu must be held.
+func (k *KeyedLimiter) startLocked(key string) (func(), error) {
+	current, tracked := k.current[key]
+	override, overridden := k.overrides[key]
+	if !tracked && !overridden && k.maxKeys > 0 && len(k.current) >= k.maxKeys {
+		if k.overflow != OverflowShared || k.overflowCurrent >= k.max {
+			return nil, ErrLimited
+		}
+		k.overflowCurrent++
+		k.total++
+		return k.endOverflow, nil
+	}
+
+	next := current + 1
+	if overridden {
+		if next > override {
+			return nil, ErrLimited
+		}
+	} else if next > k.max && (next > k.ceiling || k.total >= k.capacity) {
+		return nil, ErrLimited
+	}
+	k.current[key] = next
+	k.total++
+
+	return func() { k.end(key) }, nil
+}
+
+func (k *KeyedLimiter) endOverflow() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.overflowCurrent--
+	if k.overflowCurrent < 0 {
+		panic("bug: mismatched calls to start/end")
+	}
+	k.total--
+	k.notifyLocked()
+}
+
+// notifyLocked wakes the waiting operations after an operation ends. k.mu must be held.
+func (k *KeyedLimiter) notifyLocked() {
+	if k.changed != nil {
+		close(k.changed)
+		k.changed = nil
+	}
+}
+
+func (k *KeyedLimiter) end(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	next := k.current[key] - 1
+	if next < 0 {
+		panic("bug: mismatched calls to start/end")
+	}
+	k.total--
+	if next == 0 {
+		delete(k.current, key)
+	} else {
+		k.current[key] = next
+	}
+	k.notifyLocked()
+}
+
+// KeyedHandler returns an http.Handler that uses limiter to limit the concurrent requests for
+// each key returned by keyFunc. Rejected requests are ShedClient: see WriteRejection.
+func KeyedHandler(
+	limiter *KeyedLimiter, keyFunc func(*http.Request) string, handler http.Handler,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		end, err := limiter.StartContext(r.Context(), keyFunc(r))
+		if err == ErrLimited {
+			WriteRejection(w, ShedClient, err)
+			return
+		}
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			// the client stopped waiting for the response
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Println("concurrentlimit.KeyedHandler BUG: unexpected error: " + err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer end()
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// HeaderKey returns a key function for KeyedHandler that uses the value of the request header
+// name, such as an API key. Requests without the header return the empty string, so they share a
+// single key. Clients can send any value, so only use headers that are authenticated before the
+// limit, or where a client evading its limit is acceptable.
+func HeaderKey(name string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// ClientCertKey returns the identity of the verified TLS client certificate for r, for use with
+// KeyedHandler. See CertificateIdentity. Requests without a verified client certificate return
+// the empty string, so they share a single key.
+func ClientCertKey(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return CertificateIdentity(r.TLS.VerifiedChains[0][0])
+}
+
+// CertificateIdentity returns the identity of a client certificate: its SPIFFE ID if it has one,
+// otherwise its subject common name. Only use this with verified certificates, otherwise the
+// identity can be spoofed.
+func CertificateIdentity(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,162 @@
+// Package limitclient parses the rejections of servers that use concurrentlimit and grpclimit,
+// and advises clients how to back off, so every client reacts to overload the same way. HTTP
+// servers should set concurrentlimit.RejectPolicy.JSON to describe their rejections; without it,
+// the advice only uses the status code and Retry-After header. gRPC servers describe their
+// rejections in the status details.
+package limitclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/evanj/concurrentlimit"
+	"github.com/evanj/concurrentlimit/grpclimit"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxBodyBytes is the most FromHTTPResponse reads from a response body. Rejections are much
+// smaller.
+const maxBodyBytes = 64 << 10
+
+// Action is what a client should do after a request.
+type Action int
+
+const (
+	// None means the request was not rejected by a limit: handle the response or error as usual.
+	None Action = iota
+	// Retry means the server was at capacity: retry after Advice.RetryAfter, preferably on another
+	// server.
+	Retry
+	// SlowDown means the client exceeded its own limit: send fewer concurrent requests. Retrying
+	// without reducing them is rejected again.
+	SlowDown
+)
+
+func (a Action) String() string {
+	switch a {
+	case None:
+		return "none"
+	case Retry:
+		return "retry"
+	case SlowDown:
+		return "slow down"
+	default:
+		return "Action(" + strconv.Itoa(int(a)) + ")"
+	}
+}
+
+// Advice is how a client should react to a request.
+type Advice struct {
+	Action Action
+	// RetryAfter is how long to wait before sending the request again, or 0 if the server did not
+	// say.
+	RetryAfter time.Duration
+	// Rejection is the server's description of the rejection. It is incomplete if the server did
+	// not send one: only Code is set.
+	Rejection concurrentlimit.Rejection
+}
+
+// fromRejection returns the advice for a rejection described by a server.
+func fromRejection(rejection concurrentlimit.Rejection) Advice {
+	advice := Advice{
+		Action:     Retry,
+		RetryAfter: time.Duration(rejection.RetryAfterMS) * time.Millisecond,
+		Rejection:  rejection,
+	}
+	if rejection.Code == concurrentlimit.ShedClient.String() {
+		advice.Action = SlowDown
+	}
+	return advice
+}
+
+// FromHTTPResponse returns the advice for resp. A JSON body is parsed as a
+// concurrentlimit.Rejection; otherwise, 503 Service Unavailable with Retry-After means Retry, and
+// 429 Too Many Requests means SlowDown, which are the defaults of concurrentlimit.RejectPolicy. It
+// reads the body of JSON error responses, and replaces resp.Body so the caller can still read it.
+// It only returns an error if reading the body fails.
+func FromHTTPResponse(resp *http.Response) (Advice, error) {
+	if resp.StatusCode < http.StatusBadRequest {
+		return Advice{}, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		if err != nil {
+			return Advice{}, err
+		}
+
+		rejection := concurrentlimit.Rejection{}
+		err = json.Unmarshal(body, &rejection)
+		if err == nil && (rejection.Code == concurrentlimit.ShedCapacity.String() ||
+			rejection.Code == concurrentlimit.ShedClient.String()) {
+			return fromRejection(rejection), nil
+		}
+	}
+
+	// Retry-After may also be an HTTP date, which concurrentlimit does not send
+	retryAfter := time.Duration(0)
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "":
+		return Advice{Action: Retry, RetryAfter: retryAfter,
+			Rejection: concurrentlimit.Rejection{Code: concurrentlimit.ShedCapacity.String()}}, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return Advice{Action: SlowDown, RetryAfter: retryAfter,
+			Rejection: concurrentlimit.Rejection{Code: concurrentlimit.ShedClient.String()}}, nil
+	}
+	return Advice{}, nil
+}
+
+// FromError returns the advice for the error of a gRPC request. Only codes.ResourceExhausted
+// errors with the details added by grpclimit are rejections: the same code is also used for
+// other errors, such as messages that are too large, which retrying does not fix.
+func FromError(err error) Advice {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		return Advice{}
+	}
+
+	var info *errdetails.ErrorInfo
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.ErrorInfo:
+			if detail.GetDomain() == grpclimit.ErrorInfoDomain {
+				info = detail
+			}
+		case *errdetails.RetryInfo:
+			retryInfo = detail
+		}
+	}
+	if info == nil {
+		return Advice{}
+	}
+
+	metadata := info.GetMetadata()
+	rejection := concurrentlimit.Rejection{Code: concurrentlimit.ShedCapacity.String(), Reason: metadata["reason"]}
+	if info.GetReason() == "CLIENT" {
+		rejection.Code = concurrentlimit.ShedClient.String()
+	}
+	// ignore errors: missing values are 0
+	rejection.RetryAfterMS, _ = strconv.ParseInt(metadata["retry_after_ms"], 10, 64)
+	rejection.QueueDepth, _ = strconv.Atoi(metadata["queue_depth"])
+	advice := fromRejection(rejection)
+	if retryInfo != nil && retryInfo.GetRetryDelay() != nil {
+		advice.RetryAfter = retryInfo.GetRetryDelay().AsDuration()
+	}
+	return advice
+}
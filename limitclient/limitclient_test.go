@@ -0,0 +1,100 @@
+package limitclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit"
+	"github.com/evanj/concurrentlimit/grpclimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fullLimiter returns a limiter that rejects every operation until end is called.
+func fullLimiter(t *testing.T) (concurrentlimit.Limiter, func()) {
+	limiter := concurrentlimit.New(1)
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return limiter, end
+}
+
+func TestFromHTTPResponse(t *testing.T) {
+	limiter, end := fullLimiter(t)
+	defer end()
+	handler := concurrentlimit.Handler(limiter, http.NotFoundHandler())
+	serve := func() *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Result()
+	}
+
+	concurrentlimit.SetRejectPolicy(concurrentlimit.RejectPolicy{JSON: true, RetryAfter: 1500 * time.Millisecond})
+	defer concurrentlimit.SetRejectPolicy(concurrentlimit.RejectPolicy{})
+	resp := serve()
+	advice, err := FromHTTPResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := concurrentlimit.Rejection{
+		Code: "capacity", Reason: concurrentlimit.ErrLimited.Error(), RetryAfterMS: 1500}
+	if advice.Action != Retry || advice.RetryAfter != 1500*time.Millisecond || advice.Rejection != expected {
+		t.Errorf("unexpected advice for a JSON rejection: %#v", advice)
+	}
+	// the body can still be read
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || len(body) == 0 {
+		t.Errorf("expected the body to be readable: %#v %v", string(body), err)
+	}
+
+	// text rejections only have the status and Retry-After
+	concurrentlimit.SetRejectPolicy(concurrentlimit.RejectPolicy{})
+	advice, err = FromHTTPResponse(serve())
+	if err != nil || advice.Action != Retry || advice.RetryAfter != time.Second {
+		t.Errorf("unexpected advice for a text rejection: %#v %v", advice, err)
+	}
+	w := httptest.NewRecorder()
+	concurrentlimit.WriteRejection(w, concurrentlimit.ShedClient, concurrentlimit.ErrLimited)
+	advice, err = FromHTTPResponse(w.Result())
+	if err != nil || advice.Action != SlowDown || advice.Rejection.Code != "client" {
+		t.Errorf("unexpected advice for a client rejection: %#v %v", advice, err)
+	}
+	advice, err = FromHTTPResponse(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}})
+	if err != nil || advice.Action != None {
+		t.Errorf("expected a 503 without Retry-After not to be a rejection: %#v %v", advice, err)
+	}
+}
+
+func TestFromError(t *testing.T) {
+	limiter, end := fullLimiter(t)
+	defer end()
+	interceptor := grpclimit.UnaryInterceptor(limiter, nil)
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test/Method"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatal("expected ResourceExhausted:", err)
+	}
+
+	advice := FromError(err)
+	expected := concurrentlimit.Rejection{
+		Code: "capacity", Reason: concurrentlimit.ErrLimited.Error(), RetryAfterMS: 1000}
+	if advice.Action != Retry || advice.RetryAfter != time.Second || advice.Rejection != expected {
+		t.Errorf("unexpected advice: %#v", advice)
+	}
+
+	// other ResourceExhausted errors are not rejections
+	if advice := FromError(status.Error(codes.ResourceExhausted, "message too large")); advice.Action != None {
+		t.Errorf("unexpected advice: %#v", advice)
+	}
+	if advice := FromError(nil); advice.Action != None {
+		t.Errorf("unexpected advice: %#v", advice)
+	}
+}
@@ -0,0 +1,102 @@
+package concurrentlimit
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// Limits are the related limits of a server. A request limit alone is not enough to reason about
+// a server: HTTP/1.1 clients send one request at a time on each connection, while HTTP/2 and gRPC
+// clients send up to the stream limit on each one, so a configuration can make one limit
+// unreachable, or make clients wait while the server has capacity. CheckLimits finds these.
+type Limits struct {
+	// RequestLimit is the maximum number of concurrent requests, shared by all connections.
+	RequestLimit int
+	// ConnectionLimit is the maximum number of concurrent connections, or 0 if not limited.
+	ConnectionLimit int
+	// StreamLimit is the maximum number of concurrent requests on one HTTP/2 connection, which is
+	// MaxConcurrentStreams, or 0 if not limited. gRPC servers do not limit streams by default, and
+	// net/http's HTTP/2 server limits them to 250.
+	StreamLimit int
+	// HTTP1 is true if clients can use HTTP/1.1. HTTP servers always accept it; gRPC does not.
+	HTTP1 bool
+	// HTTP2 is true if clients can use HTTP/2, including gRPC.
+	HTTP2 bool
+}
+
+// CheckLimits returns an error if limits are invalid, and a warning for each way that they
+// conflict. The warnings do not prevent a server from working, so they should be logged.
+func CheckLimits(limits Limits) ([]string, error) {
+	if limits.RequestLimit <= 0 || limits.ConnectionLimit < 0 || limits.StreamLimit < 0 {
+		return nil, fmt.Errorf("CheckLimits: RequestLimit=%d must be > 0, and ConnectionLimit=%d and StreamLimit=%d must be >= 0",
+			limits.RequestLimit, limits.ConnectionLimit, limits.StreamLimit)
+	}
+	if !limits.HTTP1 && !limits.HTTP2 {
+		return nil, errors.New("CheckLimits: HTTP1 or HTTP2 must be true")
+	}
+
+	var warnings []string
+	if limits.HTTP1 && limits.ConnectionLimit > 0 && limits.ConnectionLimit < limits.RequestLimit {
+		warnings = append(warnings, fmt.Sprintf(
+			"ConnectionLimit=%d < RequestLimit=%d: HTTP/1.1 clients send one request at a time on each connection, so they cannot reach the request limit",
+			limits.ConnectionLimit, limits.RequestLimit))
+	}
+	if !limits.HTTP2 {
+		return warnings, nil
+	}
+	if limits.ConnectionLimit > 0 && limits.StreamLimit > 0 &&
+		limits.ConnectionLimit*limits.StreamLimit < limits.RequestLimit {
+		warnings = append(warnings, fmt.Sprintf(
+			"ConnectionLimit=%d * StreamLimit=%d < RequestLimit=%d: HTTP/2 clients cannot reach the request limit",
+			limits.ConnectionLimit, limits.StreamLimit, limits.RequestLimit))
+	}
+	if limits.StreamLimit > 0 && limits.StreamLimit < limits.RequestLimit {
+		warnings = append(warnings, fmt.Sprintf(
+			"StreamLimit=%d < RequestLimit=%d: clients that send all requests on one connection, such as gRPC clients, wait behind each other while the server can run more requests",
+			limits.StreamLimit, limits.RequestLimit))
+	}
+	if limits.StreamLimit == 0 || limits.StreamLimit > limits.RequestLimit {
+		warnings = append(warnings, fmt.Sprintf(
+			"StreamLimit=%d (0 is unlimited) > RequestLimit=%d: one connection can send more requests than the limit, which are rejected instead of waiting in the client; set StreamLimit to RequestLimit",
+			limits.StreamLimit, limits.RequestLimit))
+	}
+	return warnings, nil
+}
+
+// ListenWithLimits is a version of ListenForServer that configures srv to enforce all of limits
+// together, after checking them with CheckLimits. It limits requests with New(RequestLimit),
+// and connections to ConnectionLimit, which must be > 0. If HTTP2 is true, it sets the HTTP/2
+// server's MaxConcurrentStreams to StreamLimit, or to RequestLimit if StreamLimit is 0, so clients
+// wait instead of sending requests that will be rejected. If HTTP2 is false, it disables HTTP/2.
+// HTTP1 is ignored, since HTTP servers always accept HTTP/1.1. It returns CheckLimits's warnings,
+// which the caller should log.
+func ListenWithLimits(srv *http.Server, limits Limits) (net.Listener, []string, error) {
+	limits.HTTP1 = true
+	if limits.HTTP2 && limits.StreamLimit == 0 {
+		limits.StreamLimit = limits.RequestLimit
+	}
+	warnings, err := CheckLimits(limits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if limits.HTTP2 {
+		err = http2.ConfigureServer(srv, &http2.Server{MaxConcurrentStreams: uint32(limits.StreamLimit)})
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		// a non-nil empty map disables HTTP/2
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	listener, err := ListenForServer(srv, New(limits.RequestLimit), limits.ConnectionLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listener, warnings, nil
+}
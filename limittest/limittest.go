@@ -0,0 +1,172 @@
+// Package limittest provides a concurrentlimit.Limiter for unit tests of code that handles
+// overload, without starting real servers or creating real overload. Tests control which
+// operations are admitted, can delay the end of operations, and can check that every started
+// operation ended exactly once. Clock replaces the system clock, so tests that measure waiting
+// run instantly. MemoryPressure grows the heap and causes garbage collections on demand, to test
+// code that reacts to memory.
+package limittest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit"
+)
+
+// Limiter is a concurrentlimit.Limiter and concurrentlimit.StatsReporter controlled by a test. It
+// is safe to use from multiple goroutines.
+type Limiter struct {
+	mu sync.Mutex
+	// limit is the maximum running operations, or 0 if they are not limited
+	limit   int
+	reject  bool
+	script  []error
+	hold    bool
+	held    int
+	running int
+	peak    int
+	started int
+	// rejected counts Start calls that returned an error
+	rejected int
+	// misuse describes calls to end functions that were already called
+	misuse []string
+}
+
+// New returns a Limiter that permits limit concurrent operations, or any number if limit is 0.
+func New(limit int) *Limiter {
+	if limit < 0 {
+		panic(fmt.Sprintf("limit must be >= 0: %d", limit))
+	}
+	return &Limiter{limit: limit}
+}
+
+// Start begins an operation. It returns the next result from Script if there is one. Otherwise,
+// it returns ErrLimited if SetReject(true) was called or the limit is reached.
+func (l *Limiter) Start() (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	if len(l.script) > 0 {
+		err = l.script[0]
+		l.script = l.script[1:]
+	} else if l.reject || (l.limit > 0 && l.running >= l.limit) {
+		err = concurrentlimit.ErrLimited
+	}
+	if err != nil {
+		l.rejected++
+		return nil, err
+	}
+
+	l.started++
+	l.running++
+	if l.running > l.peak {
+		l.peak = l.running
+	}
+	id := l.started
+	ended := false
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if ended {
+			l.misuse = append(l.misuse, fmt.Sprintf("end of operation %d called more than once", id))
+			return
+		}
+		ended = true
+		if l.hold {
+			l.held++
+			return
+		}
+		l.running--
+	}, nil
+}
+
+// SetReject makes Start return ErrLimited if reject is true, as if the limiter is overloaded.
+func (l *Limiter) SetReject(reject bool) {
+	l.mu.Lock()
+	l.reject = reject
+	l.mu.Unlock()
+}
+
+// Script sets the results of the next len(results) calls to Start, which take priority over
+// SetReject and the limit. A nil result admits the operation.
+func (l *Limiter) Script(results ...error) {
+	l.mu.Lock()
+	l.script = append(l.script, results...)
+	l.mu.Unlock()
+}
+
+// Hold delays the end of operations: while hold is true, calling an end function returns
+// immediately, but the operation keeps using the limit until Release is called. This simulates
+// operations that end later than the caller, such as work that continues after a timeout.
+func (l *Limiter) Hold(hold bool) {
+	l.mu.Lock()
+	l.hold = hold
+	l.mu.Unlock()
+}
+
+// Release ends the operations delayed by Hold, and returns how many it ended.
+func (l *Limiter) Release() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := l.held
+	l.running -= l.held
+	l.held = 0
+	return count
+}
+
+// Stats returns the state of the limiter. It implements concurrentlimit.StatsReporter.
+func (l *Limiter) Stats() concurrentlimit.Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return concurrentlimit.Stats{Current: l.running, Limit: l.limit, Peak: l.peak}
+}
+
+// Counts returns the number of operations that were started and rejected.
+func (l *Limiter) Counts() (started int, rejected int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.started, l.rejected
+}
+
+// AssertBalanced reports an error to t if an operation is still running or held, or if an end
+// function was called more than once.
+func (l *Limiter) AssertBalanced(t testing.TB) {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, misuse := range l.misuse {
+		t.Error("limittest: " + misuse)
+	}
+	if l.running != 0 {
+		t.Errorf("limittest: %d operations did not end (%d held)", l.running, l.held)
+	}
+}
+
+// Clock is a concurrentlimit.Clock that only changes when Advance is called. It is safe to use
+// from multiple goroutines.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock that starts at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the clock's time. It implements concurrentlimit.Clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
@@ -0,0 +1,248 @@
+package limittest
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit"
+)
+
+// recordingTB records errors instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	errors int
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Error(args ...interface{}) {
+	r.errors++
+}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errors++
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := New(1)
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = limiter.Start()
+	if err != concurrentlimit.ErrLimited {
+		t.Fatal("expected ErrLimited at the limit:", err)
+	}
+	end()
+
+	// scripted results take priority over the limit and SetReject
+	errBackend := errors.New("backend failed")
+	limiter.Script(concurrentlimit.ErrLimited, errBackend, nil)
+	for _, expected := range []error{concurrentlimit.ErrLimited, errBackend, nil} {
+		end, err := limiter.Start()
+		if err != expected {
+			t.Fatalf("expected %v: %v", expected, err)
+		}
+		if end != nil {
+			end()
+		}
+	}
+	limiter.SetReject(true)
+	_, err = limiter.Start()
+	if err != concurrentlimit.ErrLimited {
+		t.Fatal("expected ErrLimited after SetReject(true):", err)
+	}
+	limiter.SetReject(false)
+
+	// held operations keep using the limit until they are released
+	limiter.Hold(true)
+	end, err = limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	end()
+	if _, err := limiter.Start(); err != concurrentlimit.ErrLimited {
+		t.Fatal("expected ErrLimited with a held operation:", err)
+	}
+	recorder := &recordingTB{TB: t}
+	limiter.AssertBalanced(recorder)
+	if recorder.errors != 1 {
+		t.Error("held operations must not be balanced:", recorder.errors)
+	}
+	if released := limiter.Release(); released != 1 {
+		t.Error("expected 1 released operation:", released)
+	}
+	limiter.AssertBalanced(t)
+
+	started, rejected := limiter.Counts()
+	if started != 3 || rejected != 5 {
+		t.Errorf("unexpected counts: started=%d rejected=%d", started, rejected)
+	}
+	if stats := limiter.Stats(); stats.Current != 0 || stats.Limit != 1 || stats.Peak != 1 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+
+	// calling end twice is reported
+	limiter.Hold(false)
+	end, err = limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	end()
+	end()
+	recorder = &recordingTB{TB: t}
+	limiter.AssertBalanced(recorder)
+	if recorder.errors != 1 {
+		t.Error("calling end twice must not be balanced:", recorder.errors)
+	}
+}
+
+func TestLimiterWithHandler(t *testing.T) {
+	limiter := New(0)
+	handler := concurrentlimit.Handler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	limiter.Script(concurrentlimit.ErrLimited)
+	for _, expected := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != expected {
+			t.Errorf("expected status %d: %d", expected, w.Code)
+		}
+	}
+	limiter.AssertBalanced(t)
+}
+
+func TestClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewClock(start)
+	metrics := concurrentlimit.NewMetricsLimiter(concurrentlimit.New(1))
+	metrics.SetClock(clock)
+
+	end, err := metrics.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	end()
+	if !clock.Now().Equal(start.Add(time.Minute)) {
+		t.Error("unexpected time:", clock.Now())
+	}
+	w := httptest.NewRecorder()
+	concurrentlimit.MetricsHandler(metrics).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "concurrentlimit_operation_duration_seconds_sum 60\n") {
+		t.Errorf("expected a 60 second operation:\n%s", w.Body.String())
+	}
+}
+
+func TestQueueWaitClock(t *testing.T) {
+	clock := NewClock(time.Unix(1000, 0))
+	limiter := concurrentlimit.NewQueued(1, 1)
+	waits := make(chan time.Duration, 1)
+	handler := concurrentlimit.QueuedHandler(limiter,
+		concurrentlimit.QueueOptions{MaxWait: time.Minute, ServerTiming: true, Clock: clock},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			waits <- concurrentlimit.QueueWait(r.Context())
+		}))
+
+	end, err := limiter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+	for limiter.Stats().Queued == 0 {
+		runtime.Gosched()
+	}
+	clock.Advance(5 * time.Second)
+	end()
+	<-done
+
+	if wait := <-waits; wait != 5*time.Second {
+		t.Error("expected QueueWait to use the clock:", wait)
+	}
+	if timing := w.Header().Get("Server-Timing"); timing != "queue;dur=5000.000" {
+		t.Error("unexpected Server-Timing:", timing)
+	}
+}
+
+func TestMemoryPressure(t *testing.T) {
+	pressure := &MemoryPressure{}
+	defer pressure.Release()
+
+	// concurrentlimit.MemorySignal uses the Go runtime's memory limit: set it above the current use
+	const probeLimit = 1 << 40
+	used := int64(concurrentlimit.MemorySignal(probeLimit).Value() * probeLimit)
+	previous := debug.SetMemoryLimit(used + 32<<20)
+	defer debug.SetMemoryLimit(previous)
+	composite := concurrentlimit.NewComposite(concurrentlimit.NoLimit(), concurrentlimit.AnyExceeds,
+		concurrentlimit.MemorySignal(0))
+	end, err := composite.Start()
+	if err != nil {
+		t.Fatal("expected memory under the limit to admit:", err)
+	}
+	end()
+
+	pressure.Grow(64 << 20)
+	if pressure.Held() != 64<<20 {
+		t.Errorf("expected 64 MiB held: %d", pressure.Held())
+	}
+	if _, err := composite.Start(); err != concurrentlimit.ErrLimited {
+		t.Error("expected memory over the limit to reject:", err)
+	}
+	pressure.Release()
+	end, err = composite.Start()
+	if err != nil {
+		t.Fatal("expected the released memory to admit:", err)
+	}
+	end()
+
+	// churn and GC cause garbage collections
+	stats := &runtime.MemStats{}
+	runtime.ReadMemStats(stats)
+	numGC := stats.NumGC
+	pressure.Churn(1 << 30)
+	pressure.GC(2)
+	time.Sleep(50 * time.Millisecond)
+	pressure.Churn(0)
+	runtime.ReadMemStats(stats)
+	if stats.NumGC < numGC+2 || pressure.ChurnRate() != 0 {
+		t.Errorf("expected garbage collections: %d -> %d; churn rate %d", numGC, stats.NumGC, pressure.ChurnRate())
+	}
+
+	w := httptest.NewRecorder()
+	pressure.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?grow=1024&churn=1048576", nil))
+	expected := "memory pressure HeldBytes=1024 ChurnBytesPerSecond=1048576\n"
+	if w.Body.String() != expected {
+		t.Errorf("unexpected response: %d %#v", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	pressure.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/", nil))
+	if w.Body.String() != "memory pressure HeldBytes=0 ChurnBytesPerSecond=0\n" {
+		t.Errorf("unexpected response: %d %#v", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	pressure.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?gc=1000000", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected too many collections to be rejected: %d %#v", w.Code, w.Body.String())
+	}
+
+	// rates do not overflow, and small rates allocate at least one byte
+	for bytesPerSecond, expected := range map[int64]int64{
+		1: 1, 99: 1, 100: 1, 1 << 20: (1 << 20) / 100, math.MaxInt64: math.MaxInt64 / 100,
+	} {
+		if bytes := churnBytesPerInterval(bytesPerSecond); bytes != expected {
+			t.Errorf("churnBytesPerInterval(%d)=%d; expected %d", bytesPerSecond, bytes, expected)
+		}
+	}
+}
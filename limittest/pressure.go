@@ -0,0 +1,206 @@
+package limittest
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pressureChunkBytes is the size of the allocations made by MemoryPressure, so a large heap is
+// many objects the garbage collector must scan, like a real server's heap.
+const pressureChunkBytes = 64 << 10
+
+// churnInterval is how often MemoryPressure.Churn allocates garbage.
+const churnInterval = 10 * time.Millisecond
+
+// maxGCs is the most collections Handler runs for one request, so a request cannot keep the
+// process collecting garbage for a long time.
+const maxGCs = 100
+
+// pageBytes is the smallest page size of common operating systems. Writing one byte per page
+// makes the operating system commit the memory, so it counts toward the process's resident size
+// and cgroup limits, and not only the Go runtime's statistics.
+const pageBytes = 4096
+
+// MemoryPressure creates heap growth and garbage collection pressure inside a process on demand,
+// independent of the requests it serves. Tests use it to exercise code that reacts to memory, such
+// as concurrentlimit.MemorySignal and the Go runtime's memory limit (GOMEMLIMIT or
+// debug.SetMemoryLimit), deterministically: Grow holds memory until Release, and GC and Churn make
+// the garbage collector pause and use CPU. Handler lets a demo server do the same over HTTP. The
+// zero value is ready to use, and it is safe to use from multiple goroutines.
+type MemoryPressure struct {
+	mu        sync.Mutex
+	held      [][]byte
+	heldBytes int64
+	// stopChurn stops the running Churn goroutine, or is nil if there is none
+	stopChurn chan struct{}
+	churnRate int64
+}
+
+// Grow allocates bytes of heap memory and holds it until Release is called. The memory is
+// written, so it is resident.
+func (m *MemoryPressure) Grow(bytes int64) {
+	chunks := [][]byte{}
+	for remaining := bytes; remaining > 0; remaining -= pressureChunkBytes {
+		size := int64(pressureChunkBytes)
+		if remaining < size {
+			size = remaining
+		}
+		chunk := make([]byte, size)
+		for i := 0; i < len(chunk); i += pageBytes {
+			chunk[i] = 1
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	m.mu.Lock()
+	m.held = append(m.held, chunks...)
+	m.heldBytes += bytes
+	m.mu.Unlock()
+}
+
+// Held returns the bytes held by Grow.
+func (m *MemoryPressure) Held() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.heldBytes
+}
+
+// Release frees the memory held by Grow, and returns it to the operating system so the process's
+// memory use drops immediately, instead of after the next garbage collection.
+func (m *MemoryPressure) Release() {
+	m.mu.Lock()
+	m.held = nil
+	m.heldBytes = 0
+	m.mu.Unlock()
+	debug.FreeOSMemory()
+}
+
+// GC runs n garbage collections, each of which stops the process briefly and scans the heap,
+// including the memory held by Grow.
+func (m *MemoryPressure) GC(n int) {
+	for i := 0; i < n; i++ {
+		runtime.GC()
+	}
+}
+
+// Churn allocates bytesPerSecond of garbage in a background goroutine, which makes the garbage
+// collector run more often, as a server that allocates a lot per request does. It replaces the
+// rate of a previous call. A rate <= 0 stops it.
+func (m *MemoryPressure) Churn(bytesPerSecond int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopChurn != nil {
+		close(m.stopChurn)
+		m.stopChurn = nil
+	}
+	m.churnRate = 0
+	if bytesPerSecond <= 0 {
+		return
+	}
+
+	m.churnRate = bytesPerSecond
+	m.stopChurn = make(chan struct{})
+	go churn(churnBytesPerInterval(bytesPerSecond), m.stopChurn)
+}
+
+// churnBytesPerInterval returns the bytes to allocate every churnInterval for bytesPerSecond,
+// which must be > 0. It allocates at least one byte, so small rates still churn.
+func churnBytesPerInterval(bytesPerSecond int64) int64 {
+	// divide first: multiplying by churnInterval in nanoseconds overflows for large rates
+	intervalsPerSecond := int64(time.Second / churnInterval)
+	bytes := bytesPerSecond / intervalsPerSecond
+	if bytes < 1 {
+		bytes = 1
+	}
+	return bytes
+}
+
+// ChurnRate returns the bytes per second allocated by Churn, or 0 if it is stopped.
+func (m *MemoryPressure) ChurnRate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.churnRate
+}
+
+// churnSink keeps the compiler from removing the allocations of churn, or allocating them on the
+// stack.
+var churnSink atomic.Pointer[[]byte]
+
+// churn allocates bytesPerInterval of garbage every churnInterval until stop is closed.
+func churn(bytesPerInterval int64, stop chan struct{}) {
+	ticker := time.NewTicker(churnInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for remaining := bytesPerInterval; remaining > 0; remaining -= pressureChunkBytes {
+			size := int64(pressureChunkBytes)
+			if remaining < size {
+				size = remaining
+			}
+			chunk := make([]byte, size)
+			churnSink.Store(&chunk)
+		}
+	}
+}
+
+// Handler returns an http.Handler that reports the pressure, and changes it on POST requests with
+// the form values grow (bytes to hold), gc (collections to run), and churn (bytes of garbage per
+// second), e.g. curl -d grow=104857600 -d churn=52428800. It runs at most 100 collections per
+// request. DELETE requests release the held memory
+// and stop the churn. Like concurrentlimit.AdminHandler, it should only be served on a private
+// address.
+func (m *MemoryPressure) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			values := [3]int64{}
+			for i, name := range []string{"grow", "gc", "churn"} {
+				if r.FormValue(name) == "" {
+					values[i] = -1
+					continue
+				}
+				var err error
+				values[i], err = strconv.ParseInt(r.FormValue(name), 10, 64)
+				if err != nil || values[i] < 0 {
+					http.Error(w, fmt.Sprintf("%s=%#v must be an integer >= 0", name, r.FormValue(name)),
+						http.StatusBadRequest)
+					return
+				}
+				if name == "gc" && values[i] > maxGCs {
+					http.Error(w, fmt.Sprintf("gc=%d must be <= %d", values[i], maxGCs), http.StatusBadRequest)
+					return
+				}
+			}
+			if values[0] > 0 {
+				m.Grow(values[0])
+			}
+			if values[2] >= 0 {
+				m.Churn(values[2])
+			}
+			if values[1] > 0 {
+				m.GC(int(values[1]))
+			}
+		case http.MethodDelete:
+			m.Churn(0)
+			m.Release()
+		default:
+			http.Error(w, "only GET, POST, and DELETE are supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		fmt.Fprintf(w, "memory pressure HeldBytes=%d ChurnBytesPerSecond=%d\n", m.Held(), m.ChurnRate())
+	})
+}
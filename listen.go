@@ -0,0 +1,129 @@
+package concurrentlimit
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/netutil"
+)
+
+// ListenOptions configures the connections accepted by ListenWithOptions and LimitListener.
+type ListenOptions struct {
+	// ConnectionLimit is the maximum number of concurrent connections, or 0 for no limit.
+	ConnectionLimit int
+	// ReadDeadline is the maximum time after a connection is accepted that it can read, or 0 for
+	// no limit. Reads after this fail with a timeout error, even if the connection's owner sets a
+	// later deadline. This protects servers from clients that send slowly to keep connections
+	// open (slowloris), including servers that are not http.Server, which has its own timeouts.
+	ReadDeadline time.Duration
+	// WriteDeadline is the maximum time after a connection is accepted that it can write, or 0 for
+	// no limit. This protects servers from clients that read slowly.
+	WriteDeadline time.Duration
+	// Bandwidth limits the bytes connections read and write, or is nil for no limit. The same
+	// BandwidthLimiter can be shared by several listeners to limit their total bandwidth.
+	Bandwidth *BandwidthLimiter
+	// Name registers the listener with RegisterListener, so ListenerStats reports its
+	// connections, or is empty to not register it. Names must be unique among open listeners.
+	Name string
+}
+
+// ListenWithOptions is a version of Listen that configures the accepted connections with
+// options.
+func ListenWithOptions(network string, address string, options ListenOptions) (net.Listener, error) {
+	unlimitedListener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return LimitListener(unlimitedListener, options), nil
+}
+
+// LimitListener returns a listener that configures the connections accepted from listener with
+// options.
+func LimitListener(listener net.Listener, options ListenOptions) net.Listener {
+	if options.ReadDeadline > 0 || options.WriteDeadline > 0 {
+		listener = &deadlineListener{listener, options.ReadDeadline, options.WriteDeadline}
+	}
+	if options.Bandwidth != nil {
+		listener = &bandwidthListener{listener, options.Bandwidth}
+	}
+	if options.ConnectionLimit > 0 {
+		listener = netutil.LimitListener(listener, options.ConnectionLimit)
+	}
+	if options.Name != "" {
+		listener = RegisterListener(options.Name, listener, options.ConnectionLimit)
+	}
+	return listener
+}
+
+type bandwidthListener struct {
+	net.Listener
+	limiter *BandwidthLimiter
+}
+
+func (l *bandwidthListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.limiter.Conn(conn), nil
+}
+
+type deadlineListener struct {
+	net.Listener
+	readDeadline  time.Duration
+	writeDeadline time.Duration
+}
+
+func (l *deadlineListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	deadlineConn := &deadlineConn{Conn: conn}
+	if l.readDeadline > 0 {
+		deadlineConn.readDeadline = now.Add(l.readDeadline)
+	}
+	if l.writeDeadline > 0 {
+		deadlineConn.writeDeadline = now.Add(l.writeDeadline)
+	}
+	err = deadlineConn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return deadlineConn, nil
+}
+
+// deadlineConn is a net.Conn that can only set deadlines earlier than its absolute deadlines.
+// The zero time means no absolute deadline.
+type deadlineConn struct {
+	net.Conn
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(earliestDeadline(t, c.readDeadline))
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(earliestDeadline(t, c.writeDeadline))
+}
+
+// earliestDeadline returns the earliest of two deadlines, where the zero time means no deadline.
+func earliestDeadline(t time.Time, limit time.Time) time.Time {
+	if limit.IsZero() || (!t.IsZero() && t.Before(limit)) {
+		return t
+	}
+	return limit
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// autoscaleMaxRejected is the fraction of an interval's requests that can be rate limited or fail
+// before the autoscaler considers the server over capacity. Rejected requests are fast, so they
+// do not increase the latency of the requests that succeed.
+const autoscaleMaxRejected = 0.01
+
+// autoscaler adjusts the number of closed-loop client goroutines after each interval to hold the
+// p99 latency at a target, to find the concurrency a server can sustain. It increases the
+// goroutines by 10% (at least one) after each interval that meets the target, and decreases them
+// by 25% after each interval that does not. It is not safe for concurrent use.
+type autoscaler struct {
+	target time.Duration
+	max    int
+	// start starts a goroutine that runs until stop is closed
+	start func(stop <-chan struct{})
+	stops []chan struct{}
+	// sustainable is the highest concurrency of an interval that met the target
+	sustainable int
+}
+
+// newAutoscaler starts initial goroutines with start, and returns an autoscaler that adjusts them
+// between 1 and max to hold the p99 latency at target.
+func newAutoscaler(target time.Duration, initial int, max int, start func(stop <-chan struct{})) *autoscaler {
+	a := &autoscaler{target: target, max: max, start: start}
+	a.scale(initial)
+	return a
+}
+
+// concurrency returns the number of running goroutines.
+func (a *autoscaler) concurrency() int {
+	return len(a.stops)
+}
+
+// scale starts or stops goroutines so n are running.
+func (a *autoscaler) scale(n int) {
+	for len(a.stops) < n {
+		stop := make(chan struct{})
+		a.stops = append(a.stops, stop)
+		a.start(stop)
+	}
+	for len(a.stops) > n {
+		close(a.stops[len(a.stops)-1])
+		a.stops = a.stops[:len(a.stops)-1]
+	}
+}
+
+// endInterval adjusts the goroutines based on the results of the interval that just ended.
+func (a *autoscaler) endInterval(interval *intervalResults) {
+	concurrency := a.concurrency()
+	counts := countStatuses(interval.statuses)
+	p99 := interval.latencies.percentile(99)
+	rejected := 0.0
+	if counts.total() > 0 {
+		rejected = float64(counts.rateLimited+counts.timeouts+counts.errors) / float64(counts.total())
+	}
+
+	next := concurrency
+	if interval.latencies.count > 0 && p99 <= a.target && rejected <= autoscaleMaxRejected {
+		if concurrency > a.sustainable {
+			a.sustainable = concurrency
+		}
+		next += concurrency / 10
+		if next == concurrency {
+			next++
+		}
+		if next > a.max {
+			next = a.max
+		}
+	} else {
+		next -= concurrency / 4
+		if next == concurrency && next > 1 {
+			next--
+		}
+	}
+	if next != concurrency {
+		log.Printf("autoscale: p99=%s rejected=%.4f with %d goroutines; changing to %d",
+			roundDuration(p99), rejected, concurrency, next)
+		a.scale(next)
+	}
+}
+
+// stop stops all goroutines.
+func (a *autoscaler) stop() {
+	a.scale(0)
+}
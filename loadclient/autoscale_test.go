@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoscaler(t *testing.T) {
+	running := 0
+	a := newAutoscaler(100*time.Millisecond, 10, 12, func(stop <-chan struct{}) {
+		running++
+		go func() {
+			<-stop
+		}()
+	})
+	if a.concurrency() != 10 || running != 10 {
+		t.Fatalf("concurrency=%d running=%d; expected 10", a.concurrency(), running)
+	}
+
+	interval := func(latency time.Duration, statuses ...string) *intervalResults {
+		i := &intervalResults{statuses: map[string]uint64{}}
+		for _, status := range statuses {
+			i.statuses[status]++
+			if !isError(status) && !isRateLimited(status) {
+				i.latencies.record(latency)
+			}
+		}
+		return i
+	}
+
+	// meeting the target increases by 10%, up to the maximum
+	a.endInterval(interval(10*time.Millisecond, statusOK))
+	if a.concurrency() != 11 || a.sustainable != 10 {
+		t.Errorf("concurrency=%d sustainable=%d", a.concurrency(), a.sustainable)
+	}
+	a.endInterval(interval(10*time.Millisecond, statusOK))
+	a.endInterval(interval(10*time.Millisecond, statusOK))
+	if a.concurrency() != 12 || a.sustainable != 12 {
+		t.Errorf("concurrency=%d sustainable=%d", a.concurrency(), a.sustainable)
+	}
+
+	// missing the target decreases by 25%
+	a.endInterval(interval(time.Second, statusOK))
+	if a.concurrency() != 9 || a.sustainable != 12 {
+		t.Errorf("concurrency=%d sustainable=%d", a.concurrency(), a.sustainable)
+	}
+
+	// rate limited requests are fast, but mean the server is over capacity
+	a.endInterval(interval(time.Millisecond, statusOK, statusRateLimited))
+	if a.concurrency() != 7 {
+		t.Errorf("concurrency=%d", a.concurrency())
+	}
+
+	// an interval without responses is over capacity, but at least one goroutine keeps running
+	for i := 0; i < 10; i++ {
+		a.endInterval(interval(0))
+	}
+	if a.concurrency() != 1 {
+		t.Errorf("concurrency=%d", a.concurrency())
+	}
+
+	a.stop()
+	if a.concurrency() != 0 {
+		t.Errorf("concurrency=%d", a.concurrency())
+	}
+}
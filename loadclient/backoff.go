@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially increasing delays with "full jitter": each delay is random
+// between zero and the current maximum, which doubles after each failure. Jitter prevents clients
+// that failed at the same time from retrying at the same time. See
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+// It is not safe for concurrent use: each goroutine should have its own backoff.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+	rand    *rand.Rand
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{
+		initial: initial,
+		max:     max,
+		current: initial,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the delay before retrying after a failure.
+func (b *backoff) next() time.Duration {
+	if b.current <= 0 {
+		return 0
+	}
+	delay := time.Duration(b.rand.Int63n(int64(b.current)) + 1)
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return delay
+}
+
+// reset is called after a success, so the next failure uses the initial delay.
+func (b *backoff) reset() {
+	b.current = b.initial
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(100*time.Millisecond, time.Second)
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		delay := b.next()
+		if !(0 < delay && delay <= max*time.Millisecond) {
+			t.Errorf("attempt %d: delay=%s; expected <= %dms", i, delay, max)
+		}
+	}
+	b.reset()
+	if delay := b.next(); delay > 100*time.Millisecond {
+		t.Error("reset must restart from the initial delay:", delay)
+	}
+
+	if delay := newBackoff(0, time.Second).next(); delay != 0 {
+		t.Error("zero initial delay must not wait:", delay)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+)
+
+// comparisonTargets returns a copy of config for each of its two targets, so the same load can be
+// sent to both.
+func comparisonTargets(config *runConfig) ([]*runConfig, error) {
+	var targets stringList
+	isHTTP := len(config.httpTargets) > 0
+	if isHTTP {
+		targets = config.httpTargets
+	} else {
+		targets = config.grpcTargets
+	}
+	if len(targets) != 2 {
+		return nil, fmt.Errorf("--compare requires exactly 2 targets; got %d", len(targets))
+	}
+
+	configs := make([]*runConfig, len(targets))
+	for i, target := range targets {
+		copied := *config
+		if isHTTP {
+			copied.httpTargets = stringList{target}
+		} else {
+			copied.grpcTargets = stringList{target}
+		}
+		configs[i] = &copied
+	}
+	return configs, nil
+}
+
+// runComparison sends identical load to each of the two targets in config at the same time, and
+// returns the results for each target.
+func runComparison(ctx context.Context, config *runConfig) ([]*results, error) {
+	configs, err := comparisonTargets(config)
+	if err != nil {
+		return nil, err
+	}
+
+	allResults := make([]*results, len(configs))
+	errs := make([]error, len(configs))
+	var wg sync.WaitGroup
+	for i, config := range configs {
+		wg.Add(1)
+		go func(i int, config *runConfig) {
+			defer wg.Done()
+			allResults[i], errs[i] = run(ctx, config)
+		}(i, config)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return allResults, nil
+}
+
+// writeComparison writes a table comparing the results for each of names to w.
+func writeComparison(w io.Writer, names []string, allResults []*results) error {
+	rows := []struct {
+		name  string
+		value func(r *results) string
+	}{
+		{"requests/sec", func(r *results) string {
+			return fmt.Sprintf("%.1f", float64(r.latencies.count)/r.end.Sub(r.start).Seconds())
+		}},
+		{"ok", func(r *results) string { return fmt.Sprint(countStatuses(r.statuses).ok) }},
+		{"rate_limited", func(r *results) string { return fmt.Sprint(countStatuses(r.statuses).rateLimited) }},
+		{"timeouts", func(r *results) string { return fmt.Sprint(countStatuses(r.statuses).timeouts) }},
+		{"errors", func(r *results) string { return fmt.Sprint(countStatuses(r.statuses).errors) }},
+		{"error_rate", func(r *results) string { return fmt.Sprintf("%.4f", countStatuses(r.statuses).errorRate()) }},
+		{"p50", func(r *results) string { return roundDuration(r.latencies.percentile(50)).String() }},
+		{"p90", func(r *results) string { return roundDuration(r.latencies.percentile(90)).String() }},
+		{"p99", func(r *results) string { return roundDuration(r.latencies.percentile(99)).String() }},
+		{"p99.9", func(r *results) string { return roundDuration(r.latencies.percentile(99.9)).String() }},
+		{"max", func(r *results) string { return roundDuration(r.latencies.max).String() }},
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "\t")
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t", name)
+	}
+	fmt.Fprintln(tw)
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t", row.name)
+		for _, r := range allResults {
+			fmt.Fprintf(tw, "%s\t", row.value(r))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComparisonTargets(t *testing.T) {
+	config := &runConfig{httpTargets: stringList{"http://a/", "http://b/"}, concurrent: 3}
+	configs, err := comparisonTargets(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || configs[1].httpTargets.String() != "http://b/" || configs[1].concurrent != 3 {
+		t.Errorf("unexpected configs: %#v", configs)
+	}
+	if config.httpTargets.String() != "http://a/,http://b/" {
+		t.Error("must not modify the original config:", config.httpTargets)
+	}
+
+	_, err = comparisonTargets(&runConfig{grpcTargets: stringList{"localhost:1"}})
+	if err == nil {
+		t.Error("expected error with one target")
+	}
+}
+
+func TestWriteComparison(t *testing.T) {
+	start := time.Now()
+	limited := newResults(start, 0)
+	limited.record(statusHTTPOK, 10*time.Millisecond)
+	limited.recordFailure(statusHTTPRateLimited, errRetry)
+	limited.end = start.Add(time.Second)
+	unlimited := newResults(start, 0)
+	unlimited.record(statusHTTPOK, time.Second)
+	unlimited.record(statusHTTPOK, time.Second)
+	unlimited.end = start.Add(time.Second)
+
+	out := &strings.Builder{}
+	err := writeComparison(out, []string{"limited", "unlimited"}, []*results{limited, unlimited})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	for _, expected := range []string{
+		"              limited  unlimited",
+		"requests/sec  1.0      2.0",
+		"rate_limited  1        0",
+		"p50           10ms     1s",
+	} {
+		found := false
+		for _, line := range lines {
+			if strings.TrimRight(line, " ") == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing line %#v in output:\n%s", expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+)
+
+// grpcOptions configures grpcSender.
+type grpcOptions struct {
+	// timeout is the maximum time for each request if > 0
+	timeout time.Duration
+	// md is sent with each request
+	md metadata.MD
+	// stream sends requests with the SleepStream streaming RPC
+	stream bool
+	// keepalive configures client keepalive pings if keepalive.Time > 0
+	keepalive keepalive.ClientParameters
+	// maxIdle closes connections that have no requests for this long if > 0. The next request
+	// dials a new connection.
+	maxIdle time.Duration
+	// maxStreams limits the concurrent requests on each connection if > 0. Additional requests
+	// wait, like a server's MaxConcurrentStreams, and the wait counts as latency.
+	maxStreams int
+}
+
+// dialOptions returns the options to dial a connection.
+func (o *grpcOptions) dialOptions() []grpc.DialOption {
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	}
+	if o.keepalive.Time > 0 {
+		options = append(options, grpc.WithKeepaliveParams(o.keepalive))
+	}
+	return options
+}
+
+// grpcConn is a connection, which is shared by the clones of a grpcSender after it is dialed. It
+// redials the connection if it was closed after being idle for grpcOptions.maxIdle.
+type grpcConn struct {
+	addr    string
+	options *grpcOptions
+	// streams has one entry for each running request if options.maxStreams > 0
+	streams chan struct{}
+
+	mu     sync.Mutex
+	conn   *grpc.ClientConn
+	client sleepymemory.SleeperClient
+	active int
+	// idleTimer closes conn after options.maxIdle with no active requests
+	idleTimer *time.Timer
+}
+
+func newGRPCConn(addr string, options *grpcOptions) *grpcConn {
+	c := &grpcConn{addr: addr, options: options}
+	if options.maxStreams > 0 {
+		c.streams = make(chan struct{}, options.maxStreams)
+	}
+	return c
+}
+
+// acquire waits for a stream if the streams are limited, then returns a client, dialing it if
+// needed. The caller must call release when the request completes, unless acquire fails.
+func (c *grpcConn) acquire() (sleepymemory.SleeperClient, error) {
+	if c.streams != nil {
+		c.streams <- struct{}{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	if c.conn == nil {
+		dialCtx, cancel := context.WithTimeout(context.Background(), grpcConnectTimeout)
+		conn, err := grpc.DialContext(dialCtx, c.addr, c.options.dialOptions()...)
+		cancel()
+		if err != nil {
+			if c.streams != nil {
+				<-c.streams
+			}
+			return nil, err
+		}
+		c.conn = conn
+		c.client = sleepymemory.NewSleeperClient(conn)
+	}
+	c.active++
+	return c.client, nil
+}
+
+// release ends a request started with acquire.
+func (c *grpcConn) release() {
+	c.mu.Lock()
+	c.active--
+	if c.active == 0 && c.options.maxIdle > 0 {
+		c.idleTimer = time.AfterFunc(c.options.maxIdle, c.closeIfIdle)
+	}
+	c.mu.Unlock()
+
+	if c.streams != nil {
+		<-c.streams
+	}
+}
+
+// closeIfIdle closes the connection if it has no active requests.
+func (c *grpcConn) closeIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active == 0 && c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.client = nil
+	}
+}
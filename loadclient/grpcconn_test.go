@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+// peakSleeper sleeps for the requested duration and records the peak concurrent requests.
+type peakSleeper struct {
+	sleepymemory.UnimplementedSleeperServer
+	mu      sync.Mutex
+	current int
+	peak    int
+}
+
+func (p *peakSleeper) Sleep(ctx context.Context, req *sleepymemory.SleepRequest) (*sleepymemory.SleepResponse, error) {
+	p.mu.Lock()
+	p.current++
+	if p.current > p.peak {
+		p.peak = p.current
+	}
+	p.mu.Unlock()
+
+	time.Sleep(req.SleepDuration.AsDuration())
+
+	p.mu.Lock()
+	p.current--
+	p.mu.Unlock()
+	return &sleepymemory.SleepResponse{}, nil
+}
+
+// connCounter counts the connections accepted by a gRPC server.
+type connCounter struct {
+	conns atomic.Int64
+}
+
+func (c *connCounter) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (c *connCounter) HandleRPC(ctx context.Context, s stats.RPCStats) {}
+
+func (c *connCounter) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	c.conns.Add(1)
+	return ctx
+}
+
+func (c *connCounter) HandleConn(ctx context.Context, s stats.ConnStats) {}
+
+func TestGRPCConnOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grpc.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleeper := &peakSleeper{}
+	counter := &connCounter{}
+	server := grpc.NewServer(grpc.StatsHandler(counter))
+	sleepymemory.RegisterSleeperServer(server, sleeper)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	// clones of a used sender share its connection and its stream limit
+	sender := newGRPCSender("unix://"+path, grpcOptions{maxStreams: 1, maxIdle: 50 * time.Millisecond})
+	req := &sleepymemory.SleepRequest{SleepDuration: sleepymemory.Duration(20 * time.Millisecond)}
+	_, err = sender.send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(clone requestSender) {
+			defer wg.Done()
+			status, err := clone.send(req)
+			if err != nil || status != statusOK {
+				t.Errorf("status=%s err=%v", status, err)
+			}
+		}(sender.clone())
+	}
+	wg.Wait()
+	if sleeper.peak != 1 {
+		t.Errorf("--grpcMaxStreams=1 must limit concurrent requests: peak=%d", sleeper.peak)
+	}
+	if counter.conns.Load() != 1 {
+		t.Errorf("clones must share one connection: conns=%d", counter.conns.Load())
+	}
+
+	// the idle connection is closed, and the next request dials a new one
+	time.Sleep(100 * time.Millisecond)
+	sender.conn.mu.Lock()
+	closed := sender.conn.conn == nil
+	sender.conn.mu.Unlock()
+	if !closed {
+		t.Error("the idle connection must be closed")
+	}
+	_, err = sender.send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter.conns.Load() != 2 {
+		t.Errorf("expected a new connection after --grpcMaxIdle: conns=%d", counter.conns.Load())
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// heapProfileTimeout is the maximum time to wait for a heap profile.
+const heapProfileTimeout = 10 * time.Second
+
+// Points in a run that heap profiles can be captured at, in addition to times since the start.
+const (
+	heapProfilePeak = "peak"
+	heapProfileEnd  = "end"
+)
+
+// heapProfiler saves the target server's heap profile at points during a run, so the memory
+// used at peak load can be examined with go tool pprof. It is not safe for concurrent use.
+type heapProfiler struct {
+	url string
+	// prefix is the start of the path of each profile
+	prefix string
+	// peak captures a profile after each interval with the highest request rate so far
+	peak bool
+	// end captures a profile when the run ends, before waiting for requests to complete
+	end bool
+	// offsets captures profiles at these times since the start, in increasing order
+	offsets []time.Duration
+
+	client   *http.Client
+	start    time.Time
+	next     int
+	peakRate float64
+}
+
+// newHeapProfiler returns a heapProfiler that fetches profiles from url at the comma-separated
+// points: peak, end, or durations since the start. Profiles are saved next to output if it is
+// set, otherwise in the current directory.
+func newHeapProfiler(url string, points string, output string) (*heapProfiler, error) {
+	h := &heapProfiler{url: url, client: &http.Client{Timeout: heapProfileTimeout}}
+	if output != "" {
+		h.prefix = strings.TrimSuffix(output, filepath.Ext(output)) + "-"
+	}
+	for _, point := range strings.Split(points, ",") {
+		point = strings.TrimSpace(point)
+		switch point {
+		case heapProfilePeak:
+			h.peak = true
+		case heapProfileEnd:
+			h.end = true
+		default:
+			offset, err := time.ParseDuration(point)
+			if err != nil || offset <= 0 {
+				return nil, fmt.Errorf("invalid heap profile point %#v: must be peak, end, or a duration > 0", point)
+			}
+			h.offsets = append(h.offsets, offset)
+		}
+	}
+	sort.Slice(h.offsets, func(i int, j int) bool {
+		return h.offsets[i] < h.offsets[j]
+	})
+	return h, nil
+}
+
+// path returns the path of the profile captured at point.
+func (h *heapProfiler) path(point string) string {
+	return h.prefix + "heap-" + point + ".pb.gz"
+}
+
+// begin starts a run at start. It returns a channel that receives when the next offset profile
+// should be captured, or nil if there are none.
+func (h *heapProfiler) begin(start time.Time) <-chan time.Time {
+	h.start = start
+	return h.nextOffset()
+}
+
+func (h *heapProfiler) nextOffset() <-chan time.Time {
+	if h.next >= len(h.offsets) {
+		return nil
+	}
+	return time.After(time.Until(h.start.Add(h.offsets[h.next])))
+}
+
+// captureOffset captures the profile for the next offset, and returns the channel for the one
+// after it, like begin.
+func (h *heapProfiler) captureOffset() <-chan time.Time {
+	h.capture(h.offsets[h.next].String())
+	h.next++
+	return h.nextOffset()
+}
+
+// endInterval captures the peak profile if interval had the highest request rate so far.
+func (h *heapProfiler) endInterval(interval *intervalResults) {
+	if !h.peak {
+		return
+	}
+	rate := float64(interval.latencies.count) / interval.end.Sub(interval.start).Seconds()
+	if rate > h.peakRate {
+		h.peakRate = rate
+		h.capture(heapProfilePeak)
+	}
+}
+
+// endRun captures the end profile.
+func (h *heapProfiler) endRun() {
+	if h.end {
+		h.capture(heapProfileEnd)
+	}
+}
+
+// capture saves the heap profile for point. Errors are logged, since the server may be too
+// overloaded to respond, and the run should continue.
+func (h *heapProfiler) capture(point string) {
+	path := h.path(point)
+	err := h.save(path)
+	if err != nil {
+		log.Printf("failed to capture %s heap profile: %s", point, err.Error())
+		return
+	}
+	log.Printf("saved %s heap profile to %s", point, path)
+}
+
+func (h *heapProfiler) save(path string) error {
+	resp, err := h.client.Get(h.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("expected status ok from %s: %s", h.url, resp.Status)
+	}
+
+	// write to a temporary file so a failure does not replace an earlier peak profile
+	tempPath := path + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeapProfiler(t *testing.T) {
+	var profiles atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("profile " + strconv.FormatInt(profiles.Add(1), 10)))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	h, err := newHeapProfiler(server.URL, "end, 20ms,peak,10ms", filepath.Join(dir, "results.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.peak || !h.end || len(h.offsets) != 2 || h.offsets[0] != 10*time.Millisecond {
+		t.Fatalf("unexpected profiler: %#v", h)
+	}
+	if h.path("peak") != filepath.Join(dir, "results-heap-peak.pb.gz") {
+		t.Errorf("unexpected path: %s", h.path("peak"))
+	}
+
+	// offsets are captured in order
+	offset := h.begin(time.Now())
+	for offset != nil {
+		<-offset
+		offset = h.captureOffset()
+	}
+	for i, name := range []string{"results-heap-10ms.pb.gz", "results-heap-20ms.pb.gz"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != "profile "+strconv.Itoa(i+1) {
+			t.Errorf("%s: %#v %v", name, string(data), err)
+		}
+	}
+
+	// the peak profile is replaced only by intervals with a higher rate
+	start := time.Now()
+	for _, count := range []int{10, 20, 5} {
+		interval := &intervalResults{start: start, end: start.Add(time.Second)}
+		for i := 0; i < count; i++ {
+			interval.latencies.record(time.Millisecond)
+		}
+		h.endInterval(interval)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "results-heap-peak.pb.gz"))
+	if err != nil || string(data) != "profile 4" {
+		t.Errorf("peak: %#v %v", string(data), err)
+	}
+	h.endRun()
+	data, err = os.ReadFile(filepath.Join(dir, "results-heap-end.pb.gz"))
+	if err != nil || string(data) != "profile 5" {
+		t.Errorf("end: %#v %v", string(data), err)
+	}
+
+	for _, invalid := range []string{"", "start", "-1s"} {
+		_, err := newHeapProfiler(server.URL, invalid, "")
+		if err == nil {
+			t.Errorf("newHeapProfiler(%#v) must fail", invalid)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// subBucketBits is the number of bits of precision recorded by latencyHistogram. Values are
+// recorded with a relative error of at most 1/2^(subBucketBits-1), about 3%.
+const subBucketBits = 6
+const subBucketCount = 1 << subBucketBits
+const subBucketHalf = subBucketCount / 2
+
+// latencyHistogram records durations in log-linear buckets, similar to HdrHistogram: each power
+// of two is divided into a fixed number of linear buckets. This uses a small amount of memory
+// while recording precise percentiles. It is not safe for concurrent use.
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// bucketIndex returns the index of the bucket containing value.
+func bucketIndex(value uint64) int {
+	if value < subBucketCount {
+		return int(value)
+	}
+	shift := bits.Len64(value) - subBucketBits
+	sub := value >> shift
+	return subBucketCount + (shift-1)*subBucketHalf + int(sub-subBucketHalf)
+}
+
+// bucketHighest returns the largest value recorded in the bucket at index.
+func bucketHighest(index int) uint64 {
+	if index < subBucketCount {
+		return uint64(index)
+	}
+	shift := (index-subBucketCount)/subBucketHalf + 1
+	sub := uint64((index-subBucketCount)%subBucketHalf + subBucketHalf)
+	return (sub+1)<<shift - 1
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	index := bucketIndex(uint64(d))
+	if index >= len(h.counts) {
+		grown := make([]uint64, index+1)
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	h.counts[index]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// merge adds all values recorded in other to h.
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	if len(other.counts) > len(h.counts) {
+		grown := make([]uint64, len(other.counts))
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+	h.count += other.count
+	h.sum += other.sum
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// percentile returns the value that is larger than or equal to percent of the recorded values.
+func (h *latencyHistogram) percentile(percent float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(percent / 100 * float64(h.count)))
+	if target == 0 {
+		target = 1
+	}
+
+	cumulative := uint64(0)
+	for i, count := range h.counts {
+		cumulative += count
+		if cumulative >= target {
+			value := time.Duration(bucketHighest(i))
+			if value > h.max {
+				value = h.max
+			}
+			return value
+		}
+	}
+	return h.max
+}
+
+func (h *latencyHistogram) mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// String returns a summary of the latency distribution.
+func (h *latencyHistogram) String() string {
+	return fmt.Sprintf("mean=%s p50=%s p90=%s p99=%s p99.9=%s max=%s",
+		roundDuration(h.mean()), roundDuration(h.percentile(50)), roundDuration(h.percentile(90)),
+		roundDuration(h.percentile(99)), roundDuration(h.percentile(99.9)), roundDuration(h.max))
+}
+
+// roundDuration rounds d to 3 significant digits to make it easier to read.
+func roundDuration(d time.Duration) time.Duration {
+	precision := time.Duration(1)
+	for d/precision >= 1000 {
+		precision *= 10
+	}
+	return d.Round(precision)
+}
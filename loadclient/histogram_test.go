@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketIndex(t *testing.T) {
+	// every value must be in a bucket whose highest value is >= value, within the relative error
+	for _, value := range []uint64{0, 1, 63, 64, 65, 127, 128, 1000, 123456789, 1 << 40} {
+		index := bucketIndex(value)
+		highest := bucketHighest(index)
+		if highest < value || float64(highest-value) > float64(value)/subBucketHalf {
+			t.Errorf("value=%d index=%d highest=%d", value, index, highest)
+		}
+		if index > 0 && bucketHighest(index-1) >= value {
+			t.Errorf("value=%d index=%d: previous bucket contains value", value, index)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := &latencyHistogram{}
+	if h.percentile(99) != 0 {
+		t.Error("empty histogram must return 0")
+	}
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+
+	other := &latencyHistogram{}
+	other.record(time.Hour)
+	h.merge(other)
+
+	if h.count != 1001 || h.max != time.Hour {
+		t.Errorf("count=%d max=%s", h.count, h.max)
+	}
+	for _, test := range []struct {
+		percent  float64
+		expected time.Duration
+	}{
+		{50, 501 * time.Millisecond},
+		{99, 991 * time.Millisecond},
+		{100, time.Hour},
+	} {
+		value := h.percentile(test.percent)
+		delta := value - test.expected
+		if delta < 0 || delta > test.expected/subBucketHalf {
+			t.Errorf("percentile(%f)=%s; expected about %s", test.percent, value, test.expected)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// htmlChart is one line chart of an HTML report, with a value for each interval in each series.
+type htmlChart struct {
+	Title string `json:"title"`
+	// X is the start of each interval in seconds
+	X      []float64    `json:"x"`
+	Series []htmlSeries `json:"series"`
+}
+
+type htmlSeries struct {
+	Name   string    `json:"name"`
+	Values []float64 `json:"values"`
+}
+
+// htmlCharts returns the charts for report's intervals: throughput, latency, the fraction of
+// requests that were rate limited or failed, and the server's memory if it was recorded.
+func htmlCharts(report *runReport) []htmlChart {
+	x := make([]float64, len(report.Intervals))
+	series := func(name string, value func(interval *intervalReport) float64) htmlSeries {
+		values := make([]float64, len(report.Intervals))
+		for i := range report.Intervals {
+			values[i] = value(&report.Intervals[i])
+		}
+		return htmlSeries{name, values}
+	}
+	for i, interval := range report.Intervals {
+		x[i] = interval.StartSeconds
+	}
+	fraction := func(count func(counts statusCounts) uint64) func(interval *intervalReport) float64 {
+		return func(interval *intervalReport) float64 {
+			counts := countStatuses(interval.Statuses)
+			if counts.total() == 0 {
+				return 0
+			}
+			return float64(count(counts)) / float64(counts.total())
+		}
+	}
+
+	charts := []htmlChart{
+		{"Requests/sec", x, []htmlSeries{
+			series("requests/sec", func(i *intervalReport) float64 { return i.RequestsPerSecond }),
+		}},
+		{"Latency (ms)", x, []htmlSeries{
+			series("p50", func(i *intervalReport) float64 { return i.Latency.P50MS }),
+			series("p90", func(i *intervalReport) float64 { return i.Latency.P90MS }),
+			series("p99", func(i *intervalReport) float64 { return i.Latency.P99MS }),
+		}},
+		{"Fraction of requests", x, []htmlSeries{
+			series("rate_limited", fraction(func(c statusCounts) uint64 { return c.rateLimited })),
+			series("timeouts", fraction(func(c statusCounts) uint64 { return c.timeouts })),
+			series("errors", fraction(func(c statusCounts) uint64 { return c.errors })),
+		}},
+	}
+	if report.MaxServerSysBytes > 0 {
+		mebibytes := func(bytes uint64) float64 { return float64(bytes) / (1 << 20) }
+		charts = append(charts, htmlChart{"Server memory (MiB)", x, []htmlSeries{
+			series("heap_alloc", func(i *intervalReport) float64 { return mebibytes(i.MaxServerHeapAllocBytes) }),
+			series("sys", func(i *intervalReport) float64 { return mebibytes(i.MaxServerSysBytes) }),
+		}})
+	}
+	return charts
+}
+
+// htmlReportRow is a row in the summary table of an HTML report.
+type htmlReportRow struct {
+	Name  string
+	Value string
+}
+
+// writeHTMLReport writes report as a self-contained HTML page, which draws its charts with
+// embedded JavaScript, so it can be shared without other files or network access.
+func writeHTMLReport(w io.Writer, report *runReport) error {
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', 3, 64)
+	}
+	counts := statusCounts{report.OK, report.RateLimited, report.Timeouts, report.Errors}
+	summary := []htmlReportRow{
+		{"start", report.Start.Format("2006-01-02 15:04:05 MST")},
+		{"duration_seconds", formatFloat(report.DurationSeconds)},
+		{"requests", strconv.FormatUint(report.Requests, 10)},
+		{"requests_per_second", formatFloat(report.RequestsPerSecond)},
+		{"statuses", counts.String()},
+		{"mean_ms", formatFloat(report.Latency.MeanMS)},
+		{"p50_ms", formatFloat(report.Latency.P50MS)},
+		{"p90_ms", formatFloat(report.Latency.P90MS)},
+		{"p99_ms", formatFloat(report.Latency.P99MS)},
+		{"p999_ms", formatFloat(report.Latency.P999MS)},
+		{"max_ms", formatFloat(report.Latency.MaxMS)},
+	}
+	if report.MaxServerSysBytes > 0 {
+		summary = append(summary,
+			htmlReportRow{"max_server_heap_alloc", mebibytes(report.MaxServerHeapAllocBytes)},
+			htmlReportRow{"max_server_sys", mebibytes(report.MaxServerSysBytes)})
+	}
+
+	var config []htmlReportRow
+	for name, value := range report.Config {
+		config = append(config, htmlReportRow{name, value})
+	}
+	sort.Slice(config, func(i int, j int) bool {
+		return config[i].Name < config[j].Name
+	})
+
+	return htmlReportTemplate.Execute(w, map[string]interface{}{
+		"Summary": summary,
+		"Config":  config,
+		"Charts":  htmlCharts(report),
+	})
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>loadclient results</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td { border: 1px solid #ccc; padding: 0.2em 0.6em; font-family: monospace; }
+canvas { display: block; margin-bottom: 2em; }
+</style></head>
+<body>
+<h1>loadclient results</h1>
+<table>{{range .Summary}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>{{end}}</table>
+<div id="charts"></div>
+<details><summary>Flags</summary>
+<table>{{range .Config}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>{{end}}</table>
+</details>
+<script>
+const charts = {{.Charts}};
+const colors = ["#1f77b4", "#ff7f0e", "#2ca02c", "#d62728"];
+const width = 900, height = 300, left = 70, right = 20, top = 40, bottom = 40;
+
+for (const chart of charts) {
+  const canvas = document.createElement("canvas");
+  canvas.width = width;
+  canvas.height = height;
+  document.getElementById("charts").appendChild(canvas);
+  const ctx = canvas.getContext("2d");
+  ctx.font = "12px sans-serif";
+  ctx.fillText(chart.title, left, 20);
+
+  const xMax = Math.max(1, ...chart.x);
+  let yMax = 0;
+  for (const s of chart.series) {
+    yMax = Math.max(yMax, ...s.values);
+  }
+  if (yMax === 0) {
+    yMax = 1;
+  }
+  const px = (x) => left + (x / xMax) * (width - left - right);
+  const py = (y) => height - bottom - (y / yMax) * (height - top - bottom);
+
+  // axes with a few labelled ticks
+  ctx.strokeStyle = "#999";
+  ctx.beginPath();
+  ctx.moveTo(left, top);
+  ctx.lineTo(left, height - bottom);
+  ctx.lineTo(width - right, height - bottom);
+  ctx.stroke();
+  for (let i = 0; i <= 4; i++) {
+    const y = (yMax * i) / 4;
+    ctx.fillText(y.toPrecision(3), 5, py(y) + 4);
+    const x = (xMax * i) / 4;
+    ctx.fillText(x.toFixed(0) + "s", px(x) - 10, height - bottom + 15);
+  }
+
+  chart.series.forEach((s, i) => {
+    ctx.strokeStyle = colors[i % colors.length];
+    ctx.fillStyle = ctx.strokeStyle;
+    ctx.beginPath();
+    s.values.forEach((v, j) => {
+      if (j === 0) {
+        ctx.moveTo(px(chart.x[j]), py(v));
+      } else {
+        ctx.lineTo(px(chart.x[j]), py(v));
+      }
+    });
+    ctx.stroke();
+    ctx.fillText(s.name, width - right - 100, top + 15 * i);
+  });
+  ctx.fillStyle = "#000";
+}
+</script>
+</body></html>
+`))
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTMLReport(t *testing.T) {
+	start := time.Now()
+	results := newResults(start, 0)
+	results.record(statusHTTPOK, 10*time.Millisecond)
+	results.recordFailure(statusHTTPRateLimited, errRetry)
+	results.endInterval(start.Add(time.Second))
+	results.record(statusHTTPOK, 20*time.Millisecond)
+	results.endInterval(start.Add(2 * time.Second))
+	report := newRunReport(results, start.Add(2*time.Second))
+
+	charts := htmlCharts(report)
+	if len(charts) != 3 {
+		t.Fatalf("expected 3 charts without server memory: %d", len(charts))
+	}
+	if charts[0].X[1] != 1 || charts[0].Series[0].Values[1] != 1 {
+		t.Errorf("unexpected requests/sec chart: %#v", charts[0])
+	}
+	if rateLimited := charts[2].Series[0]; rateLimited.Values[0] != 0.5 || rateLimited.Values[1] != 0 {
+		t.Errorf("unexpected rate limited series: %#v", rateLimited)
+	}
+
+	report.MaxServerSysBytes = 1 << 20
+	if len(htmlCharts(report)) != 4 {
+		t.Error("expected a server memory chart")
+	}
+
+	out := &strings.Builder{}
+	err := writeHTMLReport(out, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"<td>requests</td><td>2</td>", `"title":"Requests/sec"`, "max_server_sys"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("report must contain %#v", expected)
+		}
+	}
+}
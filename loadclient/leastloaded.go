@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/evanj/concurrentlimit/grpclimit/leastloaded"
+	"google.golang.org/grpc/resolver"
+)
+
+// leastLoadedScheme is the scheme of gRPC targets that list several servers, separated by commas,
+// to balance with the leastloaded policy, e.g. concurrentlimit-least-loaded:///host1:8081,host2:8081.
+// The query parameter maxRequestsPerServer sets the policy's limit for each server.
+const leastLoadedScheme = "concurrentlimit-least-loaded"
+
+func init() {
+	resolver.Register(leastLoadedResolverBuilder{})
+}
+
+// leastLoadedTarget returns a gRPC target that balances between addrs with the leastloaded policy,
+// with at most maxRequestsPerServer concurrent requests to each, or no limit if it is 0.
+func leastLoadedTarget(addrs []string, maxRequestsPerServer int) string {
+	target := leastLoadedScheme + ":///" + strings.Join(addrs, ",")
+	if maxRequestsPerServer > 0 {
+		target += "?maxRequestsPerServer=" + strconv.Itoa(maxRequestsPerServer)
+	}
+	return target
+}
+
+// leastLoadedResolverBuilder resolves targets created by leastLoadedTarget to the addresses they
+// list, and selects the leastloaded policy.
+type leastLoadedResolverBuilder struct{}
+
+func (leastLoadedResolverBuilder) Build(
+	target resolver.Target, cc resolver.ClientConn, options resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	var addresses []resolver.Address
+	for _, addr := range strings.Split(strings.TrimPrefix(target.URL.Path, "/"), ",") {
+		addresses = append(addresses, resolver.Address{Addr: addr})
+	}
+	maxRequestsPerServer := 0
+	if value := target.URL.Query().Get("maxRequestsPerServer"); value != "" {
+		var err error
+		maxRequestsPerServer, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxRequestsPerServer: %w", err)
+		}
+	}
+	serviceConfig := cc.ParseServiceConfig(fmt.Sprintf(`{"loadBalancingConfig": [{"%s": {"maxRequestsPerServer": %d}}]}`,
+		leastloaded.Name, maxRequestsPerServer))
+	if serviceConfig.Err != nil {
+		return nil, fmt.Errorf("bug: invalid service config: %w", serviceConfig.Err)
+	}
+	err := cc.UpdateState(resolver.State{Addresses: addresses, ServiceConfig: serviceConfig})
+	if err != nil {
+		return nil, err
+	}
+	return leastLoadedResolver{}, nil
+}
+
+func (leastLoadedResolverBuilder) Scheme() string {
+	return leastLoadedScheme
+}
+
+// leastLoadedResolver never changes the addresses, since they are listed in the target.
+type leastLoadedResolver struct{}
+
+func (leastLoadedResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (leastLoadedResolver) Close() {}
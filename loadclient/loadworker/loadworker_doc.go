@@ -0,0 +1,2 @@
+// Package loadworker contains the protobuf messages used by distributed loadclients.
+package loadworker
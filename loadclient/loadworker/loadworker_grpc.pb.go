@@ -0,0 +1,145 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v4.22.0
+// source: loadclient/loadworker/loadworker.proto
+
+package loadworker
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// LoadWorkerClient is the client API for LoadWorker service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LoadWorkerClient interface {
+	// Run sends requests as configured by the arguments and returns the results when done.
+	Run(ctx context.Context, in *RunRequest, opts ...grpc.CallOption) (*RunResponse, error)
+	// Stop ends the current run early. The Run call returns the results so far.
+	Stop(ctx context.Context, in *StopRequest, opts ...grpc.CallOption) (*StopResponse, error)
+}
+
+type loadWorkerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLoadWorkerClient(cc grpc.ClientConnInterface) LoadWorkerClient {
+	return &loadWorkerClient{cc}
+}
+
+func (c *loadWorkerClient) Run(ctx context.Context, in *RunRequest, opts ...grpc.CallOption) (*RunResponse, error) {
+	out := new(RunResponse)
+	err := c.cc.Invoke(ctx, "/loadworker.LoadWorker/Run", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *loadWorkerClient) Stop(ctx context.Context, in *StopRequest, opts ...grpc.CallOption) (*StopResponse, error) {
+	out := new(StopResponse)
+	err := c.cc.Invoke(ctx, "/loadworker.LoadWorker/Stop", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LoadWorkerServer is the server API for LoadWorker service.
+// All implementations must embed UnimplementedLoadWorkerServer
+// for forward compatibility
+type LoadWorkerServer interface {
+	// Run sends requests as configured by the arguments and returns the results when done.
+	Run(context.Context, *RunRequest) (*RunResponse, error)
+	// Stop ends the current run early. The Run call returns the results so far.
+	Stop(context.Context, *StopRequest) (*StopResponse, error)
+	mustEmbedUnimplementedLoadWorkerServer()
+}
+
+// UnimplementedLoadWorkerServer must be embedded to have forward compatible implementations.
+type UnimplementedLoadWorkerServer struct {
+}
+
+func (UnimplementedLoadWorkerServer) Run(context.Context, *RunRequest) (*RunResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Run not implemented")
+}
+func (UnimplementedLoadWorkerServer) Stop(context.Context, *StopRequest) (*StopResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stop not implemented")
+}
+func (UnimplementedLoadWorkerServer) mustEmbedUnimplementedLoadWorkerServer() {}
+
+// UnsafeLoadWorkerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LoadWorkerServer will
+// result in compilation errors.
+type UnsafeLoadWorkerServer interface {
+	mustEmbedUnimplementedLoadWorkerServer()
+}
+
+func RegisterLoadWorkerServer(s grpc.ServiceRegistrar, srv LoadWorkerServer) {
+	s.RegisterService(&LoadWorker_ServiceDesc, srv)
+}
+
+func _LoadWorker_Run_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RunRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LoadWorkerServer).Run(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/loadworker.LoadWorker/Run",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LoadWorkerServer).Run(ctx, req.(*RunRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LoadWorker_Stop_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StopRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LoadWorkerServer).Stop(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/loadworker.LoadWorker/Stop",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LoadWorkerServer).Stop(ctx, req.(*StopRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// LoadWorker_ServiceDesc is the grpc.ServiceDesc for LoadWorker service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LoadWorker_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "loadworker.LoadWorker",
+	HandlerType: (*LoadWorkerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Run",
+			Handler:    _LoadWorker_Run_Handler,
+		},
+		{
+			MethodName: "Stop",
+			Handler:    _LoadWorker_Stop_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "loadclient/loadworker/loadworker.proto",
+}
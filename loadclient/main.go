@@ -1,34 +1,62 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/evanj/concurrentlimit/sleepymemory"
-	"google.golang.org/grpc"
+	"golang.org/x/net/http2"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 const grpcConnectTimeout = 30 * time.Second
 
+// exitErrorBudget is the exit code when the error rate exceeds --maxErrorRate.
+const exitErrorBudget = 3
+
+// exitSLOViolated is the exit code when the run did not meet --sloP99 or --sloAvailability.
+const exitSLOViolated = 4
+
+// exitInterrupted is the exit code after Ctrl-C or SIGTERM stops a run early, matching shells.
+const exitInterrupted = 130
+
+// minErrorRateRequests is the number of requests required before stopping a run early due to
+// --maxErrorRate, to avoid stopping due to a few errors at the start.
+const minErrorRateRequests = 100
+
+// apiKeyHeader is the header or metadata that sleepyserver --apiKeyLimit uses to identify tenants.
+const apiKeyHeader = "X-API-Key"
+
+// sendRequestsGoroutine sends requests in a "closed loop" until done is closed: it sends the next
+// request after the previous request completes.
 func sendRequestsGoroutine(
-	done <-chan struct{}, totalRequestsChan chan<- int, sender requestSender,
-	req *sleepymemory.SleepRequest,
+	done <-chan struct{}, wg *sync.WaitGroup, sender requestSender,
+	req *sleepymemory.SleepRequest, results *results, retryBackoff *backoff, pacer *pacer,
 ) {
+	defer wg.Done()
+
 	// create a new sender for each goroutine
 	sender = sender.clone()
 
-	requestCount := 0
 sendLoop:
 	for {
 		// if done is closed, break out of the loop
@@ -38,167 +66,925 @@ sendLoop:
 		default:
 		}
 
-		err := sender.send(req)
+		start := time.Now()
+		results.inFlight.Add(1)
+		status, err := sender.send(req)
+		results.inFlight.Add(-1)
 		if err != nil {
-			if err == errRetry || err == context.DeadlineExceeded {
-				// TODO: exponential backoff?
-				time.Sleep(time.Second)
-				continue
-			}
-			panic(err)
+			// keep going after errors: the server may be overloaded or restarting
+			results.recordFailure(status, err)
+			sleepUntilDone(done, retryBackoff.next())
+			continue
 		}
 
-		requestCount++
+		elapsed := time.Since(start)
+		results.record(status, elapsed)
+		retryBackoff.reset()
+		sleepUntilDone(done, pacer.delay(elapsed))
+	}
+}
+
+// sleepUntilDone sleeps for d, or until done is closed.
+func sleepUntilDone(done <-chan struct{}, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
 	}
-	totalRequestsChan <- requestCount
 }
 
 var errRetry = errors.New("retriable error")
 
+// statusConnectionError is the status of requests that failed without a response.
+const statusConnectionError = "connection_error"
+
 type requestSender interface {
 	clone() requestSender
-	send(req *sleepymemory.SleepRequest) error
+	// send sends req and returns the status of the response: the HTTP status code, the gRPC
+	// status code, or statusConnectionError.
+	send(req *sleepymemory.SleepRequest) (string, error)
+}
+
+// HTTP versions supported by httpSender.
+const (
+	httpVersion1   = "1.1"
+	httpVersion2   = "2"
+	httpVersionH2C = "h2c"
+)
+
+// httpOptions configures httpSender.
+type httpOptions struct {
+	version string
+	// shared causes clones to share one client and its connections
+	shared bool
+	method string
+	// body is sent with each request if it is not empty
+	body []byte
+	// timeout is the maximum time for each request if > 0
+	timeout time.Duration
+	// header is added to each request
+	header http.Header
 }
 
 type httpSender struct {
 	client  *http.Client
 	baseURL string
+	// requestURL is the URL requests are sent to: baseURL, or a placeholder for Unix sockets
+	requestURL string
+	options    httpOptions
 }
 
-func newHTTPSender(baseURL string) *httpSender {
-	return &httpSender{
-		// create a separate client and transport so each goroutine uses a separate connection
-		&http.Client{Transport: &http.Transport{}},
-		baseURL,
+// unixPrefix is the prefix of targets that are Unix domain sockets, e.g. unix:///tmp/server.sock.
+const unixPrefix = "unix://"
+
+func newHTTPSender(baseURL string, options httpOptions) (*httpSender, error) {
+	if options.method != http.MethodGet && options.method != http.MethodPost {
+		return nil, fmt.Errorf("unsupported HTTP method %#v: must be GET or POST", options.method)
+	}
+
+	requestURL := baseURL
+	dial := (&net.Dialer{}).DialContext
+	if strings.HasPrefix(baseURL, unixPrefix) {
+		if options.version == httpVersion2 {
+			return nil, fmt.Errorf("--httpVersion=%s requires TLS, which is not supported with %s",
+				httpVersion2, baseURL)
+		}
+		// the host is ignored: all connections are to the socket
+		socketPath := strings.TrimPrefix(baseURL, unixPrefix)
+		requestURL = "http://unix/"
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		}
+	}
+
+	var transport http.RoundTripper
+	switch options.version {
+	case httpVersion1:
+		// disable HTTP/2, which is otherwise used with https URLs
+		transport = &http.Transport{
+			DialContext:  dial,
+			TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+		}
+	case httpVersion2:
+		transport = &http.Transport{ForceAttemptHTTP2: true}
+	case httpVersionH2C:
+		// HTTP/2 without TLS, with "prior knowledge" that the server supports it
+		transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported HTTP version %#v: must be one of %s, %s, %s",
+			options.version, httpVersion1, httpVersion2, httpVersionH2C)
 	}
+
+	client := &http.Client{Transport: transport, Timeout: options.timeout}
+	return &httpSender{client, baseURL, requestURL, options}, nil
 }
 
 func (h *httpSender) clone() requestSender {
-	return newHTTPSender(h.baseURL)
+	if h.options.shared {
+		// share the client and its connections
+		return h
+	}
+
+	// create a separate client and transport so each goroutine uses a separate connection
+	cloned, err := newHTTPSender(h.baseURL, h.options)
+	if err != nil {
+		panic("bug: the options were checked by newHTTPSender: " + err.Error())
+	}
+	return cloned
 }
 
-func (h *httpSender) send(req *sleepymemory.SleepRequest) error {
-	reqURL := fmt.Sprintf("%s?sleep=%d&waste=%d",
-		h.baseURL, req.SleepDuration.Seconds, req.WasteBytes)
+func (h *httpSender) send(req *sleepymemory.SleepRequest) (string, error) {
+	// the servers parse sleep as a Go duration, so sub-second sleeps are not truncated
+	reqURL := fmt.Sprintf("%s?sleep=%s&waste=%d",
+		h.requestURL, url.QueryEscape(req.SleepDuration.AsDuration().String()), req.WasteBytes)
+	if req.Leak {
+		reqURL += "&leak=true"
+	}
+	if req.WasteFiles > 0 {
+		reqURL += fmt.Sprintf("&files=%d", req.WasteFiles)
+	}
+
+	var body io.Reader
+	if len(h.options.body) > 0 {
+		body = bytes.NewReader(h.options.body)
+	}
+	httpReq, err := http.NewRequest(h.options.method, reqURL, body)
+	if err != nil {
+		return statusConnectionError, err
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/octet-stream")
+	}
+	for key, values := range h.options.header {
+		httpReq.Header[key] = values
+	}
 
-	resp, err := h.client.Get(reqURL)
+	resp, err := h.client.Do(httpReq)
 	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && h.options.timeout > 0 {
+			return statusTimeout, err
+		}
 		// docker's proxy is pretty unhappy with how we hit this with tons of connections concurrently
 		// we also get "operation timed out" when we are limiting the number of connections
 		if strings.Contains(err.Error(), "connection reset by peer") ||
 			strings.Contains(err.Error(), "write: broken pipe") ||
 			strings.Contains(err.Error(), "operation timed out") {
-			return errRetry
+			return statusConnectionError, errRetry
 		}
-		return err
+		return statusConnectionError, err
 	}
 	defer resp.Body.Close()
+	status := strconv.Itoa(resp.StatusCode)
+	if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "" {
+		status = statusHTTPOverloaded
+	}
 
 	// drain the body so the connection can be reused by keep alives
 	_, err = io.Copy(io.Discard, resp.Body)
 	if err != nil {
-		return err
+		return status, err
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return err
+		return status, err
 	}
 
-	if resp.StatusCode == http.StatusTooManyRequests {
+	if isRateLimited(status) {
 		// we were rate limited! Try again later
-		return errRetry
+		return status, errRetry
 	} else if resp.StatusCode != http.StatusOK {
-		return errors.New("expected status ok: " + resp.Status)
+		return status, errors.New("expected status ok: " + resp.Status)
 	}
-	return nil
+	return status, nil
 }
 
 type grpcSender struct {
-	addr   string
-	client sleepymemory.SleeperClient
+	addr    string
+	options *grpcOptions
+	// conn is nil until the first request
+	conn *grpcConn
 }
 
-func newGRPCSender(addr string) *grpcSender {
-	return &grpcSender{addr: addr}
+func newGRPCSender(addr string, options grpcOptions) *grpcSender {
+	return &grpcSender{addr: addr, options: &options}
 }
 
 func (g *grpcSender) clone() requestSender {
-	// copies the client: if it was used it will share a connection
+	// copies the connection: if it was used it will be shared
 	cloned := *g
 	return &cloned
 }
 
-func (g *grpcSender) send(req *sleepymemory.SleepRequest) error {
-	if g.client == nil {
-		dialCtx, cancel := context.WithTimeout(context.Background(), grpcConnectTimeout)
-		conn, err := grpc.DialContext(dialCtx, g.addr,
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithBlock())
-		cancel()
-		if err != nil {
-			return err
-		}
-		g.client = sleepymemory.NewSleeperClient(conn)
+func (g *grpcSender) send(req *sleepymemory.SleepRequest) (string, error) {
+	if g.conn == nil {
+		g.conn = newGRPCConn(g.addr, g.options)
 	}
+	client, err := g.conn.acquire()
+	if err != nil {
+		return statusConnectionError, err
+	}
+	defer g.conn.release()
 
-	_, err := g.client.Sleep(context.Background(), req)
-	if status.Code(err) == codes.ResourceExhausted {
+	ctx := context.Background()
+	if len(g.options.md) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, g.options.md)
+	}
+	if g.options.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.options.timeout)
+		defer cancel()
+	}
+	if g.options.stream {
+		err = sendStream(ctx, client, req)
+	} else {
+		_, err = client.Sleep(ctx, req)
+	}
+	code := status.Code(err)
+	if code == codes.ResourceExhausted {
 		err = errRetry
 	}
-	return err
+	return code.String(), err
 }
 
-func main() {
-	httpTarget := flag.String("httpTarget", "", "HTTP address to send requests to")
-	grpcTarget := flag.String("grpcTarget", "", "HTTP address to send requests to")
-	duration := flag.Duration("duration", time.Minute, "Duration to run the test")
-	concurrent := flag.Int("concurrent", 1, "Number of concurrent client goroutines")
-	sleep := flag.Duration("sleep", 0, "Time for the server to sleep handling a request")
-	waste := flag.Int("waste", 0, "Bytes of memory the server should waste while handling a request")
-	shareGRPC := flag.Bool("shareGRPC", false, "If set, the gRPC goroutines will share a single client")
-	flag.Parse()
+// runConfig configures a run. It is set by command-line flags, or by the arguments sent by a
+// coordinator to a worker.
+type runConfig struct {
+	httpTargets    stringList
+	grpcTargets    stringList
+	targetWeights  string
+	duration       time.Duration
+	concurrent     int
+	sleep          time.Duration
+	waste          int
+	leak           bool
+	wasteFiles     int
+	shareGRPC      bool
+	shareHTTP      bool
+	requestTimeout time.Duration
+	method         string
+	bodyBytes      int
+	httpVersion    string
+	rate           float64
+	profile        string
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+	interval       time.Duration
+	maxRequests    uint64
+	maxErrorRate   float64
+	scenario       string
+	thinkTime      delayRange
+	pace           delayRange
+	statsURL       string
+	statsInterval  time.Duration
+	grpcStream     bool
+	streaming      bool
+	streams        int
+	streamRate     float64
+	headers        keyValueList
+	metadata       keyValueList
+	apiKey         string
+	leastLoaded    bool
+	maxPerServer   int
 
-	req := &sleepymemory.SleepRequest{
-		SleepDuration: durationpb.New(*sleep),
-		WasteBytes:    int64(*waste),
+	grpcKeepaliveTime       time.Duration
+	grpcKeepaliveTimeout    time.Duration
+	grpcKeepaliveWithoutRPC bool
+	grpcMaxIdle             time.Duration
+	grpcMaxStreams          int
+	autoscaleP99            time.Duration
+	autoscaleMax            int
+
+	// recorder records each request for --record, and trace is the requests to send for --replay.
+	// They are set by main, not by flags, since workers must not read or write local files.
+	recorder *traceRecorder
+	trace    []traceRecord
+	// heapProfiler captures the server's heap profiles for --heapProfileURL; set by main
+	heapProfiler *heapProfiler
+}
+
+// registerFlags registers flags on fs that set the fields of c.
+func (c *runConfig) registerFlags(fs *flag.FlagSet) {
+	fs.Var(&c.httpTargets, "httpTarget", "HTTP URL to send requests to, or unix:///path for a Unix socket; may be repeated or comma-separated")
+	fs.Var(&c.grpcTargets, "grpcTarget", "gRPC address to send requests to, or unix:///path for a Unix socket; may be repeated or comma-separated")
+	fs.StringVar(&c.targetWeights, "targetWeights", "",
+		"Comma-separated weights for distributing requests to multiple targets (default: round-robin)")
+	fs.BoolVar(&c.leastLoaded, "grpcLeastLoaded", false,
+		"If set, each gRPC client balances requests between all --grpcTarget servers, preferring the ones that report "+
+			"lower utilization (sleepyserver --limitMode=library), instead of distributing them with --targetWeights")
+	fs.IntVar(&c.maxPerServer, "grpcMaxRequestsPerServer", 0,
+		"With --grpcLeastLoaded, the maximum concurrent requests each gRPC client sends to each server; "+
+			"requests are rejected when every server is full")
+	fs.DurationVar(&c.duration, "duration", time.Minute, "Duration to run the test")
+	fs.IntVar(&c.concurrent, "concurrent", 1, "Number of concurrent client goroutines")
+	fs.DurationVar(&c.autoscaleP99, "autoscaleP99", 0,
+		"If set, start with --concurrent client goroutines, then adjust them after each --interval to hold the p99 "+
+			"latency at this, and report the highest concurrency the server sustained")
+	fs.IntVar(&c.autoscaleMax, "autoscaleMax", 4096, "Maximum client goroutines with --autoscaleP99")
+	fs.DurationVar(&c.sleep, "sleep", 0, "Time for the server to sleep handling a request")
+	fs.IntVar(&c.waste, "waste", 0, "Bytes of memory the server should waste while handling a request")
+	fs.BoolVar(&c.leak, "leak", false,
+		"If set, the server keeps the --waste memory after each request, to simulate a memory leak")
+	fs.IntVar(&c.wasteFiles, "wasteFiles", 0,
+		"File descriptors the server should hold open while handling a request")
+	fs.BoolVar(&c.shareGRPC, "shareGRPC", false, "If set, the gRPC goroutines will share a single client")
+	fs.DurationVar(&c.grpcKeepaliveTime, "grpcKeepaliveTime", 0,
+		"If set, gRPC clients ping the server after this long without activity (minimum 10s); servers may close "+
+			"connections that ping more often than they permit (by default: every 5m)")
+	fs.DurationVar(&c.grpcKeepaliveTimeout, "grpcKeepaliveTimeout", 20*time.Second,
+		"Time gRPC clients wait for a --grpcKeepaliveTime ping response before closing the connection")
+	fs.BoolVar(&c.grpcKeepaliveWithoutRPC, "grpcKeepaliveWithoutRPC", false,
+		"If set, gRPC clients send --grpcKeepaliveTime pings even when they have no requests in flight")
+	fs.DurationVar(&c.grpcMaxIdle, "grpcMaxIdle", 0,
+		"If set, gRPC clients close their connection after this long without requests, and reconnect for the next one")
+	fs.IntVar(&c.grpcMaxStreams, "grpcMaxStreams", 0,
+		"If set, limit the concurrent requests on each gRPC connection; more requests wait, "+
+			"which is useful with --shareGRPC")
+	fs.BoolVar(&c.shareHTTP, "shareHTTP", false,
+		"If set, the HTTP goroutines will share a single client (with --httpVersion=2 or h2c: one connection)")
+	fs.DurationVar(&c.requestTimeout, "requestTimeout", 0,
+		"If set, requests that take longer than this are cancelled and counted as timeouts")
+	fs.StringVar(&c.method, "method", http.MethodGet, "HTTP method to use: GET or POST")
+	fs.IntVar(&c.bodyBytes, "bodyBytes", 0, "Bytes of request body to send with each HTTP request")
+	fs.StringVar(&c.httpVersion, "httpVersion", httpVersion1,
+		"HTTP version to use: 1.1; 2 (requires an https target); or h2c (HTTP/2 without TLS: the target must support it)")
+	fs.Float64Var(&c.rate, "rate", 0,
+		"If set, send requests at this rate per second, independent of responses, using at most --concurrent senders")
+	fs.StringVar(&c.profile, "profile", "",
+		"Send requests with rates that change over time, using at most --concurrent senders; "+
+			"overrides --rate and --duration (e.g. 0-60s:100rps,60s-2m:100-500rps)")
+	fs.DurationVar(&c.backoffInitial, "backoffInitial", 100*time.Millisecond,
+		"Maximum delay before retrying after the first failure; doubles after each failure")
+	fs.DurationVar(&c.backoffMax, "backoffMax", 10*time.Second, "Maximum delay before retrying after a failure")
+	fs.DurationVar(&c.interval, "interval", 10*time.Second,
+		"Print progress and record results in --output for each interval of this duration")
+	fs.Uint64Var(&c.maxRequests, "maxRequests", 0, "If set, stop after this many requests complete")
+	fs.Float64Var(&c.maxErrorRate, "maxErrorRate", 0,
+		"If set, stop and exit with status 3 if the fraction of requests that fail or time out exceeds this "+
+			"(e.g. 0.01); rate limited requests are not errors")
+	fs.Var(&c.thinkTime, "thinkTime",
+		"Time each client goroutine waits after a response before sending the next request: "+
+			"fixed (e.g. 100ms) or uniformly random (e.g. 50ms-150ms)")
+	fs.Var(&c.pace, "pace",
+		"Minimum time between the start of each client goroutine's requests: "+
+			"fixed (e.g. 1s) or uniformly random (e.g. 500ms-1.5s)")
+	fs.StringVar(&c.statsURL, "statsURL", "",
+		"If set, poll the server's memory from this URL (e.g. http://localhost:8080/stats) and report it with the results")
+	fs.DurationVar(&c.statsInterval, "statsInterval", time.Second, "Time between polls of --statsURL")
+	fs.BoolVar(&c.grpcStream, "grpcStream", false,
+		"If set, send gRPC requests with the streaming SleepStream RPC, which sends a response every second")
+	fs.BoolVar(&c.streaming, "streaming", false,
+		"If set, keep --streams long-lived SleepStream streams open to --grpcTarget, each receiving --streamRate responses/sec")
+	fs.IntVar(&c.streams, "streams", 1, "Number of streams to keep open with --streaming")
+	fs.Float64Var(&c.streamRate, "streamRate", 1, "Responses per second on each stream with --streaming")
+	fs.Var(&c.headers, "header", "HTTP header to send with each request as key=value; may be repeated")
+	fs.Var(&c.metadata, "metadata", "gRPC metadata to send with each request as key=value; may be repeated")
+	fs.StringVar(&c.apiKey, "apiKey", "",
+		"If set, send this as the "+apiKeyHeader+" HTTP header and gRPC metadata, for sleepyserver --apiKeyLimit")
+	fs.StringVar(&c.scenario, "scenario", "",
+		"If set, send the mix of request types described by this JSON file; overrides --sleep and --waste")
+}
+
+// httpHeader returns the --header values, and the --apiKey header if it is set.
+func (c *runConfig) httpHeader() http.Header {
+	header := c.headers.httpHeader()
+	if c.apiKey != "" {
+		header.Set(apiKeyHeader, c.apiKey)
 	}
+	return header
+}
 
-	var sender requestSender
-	if *httpTarget != "" {
-		log.Printf("sending HTTP requests to %s ...", *httpTarget)
-		sender = newHTTPSender(*httpTarget)
-	} else if *grpcTarget != "" {
-		log.Printf("sending gRPC requests to %s ...", *grpcTarget)
-		sender = newGRPCSender(*grpcTarget)
-		if *shareGRPC {
-			// make a request to create the client before we clone it so it will be shared
-			log.Printf("sharing a single gRPC connection ...")
-			err := sender.send(req)
+// grpcMetadata returns the --metadata values, and the --apiKey metadata if it is set.
+func (c *runConfig) grpcMetadata() metadata.MD {
+	md := c.metadata.metadata()
+	if c.apiKey != "" {
+		md.Set(apiKeyHeader, c.apiKey)
+	}
+	return md
+}
+
+// newHTTPTarget returns a sender for the HTTP URL target.
+func (c *runConfig) newHTTPTarget(target string) (requestSender, error) {
+	log.Printf("sending HTTP/%s requests to %s ...", c.httpVersion, target)
+	sender, err := newHTTPSender(target, httpOptions{
+		version: c.httpVersion,
+		shared:  c.shareHTTP,
+		method:  c.method,
+		body:    make([]byte, c.bodyBytes),
+		timeout: c.requestTimeout,
+		header:  c.httpHeader(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.recordSender(sender), nil
+}
+
+// grpcOptions returns the options for gRPC connections and requests.
+func (c *runConfig) grpcOptions() grpcOptions {
+	return grpcOptions{
+		timeout: c.requestTimeout,
+		md:      c.grpcMetadata(),
+		stream:  c.grpcStream,
+		keepalive: keepalive.ClientParameters{
+			Time:                c.grpcKeepaliveTime,
+			Timeout:             c.grpcKeepaliveTimeout,
+			PermitWithoutStream: c.grpcKeepaliveWithoutRPC,
+		},
+		maxIdle:    c.grpcMaxIdle,
+		maxStreams: c.grpcMaxStreams,
+	}
+}
+
+// newGRPCTarget returns a sender for the gRPC address target. With --shareGRPC, it sends req to
+// create the connection that will be shared.
+func (c *runConfig) newGRPCTarget(target string, req *sleepymemory.SleepRequest) (requestSender, error) {
+	if c.bodyBytes != 0 || c.method != http.MethodGet {
+		return nil, errors.New("--bodyBytes and --method are only supported with --httpTarget")
+	}
+	log.Printf("sending gRPC requests to %s ...", target)
+	sender := newGRPCSender(target, c.grpcOptions())
+	if c.shareGRPC {
+		// make a request to create the client before we clone it so it will be shared
+		log.Printf("sharing a single gRPC connection ...")
+		_, err := sender.send(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.recordSender(sender), nil
+}
+
+// recordSender returns sender, wrapped to record its requests if --record is set. Each target is
+// wrapped separately, so the requests of a --scenario are recorded as they are sent.
+func (c *runConfig) recordSender(sender requestSender) requestSender {
+	if c.recorder == nil {
+		return sender
+	}
+	return &traceSender{sender, c.recorder}
+}
+
+// newTargetsSender returns a sender for --httpTarget or --grpcTarget, which distributes requests
+// if there are multiple targets.
+func (c *runConfig) newTargetsSender(req *sleepymemory.SleepRequest) (requestSender, error) {
+	if c.maxPerServer != 0 && !c.leastLoaded {
+		return nil, errors.New("--grpcMaxRequestsPerServer requires --grpcLeastLoaded")
+	}
+	var senders []requestSender
+	if len(c.httpTargets) > 0 {
+		for _, httpTarget := range c.httpTargets {
+			sender, err := c.newHTTPTarget(httpTarget)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
+			senders = append(senders, sender)
+		}
+	} else if c.leastLoaded {
+		if c.targetWeights != "" {
+			return nil, errors.New("--targetWeights cannot be used with --grpcLeastLoaded")
+		}
+		target := leastLoadedTarget(c.grpcTargets, c.maxPerServer)
+		sender, err := c.newGRPCTarget(target, req)
+		if err != nil {
+			return nil, err
 		}
+		senders = append(senders, sender)
 	} else {
-		panic("specify --httpTarget or --grpcTarget")
+		for _, grpcTarget := range c.grpcTargets {
+			sender, err := c.newGRPCTarget(grpcTarget, req)
+			if err != nil {
+				return nil, err
+			}
+			senders = append(senders, sender)
+		}
+	}
+
+	if len(senders) == 1 {
+		return senders[0], nil
+	}
+	weights, err := parseWeights(c.targetWeights, len(senders))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("distributing requests to %d targets with weights %v", len(senders), weights)
+	return newMultiSender(senders, weights), nil
+}
+
+// run sends requests as configured by config until the run ends or ctx is cancelled, and returns
+// the results.
+func run(ctx context.Context, config *runConfig) (*results, error) {
+	req := &sleepymemory.SleepRequest{
+		SleepDuration: sleepymemory.Duration(config.sleep),
+		WasteBytes:    int64(config.waste),
+		Leak:          config.leak,
+		WasteFiles:    int64(config.wasteFiles),
+	}
+
+	if config.streaming {
+		err := checkStreaming(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var sender requestSender
+	if config.streaming {
+		// streams do not use senders
+	} else if len(config.httpTargets) > 0 || len(config.grpcTargets) > 0 {
+		var err error
+		sender, err = config.newTargetsSender(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.scenario != "" {
+		scenario, err := loadScenario(config.scenario)
+		if err != nil {
+			return nil, err
+		}
+		sender, err = scenario.newSender(config, sender)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("sending the %d request types in scenario %s ...", len(scenario.Requests), config.scenario)
+	} else if sender == nil && !config.streaming {
+		return nil, errors.New("specify --httpTarget, --grpcTarget, or --scenario")
+	}
+
+	duration := config.duration
+	var profile loadProfile
+	if config.profile != "" {
+		var err error
+		profile, err = parseProfile(config.profile)
+		if err != nil {
+			return nil, err
+		}
+		duration = profile.duration()
+		log.Printf("sending requests with profile %s for %s using at most %d senders ...",
+			config.profile, duration.String(), config.concurrent)
+	} else if config.rate > 0 {
+		profile = constantProfile(config.rate, duration)
+		log.Printf("sending %.1f requests/sec for %s using at most %d senders ...",
+			config.rate, duration.String(), config.concurrent)
+	}
+
+	if profile != nil && (config.thinkTime != delayRange{} || config.pace != delayRange{}) {
+		return nil, errors.New("--thinkTime and --pace are only supported without --rate or --profile")
+	}
+
+	if config.autoscaleP99 > 0 && (profile != nil || config.streaming || config.trace != nil) {
+		return nil, errors.New("--autoscaleP99 does not support --rate, --profile, --streaming, or --replay")
+	}
+
+	maxRequests := config.maxRequests
+	if config.trace != nil {
+		if profile != nil || config.streaming || config.scenario != "" ||
+			config.thinkTime != (delayRange{}) || config.pace != (delayRange{}) {
+			return nil, errors.New("--replay does not support --rate, --profile, --streaming, --scenario, --thinkTime, or --pace")
+		}
+		// stop when all requests complete, or --duration after the last request is sent
+		if maxRequests == 0 {
+			maxRequests = uint64(len(config.trace))
+		}
+		duration = traceDuration(config.trace) + config.duration
+		log.Printf("replaying %d requests over %s using at most %d senders ...",
+			len(config.trace), traceDuration(config.trace).String(), config.concurrent)
 	}
 
-	log.Printf("sending requests for %s using %d client goroutines ...",
-		duration.String(), *concurrent)
 	done := make(chan struct{})
-	totalRequestsChan := make(chan int)
-	for i := 0; i < *concurrent; i++ {
-		go sendRequestsGoroutine(done, totalRequestsChan, sender, req)
+	results := newResults(time.Now(), maxRequests)
+	if config.recorder != nil {
+		config.recorder.start = results.start
+	}
+	var wg sync.WaitGroup
+	var scaler *autoscaler
+	if config.statsURL != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pollServerStats(done, config.statsURL, config.statsInterval, results)
+		}()
 	}
+	if config.streaming {
+		err := startStreams(done, &wg, config, results)
+		if err != nil {
+			close(done)
+			wg.Wait()
+			return nil, err
+		}
+	} else if profile != nil || config.trace != nil {
+		senders := make(chan requestSender, config.concurrent)
+		for i := 0; i < config.concurrent; i++ {
+			senders <- sender.clone()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if config.trace != nil {
+				sendTrace(done, config.trace, senders, results)
+			} else {
+				sendAtRate(done, profile, senders, req, results)
+			}
+		}()
+	} else if config.autoscaleP99 > 0 {
+		log.Printf("sending requests for %s starting with %d client goroutines, adjusted to hold p99 <= %s ...",
+			duration.String(), config.concurrent, config.autoscaleP99)
+		scaler = newAutoscaler(config.autoscaleP99, config.concurrent, config.autoscaleMax, func(stop <-chan struct{}) {
+			wg.Add(1)
+			go sendRequestsGoroutine(stop, &wg, sender, req, results,
+				newBackoff(config.backoffInitial, config.backoffMax), newPacer(config.thinkTime, config.pace))
+		})
+	} else {
+		log.Printf("sending requests for %s using %d client goroutines ...",
+			duration.String(), config.concurrent)
+		for i := 0; i < config.concurrent; i++ {
+			wg.Add(1)
+			go sendRequestsGoroutine(done, &wg, sender, req, results,
+				newBackoff(config.backoffInitial, config.backoffMax), newPacer(config.thinkTime, config.pace))
+		}
+	}
+
+	// record results for each interval until the run ends
+	ticker := time.NewTicker(config.interval)
+	runTimer := time.NewTimer(duration)
+	var heapProfileOffset <-chan time.Time
+	if config.heapProfiler != nil {
+		heapProfileOffset = config.heapProfiler.begin(results.start)
+	}
+runLoop:
+	for {
+		select {
+		case now := <-ticker.C:
+			ended := results.endInterval(now)
+			log.Printf("%s-%s: %s in_flight=%d", ended.start.Sub(results.start).Round(time.Second),
+				now.Sub(results.start).Round(time.Second), ended.String(), results.inFlight.Load())
+			if config.heapProfiler != nil {
+				config.heapProfiler.endInterval(ended)
+			}
+			if scaler != nil {
+				scaler.endInterval(ended)
+			}
 
-	time.Sleep(*duration)
+			if config.maxErrorRate > 0 {
+				results.mu.Lock()
+				counts := countStatuses(results.statuses)
+				results.mu.Unlock()
+				if counts.total() >= minErrorRateRequests && counts.errorRate() > config.maxErrorRate {
+					log.Printf("stopping: error rate %.4f exceeds --maxErrorRate=%.4f",
+						counts.errorRate(), config.maxErrorRate)
+					results.errorBudgetExceeded = true
+					break runLoop
+				}
+			}
+		case <-results.maxRequestsReached:
+			log.Printf("stopping: completed %d requests", maxRequests)
+			break runLoop
+		case <-heapProfileOffset:
+			heapProfileOffset = config.heapProfiler.captureOffset()
+		case <-runTimer.C:
+			break runLoop
+		case <-ctx.Done():
+			log.Printf("stopping: %s", ctx.Err().Error())
+			break runLoop
+		}
+	}
+	ticker.Stop()
+	runTimer.Stop()
+	if config.heapProfiler != nil {
+		config.heapProfiler.endRun()
+	}
 	close(done)
+	if scaler != nil {
+		scaler.stop()
+		results.sustainableConcurrency = scaler.sustainable
+	}
+	wg.Wait()
+	results.end = time.Now()
+	results.endInterval(results.end)
+	return results, nil
+}
 
-	totalRequests := 0
-	for i := 0; i < *concurrent; i++ {
-		totalRequests += <-totalRequestsChan
+// sendStream sends req with the SleepStream RPC, and reads responses until the stream ends.
+func sendStream(ctx context.Context, client sleepymemory.SleeperClient, req *sleepymemory.SleepRequest) error {
+	stream, err := client.SleepStream(ctx, &sleepymemory.SleepStreamRequest{
+		SleepDuration: req.SleepDuration,
+		WasteBytes:    req.WasteBytes,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		_, err = stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	config := &runConfig{}
+	config.registerFlags(flag.CommandLine)
+	output := flag.String("output", "",
+		"If set, write results to this file: as CSV if it ends with .csv, as a page with charts if it ends with .html, "+
+			"otherwise as JSON")
+	workerAddr := flag.String("workerAddr", "",
+		"If set, run as a worker: listen for runs from a coordinator on this address (e.g. :9000)")
+	workerToken := flag.String("workerToken", os.Getenv("LOADCLIENT_WORKER_TOKEN"),
+		"Secret shared by a coordinator and its workers, required by --workerAddr (default $LOADCLIENT_WORKER_TOKEN)")
+	var workers stringList
+	flag.Var(&workers, "workers",
+		"If set, run as a coordinator: send the run to these worker addresses and combine the results; "+
+			"the other flags apply to each worker; may be repeated or comma-separated")
+	compare := flag.Bool("compare", false,
+		"If set, send the same load to each of two targets at the same time and print a comparison")
+	sweep := flag.String("sweep", "",
+		"If set, run at each power of two concurrency in this range (e.g. 1-1024) for --duration, "+
+			"and report the concurrency where throughput stops increasing or latency degrades")
+	sweepWarmup := flag.Duration("sweepWarmup", 5*time.Second,
+		"Time to run at each --sweep concurrency before recording results")
+	record := flag.String("record", "",
+		"If set, write the time, parameters, and outcome of each request to this file, to send again with --replay")
+	replay := flag.String("replay", "",
+		"If set, send the requests recorded by --record to the target at the same times, ignoring --sleep, --waste, "+
+			"and --rate; the run ends when they all complete, or --duration after the last is sent")
+	heapProfileURL := flag.String("heapProfileURL", "",
+		"If set, save the server's heap profile from this URL (e.g. http://localhost:8080/debug/pprof/heap) "+
+			"at --heapProfiles, next to --output")
+	heapProfiles := flag.String("heapProfiles", heapProfilePeak+","+heapProfileEnd,
+		"Comma-separated points to save --heapProfileURL: peak (after the interval with the highest request rate), "+
+			"end, or times since the start (e.g. 30s)")
+	slo := &sloTargets{}
+	flag.DurationVar(&slo.p99, "sloP99", 0,
+		"If set, print an SLO verdict and exit with status 4 if the 99th percentile latency exceeds this (e.g. 200ms)")
+	flag.Var(&slo.availability, "sloAvailability",
+		"If set, print an SLO verdict and exit with status 4 if fewer requests than this succeed (e.g. 99.9%); "+
+			"rate limited requests count as unavailable")
+	flag.Parse()
+
+	if *workerAddr != "" {
+		err := serveWorker(*workerAddr, *workerToken)
+		if err != nil {
+			panic(err)
+		}
+		return
 	}
-	close(totalRequestsChan)
 
-	log.Printf("sent %d requests in %s using %d clients = %.3f reqs/sec",
-		totalRequests, duration.String(), *concurrent, float64(totalRequests)/duration.Seconds())
+	// stop the run on Ctrl-C, and report the results so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// a second Ctrl-C exits immediately
+		stop()
+	}()
+
+	if (*record != "" || *replay != "") && (len(workers) > 0 || *sweep != "") {
+		panic("--record and --replay do not support --workers or --sweep")
+	}
+	if *replay != "" {
+		trace, err := loadTrace(*replay)
+		if err != nil {
+			panic(err)
+		}
+		config.trace = trace
+	}
+	if *record != "" {
+		if *compare {
+			panic("--record does not support --compare")
+		}
+		f, err := os.Create(*record)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		config.recorder = newTraceRecorder(f)
+	}
+
+	if *heapProfileURL != "" {
+		if len(workers) > 0 || *compare || *sweep != "" {
+			panic("--heapProfileURL does not support --workers, --compare, or --sweep")
+		}
+		profiler, err := newHeapProfiler(*heapProfileURL, *heapProfiles, *output)
+		if err != nil {
+			panic(err)
+		}
+		config.heapProfiler = profiler
+	}
+
+	if *compare {
+		if len(workers) > 0 || *output != "" || slo.enabled() {
+			panic("--compare does not support --workers, --output, or --slo* flags")
+		}
+		allResults, err := runComparison(ctx, config)
+		if err != nil {
+			panic(err)
+		}
+		names := append(append([]string{}, config.httpTargets...), config.grpcTargets...)
+		err = writeComparison(os.Stdout, names, allResults)
+		if err != nil {
+			panic(err)
+		}
+		if ctx.Err() != nil {
+			os.Exit(exitInterrupted)
+		}
+		return
+	}
+
+	if *sweep != "" {
+		if len(workers) > 0 || *output != "" || *compare || slo.enabled() {
+			panic("--sweep does not support --workers, --output, --compare, or --slo* flags")
+		}
+		concurrencies, err := parseSweep(*sweep)
+		if err != nil {
+			panic(err)
+		}
+		steps, err := runSweep(ctx, config, concurrencies, *sweepWarmup)
+		if err != nil {
+			panic(err)
+		}
+		err = writeSweep(os.Stdout, steps)
+		if err != nil {
+			panic(err)
+		}
+		if ctx.Err() != nil {
+			os.Exit(exitInterrupted)
+		}
+		return
+	}
+
+	var results *results
+	var err error
+	if len(workers) > 0 {
+		results, err = coordinate(ctx, workers, *workerToken, coordinatorArgs())
+	} else {
+		results, err = run(ctx, config)
+	}
+	if err != nil {
+		panic(err)
+	}
+	interrupted := ctx.Err() != nil
+	if interrupted {
+		log.Printf("interrupted: reporting the results of the partial run")
+	}
+
+	latencies := &results.latencies
+	elapsed := results.end.Sub(results.start)
+	counts := countStatuses(results.statuses)
+	log.Printf("sent %d successful requests in %s using %d clients = %.3f reqs/sec",
+		latencies.count, elapsed.Round(time.Millisecond), config.concurrent,
+		float64(latencies.count)/elapsed.Seconds())
+	log.Printf("%s", counts.String())
+	log.Printf("latency %s", latencies.String())
+	if config.autoscaleP99 > 0 && len(workers) == 0 {
+		log.Printf("sustainable concurrency %d with p99 <= %s", results.sustainableConcurrency, config.autoscaleP99)
+	}
+	if results.maxServerMemory.sys > 0 {
+		log.Printf("max server memory heap_alloc=%s sys=%s",
+			mebibytes(results.maxServerMemory.heapAlloc), mebibytes(results.maxServerMemory.sys))
+	}
+
+	if config.recorder != nil {
+		err := config.recorder.flush()
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("recorded requests to %s", *record)
+	}
+
+	if *output != "" {
+		err := writeReport(*output, newRunReport(results, results.end))
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("wrote results to %s", *output)
+	}
+
+	if config.maxErrorRate > 0 && (results.errorBudgetExceeded || counts.errorRate() > config.maxErrorRate) {
+		log.Printf("FAILED: error rate %.4f exceeds --maxErrorRate=%.4f", counts.errorRate(), config.maxErrorRate)
+		os.Exit(exitErrorBudget)
+	}
+	if slo.enabled() {
+		passed, err := writeSLOVerdict(os.Stdout, slo.evaluate(results))
+		if err != nil {
+			panic(err)
+		}
+		if !passed {
+			os.Exit(exitSLOViolated)
+		}
+	}
+	if interrupted {
+		os.Exit(exitInterrupted)
+	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit/grpclimit"
+	"github.com/evanj/concurrentlimit/sleepymemory"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type fakeSleeper struct {
+	sleepymemory.UnimplementedSleeperServer
+}
+
+func (f *fakeSleeper) Sleep(ctx context.Context, req *sleepymemory.SleepRequest) (*sleepymemory.SleepResponse, error) {
+	return &sleepymemory.SleepResponse{}, nil
+}
+
+func TestUnixSocketTargets(t *testing.T) {
+	req := &sleepymemory.SleepRequest{SleepDuration: sleepymemory.Duration(1500 * time.Millisecond)}
+	dir := t.TempDir()
+
+	httpPath := filepath.Join(dir, "http.sock")
+	httpListener, err := net.Listen("unix", httpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("sleep") != "1.5s" {
+			http.Error(w, "expected sleep=1.5s: "+r.FormValue("sleep"), http.StatusBadRequest)
+		}
+	})
+	httpServer := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+	go httpServer.Serve(httpListener)
+	defer httpServer.Close()
+
+	for _, version := range []string{httpVersion1, httpVersionH2C} {
+		sender, err := newHTTPSender("unix://"+httpPath, httpOptions{version: version, method: http.MethodGet})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := sender.clone().send(req)
+		if err != nil || status != statusHTTPOK {
+			t.Errorf("version=%s: status=%s err=%v", version, status, err)
+		}
+	}
+	_, err = newHTTPSender("unix://"+httpPath, httpOptions{version: httpVersion2, method: http.MethodGet})
+	if err == nil {
+		t.Error("expected error for HTTP/2 with TLS over a Unix socket")
+	}
+
+	grpcPath := filepath.Join(dir, "grpc.sock")
+	grpcListener, err := net.Listen("unix", grpcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	sleepymemory.RegisterSleeperServer(grpcServer, &fakeSleeper{})
+	go grpcServer.Serve(grpcListener)
+	defer grpcServer.Stop()
+
+	status, err := newGRPCSender("unix://"+grpcPath, grpcOptions{}).send(req)
+	if err != nil || status != statusOK {
+		t.Errorf("gRPC: status=%s err=%v", status, err)
+	}
+}
+
+// countingSleeper reports a fixed utilization and counts its requests.
+type countingSleeper struct {
+	sleepymemory.UnimplementedSleeperServer
+	utilization string
+	requests    atomic.Int64
+}
+
+func (c *countingSleeper) Sleep(ctx context.Context, req *sleepymemory.SleepRequest) (*sleepymemory.SleepResponse, error) {
+	c.requests.Add(1)
+	err := grpc.SetTrailer(ctx, metadata.Pairs(grpclimit.LoadTrailerKey, c.utilization))
+	return &sleepymemory.SleepResponse{}, err
+}
+
+func TestLeastLoadedTarget(t *testing.T) {
+	dir := t.TempDir()
+	var targets []string
+	var sleepers []*countingSleeper
+	for i, utilization := range []string{"0.9", "0.1"} {
+		path := filepath.Join(dir, strconv.Itoa(i)+".sock")
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := grpc.NewServer()
+		sleeper := &countingSleeper{utilization: utilization}
+		sleepymemory.RegisterSleeperServer(server, sleeper)
+		go server.Serve(listener)
+		defer server.Stop()
+		targets = append(targets, "unix://"+path)
+		sleepers = append(sleepers, sleeper)
+	}
+
+	config := &runConfig{grpcTargets: targets, leastLoaded: true, method: http.MethodGet}
+	sender, err := config.newTargetsSender(&sleepymemory.SleepRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const requests = 100
+	for i := 0; i < requests; i++ {
+		status, err := sender.send(&sleepymemory.SleepRequest{})
+		if err != nil || status != statusOK {
+			t.Fatalf("status=%s err=%v", status, err)
+		}
+	}
+	if sleepers[1].requests.Load() < requests*6/10 {
+		t.Errorf("expected most requests to use the less loaded server: %d %d",
+			sleepers[0].requests.Load(), sleepers[1].requests.Load())
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+	"google.golang.org/grpc/metadata"
+)
+
+// stringList is a flag.Value that can be repeated or contain comma-separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			*l = append(*l, part)
+		}
+	}
+	return nil
+}
+
+// keyValue is one value of a keyValueList.
+type keyValue struct {
+	key   string
+	value string
+}
+
+// keyValueList is a flag.Value for "key=value" pairs that can be repeated. Unlike stringList,
+// values are not split on commas, since header values can contain them.
+type keyValueList []keyValue
+
+func (l *keyValueList) String() string {
+	return strings.Join(l.values(), ",")
+}
+
+func (l *keyValueList) Set(value string) error {
+	key, v, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("invalid %#v: must be key=value", value)
+	}
+	*l = append(*l, keyValue{key, v})
+	return nil
+}
+
+// values returns each pair as "key=value", in the format passed to Set.
+func (l *keyValueList) values() []string {
+	values := make([]string, len(*l))
+	for i, kv := range *l {
+		values[i] = kv.key + "=" + kv.value
+	}
+	return values
+}
+
+// httpHeader returns the pairs as an HTTP header.
+func (l keyValueList) httpHeader() http.Header {
+	header := http.Header{}
+	for _, kv := range l {
+		header.Add(kv.key, kv.value)
+	}
+	return header
+}
+
+// metadata returns the pairs as gRPC metadata.
+func (l keyValueList) metadata() metadata.MD {
+	md := metadata.MD{}
+	for _, kv := range l {
+		md.Append(kv.key, kv.value)
+	}
+	return md
+}
+
+// parseWeights parses a comma-separated list of n positive integer weights. If s is empty, it
+// returns n equal weights.
+func parseWeights(s string, n int) ([]int, error) {
+	weights := make([]int, 0, n)
+	if s == "" {
+		for i := 0; i < n; i++ {
+			weights = append(weights, 1)
+		}
+		return weights, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight %#v: must be an integer > 0", part)
+		}
+		weights = append(weights, weight)
+	}
+	if len(weights) != n {
+		return nil, fmt.Errorf("got %d weights for %d targets", len(weights), n)
+	}
+	return weights, nil
+}
+
+// multiSender distributes requests across senders in proportion to their weights, using the
+// "smooth weighted round-robin" algorithm from nginx. With equal weights, it is round-robin.
+type multiSender struct {
+	senders []requestSender
+	weights []int
+	current []int
+	total   int
+}
+
+func newMultiSender(senders []requestSender, weights []int) *multiSender {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	return &multiSender{senders, weights, make([]int, len(senders)), total}
+}
+
+func (m *multiSender) clone() requestSender {
+	cloned := make([]requestSender, len(m.senders))
+	for i, sender := range m.senders {
+		cloned[i] = sender.clone()
+	}
+	return newMultiSender(cloned, m.weights)
+}
+
+// pick returns the index of the next sender to use.
+func (m *multiSender) pick() int {
+	best := 0
+	for i, weight := range m.weights {
+		m.current[i] += weight
+		if m.current[i] > m.current[best] {
+			best = i
+		}
+	}
+	m.current[best] -= m.total
+	return best
+}
+
+func (m *multiSender) send(req *sleepymemory.SleepRequest) (string, error) {
+	return m.senders[m.pick()].send(req)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestStringList(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	var list stringList
+	flags.Var(&list, "target", "")
+	err := flags.Parse([]string{"--target=a,b", "--target", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string(list), []string{"a", "b", "c"}) {
+		t.Error("unexpected list:", list)
+	}
+}
+
+func TestMultiSenderPick(t *testing.T) {
+	weights, err := parseWeights("3,1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMultiSender(make([]requestSender, 2), weights)
+	picks := []int{}
+	for i := 0; i < 8; i++ {
+		picks = append(picks, m.pick())
+	}
+	// the heavier sender is picked 3 times as often, and the lighter one is spread out
+	expected := []int{0, 0, 1, 0, 0, 0, 1, 0}
+	if !reflect.DeepEqual(picks, expected) {
+		t.Error("unexpected picks:", picks)
+	}
+
+	for _, invalid := range []string{"1", "1,0", "1,x"} {
+		_, err := parseWeights(invalid, 2)
+		if err == nil {
+			t.Errorf("parseWeights(%#v) must fail", invalid)
+		}
+	}
+}
+
+func TestKeyValueList(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	var list keyValueList
+	flags.Var(&list, "header", "")
+	err := flags.Parse([]string{"--header=X-Tenant=a", "--header", "Accept=text/html, text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := list.httpHeader()
+	if header.Get("X-Tenant") != "a" || header.Get("Accept") != "text/html, text/plain" {
+		t.Error("unexpected header:", header)
+	}
+	md := list.metadata()
+	if !reflect.DeepEqual(md.Get("x-tenant"), []string{"a"}) {
+		t.Error("unexpected metadata:", md)
+	}
+
+	for _, invalid := range []string{"novalue", "=value"} {
+		if list.Set(invalid) == nil {
+			t.Errorf("Set(%#v) must fail", invalid)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+)
+
+// sendAtRate sends requests at the rate described by profile until done is closed, independent of
+// how long the requests take. The latency of each request is measured from the time it was
+// scheduled to be sent, so delays caused by the server slowing down are included, avoiding
+// "coordinated omission". Requests are sent using one of senders, so at most len(senders) requests
+// are in flight: the rest wait for a sender, and that time counts as latency. Requests still
+// waiting for a sender when done is closed are not sent. It returns after all sent requests have
+// completed.
+func sendAtRate(
+	done <-chan struct{}, profile loadProfile, senders chan requestSender,
+	req *sleepymemory.SleepRequest, results *results,
+) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	// consume the first tick: with go.mod's Go version, Reset does not discard a pending tick
+	<-timer.C
+	// start before the beginning of the profile to find the first request
+	for elapsed, ok := profile.next(-1); ok; elapsed, ok = profile.next(elapsed) {
+		intended := start.Add(elapsed)
+		timer.Reset(time.Until(intended))
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendScheduled(done, senders, req, results, intended)
+		}()
+	}
+}
+
+// sendScheduled waits for one of senders, sends req, and records its latency since intended, the
+// time it was scheduled to be sent. If done is closed while waiting for a sender, req is not sent.
+func sendScheduled(
+	done <-chan struct{}, senders chan requestSender, req *sleepymemory.SleepRequest, results *results,
+	intended time.Time,
+) {
+	var sender requestSender
+	select {
+	case <-done:
+		// the run ended while waiting for a sender: drop the request
+		return
+	case sender = <-senders:
+	}
+	defer func() { senders <- sender }()
+
+	results.inFlight.Add(1)
+	status, err := sender.send(req)
+	results.inFlight.Add(-1)
+	if err != nil {
+		// open-loop clients do not retry: the request is lost
+		results.recordFailure(status, err)
+		return
+	}
+	results.record(status, time.Since(intended))
+}
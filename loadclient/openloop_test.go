@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+)
+
+// blockingSender records the time of each request, and blocks until unblock is closed.
+type blockingSender struct {
+	unblock chan struct{}
+	mu      sync.Mutex
+	sent    []time.Time
+}
+
+func (b *blockingSender) clone() requestSender {
+	return b
+}
+
+func (b *blockingSender) send(req *sleepymemory.SleepRequest) (string, error) {
+	b.mu.Lock()
+	b.sent = append(b.sent, time.Now())
+	b.mu.Unlock()
+	<-b.unblock
+	return statusHTTPOK, nil
+}
+
+func TestSendAtRate(t *testing.T) {
+	// the first request is sent at the start of the profile, not immediately
+	sender := &blockingSender{unblock: make(chan struct{})}
+	close(sender.unblock)
+	senders := make(chan requestSender, 1)
+	senders <- sender
+	profile := loadProfile{{100 * time.Millisecond, 150 * time.Millisecond, 1, 1}}
+	start := time.Now()
+	sendAtRate(make(chan struct{}), profile, senders, &sleepymemory.SleepRequest{}, newResults(start, 0))
+	if len(sender.sent) != 1 || sender.sent[0].Sub(start) < 100*time.Millisecond {
+		t.Errorf("expected one request after 100ms: %v", sender.sent)
+	}
+
+	// requests waiting for a sender are dropped when the run ends
+	<-senders
+	sender = &blockingSender{unblock: make(chan struct{})}
+	senders <- sender
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(done)
+		time.Sleep(10 * time.Millisecond)
+		close(sender.unblock)
+	}()
+	sendAtRate(done, constantProfile(1000, time.Minute), senders, &sleepymemory.SleepRequest{},
+		newResults(time.Now(), 0))
+	if len(sender.sent) != 1 {
+		t.Errorf("expected only the request in flight when the run ended to be sent: %d", len(sender.sent))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// delayRange is a flag.Value for a fixed duration like "1s", or a range like "500ms-1.5s" that
+// means a uniformly random duration in the range.
+type delayRange struct {
+	min time.Duration
+	max time.Duration
+}
+
+func (d *delayRange) String() string {
+	if d.min == d.max {
+		return d.min.String()
+	}
+	return d.min.String() + "-" + d.max.String()
+}
+
+func (d *delayRange) Set(value string) error {
+	min, max, err := parseRange(value, parseProfileDuration)
+	if err != nil {
+		return err
+	}
+	if min < 0 || max < min {
+		return fmt.Errorf("invalid range %#v: must be >= 0 and increasing", value)
+	}
+	d.min = min
+	d.max = max
+	return nil
+}
+
+// random returns a random duration in the range.
+func (d delayRange) random(r *rand.Rand) time.Duration {
+	if d.min == d.max {
+		return d.min
+	}
+	return d.min + time.Duration(r.Int63n(int64(d.max-d.min)+1))
+}
+
+// pacer computes the delay between requests sent by one closed-loop goroutine, to emulate users
+// instead of a tight loop. It is not safe for concurrent use: each goroutine should have its own.
+type pacer struct {
+	// thinkTime is the delay between receiving a response and sending the next request
+	thinkTime delayRange
+	// pace is the minimum time between starting requests
+	pace delayRange
+	rand *rand.Rand
+}
+
+func newPacer(thinkTime delayRange, pace delayRange) *pacer {
+	return &pacer{thinkTime, pace, rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// delay returns the time to wait before sending the next request, after a request that took
+// elapsed. It satisfies both the think time and the pace.
+func (p *pacer) delay(elapsed time.Duration) time.Duration {
+	delay := p.thinkTime.random(p.rand)
+	paceDelay := p.pace.random(p.rand) - elapsed
+	if paceDelay > delay {
+		delay = paceDelay
+	}
+	return delay
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestDelayRange(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	var fixed delayRange
+	var random delayRange
+	flags.Var(&fixed, "fixed", "")
+	flags.Var(&random, "random", "")
+	err := flags.Parse([]string{"--fixed=100ms", "--random=1s-2s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed.String() != "100ms" || random.String() != "1s-2s" {
+		t.Errorf("unexpected ranges: %s %s", fixed.String(), random.String())
+	}
+
+	for _, invalid := range []string{"x", "-1s", "2s-1s"} {
+		var d delayRange
+		if d.Set(invalid) == nil {
+			t.Errorf("Set(%#v) must fail", invalid)
+		}
+	}
+
+	p := newPacer(random, delayRange{})
+	for i := 0; i < 100; i++ {
+		delay := p.delay(0)
+		if delay < time.Second || delay > 2*time.Second {
+			t.Fatalf("delay=%s must be between 1s and 2s", delay)
+		}
+	}
+}
+
+func TestPacerDelay(t *testing.T) {
+	p := newPacer(delayRange{10 * time.Millisecond, 10 * time.Millisecond}, delayRange{time.Second, time.Second})
+	// the pace requires waiting for the rest of the second
+	if delay := p.delay(300 * time.Millisecond); delay != 700*time.Millisecond {
+		t.Errorf("delay=%s; expected 700ms", delay)
+	}
+	// the think time applies after slow requests
+	if delay := p.delay(2 * time.Second); delay != 10*time.Millisecond {
+		t.Errorf("delay=%s; expected 10ms", delay)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadProfile describes the request rate over time, as a sequence of steps in time order.
+type loadProfile []profileStep
+
+// profileStep sends requests from start to end, with a rate that changes linearly from startRate
+// to endRate in requests per second.
+type profileStep struct {
+	start     time.Duration
+	end       time.Duration
+	startRate float64
+	endRate   float64
+}
+
+// constantProfile returns a profile that sends rate requests per second for duration.
+func constantProfile(rate float64, duration time.Duration) loadProfile {
+	return loadProfile{{0, duration, rate, rate}}
+}
+
+// parseProfile parses a comma-separated list of steps, where each step is start-end:rate, or
+// start-end:startRate-endRate to ramp the rate. Times are Go durations and rates may have an
+// optional "rps" suffix. For example: "0-60s:100rps,60s-2m:100-500rps".
+func parseProfile(s string) (loadProfile, error) {
+	profile := loadProfile{}
+	for _, stepString := range strings.Split(s, ",") {
+		timesString, ratesString, ok := strings.Cut(strings.TrimSpace(stepString), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid profile step %#v: expected start-end:rate", stepString)
+		}
+
+		step := profileStep{}
+		var err error
+		step.start, step.end, err = parseRange(timesString, parseProfileDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile step %#v: %w", stepString, err)
+		}
+		step.startRate, step.endRate, err = parseRange(strings.TrimSuffix(ratesString, "rps"), parseRate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile step %#v: %w", stepString, err)
+		}
+
+		if step.end <= step.start {
+			return nil, fmt.Errorf("invalid profile step %#v: end must be after start", stepString)
+		}
+		if len(profile) > 0 && step.start < profile[len(profile)-1].end {
+			return nil, fmt.Errorf("invalid profile step %#v: overlaps the previous step", stepString)
+		}
+		profile = append(profile, step)
+	}
+	return profile, nil
+}
+
+// parseRange parses "a-b" or "a" (meaning "a-a") using parse.
+func parseRange[T any](s string, parse func(string) (T, error)) (T, T, error) {
+	startString, endString, isRange := strings.Cut(s, "-")
+	start, err := parse(startString)
+	if err != nil {
+		return start, start, err
+	}
+	if !isRange {
+		return start, start, nil
+	}
+	end, err := parse(endString)
+	return start, end, err
+}
+
+// parseProfileDuration parses a Go duration, also permitting "0" without a unit.
+func parseProfileDuration(s string) (time.Duration, error) {
+	if s == "0" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 {
+		return 0, fmt.Errorf("rate=%f must be >= 0", rate)
+	}
+	return rate, nil
+}
+
+// duration returns the time the last step ends.
+func (p loadProfile) duration() time.Duration {
+	if len(p) == 0 {
+		return 0
+	}
+	return p[len(p)-1].end
+}
+
+// rate returns the rate of requests per second at elapsed.
+func (p loadProfile) rate(elapsed time.Duration) float64 {
+	for _, step := range p {
+		if step.start <= elapsed && elapsed < step.end {
+			fraction := float64(elapsed-step.start) / float64(step.end-step.start)
+			return step.startRate + fraction*(step.endRate-step.startRate)
+		}
+	}
+	return 0
+}
+
+// next returns the time to send the request after a request sent at elapsed. It returns false if
+// there are no more requests to send.
+func (p loadProfile) next(elapsed time.Duration) (time.Duration, bool) {
+	for _, step := range p {
+		if elapsed >= step.end {
+			continue
+		}
+		if elapsed < step.start {
+			elapsed = step.start
+			if step.startRate > 0 {
+				return elapsed, true
+			}
+		}
+
+		// find the time d when the integral of the rate from elapsed is one request. The rate is
+		// r + k*d, so the integral is r*d + k*d^2/2 = 1.
+		r := p.rate(elapsed)
+		k := (step.endRate - step.startRate) / (step.end - step.start).Seconds()
+		var seconds float64
+		if k == 0 {
+			if r <= 0 {
+				// a pause: no requests until the next step
+				elapsed = step.end
+				continue
+			}
+			seconds = 1 / r
+		} else {
+			discriminant := r*r + 2*k
+			if discriminant < 0 {
+				// the rate decreases to zero before sending another request
+				elapsed = step.end
+				continue
+			}
+			seconds = (math.Sqrt(discriminant) - r) / k
+		}
+
+		next := elapsed + time.Duration(seconds*float64(time.Second))
+		if next < step.end {
+			return next, true
+		}
+		elapsed = step.end
+	}
+	return 0, false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProfile(t *testing.T) {
+	profile, err := parseProfile("0-60s:100rps, 60s-2m:100-500rps,3m-4m:0-10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := loadProfile{
+		{0, time.Minute, 100, 100},
+		{time.Minute, 2 * time.Minute, 100, 500},
+		{3 * time.Minute, 4 * time.Minute, 0, 10},
+	}
+	if len(profile) != len(expected) {
+		t.Fatalf("profile=%v", profile)
+	}
+	for i := range profile {
+		if profile[i] != expected[i] {
+			t.Errorf("step %d=%v; expected %v", i, profile[i], expected[i])
+		}
+	}
+	if profile.duration() != 4*time.Minute {
+		t.Error("unexpected duration:", profile.duration())
+	}
+	if rate := profile.rate(90 * time.Second); rate != 300 {
+		t.Error("unexpected ramp rate:", rate)
+	}
+	if rate := profile.rate(150 * time.Second); rate != 0 {
+		t.Error("unexpected rate between steps:", rate)
+	}
+
+	for _, invalid := range []string{"", "0-60s", "60s-0:10", "0-60s:x", "0-60s:-1", "0-60s:1,30s-90s:1"} {
+		_, err := parseProfile(invalid)
+		if err == nil {
+			t.Errorf("parseProfile(%#v) must fail", invalid)
+		}
+	}
+}
+
+func TestProfileNext(t *testing.T) {
+	profile, err := parseProfile("0-1s:10,2s-3s:0-9")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for elapsed, ok := time.Duration(0), true; ok; elapsed, ok = profile.next(elapsed) {
+		count++
+		if profile.rate(elapsed) == 0 {
+			t.Error("request scheduled with a rate of zero:", elapsed)
+		}
+	}
+	// 10 requests in the first step, and 4 in the ramp from 0 to 9 requests/second
+	if count != 14 {
+		t.Error("unexpected requests:", count)
+	}
+}
+
+func TestProfileNextPause(t *testing.T) {
+	profile, err := parseProfile("0-10s:0,10s-20s:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elapsed, ok := profile.next(-1)
+	if !ok || elapsed != 10200*time.Millisecond {
+		t.Fatal("expected the first request after the pause:", elapsed, ok)
+	}
+	count := 0
+	for ; ok; elapsed, ok = profile.next(elapsed) {
+		count++
+		if elapsed < 10*time.Second || elapsed >= 20*time.Second {
+			t.Fatal("request scheduled outside the second step:", elapsed)
+		}
+	}
+	if count != 49 {
+		t.Error("unexpected requests:", count)
+	}
+
+	// a profile that only pauses sends no requests
+	_, ok = constantProfile(0, time.Minute).next(-1)
+	if ok {
+		t.Error("expected no requests with a rate of zero")
+	}
+}
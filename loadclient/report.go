@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// runReport is the machine-readable summary of a run written by --output.
+type runReport struct {
+	Config            map[string]string `json:"config"`
+	Start             time.Time         `json:"start"`
+	DurationSeconds   float64           `json:"duration_seconds"`
+	Requests          uint64            `json:"requests"`
+	RequestsPerSecond float64           `json:"requests_per_second"`
+	OK                uint64            `json:"ok"`
+	RateLimited       uint64            `json:"rate_limited"`
+	Timeouts          uint64            `json:"timeouts"`
+	Errors            uint64            `json:"errors"`
+	Latency           latencySummary    `json:"latency"`
+	Statuses          map[string]uint64 `json:"statuses"`
+	Intervals         []intervalReport  `json:"intervals"`
+	// the maximum memory used by the server, if --statsURL is set
+	MaxServerHeapAllocBytes uint64 `json:"max_server_heap_alloc_bytes,omitempty"`
+	MaxServerSysBytes       uint64 `json:"max_server_sys_bytes,omitempty"`
+	// the highest concurrency that met the target latency, if --autoscaleP99 is set
+	SustainableConcurrency int `json:"sustainable_concurrency,omitempty"`
+}
+
+// intervalReport summarizes the requests that completed during one interval of a run.
+type intervalReport struct {
+	StartSeconds      float64           `json:"start_seconds"`
+	DurationSeconds   float64           `json:"duration_seconds"`
+	Requests          uint64            `json:"requests"`
+	RequestsPerSecond float64           `json:"requests_per_second"`
+	Latency           latencySummary    `json:"latency"`
+	Statuses          map[string]uint64 `json:"statuses"`
+	// the maximum memory used by the server during the interval, if --statsURL is set
+	MaxServerHeapAllocBytes uint64 `json:"max_server_heap_alloc_bytes,omitempty"`
+	MaxServerSysBytes       uint64 `json:"max_server_sys_bytes,omitempty"`
+}
+
+// latencySummary contains latency percentiles in milliseconds.
+type latencySummary struct {
+	MeanMS float64 `json:"mean_ms"`
+	P50MS  float64 `json:"p50_ms"`
+	P90MS  float64 `json:"p90_ms"`
+	P99MS  float64 `json:"p99_ms"`
+	P999MS float64 `json:"p999_ms"`
+	MaxMS  float64 `json:"max_ms"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func summarizeLatency(h *latencyHistogram) latencySummary {
+	return latencySummary{
+		MeanMS: milliseconds(h.mean()),
+		P50MS:  milliseconds(h.percentile(50)),
+		P90MS:  milliseconds(h.percentile(90)),
+		P99MS:  milliseconds(h.percentile(99)),
+		P999MS: milliseconds(h.percentile(99.9)),
+		MaxMS:  milliseconds(h.max),
+	}
+}
+
+// newRunReport summarizes results for a run that ended at end. It must be called after all
+// requests have completed.
+func newRunReport(results *results, end time.Time) *runReport {
+	config := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = f.Value.String()
+	})
+
+	duration := end.Sub(results.start)
+	report := &runReport{
+		Config:            config,
+		Start:             results.start,
+		DurationSeconds:   duration.Seconds(),
+		Requests:          results.latencies.count,
+		RequestsPerSecond: float64(results.latencies.count) / duration.Seconds(),
+		Latency:           summarizeLatency(&results.latencies),
+		Statuses:          results.statuses,
+
+		MaxServerHeapAllocBytes: results.maxServerMemory.heapAlloc,
+		MaxServerSysBytes:       results.maxServerMemory.sys,
+		SustainableConcurrency:  results.sustainableConcurrency,
+	}
+	counts := countStatuses(results.statuses)
+	report.OK = counts.ok
+	report.RateLimited = counts.rateLimited
+	report.Timeouts = counts.timeouts
+	report.Errors = counts.errors
+	for _, interval := range results.intervals {
+		intervalDuration := interval.end.Sub(interval.start)
+		report.Intervals = append(report.Intervals, intervalReport{
+			StartSeconds:      interval.start.Sub(results.start).Seconds(),
+			DurationSeconds:   intervalDuration.Seconds(),
+			Requests:          interval.latencies.count,
+			RequestsPerSecond: float64(interval.latencies.count) / intervalDuration.Seconds(),
+			Latency:           summarizeLatency(&interval.latencies),
+			Statuses:          interval.statuses,
+
+			MaxServerHeapAllocBytes: interval.maxServerMemory.heapAlloc,
+			MaxServerSysBytes:       interval.maxServerMemory.sys,
+		})
+	}
+	return report
+}
+
+// writeReport writes report to path, as CSV if it ends with .csv, as an HTML page with charts if
+// it ends with .html, otherwise as JSON.
+func writeReport(path string, report *runReport) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".csv":
+		err = writeCSVReport(f, report)
+	case ".html":
+		err = writeHTMLReport(f, report)
+	default:
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeCSVReport writes one row for each interval of report, with one column for each status.
+func writeCSVReport(f *os.File, report *runReport) error {
+	statuses := make([]string, 0, len(report.Statuses))
+	for status := range report.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	w := csv.NewWriter(f)
+	header := []string{"start_seconds", "duration_seconds", "requests", "requests_per_second",
+		"mean_ms", "p50_ms", "p90_ms", "p99_ms", "p999_ms", "max_ms"}
+	for _, status := range statuses {
+		header = append(header, "status_"+status)
+	}
+	includeServerMemory := report.MaxServerSysBytes > 0
+	if includeServerMemory {
+		header = append(header, "max_server_heap_alloc_bytes", "max_server_sys_bytes")
+	}
+	err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', 3, 64)
+	}
+	for _, interval := range report.Intervals {
+		row := []string{
+			formatFloat(interval.StartSeconds),
+			formatFloat(interval.DurationSeconds),
+			strconv.FormatUint(interval.Requests, 10),
+			formatFloat(interval.RequestsPerSecond),
+			formatFloat(interval.Latency.MeanMS),
+			formatFloat(interval.Latency.P50MS),
+			formatFloat(interval.Latency.P90MS),
+			formatFloat(interval.Latency.P99MS),
+			formatFloat(interval.Latency.P999MS),
+			formatFloat(interval.Latency.MaxMS),
+		}
+		for _, status := range statuses {
+			row = append(row, strconv.FormatUint(interval.Statuses[status], 10))
+		}
+		if includeServerMemory {
+			row = append(row, strconv.FormatUint(interval.MaxServerHeapAllocBytes, 10),
+				strconv.FormatUint(interval.MaxServerSysBytes, 10))
+		}
+		err = w.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("writing CSV: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+var statusOK = codes.OK.String()
+var statusHTTPOK = strconv.Itoa(http.StatusOK)
+var statusRateLimited = codes.ResourceExhausted.String()
+var statusHTTPRateLimited = strconv.Itoa(http.StatusTooManyRequests)
+
+// statusHTTPOverloaded is the status of HTTP requests rejected with 503 Service Unavailable and
+// Retry-After, which servers send when they are at capacity. 503 without Retry-After is an error.
+var statusHTTPOverloaded = strconv.Itoa(http.StatusServiceUnavailable) + " Retry-After"
+
+// statusTimeout is the status of requests that exceeded --requestTimeout, for both HTTP and gRPC.
+var statusTimeout = codes.DeadlineExceeded.String()
+
+// maxLoggedErrors limits the number of request errors that are logged, so a failing server does
+// not flood the output.
+const maxLoggedErrors = 10
+
+// isRateLimited returns true if status means the server rejected the request due to a limit.
+func isRateLimited(status string) bool {
+	return status == statusRateLimited || status == statusHTTPRateLimited || status == statusHTTPOverloaded
+}
+
+// isError returns true if status is neither successful nor rate limited.
+func isError(status string) bool {
+	return status != statusOK && status != statusHTTPOK && !isRateLimited(status)
+}
+
+// results accumulates the outcomes of requests sent by many goroutines, in total and for each
+// interval of the run.
+type results struct {
+	// inFlight is the number of requests that have been sent but not completed
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	start     time.Time
+	latencies latencyHistogram
+	statuses  map[string]uint64
+
+	current      *intervalResults
+	intervals    []*intervalResults
+	loggedErrors int
+
+	// completed counts all requests. When it reaches maxRequests (if > 0), maxRequestsReached is
+	// closed to stop the run.
+	completed          uint64
+	maxRequests        uint64
+	maxRequestsReached chan struct{}
+
+	// maxServerMemory is the maximum memory used by the target server, if --statsURL is set.
+	maxServerMemory serverMemory
+
+	// end is the time the run ended. It is set when all requests have completed.
+	end time.Time
+	// errorBudgetExceeded is true if the run stopped because of --maxErrorRate.
+	errorBudgetExceeded bool
+	// sustainableConcurrency is the highest concurrency that met --autoscaleP99, if it is set.
+	sustainableConcurrency int
+}
+
+// intervalResults are the outcomes of requests that completed during one interval.
+type intervalResults struct {
+	start     time.Time
+	end       time.Time
+	latencies latencyHistogram
+	statuses  map[string]uint64
+
+	// maxServerMemory is the maximum memory used by the target server during the interval, if
+	// --statsURL is set.
+	maxServerMemory serverMemory
+}
+
+func newResults(start time.Time, maxRequests uint64) *results {
+	return &results{
+		start:              start,
+		statuses:           map[string]uint64{},
+		current:            &intervalResults{start: start, statuses: map[string]uint64{}},
+		maxRequests:        maxRequests,
+		maxRequestsReached: make(chan struct{}),
+	}
+}
+
+// countCompletedLocked counts a completed request. r.mu must be held.
+func (r *results) countCompletedLocked() {
+	r.completed++
+	if r.completed == r.maxRequests {
+		close(r.maxRequestsReached)
+	}
+}
+
+// record records a successful request with status that took latency.
+func (r *results) record(status string, latency time.Duration) {
+	r.mu.Lock()
+	r.latencies.record(latency)
+	r.current.latencies.record(latency)
+	r.statuses[status]++
+	r.current.statuses[status]++
+	r.countCompletedLocked()
+	r.mu.Unlock()
+}
+
+// recordFailure records a request that failed with status and err. Errors other than rate
+// limiting are logged, up to maxLoggedErrors, so the cause of failures is visible.
+func (r *results) recordFailure(status string, err error) {
+	r.mu.Lock()
+	r.statuses[status]++
+	r.current.statuses[status]++
+	r.countCompletedLocked()
+	logError := err != errRetry && r.loggedErrors < maxLoggedErrors
+	if logError {
+		r.loggedErrors++
+	}
+	r.mu.Unlock()
+
+	if logError {
+		log.Printf("request failed status=%s: %s", status, err.Error())
+	}
+}
+
+// merge adds requests recorded by another run, such as a worker, to the totals and the current
+// interval.
+func (r *results) merge(latencies *latencyHistogram, statuses map[string]uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.latencies.merge(latencies)
+	r.current.latencies.merge(latencies)
+	for status, count := range statuses {
+		r.statuses[status] += count
+		r.current.statuses[status] += count
+	}
+}
+
+// recordServerMemory records the memory used by the target server.
+func (r *results) recordServerMemory(memory serverMemory) {
+	r.mu.Lock()
+	r.maxServerMemory = r.maxServerMemory.max(memory)
+	r.current.maxServerMemory = r.current.maxServerMemory.max(memory)
+	r.mu.Unlock()
+}
+
+// endInterval ends the current interval at now, starts a new one, and returns the ended interval.
+func (r *results) endInterval(now time.Time) *intervalResults {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ended := r.current
+	ended.end = now
+	r.intervals = append(r.intervals, ended)
+	r.current = &intervalResults{start: now, statuses: map[string]uint64{}}
+	return ended
+}
+
+// statusCounts counts requests by category of status.
+type statusCounts struct {
+	ok          uint64
+	rateLimited uint64
+	timeouts    uint64
+	errors      uint64
+}
+
+// countStatuses counts the requests in statuses by category.
+func countStatuses(statuses map[string]uint64) statusCounts {
+	counts := statusCounts{}
+	for status, count := range statuses {
+		if isRateLimited(status) {
+			counts.rateLimited += count
+		} else if status == statusTimeout {
+			counts.timeouts += count
+		} else if isError(status) {
+			counts.errors += count
+		} else {
+			counts.ok += count
+		}
+	}
+	return counts
+}
+
+// errorRate returns the fraction of requests that failed or timed out. Rate limited requests are
+// not counted as errors, since they are the expected result of overloading a limited server.
+func (c statusCounts) errorRate() float64 {
+	total := c.total()
+	if total == 0 {
+		return 0
+	}
+	return float64(c.errors+c.timeouts) / float64(total)
+}
+
+// total returns the number of requests.
+func (c statusCounts) total() uint64 {
+	return c.ok + c.rateLimited + c.timeouts + c.errors
+}
+
+func (c statusCounts) String() string {
+	return fmt.Sprintf("ok=%d rate_limited=%d timeouts=%d errors=%d",
+		c.ok, c.rateLimited, c.timeouts, c.errors)
+}
+
+// String returns a human-readable summary of the interval.
+func (i *intervalResults) String() string {
+	counts := countStatuses(i.statuses)
+	out := fmt.Sprintf("%.1f reqs/sec rate_limited=%d timeouts=%d errors=%d p50=%s p99=%s",
+		float64(i.latencies.count)/i.end.Sub(i.start).Seconds(), counts.rateLimited, counts.timeouts,
+		counts.errors,
+		roundDuration(i.latencies.percentile(50)), roundDuration(i.latencies.percentile(99)))
+	if i.maxServerMemory.sys > 0 {
+		out += fmt.Sprintf(" server_heap_alloc=%s server_sys=%s",
+			mebibytes(i.maxServerMemory.heapAlloc), mebibytes(i.maxServerMemory.sys))
+	}
+	return out
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+)
+
+// scenario is a mix of request types to send in one run, to emulate heterogeneous traffic. It is
+// read from a JSON file, for example:
+//
+//	{"requests": [
+//	  {"name": "cheap", "weight": 9, "sleep": "10ms"},
+//	  {"name": "expensive", "weight": 1, "sleep": "1s", "waste": 1048576,
+//	   "http_target": "http://localhost:8080/expensive"}
+//	]}
+type scenario struct {
+	Requests []scenarioRequest `json:"requests"`
+}
+
+// scenarioRequest is one type of request in a scenario.
+type scenarioRequest struct {
+	Name string `json:"name"`
+	// Weight is the relative number of requests of this type. The default is 1.
+	Weight int          `json:"weight"`
+	Sleep  jsonDuration `json:"sleep"`
+	Waste  int64        `json:"waste"`
+	// HTTPTarget or GRPCTarget is where to send the request. If neither is set, requests are
+	// sent to --httpTarget or --grpcTarget.
+	HTTPTarget string `json:"http_target"`
+	GRPCTarget string `json:"grpc_target"`
+}
+
+// jsonDuration is a time.Duration that is a string like "1.5s" in JSON.
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// loadScenario reads and checks the scenario in the JSON file at path.
+func loadScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &scenario{}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+
+	if len(s.Requests) == 0 {
+		return nil, fmt.Errorf("invalid scenario %s: requests must not be empty", path)
+	}
+	for i := range s.Requests {
+		request := &s.Requests[i]
+		if request.Weight == 0 {
+			request.Weight = 1
+		}
+		if request.Weight < 0 || request.Sleep < 0 || request.Waste < 0 {
+			return nil, fmt.Errorf("invalid scenario %s: request %d (%s): weight, sleep, and waste must be >= 0",
+				path, i, request.Name)
+		}
+		if request.HTTPTarget != "" && request.GRPCTarget != "" {
+			return nil, fmt.Errorf("invalid scenario %s: request %d (%s): only one of http_target or grpc_target can be set",
+				path, i, request.Name)
+		}
+	}
+	return s, nil
+}
+
+// newSender returns a sender that sends the scenario's requests in proportion to their weights.
+// Requests without a target are sent with defaultSender, which may be nil if all requests have
+// targets.
+func (s *scenario) newSender(config *runConfig, defaultSender requestSender) (requestSender, error) {
+	senders := make([]requestSender, len(s.Requests))
+	weights := make([]int, len(s.Requests))
+	for i, request := range s.Requests {
+		req := &sleepymemory.SleepRequest{
+			SleepDuration: sleepymemory.Duration(time.Duration(request.Sleep)),
+			WasteBytes:    request.Waste,
+		}
+
+		var sender requestSender
+		var err error
+		if request.HTTPTarget != "" {
+			sender, err = config.newHTTPTarget(request.HTTPTarget)
+		} else if request.GRPCTarget != "" {
+			sender, err = config.newGRPCTarget(request.GRPCTarget, req)
+		} else if defaultSender != nil {
+			sender = defaultSender
+		} else {
+			err = errors.New("requests without a target require --httpTarget or --grpcTarget")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("scenario request %d (%s): %w", i, request.Name, err)
+		}
+
+		senders[i] = &fixedRequestSender{sender, req}
+		weights[i] = request.Weight
+	}
+	return newMultiSender(senders, weights), nil
+}
+
+// fixedRequestSender sends the same request, ignoring the request passed to send.
+type fixedRequestSender struct {
+	sender requestSender
+	req    *sleepymemory.SleepRequest
+}
+
+func (f *fixedRequestSender) clone() requestSender {
+	return &fixedRequestSender{f.sender.clone(), f.req}
+}
+
+func (f *fixedRequestSender) send(req *sleepymemory.SleepRequest) (string, error) {
+	return f.sender.send(f.req)
+}
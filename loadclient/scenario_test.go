@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+)
+
+// recordingSender records the requests it sends.
+type recordingSender struct {
+	sent []*sleepymemory.SleepRequest
+}
+
+func (r *recordingSender) clone() requestSender {
+	return r
+}
+
+func (r *recordingSender) send(req *sleepymemory.SleepRequest) (string, error) {
+	r.sent = append(r.sent, req)
+	return statusHTTPOK, nil
+}
+
+func writeScenario(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "scenario.json")
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScenario(t *testing.T) {
+	path := writeScenario(t, `{"requests": [
+		{"name": "cheap", "weight": 3, "sleep": "10ms"},
+		{"name": "expensive", "sleep": "1s", "waste": 1024}
+	]}`)
+	s, err := loadScenario(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Requests[1].Weight != 1 || time.Duration(s.Requests[1].Sleep) != time.Second {
+		t.Errorf("unexpected request: %#v", s.Requests[1])
+	}
+
+	defaultSender := &recordingSender{}
+	sender, err := s.newSender(&runConfig{}, defaultSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		_, err = sender.send(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expensive := 0
+	for _, req := range defaultSender.sent {
+		if req.WasteBytes == 1024 {
+			expensive++
+		}
+	}
+	if len(defaultSender.sent) != 8 || expensive != 2 {
+		t.Errorf("expected 2 of 8 requests to be expensive: %d of %d", expensive, len(defaultSender.sent))
+	}
+
+	// requests without a target need a default
+	_, err = s.newSender(&runConfig{}, nil)
+	if err == nil {
+		t.Error("expected error without a default target")
+	}
+
+	for _, invalid := range []string{
+		`{"requests": []}`,
+		`{"requests": [{"sleep": 10}]}`,
+		`{"requests": [{"weight": -1}]}`,
+		`{"requests": [{"http_target": "http://localhost/", "grpc_target": "localhost:1"}]}`,
+	} {
+		_, err := loadScenario(writeScenario(t, invalid))
+		if err == nil {
+			t.Errorf("loadScenario(%s) must fail", invalid)
+		}
+	}
+}
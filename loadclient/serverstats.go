@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverStatsTimeout is the maximum time to wait for the server's stats.
+const serverStatsTimeout = 5 * time.Second
+
+// serverMemory is the memory used by the target server, in bytes.
+type serverMemory struct {
+	heapAlloc uint64
+	sys       uint64
+}
+
+// max returns the maximum of each value in m and other.
+func (m serverMemory) max(other serverMemory) serverMemory {
+	if other.heapAlloc > m.heapAlloc {
+		m.heapAlloc = other.heapAlloc
+	}
+	if other.sys > m.sys {
+		m.sys = other.sys
+	}
+	return m
+}
+
+// prometheusMemoryNames maps the Prometheus metrics exported by the Go client library to the
+// runtime.MemStats names used by /stats.
+var prometheusMemoryNames = map[string]string{
+	"go_memstats_heap_alloc_bytes": "HeapAlloc",
+	"go_memstats_sys_bytes":        "Sys",
+}
+
+// parseServerMemory parses the server's memory from the body of sleepyserver's /stats, which
+// contains values like "HeapAlloc=1234", or Prometheus metrics, which contain lines like
+// "go_memstats_heap_alloc_bytes 1234".
+func parseServerMemory(body io.Reader) (serverMemory, error) {
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && prometheusMemoryNames[fields[0]] != "" {
+			// Prometheus text format: values may use exponents like 1.2e+07
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err == nil {
+				values[prometheusMemoryNames[fields[0]]] = uint64(value)
+			}
+			continue
+		}
+		for _, field := range fields {
+			key, valueString, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			value, err := strconv.ParseUint(valueString, 10, 64)
+			if err == nil {
+				values[key] = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return serverMemory{}, err
+	}
+
+	heapAlloc, hasHeapAlloc := values["HeapAlloc"]
+	sys, hasSys := values["Sys"]
+	if !hasHeapAlloc || !hasSys {
+		return serverMemory{}, fmt.Errorf("server stats must contain HeapAlloc and Sys")
+	}
+	return serverMemory{heapAlloc, sys}, nil
+}
+
+// scrapeServerMemory fetches the server's memory from statsURL.
+func scrapeServerMemory(client *http.Client, statsURL string) (serverMemory, error) {
+	resp, err := client.Get(statsURL)
+	if err != nil {
+		return serverMemory{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return serverMemory{}, fmt.Errorf("expected status ok from %s: %s", statsURL, resp.Status)
+	}
+	return parseServerMemory(resp.Body)
+}
+
+// pollServerStats records the server's memory from statsURL in results every interval, until
+// done is closed.
+func pollServerStats(done <-chan struct{}, statsURL string, interval time.Duration, results *results) {
+	client := &http.Client{Timeout: serverStatsTimeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		memory, err := scrapeServerMemory(client, statsURL)
+		if err != nil {
+			// the server may be overloaded or restarting: keep polling
+			log.Printf("failed to read server stats: %s", err.Error())
+		} else {
+			results.recordServerMemory(memory)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// mebibytes formats bytes in MiB.
+func mebibytes(bytes uint64) string {
+	return fmt.Sprintf("%.1fMiB", float64(bytes)/(1<<20))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseServerMemory(t *testing.T) {
+	stats := "total bytes of memory obtained from the OS Sys=20000 19.5 KiB\n" +
+		"bytes of allocated heap objects HeapAlloc=1000 1000 B\n"
+	memory, err := parseServerMemory(strings.NewReader(stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory != (serverMemory{heapAlloc: 1000, sys: 20000}) {
+		t.Errorf("unexpected memory: %#v", memory)
+	}
+
+	metrics := "# HELP go_memstats_sys_bytes Number of bytes obtained from system.\n" +
+		"# TYPE go_memstats_sys_bytes gauge\n" +
+		"go_memstats_sys_bytes 1.2e+07\n" +
+		"go_memstats_heap_alloc_bytes 500\n"
+	memory, err = parseServerMemory(strings.NewReader(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory != (serverMemory{heapAlloc: 500, sys: 12000000}) {
+		t.Errorf("unexpected memory: %#v", memory)
+	}
+
+	_, err = parseServerMemory(strings.NewReader("HeapAlloc=1\n"))
+	if err == nil {
+		t.Error("expected error without Sys")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// percentValue is a flag.Value for a percentage such as 99.9%, stored as a fraction.
+type percentValue float64
+
+func (p *percentValue) String() string {
+	if *p == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(*p)*100, 'f', -1, 64) + "%"
+}
+
+func (p *percentValue) Set(value string) error {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	if err != nil {
+		return fmt.Errorf("invalid percentage %#v: %w", value, err)
+	}
+	if !(0 < percent && percent <= 100) {
+		return fmt.Errorf("invalid percentage %#v: must be > 0%% and <= 100%%", value)
+	}
+	*p = percentValue(percent / 100)
+	return nil
+}
+
+// sloTargets are the service level objectives a run must meet. Zero values are not checked.
+type sloTargets struct {
+	// p99 is the maximum 99th percentile latency of requests that got a response
+	p99 time.Duration
+	// availability is the minimum fraction of requests that succeeded
+	availability percentValue
+}
+
+// enabled returns true if any objective is set.
+func (s *sloTargets) enabled() bool {
+	return s.p99 > 0 || s.availability > 0
+}
+
+// sloResult is the outcome of checking one objective.
+type sloResult struct {
+	name   string
+	target string
+	actual string
+	met    bool
+}
+
+// evaluate checks results against the objectives. Rate limited requests count against
+// availability: a client that is rejected was not served, even if the server is behaving as
+// intended.
+func (s *sloTargets) evaluate(results *results) []sloResult {
+	var out []sloResult
+	if s.p99 > 0 {
+		p99 := results.latencies.percentile(99)
+		result := sloResult{name: "p99", target: "<= " + s.p99.String()}
+		if results.latencies.count == 0 {
+			result.actual = "no responses"
+		} else {
+			result.actual = roundDuration(p99).String()
+			result.met = p99 <= s.p99
+		}
+		out = append(out, result)
+	}
+	if s.availability > 0 {
+		counts := countStatuses(results.statuses)
+		result := sloResult{name: "availability", target: ">= " + s.availability.String()}
+		if counts.total() == 0 {
+			result.actual = "no requests"
+		} else {
+			availability := float64(counts.ok) / float64(counts.total())
+			result.actual = strconv.FormatFloat(availability*100, 'f', 3, 64) + "%"
+			result.met = availability >= float64(s.availability)
+		}
+		out = append(out, result)
+	}
+	return out
+}
+
+// writeSLOVerdict writes each result and the overall verdict to w, and returns true if all
+// objectives were met.
+func writeSLOVerdict(w io.Writer, sloResults []sloResult) (bool, error) {
+	passed := true
+	for _, result := range sloResults {
+		verdict := "ok"
+		if !result.met {
+			verdict = "VIOLATED"
+			passed = false
+		}
+		_, err := fmt.Fprintf(w, "slo %s: %s (target %s) %s\n", result.name, result.actual, result.target, verdict)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	verdict := "PASS"
+	if !passed {
+		verdict = "FAIL"
+	}
+	_, err := fmt.Fprintf(w, "slo verdict: %s\n", verdict)
+	return passed, err
+}
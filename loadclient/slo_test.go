@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentValue(t *testing.T) {
+	var p percentValue
+	for _, test := range []struct {
+		input    string
+		expected float64
+	}{{"99%", 0.99}, {"99.9%", 0.999}, {"100", 1}} {
+		err := p.Set(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if float64(p) < test.expected-1e-9 || float64(p) > test.expected+1e-9 {
+			t.Errorf("Set(%#v)=%f; expected %f", test.input, float64(p), test.expected)
+		}
+	}
+	if p.String() != "100%" {
+		t.Errorf("String()=%#v", p.String())
+	}
+
+	for _, invalid := range []string{"", "0%", "101%", "x%"} {
+		err := p.Set(invalid)
+		if err == nil {
+			t.Errorf("Set(%#v) must fail", invalid)
+		}
+	}
+}
+
+func TestSLOVerdict(t *testing.T) {
+	results := newResults(time.Now(), 0)
+	for i := 0; i < 198; i++ {
+		results.record(statusOK, 10*time.Millisecond)
+	}
+	results.record(statusOK, time.Second)
+	results.recordFailure(statusRateLimited, errRetry)
+
+	slo := &sloTargets{p99: 100 * time.Millisecond}
+	err := slo.availability.Set("99%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slo.enabled() {
+		t.Error("SLOs must be enabled")
+	}
+	sloResults := slo.evaluate(results)
+	if len(sloResults) != 2 || !sloResults[0].met || !sloResults[1].met {
+		t.Errorf("SLOs must be met: %#v", sloResults)
+	}
+	out := &strings.Builder{}
+	passed, err := writeSLOVerdict(out, sloResults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !passed || !strings.HasSuffix(out.String(), "slo verdict: PASS\n") {
+		t.Errorf("passed=%t out=%#v", passed, out.String())
+	}
+
+	// more rate limited requests drop availability below 99%
+	results.recordFailure(statusHTTPRateLimited, errRetry)
+	results.recordFailure(statusHTTPRateLimited, errRetry)
+	// the slow responses are now more than 1% of the responses
+	results.record(statusOK, time.Second)
+	results.record(statusOK, time.Second)
+	sloResults = slo.evaluate(results)
+	if sloResults[0].met || sloResults[1].met {
+		t.Errorf("SLOs must be violated: %#v", sloResults)
+	}
+	out.Reset()
+	passed, err = writeSLOVerdict(out, sloResults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passed || !strings.Contains(out.String(), "slo p99: ") ||
+		!strings.Contains(out.String(), "VIOLATED") || !strings.HasSuffix(out.String(), "slo verdict: FAIL\n") {
+		t.Errorf("passed=%t out=%#v", passed, out.String())
+	}
+
+	empty := slo.evaluate(newResults(time.Now(), 0))
+	if empty[0].met || empty[1].met {
+		t.Errorf("SLOs must not be met without requests: %#v", empty)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// checkStreaming returns an error if config cannot be used with --streaming.
+func checkStreaming(config *runConfig) error {
+	if len(config.grpcTargets) == 0 || len(config.httpTargets) > 0 {
+		return errors.New("--streaming requires --grpcTarget")
+	}
+	if config.streams <= 0 || config.streamRate <= 0 {
+		return errors.New("--streams and --streamRate must be > 0")
+	}
+	if config.rate > 0 || config.profile != "" || config.scenario != "" || config.grpcStream ||
+		(config.thinkTime != delayRange{}) || (config.pace != delayRange{}) {
+		return errors.New("--streaming cannot be used with --rate, --profile, --scenario, --grpcStream, --thinkTime, or --pace")
+	}
+	if config.grpcMaxIdle > 0 || config.grpcMaxStreams > 0 {
+		return errors.New("--streaming cannot be used with --grpcMaxIdle or --grpcMaxStreams")
+	}
+	return nil
+}
+
+// startStreams opens config.streams long-lived SleepStream streams, distributed round-robin
+// across the gRPC targets, until done is closed. Each response is recorded as a request, with the
+// time since the previous response on the stream as its latency, so a slow server shows up as
+// latency above the tick interval of 1/--streamRate. A stream lasts for --sleep, or for the whole
+// run if it is not set, and is reopened when it ends.
+func startStreams(done <-chan struct{}, wg *sync.WaitGroup, config *runConfig, results *results) error {
+	streamDuration := config.sleep
+	if streamDuration <= 0 {
+		streamDuration = config.duration
+	}
+	req := &sleepymemory.SleepStreamRequest{
+		SleepDuration: sleepymemory.Duration(streamDuration),
+		WasteBytes:    int64(config.waste),
+		TickInterval:  sleepymemory.Duration(time.Duration(float64(time.Second) / config.streamRate)),
+	}
+	log.Printf("opening %d streams to %v with %.1f responses/sec each ...",
+		config.streams, []string(config.grpcTargets), config.streamRate)
+
+	options := config.grpcOptions()
+	var sharedClients []sleepymemory.SleeperClient
+	if config.shareGRPC {
+		for _, target := range config.grpcTargets {
+			client, err := dialSleeper(target, options)
+			if err != nil {
+				return err
+			}
+			sharedClients = append(sharedClients, client)
+		}
+	}
+
+	for i := 0; i < config.streams; i++ {
+		target := config.grpcTargets[i%len(config.grpcTargets)]
+		var client sleepymemory.SleeperClient
+		if sharedClients != nil {
+			client = sharedClients[i%len(sharedClients)]
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &streamer{
+				target:  target,
+				options: options,
+				client:  client,
+				md:      config.grpcMetadata(),
+				backoff: newBackoff(config.backoffInitial, config.backoffMax),
+			}
+			s.run(done, req, results)
+		}()
+	}
+	return nil
+}
+
+// dialSleeper returns a client for the gRPC server at target.
+func dialSleeper(target string, options grpcOptions) (sleepymemory.SleeperClient, error) {
+	dialCtx, cancel := context.WithTimeout(context.Background(), grpcConnectTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, target, options.dialOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	return sleepymemory.NewSleeperClient(conn), nil
+}
+
+// streamer keeps one stream open to a target.
+type streamer struct {
+	target  string
+	options grpcOptions
+	// client is nil until the first stream, unless it is shared with --shareGRPC
+	client  sleepymemory.SleeperClient
+	md      metadata.MD
+	backoff *backoff
+}
+
+// run opens streams and records their responses until done is closed.
+func (s *streamer) run(done <-chan struct{}, req *sleepymemory.SleepStreamRequest, results *results) {
+	// cancel the open stream when the run ends
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+	if len(s.md) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, s.md)
+	}
+
+	for ctx.Err() == nil {
+		err := s.stream(ctx, req, results)
+		if ctx.Err() != nil {
+			// the run ended: the stream was cancelled, which is not a failure
+			return
+		}
+		if err != nil {
+			code := status.Code(err)
+			if code == codes.ResourceExhausted {
+				err = errRetry
+			}
+			results.recordFailure(code.String(), err)
+			sleepUntilDone(done, s.backoff.next())
+			continue
+		}
+		s.backoff.reset()
+	}
+}
+
+// stream opens one stream and records its responses until it ends.
+func (s *streamer) stream(ctx context.Context, req *sleepymemory.SleepStreamRequest, results *results) error {
+	if s.client == nil {
+		client, err := dialSleeper(s.target, s.options)
+		if err != nil {
+			return err
+		}
+		s.client = client
+	}
+
+	last := time.Now()
+	stream, err := s.client.SleepStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	results.inFlight.Add(1)
+	defer results.inFlight.Add(-1)
+	for {
+		_, err = stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		results.record(statusOK, now.Sub(last))
+		last = now
+	}
+}
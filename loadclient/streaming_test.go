@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+	"google.golang.org/grpc"
+)
+
+// tickingSleeper implements SleepStream by sending a response every tick interval.
+type tickingSleeper struct {
+	sleepymemory.UnimplementedSleeperServer
+}
+
+func (tickingSleeper) SleepStream(
+	req *sleepymemory.SleepStreamRequest, stream sleepymemory.Sleeper_SleepStreamServer,
+) error {
+	ticker := time.NewTicker(req.TickInterval.AsDuration())
+	defer ticker.Stop()
+	end := time.After(req.SleepDuration.AsDuration())
+	start := time.Now()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-end:
+			return nil
+		case <-ticker.C:
+			err := stream.Send(&sleepymemory.SleepStreamResponse{Elapsed: sleepymemory.Duration(time.Since(start))})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	sleepymemory.RegisterSleeperServer(grpcServer, tickingSleeper{})
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	config := &runConfig{
+		grpcTargets: stringList{listener.Addr().String()},
+		streaming:   true,
+		streams:     3,
+		streamRate:  50,
+		// streams are reopened after 100ms
+		sleep:          100 * time.Millisecond,
+		duration:       300 * time.Millisecond,
+		interval:       time.Minute,
+		backoffInitial: time.Millisecond,
+		backoffMax:     time.Millisecond,
+	}
+	results, err := run(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := countStatuses(results.statuses)
+	// 3 streams * 50 responses/sec * 0.3 sec = 45 responses
+	if counts.ok < 20 || counts.errors != 0 {
+		t.Errorf("unexpected responses: %s", counts.String())
+	}
+	if p50 := results.latencies.percentile(50); p50 < 10*time.Millisecond || p50 > 50*time.Millisecond {
+		t.Errorf("expected latencies near the 20ms tick interval: p50=%s", p50)
+	}
+
+	config.rate = 10
+	_, err = run(context.Background(), config)
+	if err == nil {
+		t.Error("expected --streaming with --rate to fail")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// sweepMinThroughputGain is the fraction that throughput must increase when concurrency doubles
+// before the sweep considers the server saturated.
+const sweepMinThroughputGain = 0.1
+
+// sweepMaxLatencyIncrease is the factor that p99 latency can increase over the lowest concurrency
+// before the sweep considers latency degraded.
+const sweepMaxLatencyIncrease = 2.0
+
+// sweepStep is the steady-state result of running at one concurrency.
+type sweepStep struct {
+	concurrent        int
+	requestsPerSecond float64
+	p50               time.Duration
+	p99               time.Duration
+	errors            uint64
+}
+
+// parseSweep parses a range of concurrencies like "1-1024", and returns the powers of two in the
+// range, as well as the end of the range if it is not a power of two.
+func parseSweep(s string) ([]int, error) {
+	start, end, err := parseRange(s, strconv.Atoi)
+	if err != nil {
+		return nil, err
+	}
+	if start <= 0 || end < start {
+		return nil, fmt.Errorf("invalid sweep %#v: must be a range like 1-1024", s)
+	}
+
+	var concurrencies []int
+	for c := start; c < end; c *= 2 {
+		concurrencies = append(concurrencies, c)
+	}
+	return append(concurrencies, end), nil
+}
+
+// runSweep runs config at each concurrency. Each step first runs for warmup without recording
+// results, so the server reaches a steady state, then records results for config.duration.
+func runSweep(ctx context.Context, config *runConfig, concurrencies []int, warmup time.Duration) ([]sweepStep, error) {
+	if config.rate > 0 || config.profile != "" {
+		return nil, errors.New("--sweep does not support --rate or --profile")
+	}
+
+	var steps []sweepStep
+	for _, concurrent := range concurrencies {
+		stepConfig := *config
+		stepConfig.concurrent = concurrent
+		if warmup > 0 {
+			log.Printf("sweep: warming up with concurrent=%d for %s ...", concurrent, warmup)
+			stepConfig.duration = warmup
+			_, err := run(ctx, &stepConfig)
+			if err != nil {
+				return nil, err
+			}
+			stepConfig.duration = config.duration
+		}
+
+		results, err := run(ctx, &stepConfig)
+		if err != nil {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			// the step was interrupted: its results are not steady state
+			break
+		}
+		step := sweepStep{
+			concurrent:        concurrent,
+			requestsPerSecond: float64(results.latencies.count) / results.end.Sub(results.start).Seconds(),
+			p50:               results.latencies.percentile(50),
+			p99:               results.latencies.percentile(99),
+			errors:            countStatuses(results.statuses).errors,
+		}
+		log.Printf("sweep: concurrent=%d %.1f reqs/sec p99=%s", concurrent, step.requestsPerSecond,
+			roundDuration(step.p99))
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// findKnee returns the index of the step with the highest concurrency before throughput stops
+// increasing or latency degrades. This is the most concurrency the server handles efficiently.
+func findKnee(steps []sweepStep) int {
+	for i := 1; i < len(steps); i++ {
+		saturated := steps[i].requestsPerSecond < steps[i-1].requestsPerSecond*(1+sweepMinThroughputGain)
+		degraded := float64(steps[i].p99) > float64(steps[0].p99)*sweepMaxLatencyIncrease
+		if saturated || degraded {
+			return i - 1
+		}
+	}
+	return len(steps) - 1
+}
+
+// writeSweep writes a table of the steps and the knee to w.
+func writeSweep(w io.Writer, steps []sweepStep) error {
+	if len(steps) == 0 {
+		_, err := fmt.Fprintln(w, "sweep: no steps completed")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "concurrent\treqs/sec\tp50\tp99\terrors\t")
+	for _, step := range steps {
+		fmt.Fprintf(tw, "%d\t%.1f\t%s\t%s\t%d\t\n", step.concurrent, step.requestsPerSecond,
+			roundDuration(step.p50), roundDuration(step.p99), step.errors)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	knee := steps[findKnee(steps)]
+	_, err = fmt.Fprintf(w, "knee: concurrent=%d %.1f reqs/sec p99=%s\n",
+		knee.concurrent, knee.requestsPerSecond, roundDuration(knee.p99))
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSweep(t *testing.T) {
+	concurrencies, err := parseSweep("1-16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(concurrencies, []int{1, 2, 4, 8, 16}) {
+		t.Error("unexpected concurrencies:", concurrencies)
+	}
+	concurrencies, err = parseSweep("3-20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(concurrencies, []int{3, 6, 12, 20}) {
+		t.Error("unexpected concurrencies:", concurrencies)
+	}
+
+	for _, invalid := range []string{"", "0-4", "8-4", "x"} {
+		_, err := parseSweep(invalid)
+		if err == nil {
+			t.Errorf("parseSweep(%#v) must fail", invalid)
+		}
+	}
+}
+
+func TestFindKnee(t *testing.T) {
+	steps := []sweepStep{
+		{concurrent: 1, requestsPerSecond: 100, p99: 10 * time.Millisecond},
+		{concurrent: 2, requestsPerSecond: 200, p99: 10 * time.Millisecond},
+		{concurrent: 4, requestsPerSecond: 390, p99: 12 * time.Millisecond},
+		// throughput is saturated
+		{concurrent: 8, requestsPerSecond: 400, p99: 20 * time.Millisecond},
+		{concurrent: 16, requestsPerSecond: 400, p99: 40 * time.Millisecond},
+	}
+	if knee := findKnee(steps); knee != 2 {
+		t.Errorf("knee=%d; expected 2", knee)
+	}
+
+	// latency degrades while throughput increases
+	steps[2].p99 = 30 * time.Millisecond
+	if knee := findKnee(steps); knee != 1 {
+		t.Errorf("knee=%d; expected 1", knee)
+	}
+
+	out := &strings.Builder{}
+	err := writeSweep(out, steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "knee: concurrent=2 200.0 reqs/sec p99=10ms") {
+		t.Error("unexpected output:", out.String())
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+)
+
+// traceRecord is one request in a trace written by --record and sent by --replay. Traces are
+// JSON with one record per line, for example:
+//
+//	{"offset":"1.5ms","sleep":"10ms","waste":1024,"status":"200","latency":"10.4ms"}
+type traceRecord struct {
+	// Offset is the time since the start of the run that the request was sent.
+	Offset     jsonDuration `json:"offset"`
+	Sleep      jsonDuration `json:"sleep"`
+	Waste      int64        `json:"waste,omitempty"`
+	Leak       bool         `json:"leak,omitempty"`
+	WasteFiles int64        `json:"waste_files,omitempty"`
+	// Status and Latency are the outcome of the recorded request. They are ignored by --replay.
+	Status  string       `json:"status"`
+	Latency jsonDuration `json:"latency"`
+}
+
+// request returns the request to send when replaying the record.
+func (t *traceRecord) request() *sleepymemory.SleepRequest {
+	return &sleepymemory.SleepRequest{
+		SleepDuration: sleepymemory.Duration(time.Duration(t.Sleep)),
+		WasteBytes:    t.Waste,
+		Leak:          t.Leak,
+		WasteFiles:    t.WasteFiles,
+	}
+}
+
+// traceRecorder writes a traceRecord for each request to a trace. It is safe for concurrent use.
+type traceRecorder struct {
+	// start is the start of the run; it is set by run before any requests are sent
+	start time.Time
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	encoder *json.Encoder
+	err     error
+}
+
+// newTraceRecorder returns a recorder that writes to w.
+func newTraceRecorder(w io.Writer) *traceRecorder {
+	buffered := bufio.NewWriter(w)
+	return &traceRecorder{w: buffered, encoder: json.NewEncoder(buffered)}
+}
+
+// record writes a record for req, sent at sent, which completed with status. Errors are returned
+// by flush.
+func (r *traceRecorder) record(req *sleepymemory.SleepRequest, sent time.Time, status string) {
+	latency := time.Since(sent)
+	record := &traceRecord{
+		Offset:     jsonDuration(sent.Sub(r.start)),
+		Sleep:      jsonDuration(req.SleepDuration.AsDuration()),
+		Waste:      req.WasteBytes,
+		Leak:       req.Leak,
+		WasteFiles: req.WasteFiles,
+		Status:     status,
+		Latency:    jsonDuration(latency),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.encoder.Encode(record)
+	}
+}
+
+// flush writes any buffered records, and returns the first error.
+func (r *traceRecorder) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	return r.err
+}
+
+// traceSender records each request sent by sender to a trace.
+type traceSender struct {
+	sender   requestSender
+	recorder *traceRecorder
+}
+
+func (r *traceSender) clone() requestSender {
+	return &traceSender{r.sender.clone(), r.recorder}
+}
+
+func (r *traceSender) send(req *sleepymemory.SleepRequest) (string, error) {
+	sent := time.Now()
+	status, err := r.sender.send(req)
+	r.recorder.record(req, sent, status)
+	return status, err
+}
+
+// loadTrace reads the trace written by --record at path. Records are sorted by Offset, since
+// concurrent requests may be recorded out of order.
+func loadTrace(path string) ([]traceRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var trace []traceRecord
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	for decoder.More() {
+		record := traceRecord{}
+		err = decoder.Decode(&record)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trace %s: record %d: %w", path, len(trace), err)
+		}
+		if record.Offset < 0 || record.Sleep < 0 || record.Waste < 0 || record.WasteFiles < 0 {
+			return nil, fmt.Errorf("invalid trace %s: record %d: offset, sleep, waste, and waste_files must be >= 0",
+				path, len(trace))
+		}
+		trace = append(trace, record)
+	}
+	if len(trace) == 0 {
+		return nil, fmt.Errorf("invalid trace %s: no records", path)
+	}
+	sort.SliceStable(trace, func(i int, j int) bool {
+		return trace[i].Offset < trace[j].Offset
+	})
+	return trace, nil
+}
+
+// traceDuration returns the offset of the last request in trace.
+func traceDuration(trace []traceRecord) time.Duration {
+	return time.Duration(trace[len(trace)-1].Offset)
+}
+
+// sendTrace sends the requests in trace at their recorded offsets from now, using one of senders,
+// like sendAtRate. It returns after all sent requests have completed.
+func sendTrace(done <-chan struct{}, trace []traceRecord, senders chan requestSender, results *results) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for i := range trace {
+		intended := start.Add(time.Duration(trace[i].Offset))
+		timer.Reset(time.Until(intended))
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		wg.Add(1)
+		go func(req *sleepymemory.SleepRequest) {
+			defer wg.Done()
+			sendScheduled(done, senders, req, results, intended)
+		}(trace[i].request())
+	}
+}
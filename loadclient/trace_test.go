@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit/sleepymemory"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	buf := &bytes.Buffer{}
+	recorder := newTraceRecorder(buf)
+	recorder.start = time.Now().Add(-time.Second)
+	sender := &traceSender{&recordingSender{}, recorder}
+	requests := []*sleepymemory.SleepRequest{
+		{SleepDuration: sleepymemory.Duration(10 * time.Millisecond), WasteBytes: 1024},
+		{SleepDuration: sleepymemory.Duration(time.Millisecond), Leak: true, WasteFiles: 2},
+	}
+	for _, req := range requests {
+		_, err := sender.clone().send(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := recorder.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"sleep":"10ms","waste":1024,"status":"200"`) {
+		t.Fatalf("unexpected trace: %s", buf.String())
+	}
+
+	// concurrent requests may be recorded out of order: the trace is sorted
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	err = os.WriteFile(path, []byte(lines[1]+"\n"+lines[0]+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace, err := loadTrace(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != 2 || trace[0].Offset > trace[1].Offset {
+		t.Fatalf("unexpected trace: %#v", trace)
+	}
+	for i, record := range trace {
+		req := record.request()
+		if req.SleepDuration.AsDuration() != requests[i].SleepDuration.AsDuration() ||
+			req.WasteBytes != requests[i].WasteBytes || req.Leak != requests[i].Leak ||
+			req.WasteFiles != requests[i].WasteFiles {
+			t.Errorf("record %d: request=%v; expected %v", i, req, requests[i])
+		}
+	}
+
+	for _, invalid := range []string{"", `{"offset":"-1s","sleep":"1s"}`, `{"offset":"1s","unknown":1}`, "x"} {
+		err = os.WriteFile(path, []byte(invalid), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadTrace(path)
+		if err == nil {
+			t.Errorf("loadTrace(%#v) must fail", invalid)
+		}
+	}
+}
+
+func TestSendTrace(t *testing.T) {
+	sender := &blockingSender{unblock: make(chan struct{})}
+	close(sender.unblock)
+	senders := make(chan requestSender, 1)
+	senders <- sender
+	trace := []traceRecord{{Offset: 0}, {Offset: jsonDuration(50 * time.Millisecond)}}
+	start := time.Now()
+	results := newResults(start, 0)
+	sendTrace(make(chan struct{}), trace, senders, results)
+	if len(sender.sent) != 2 || sender.sent[1].Sub(start) < 50*time.Millisecond {
+		t.Errorf("expected the second request after 50ms: %v", sender.sent)
+	}
+	if results.statuses[statusHTTPOK] != 2 {
+		t.Errorf("expected 2 requests: %v", results.statuses)
+	}
+}
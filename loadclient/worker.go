@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/evanj/concurrentlimit/loadclient/loadworker"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// coordinatorOnlyFlags are flags that configure the coordinator and are not sent to workers.
+var coordinatorOnlyFlags = map[string]bool{
+	"compare":         true,
+	"heapProfileURL":  true,
+	"heapProfiles":    true,
+	"output":          true,
+	"record":          true,
+	"replay":          true,
+	"sloAvailability": true,
+	"sloP99":          true,
+	"sweep":           true,
+	"sweepWarmup":     true,
+	"workerAddr":      true,
+	"workers":         true,
+	"workerToken":     true,
+}
+
+// workerTokenKey is the gRPC metadata key that contains the token shared by the coordinator and
+// its workers.
+const workerTokenKey = "loadworker-token"
+
+// workerServer runs loadclient runs for a coordinator, one at a time. Runs can make the worker
+// send requests to any address, fetch any URL (--statsURL), and read any local file (--scenario),
+// so only coordinators that send token are permitted.
+type workerServer struct {
+	loadworker.UnimplementedLoadWorkerServer
+	token string
+	runMu sync.Mutex
+
+	mu sync.Mutex
+	// stopRun ends the current run, or is nil if there is no run
+	stopRun context.CancelFunc
+}
+
+// authorize returns an error if the request in ctx does not contain the worker's token.
+func (w *workerServer) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get(workerTokenKey)
+	if w.token == "" || len(tokens) != 1 || subtle.ConstantTimeCompare([]byte(tokens[0]), []byte(w.token)) != 1 {
+		return status.Error(codes.PermissionDenied, "missing or incorrect --workerToken")
+	}
+	return nil
+}
+
+func (w *workerServer) Run(ctx context.Context, request *loadworker.RunRequest) (*loadworker.RunResponse, error) {
+	err := w.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !w.runMu.TryLock() {
+		return nil, status.Error(codes.Unavailable, "worker is already running")
+	}
+	defer w.runMu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w.mu.Lock()
+	w.stopRun = cancel
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.stopRun = nil
+		w.mu.Unlock()
+	}()
+
+	config := &runConfig{}
+	fs := flag.NewFlagSet("loadclient", flag.ContinueOnError)
+	// the error is returned to the coordinator
+	fs.SetOutput(io.Discard)
+	config.registerFlags(fs)
+	err = fs.Parse(request.Args)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	log.Printf("worker starting run with args %v ...", request.Args)
+	results, err := run(ctx, config)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	counts := countStatuses(results.statuses)
+	log.Printf("worker run completed: %s latency %s", counts.String(), results.latencies.String())
+
+	return &loadworker.RunResponse{
+		Elapsed:             durationpb.New(results.end.Sub(results.start)),
+		Latencies:           histogramToProto(&results.latencies),
+		Statuses:            results.statuses,
+		ErrorBudgetExceeded: results.errorBudgetExceeded,
+	}, nil
+}
+
+func (w *workerServer) Stop(ctx context.Context, request *loadworker.StopRequest) (*loadworker.StopResponse, error) {
+	err := w.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopRun != nil {
+		log.Printf("worker stopping the run at the coordinator's request ...")
+		w.stopRun()
+	}
+	return &loadworker.StopResponse{}, nil
+}
+
+// serveWorker listens on addr and runs the requests sent by coordinators with token. It only
+// returns if the server fails.
+func serveWorker(addr string, token string) error {
+	if token == "" {
+		return errors.New("--workerAddr requires --workerToken, since workers run load for any coordinator")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("worker listening for runs on %s ...", listener.Addr().String())
+
+	server := grpc.NewServer()
+	loadworker.RegisterLoadWorkerServer(server, &workerServer{token: token})
+	return server.Serve(listener)
+}
+
+// coordinatorArgs returns the command-line flags that were set, to be sent to workers.
+func coordinatorArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if coordinatorOnlyFlags[f.Name] {
+			return
+		}
+		if list, ok := f.Value.(*keyValueList); ok {
+			// values may contain commas, so each must be passed separately
+			for _, value := range list.values() {
+				args = append(args, "--"+f.Name+"="+value)
+			}
+			return
+		}
+		args = append(args, "--"+f.Name+"="+f.Value.String())
+	})
+	return args
+}
+
+// coordinate runs args on all workers at the same time, authenticated with token, and returns
+// their combined results. If ctx is cancelled, it stops the workers and returns the results so far.
+func coordinate(ctx context.Context, workers []string, token string, args []string) (*results, error) {
+	requestCtx := metadata.AppendToOutgoingContext(context.Background(), workerTokenKey, token)
+	clients := make([]loadworker.LoadWorkerClient, len(workers))
+	for i, worker := range workers {
+		conn, err := grpc.Dial(worker, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		clients[i] = loadworker.NewLoadWorkerClient(conn)
+	}
+
+	log.Printf("coordinating run on %d workers with args %v ...", len(workers), args)
+	start := time.Now()
+	responses := make([]*loadworker.RunResponse, len(workers))
+	errs := make([]error, len(workers))
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client loadworker.LoadWorkerClient) {
+			defer wg.Done()
+			responses[i], errs[i] = client.Run(requestCtx, &loadworker.RunRequest{Args: args})
+		}(i, client)
+	}
+	allDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allDone)
+	}()
+	select {
+	case <-allDone:
+	case <-ctx.Done():
+		log.Printf("stopping workers: %s", ctx.Err().Error())
+		for i, client := range clients {
+			_, err := client.Stop(requestCtx, &loadworker.StopRequest{})
+			if err != nil {
+				log.Printf("failed to stop worker %s: %s", workers[i], err.Error())
+			}
+		}
+		<-allDone
+	}
+
+	results := newResults(start, 0)
+	var elapsed time.Duration
+	for i, response := range responses {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("worker %s failed: %w", workers[i], errs[i])
+		}
+		counts := countStatuses(response.Statuses)
+		log.Printf("worker %s: %s", workers[i], counts.String())
+
+		results.merge(histogramFromProto(response.Latencies), response.Statuses)
+		results.errorBudgetExceeded = results.errorBudgetExceeded || response.ErrorBudgetExceeded
+		if response.Elapsed.AsDuration() > elapsed {
+			elapsed = response.Elapsed.AsDuration()
+		}
+	}
+
+	// the workers run at the same time, so the combined run is as long as the longest worker run
+	results.end = start.Add(elapsed)
+	results.endInterval(results.end)
+	return results, nil
+}
+
+func histogramToProto(h *latencyHistogram) *loadworker.Histogram {
+	return &loadworker.Histogram{
+		Counts: h.counts,
+		Count:  h.count,
+		Sum:    durationpb.New(h.sum),
+		Max:    durationpb.New(h.max),
+	}
+}
+
+func histogramFromProto(h *loadworker.Histogram) *latencyHistogram {
+	return &latencyHistogram{
+		counts: h.GetCounts(),
+		count:  h.GetCount(),
+		sum:    h.GetSum().AsDuration(),
+		max:    h.GetMax().AsDuration(),
+	}
+}
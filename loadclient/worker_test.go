@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit/loadclient/loadworker"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCoordinate(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	var workers []string
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := grpc.NewServer()
+		loadworker.RegisterLoadWorkerServer(server, &workerServer{token: "secret"})
+		go server.Serve(listener)
+		defer server.Stop()
+		workers = append(workers, listener.Addr().String())
+	}
+
+	results, err := coordinate(context.Background(), workers, "secret", []string{"--httpTarget=" + target.URL, "--maxRequests=10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each worker may complete one more request after reaching --maxRequests
+	if results.latencies.count < 20 || results.statuses[statusHTTPOK] != results.latencies.count {
+		t.Errorf("expected at least 20 requests from 2 workers: count=%d statuses=%v",
+			results.latencies.count, results.statuses)
+	}
+	if len(results.intervals) != 1 || results.intervals[0].latencies.count != results.latencies.count {
+		t.Errorf("expected one interval with all requests: %v", results.intervals)
+	}
+
+	_, err = coordinate(context.Background(), workers, "secret", []string{"--notAFlag"})
+	if err == nil {
+		t.Error("expected error for invalid args")
+	}
+	_, err = coordinate(context.Background(), workers, "wrong", []string{"--httpTarget=" + target.URL})
+	if status.Code(errors.Unwrap(err)) != codes.PermissionDenied {
+		t.Error("expected PermissionDenied with the wrong token:", err)
+	}
+}
+
+func TestHistogramProto(t *testing.T) {
+	h := &latencyHistogram{}
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+	out := histogramFromProto(histogramToProto(h))
+	if out.String() != h.String() || out.count != h.count {
+		t.Errorf("round trip changed histogram: %s != %s", out.String(), h.String())
+	}
+}
+
+func TestCoordinateStop(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	loadworker.RegisterLoadWorkerServer(server, &workerServer{token: "secret"})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	// cancelling the coordinator stops a long run and returns the partial results
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	results, err := coordinate(ctx, []string{listener.Addr().String()}, "secret",
+		[]string{"--httpTarget=" + target.URL, "--duration=1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 10*time.Second || results.latencies.count == 0 {
+		t.Errorf("expected partial results soon after cancelling: %s count=%d",
+			time.Since(start), results.latencies.count)
+	}
+}
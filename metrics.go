@@ -0,0 +1,311 @@
+package concurrentlimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsDurationBuckets are the upper bounds of the operation duration histogram, in seconds.
+var metricsDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+// MetricsLimiter wraps a Limiter to count operations, rejections, and their durations, so they
+// can be scraped by Prometheus with MetricsHandler. It forwards StartContext to the wrapped
+// limiter, so it can wrap a QueuedLimiter without disabling queueing, and AdminHandler changes the
+// wrapped limiter's limit.
+type MetricsLimiter struct {
+	limiter Limiter
+	clock   Clock
+
+	mu       sync.Mutex
+	started  uint64
+	rejected uint64
+	// waitCancelled counts StartContext calls whose context was done before they started
+	waitCancelled uint64
+	waitDuration  time.Duration
+	// timedOut counts requests that exceeded the TimeoutHandler timeout
+	timedOut uint64
+	current  int
+	peak     int
+	// bucketCounts[i] counts durations <= metricsDurationBuckets[i]; the last counts the rest
+	bucketCounts  []uint64
+	durationCount uint64
+	durationSum   time.Duration
+}
+
+// NewMetricsLimiter returns a MetricsLimiter that starts operations with limiter.
+func NewMetricsLimiter(limiter Limiter) *MetricsLimiter {
+	return &MetricsLimiter{
+		limiter:      limiter,
+		clock:        systemClock{},
+		bucketCounts: make([]uint64, len(metricsDurationBuckets)+1),
+	}
+}
+
+// Start begins an operation with the wrapped limiter. It implements Limiter.
+func (m *MetricsLimiter) Start() (func(), error) {
+	end, err := m.limiter.Start()
+	return m.record(end, err, 0)
+}
+
+// StartContext begins an operation with the wrapped limiter's StartContext method, which may wait
+// until ctx is done, as QueuedLimiter does. If the wrapped limiter does not have this method, it
+// calls Start.
+func (m *MetricsLimiter) StartContext(ctx context.Context) (func(), error) {
+	waiter, ok := m.limiter.(ContextLimiter)
+	if !ok {
+		return m.Start()
+	}
+
+	start := m.clock.Now()
+	end, err := waiter.StartContext(ctx)
+	return m.record(end, err, m.clock.Now().Sub(start))
+}
+
+// SetClock replaces the clock used to measure how long operations wait and run, which is the
+// system clock by default. It must be called before the limiter is used.
+func (m *MetricsLimiter) SetClock(clock Clock) {
+	m.clock = clock
+}
+
+// record counts the result of starting an operation that waited for waited.
+func (m *MetricsLimiter) record(end func(), err error, waited time.Duration) (func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waitDuration += waited
+	if err == ErrLimited {
+		m.rejected++
+	} else if err == context.Canceled || err == context.DeadlineExceeded {
+		m.waitCancelled++
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.started++
+	m.current++
+	if m.current > m.peak {
+		m.peak = m.current
+	}
+
+	start := m.clock.Now()
+	return func() {
+		end()
+		m.end(m.clock.Now().Sub(start))
+	}, nil
+}
+
+func (m *MetricsLimiter) recordTimeout() {
+	m.mu.Lock()
+	m.timedOut++
+	m.mu.Unlock()
+}
+
+func (m *MetricsLimiter) end(duration time.Duration) {
+	bucket := len(metricsDurationBuckets)
+	for i, upperBound := range metricsDurationBuckets {
+		if duration.Seconds() <= upperBound {
+			bucket = i
+			break
+		}
+	}
+
+	m.mu.Lock()
+	m.current--
+	m.bucketCounts[bucket]++
+	m.durationCount++
+	m.durationSum += duration
+	m.mu.Unlock()
+}
+
+// Stats returns the wrapped limiter's state if it implements StatsReporter. Otherwise, it only
+// reports the number of running operations and their peak.
+func (m *MetricsLimiter) Stats() Stats {
+	if reporter, ok := m.limiter.(StatsReporter); ok {
+		return reporter.Stats()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Stats{Current: m.current, Peak: m.peak}
+}
+
+// CurrentApprox returns the wrapped limiter's running operations and limit without locking, if it
+// implements ApproxReporter. It implements ApproxReporter.
+func (m *MetricsLimiter) CurrentApprox() (int, int) {
+	return currentApprox(m.limiter)
+}
+
+// WriteMetrics writes the limiter's metrics to w in the Prometheus text format.
+func (m *MetricsLimiter) WriteMetrics(w io.Writer) error {
+	return writeLimiterMetrics(w, []metricsSnapshot{m.snapshot("")})
+}
+
+// metricsSnapshot is the state of one limiter written by writeLimiterMetrics.
+type metricsSnapshot struct {
+	// labels are the Prometheus labels of this limiter's metrics, e.g. limiter="http", or empty
+	labels string
+	stats  Stats
+	// hasCounters is false if the limiter is not a MetricsLimiter, so only stats are known
+	hasCounters   bool
+	started       uint64
+	rejected      uint64
+	waitCancelled uint64
+	waitDuration  time.Duration
+	timedOut      uint64
+	bucketCounts  []uint64
+	durationCount uint64
+	durationSum   time.Duration
+}
+
+func (m *MetricsLimiter) snapshot(labels string) metricsSnapshot {
+	stats := m.Stats()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return metricsSnapshot{
+		labels:        labels,
+		stats:         stats,
+		hasCounters:   true,
+		started:       m.started,
+		rejected:      m.rejected,
+		waitCancelled: m.waitCancelled,
+		waitDuration:  m.waitDuration,
+		timedOut:      m.timedOut,
+		bucketCounts:  append([]uint64(nil), m.bucketCounts...),
+		durationCount: m.durationCount,
+		durationSum:   m.durationSum,
+	}
+}
+
+// labelSet returns the Prometheus label set of labels and extra, which may be empty.
+func labelSet(labels string, extra string) string {
+	if labels != "" && extra != "" {
+		return "{" + labels + "," + extra + "}"
+	}
+	if labels != "" || extra != "" {
+		return "{" + labels + extra + "}"
+	}
+	return ""
+}
+
+// writeLimiterMetrics writes the metrics of snapshots to w in the Prometheus text format. Each
+// metric is written once, with a sample for each snapshot.
+func writeLimiterMetrics(w io.Writer, snapshots []metricsSnapshot) error {
+	ew := &errWriter{w: w}
+	// counter writes a metric that is only known for MetricsLimiters
+	counter := func(name string, help string, value func(s metricsSnapshot) string) {
+		ew.printf("# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, s := range snapshots {
+			if s.hasCounters {
+				ew.printf("%s%s %s\n", name, labelSet(s.labels, ""), value(s))
+			}
+		}
+	}
+	gauge := func(name string, help string, value func(s metricsSnapshot) int) {
+		ew.printf("# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, s := range snapshots {
+			ew.printf("%s%s %d\n", name, labelSet(s.labels, ""), value(s))
+		}
+	}
+
+	counter("concurrentlimit_started_total", "Operations permitted by the limiter.",
+		func(s metricsSnapshot) string { return strconv.FormatUint(s.started, 10) })
+	counter("concurrentlimit_rejected_total", "Operations rejected by the limiter.",
+		func(s metricsSnapshot) string { return strconv.FormatUint(s.rejected, 10) })
+	counter("concurrentlimit_wait_cancelled_total",
+		"Operations that gave up waiting to start because their context was done.",
+		func(s metricsSnapshot) string { return strconv.FormatUint(s.waitCancelled, 10) })
+	counter("concurrentlimit_wait_seconds_total", "Total time operations waited to start.",
+		func(s metricsSnapshot) string { return strconv.FormatFloat(s.waitDuration.Seconds(), 'g', -1, 64) })
+	counter("concurrentlimit_timed_out_total",
+		"Operations that exceeded the TimeoutHandler timeout, which released their slot.",
+		func(s metricsSnapshot) string { return strconv.FormatUint(s.timedOut, 10) })
+	gauge("concurrentlimit_current", "Running operations.",
+		func(s metricsSnapshot) int { return s.stats.Current })
+	gauge("concurrentlimit_peak", "Maximum running operations since the limiter was created.",
+		func(s metricsSnapshot) int { return s.stats.Peak })
+	limited := []metricsSnapshot{}
+	for _, s := range snapshots {
+		if s.stats.Limit > 0 {
+			limited = append(limited, s)
+		}
+	}
+	if len(limited) > 0 {
+		const limitName = "concurrentlimit_limit"
+		ew.printf("# HELP %s Maximum running operations.\n# TYPE %s gauge\n", limitName, limitName)
+		for _, s := range limited {
+			ew.printf("%s%s %d\n", limitName, labelSet(s.labels, ""), s.stats.Limit)
+		}
+	}
+	gauge("concurrentlimit_queued", "Operations waiting to start.",
+		func(s metricsSnapshot) int { return s.stats.Queued })
+
+	const durationName = "concurrentlimit_operation_duration_seconds"
+	ew.printf("# HELP %s Duration of completed operations.\n# TYPE %s histogram\n", durationName, durationName)
+	for _, s := range snapshots {
+		if !s.hasCounters {
+			continue
+		}
+		cumulative := uint64(0)
+		for i, upperBound := range metricsDurationBuckets {
+			cumulative += s.bucketCounts[i]
+			le := "le=\"" + strconv.FormatFloat(upperBound, 'g', -1, 64) + "\""
+			ew.printf("%s_bucket%s %d\n", durationName, labelSet(s.labels, le), cumulative)
+		}
+		ew.printf("%s_bucket%s %d\n", durationName, labelSet(s.labels, `le="+Inf"`), s.durationCount)
+		ew.printf("%s_sum%s %s\n", durationName, labelSet(s.labels, ""),
+			strconv.FormatFloat(s.durationSum.Seconds(), 'g', -1, 64))
+		ew.printf("%s_count%s %d\n", durationName, labelSet(s.labels, ""), s.durationCount)
+	}
+	return ew.err
+}
+
+// writeRuntimeMetrics writes the Go runtime's memory and goroutine metrics to w in the Prometheus
+// text format, using the same names as the Prometheus Go client.
+func writeRuntimeMetrics(w io.Writer) error {
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+
+	ew := &errWriter{w: w}
+	ew.metric("go_goroutines", "gauge", "Number of goroutines that currently exist.",
+		strconv.Itoa(runtime.NumGoroutine()))
+	ew.metric("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.",
+		strconv.FormatUint(memStats.Sys, 10))
+	ew.metric("go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.",
+		strconv.FormatUint(memStats.HeapAlloc, 10))
+	ew.metric("go_memstats_next_gc_bytes", "gauge", "Number of heap bytes when next garbage collection will take place.",
+		strconv.FormatUint(memStats.NextGC, 10))
+	return ew.err
+}
+
+// MetricsHandler returns an http.Handler that reports the metrics of limiter and the Go runtime
+// in the Prometheus text format.
+func MetricsHandler(limiter *MetricsLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		// ignore errors: there is nothing we can do if writing the response fails
+		_ = limiter.WriteMetrics(w)
+		_ = writeRuntimeMetrics(w)
+	})
+}
+
+// errWriter writes to w until the first error, which it saves.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) printf(format string, args ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = fmt.Fprintf(e.w, format, args...)
+}
+
+// metric writes a metric with a single value and its metadata.
+func (e *errWriter) metric(name string, metricType string, help string, value string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, metricType, name, value)
+}
@@ -0,0 +1,87 @@
+package concurrentlimit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// LayerKind describes what a middleware layer does before it calls the next layer, for
+// CheckOrder.
+type LayerKind int
+
+const (
+	// LayerCheap does little work before calling the next layer, such as recovery, logging, or
+	// telemetry.
+	LayerCheap LayerKind = iota
+	// LayerExpensive allocates memory or uses significant CPU before calling the next layer, such
+	// as parsing or decompressing request bodies, or authentication.
+	LayerExpensive
+	// LayerLimit admits or rejects requests, such as Handler or grpclimit.UnaryInterceptor.
+	LayerLimit
+)
+
+// Layer describes one layer of a handler or interceptor chain.
+type Layer struct {
+	// Name identifies the layer in errors.
+	Name string
+	Kind LayerKind
+}
+
+// CheckOrder returns an error if layers, listed from the outermost to the innermost, are ordered
+// so the limit does not protect the server: if there is no LayerLimit, or if a LayerExpensive
+// runs before the first one. Expensive layers before the limit use memory for requests that will
+// be rejected, which silently defeats the limit during overload. Call it when the server starts,
+// and log the error as a warning or stop.
+func CheckOrder(layers ...Layer) error {
+	expensive := []string{}
+	for _, layer := range layers {
+		switch layer.Kind {
+		case LayerLimit:
+			if len(expensive) > 0 {
+				return fmt.Errorf("concurrentlimit: expensive layers run before limit %#v: %s",
+					layer.Name, strings.Join(expensive, ", "))
+			}
+			return nil
+		case LayerExpensive:
+			expensive = append(expensive, fmt.Sprintf("%#v", layer.Name))
+		}
+	}
+	return fmt.Errorf("concurrentlimit: no limit layer in %d layers", len(layers))
+}
+
+// Middleware is an HTTP middleware layer for Chain.
+type Middleware struct {
+	Layer
+	// Wrap returns a handler that runs this layer, then calls next.
+	Wrap func(next http.Handler) http.Handler
+}
+
+// Chain wraps handler with middleware, where the first is the outermost, after checking their
+// order with CheckOrder. It returns the error from CheckOrder and no handler if the order is
+// wrong.
+func Chain(handler http.Handler, middleware ...Middleware) (http.Handler, error) {
+	layers := make([]Layer, len(middleware))
+	for i, m := range middleware {
+		layers[i] = m.Layer
+	}
+	err := CheckOrder(layers...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i].Wrap(handler)
+	}
+	return handler, nil
+}
+
+// LimitMiddleware returns a Middleware that limits requests with Handler.
+func LimitMiddleware(limiter Limiter) Middleware {
+	return Middleware{
+		Layer: Layer{Name: "concurrentlimit.Handler", Kind: LayerLimit},
+		Wrap: func(next http.Handler) http.Handler {
+			return Handler(limiter, next)
+		},
+	}
+}
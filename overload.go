@@ -0,0 +1,103 @@
+package concurrentlimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// defaultMaxQueueDelay is the queue delay that OverloadHandler considers fully overloaded if
+// OverloadOptions.MaxQueueDelay is not set.
+const defaultMaxQueueDelay = time.Second
+
+// OverloadOptions configures OverloadHandler.
+type OverloadOptions struct {
+	// MaxQueueDelay is the queue delay that is considered fully overloaded. If <= 0, the default
+	// is one second.
+	MaxQueueDelay time.Duration
+	// MemoryLimit is the memory in bytes that is considered fully overloaded. If <= 0, the Go
+	// runtime's memory limit is used (see debug.SetMemoryLimit). If neither is set, memory is not
+	// included in the score.
+	MemoryLimit int64
+}
+
+// OverloadStatus is the state reported by OverloadHandler. Each percentage is from 0 to 100.
+type OverloadStatus struct {
+	// Score is the maximum of the other percentages: 0 is idle and 100 is fully overloaded.
+	Score             int     `json:"score"`
+	OccupancyPercent  float64 `json:"occupancy_percent"`
+	QueueDelayPercent float64 `json:"queue_delay_percent"`
+	MemoryPercent     float64 `json:"memory_percent"`
+	QueueDelayMS      int64   `json:"queue_delay_ms"`
+	MemoryBytes       uint64  `json:"memory_bytes"`
+}
+
+// ComputeOverloadStatus returns the overload status of a process using limiter. If limiter does
+// not implement StatsReporter, the score only includes memory.
+func ComputeOverloadStatus(limiter Limiter, options OverloadOptions) OverloadStatus {
+	status := OverloadStatus{}
+	if reporter, ok := limiter.(StatsReporter); ok {
+		stats := reporter.Stats()
+		if stats.Limit > 0 {
+			status.OccupancyPercent = percent(float64(stats.Current), float64(stats.Limit))
+		}
+
+		maxQueueDelay := options.MaxQueueDelay
+		if maxQueueDelay <= 0 {
+			maxQueueDelay = defaultMaxQueueDelay
+		}
+		status.QueueDelayMS = stats.QueueDelay.Milliseconds()
+		status.QueueDelayPercent = percent(float64(stats.QueueDelay), float64(maxQueueDelay))
+	}
+
+	memoryLimit := options.MemoryLimit
+	if memoryLimit <= 0 {
+		// returns math.MaxInt64 if the limit is not set
+		memoryLimit = debug.SetMemoryLimit(-1)
+	}
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	status.MemoryBytes = memStats.Sys - memStats.HeapReleased
+	if memoryLimit != math.MaxInt64 {
+		status.MemoryPercent = percent(float64(status.MemoryBytes), float64(memoryLimit))
+	}
+
+	score := math.Max(status.OccupancyPercent, math.Max(status.QueueDelayPercent, status.MemoryPercent))
+	status.Score = int(math.Round(score))
+	return status
+}
+
+// percent returns value/max as a percentage from 0 to 100.
+func percent(value float64, max float64) float64 {
+	return math.Min(100, 100*value/max)
+}
+
+// OverloadHandler returns an http.Handler that reports an overload score for load balancers. The
+// score is from 0 (idle) to 100 (fully overloaded), and is the maximum of the limiter's occupancy,
+// its queue delay, and the process's memory use. It returns JSON (see OverloadStatus) by default.
+// With the query parameter format=agent, it returns the format of HAProxy's agent-check: "up N%",
+// where N is the suggested weight (100 minus the score), or "drain" when fully overloaded.
+func OverloadHandler(limiter Limiter, options OverloadOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := ComputeOverloadStatus(limiter, options)
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.FormValue("format") == "agent" {
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			if status.Score >= 100 {
+				fmt.Fprintln(w, "drain")
+			} else {
+				fmt.Fprintf(w, "up %d%%\n", 100-status.Score)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		// ignore the error: there is nothing we can do if writing the response fails
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
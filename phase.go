@@ -0,0 +1,70 @@
+package concurrentlimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// HeaderLimiter limits the HTTP connections that are waiting for or reading request headers,
+// separately from the limit on running handlers. Reading headers uses little memory, so this limit
+// can be much higher, but it stops many slow clients from holding connections open before their
+// requests reach the handlers. The handlers, which also read the request body, should be limited
+// by a stricter limit, such as Handler or ListenForServer. net/http only reports that a request
+// is active once its headers are read, so idle keep-alive connections are counted as reading
+// headers. Use it as an http.Server's ConnState hook.
+type HeaderLimiter struct {
+	mu    sync.Mutex
+	max   int
+	peak  int
+	conns map[net.Conn]struct{}
+	// rejected counts the connections closed because the limit was reached
+	rejected atomic.Int64
+}
+
+// NewHeaderLimiter returns a HeaderLimiter that permits limit connections to wait for or read
+// request headers at the same time. It will panic if limit <= 0.
+func NewHeaderLimiter(limit int) *HeaderLimiter {
+	if limit <= 0 {
+		panic(fmt.Sprintf("limit must be > 0: %d", limit))
+	}
+	return &HeaderLimiter{max: limit, conns: map[net.Conn]struct{}{}}
+}
+
+// ConnState applies the limit when used as an http.Server's ConnState hook. New connections, and
+// connections that become idle after a request, are closed if limit connections are already
+// waiting for or reading headers.
+func (h *HeaderLimiter) ConnState(conn net.Conn, state http.ConnState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch state {
+	case http.StateNew, http.StateIdle:
+		if len(h.conns) >= h.max {
+			h.rejected.Add(1)
+			conn.Close()
+			return
+		}
+		h.conns[conn] = struct{}{}
+		if len(h.conns) > h.peak {
+			h.peak = len(h.conns)
+		}
+	case http.StateActive, http.StateHijacked, http.StateClosed:
+		// the headers were read: the request is now limited by the handler's limit
+		delete(h.conns, conn)
+	}
+}
+
+// Rejected returns the number of connections closed because the limit was reached.
+func (h *HeaderLimiter) Rejected() int64 {
+	return h.rejected.Load()
+}
+
+// Stats returns the connections waiting for or reading headers. It implements StatsReporter.
+func (h *HeaderLimiter) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return Stats{Current: len(h.conns), Limit: h.max, Peak: h.peak}
+}
@@ -0,0 +1,306 @@
+package concurrentlimit
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// profileMaxSamples is the number of operations a Profiler keeps for each label to compute
+// percentiles. After that, it keeps a uniform random sample of the operations.
+const profileMaxSamples = 10000
+
+// profileMaxLabels is the number of labels a Profiler tracks separately. Operations with other
+// labels are counted as profileOtherLabel, so a label with unbounded values, such as a path that
+// contains an ID, does not use unbounded memory.
+const profileMaxLabels = 1000
+const profileOtherLabel = "(other)"
+
+// profileHeadroom is how much larger than the 99th percentile of the observed concurrency a
+// suggested limit is, so only unusual load is rejected.
+const profileHeadroom = 1.5
+
+// allocsMetric is the cumulative number of bytes allocated on the heap.
+const allocsMetric = "/gc/heap/allocs:bytes"
+
+// ProfileOptions configures NewProfiler.
+type ProfileOptions struct {
+	// Warmup is how long after the Profiler is created to ignore operations, since a new process
+	// is slower while it fills caches and opens connections. If <= 0, the default is one minute.
+	Warmup time.Duration
+	// MemoryBytes is the memory available to the process, used to keep the suggested limits from
+	// running out of memory. If <= 0, the Go runtime's memory limit is used (see
+	// debug.SetMemoryLimit). If neither is set, the suggestions do not consider memory.
+	MemoryBytes int64
+	// ReservedFraction is the fraction of MemoryBytes reserved for the rest of the process, as in
+	// AutoOptions. If <= 0, it is 0.5.
+	ReservedFraction float64
+}
+
+// OperationProfile is the observed behaviour of the operations with one label, and the limit
+// suggested for them.
+type OperationProfile struct {
+	Label      string `json:"label"`
+	Operations uint64 `json:"operations"`
+	// PeakConcurrent and P99Concurrent are the maximum and 99th percentile of the number of
+	// operations with this label that were running when one started, including it.
+	PeakConcurrent int `json:"peak_concurrent"`
+	P99Concurrent  int `json:"p99_concurrent"`
+	// P50MS and P99MS are percentiles of the operation durations in milliseconds.
+	P50MS float64 `json:"p50_ms"`
+	P99MS float64 `json:"p99_ms"`
+	// AllocatedBytes estimates the bytes each operation allocates. The Go runtime does not count
+	// allocations by goroutine, so the process's allocations while an operation runs are divided
+	// between the operations running at the same time. It is a rough estimate that is only
+	// accurate when the operations dominate the process's allocations.
+	AllocatedBytes uint64 `json:"allocated_bytes"`
+	// SuggestedLimit is 1.5 times P99Concurrent, reduced to fit in memory if that is smaller.
+	SuggestedLimit int `json:"suggested_limit"`
+	// LimitedBy is "concurrency" or "memory": the reason for SuggestedLimit.
+	LimitedBy string `json:"limited_by"`
+}
+
+// ProfileReport is the report of a Profiler.
+type ProfileReport struct {
+	// Ready is false until the warmup has ended and an operation has completed. The suggestions
+	// are only as good as the traffic observed: they should be computed from a period of typical
+	// peak traffic.
+	Ready           bool    `json:"ready"`
+	ObservedSeconds float64 `json:"observed_seconds"`
+	// Total profiles all operations together, for a single process-wide limit. Its Label is empty.
+	Total OperationProfile `json:"total"`
+	// Operations profiles each label, sorted by label.
+	Operations []OperationProfile `json:"operations"`
+}
+
+// Profiler observes the concurrency, latency, and memory of labeled operations, such as HTTP
+// routes or gRPC methods, and suggests a limit for each label and for all of them. It bootstraps
+// the configuration of a server whose operators do not know what limits to use: run it without
+// limits, or with generous ones, during typical peak traffic, then read the report.
+type Profiler struct {
+	options ProfileOptions
+	clock   Clock
+	created time.Time
+
+	mu     sync.Mutex
+	total  *labelProfile
+	labels map[string]*labelProfile
+}
+
+// labelProfile is the observations of the operations with one label.
+type labelProfile struct {
+	current    int
+	operations uint64
+	// concurrencies[i] and durations[i] are the concurrency when a sampled operation started, and
+	// its duration
+	concurrencies  []int
+	durations      []time.Duration
+	allocatedBytes uint64
+}
+
+// NewProfiler returns a Profiler configured with options.
+func NewProfiler(options ProfileOptions) *Profiler {
+	if options.Warmup <= 0 {
+		options.Warmup = time.Minute
+	}
+	if options.ReservedFraction <= 0 {
+		options.ReservedFraction = defaultAutoReservedFraction
+	}
+	p := &Profiler{options: options, clock: systemClock{}, total: &labelProfile{}, labels: map[string]*labelProfile{}}
+	p.created = p.clock.Now()
+	return p
+}
+
+// SetClock replaces the clock used to measure operations and the warmup, which is the system
+// clock by default. It must be called before the profiler is used.
+func (p *Profiler) SetClock(clock Clock) {
+	p.clock = clock
+	p.created = clock.Now()
+}
+
+// Start records the start of an operation with label, and returns a function that must be called
+// when it ends.
+func (p *Profiler) Start(label string) func() {
+	start := p.clock.Now()
+	startAllocated := allocatedBytes()
+
+	p.mu.Lock()
+	profile := p.labels[label]
+	if profile == nil {
+		if len(p.labels) >= profileMaxLabels {
+			label = profileOtherLabel
+			profile = p.labels[label]
+		}
+		if profile == nil {
+			profile = &labelProfile{}
+			p.labels[label] = profile
+		}
+	}
+	profile.current++
+	p.total.current++
+	concurrent := profile.current
+	totalConcurrent := p.total.current
+	p.mu.Unlock()
+
+	return func() {
+		duration := p.clock.Now().Sub(start)
+		allocated := allocatedBytes() - startAllocated
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// share the allocations with the operations that ran at the same time
+		running := totalConcurrent
+		if p.total.current > running {
+			running = p.total.current
+		}
+		allocated /= uint64(running)
+		profile.current--
+		p.total.current--
+		if start.Sub(p.created) < p.options.Warmup {
+			return
+		}
+		profile.record(concurrent, duration, allocated)
+		p.total.record(totalConcurrent, duration, allocated)
+	}
+}
+
+// record adds an operation that completed after the warmup.
+func (l *labelProfile) record(concurrent int, duration time.Duration, allocated uint64) {
+	l.operations++
+	l.allocatedBytes += allocated
+	if len(l.durations) < profileMaxSamples {
+		l.concurrencies = append(l.concurrencies, concurrent)
+		l.durations = append(l.durations, duration)
+		return
+	}
+	// reservoir sampling: keep this operation with probability profileMaxSamples/operations
+	index := rand.Int63n(int64(l.operations))
+	if index < profileMaxSamples {
+		l.concurrencies[index] = concurrent
+		l.durations[index] = duration
+	}
+}
+
+// Report returns the observations since the warmup ended, and the suggested limits.
+func (p *Profiler) Report() ProfileReport {
+	available := float64(p.options.MemoryBytes)
+	if available <= 0 {
+		// returns math.MaxInt64 if the limit is not set
+		if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+			available = float64(limit)
+		}
+	}
+	available *= 1 - p.options.ReservedFraction
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	report := ProfileReport{
+		Total:      p.total.profile("", available),
+		Operations: []OperationProfile{},
+	}
+	if observed := p.clock.Now().Sub(p.created) - p.options.Warmup; observed > 0 {
+		report.ObservedSeconds = observed.Seconds()
+		report.Ready = p.total.operations > 0
+	}
+	for label, profile := range p.labels {
+		if profile.operations > 0 {
+			report.Operations = append(report.Operations, profile.profile(label, available))
+		}
+	}
+	sort.Slice(report.Operations, func(i int, j int) bool {
+		return report.Operations[i].Label < report.Operations[j].Label
+	})
+	return report
+}
+
+// profile summarizes the observations, and suggests a limit that fits in available bytes, or
+// ignores memory if available is 0.
+func (l *labelProfile) profile(label string, available float64) OperationProfile {
+	profile := OperationProfile{Label: label, Operations: l.operations}
+	if l.operations == 0 {
+		return profile
+	}
+
+	concurrencies := append([]int(nil), l.concurrencies...)
+	sort.Ints(concurrencies)
+	durations := append([]time.Duration(nil), l.durations...)
+	sort.Slice(durations, func(i int, j int) bool {
+		return durations[i] < durations[j]
+	})
+	profile.PeakConcurrent = concurrencies[len(concurrencies)-1]
+	profile.P99Concurrent = concurrencies[percentileIndex(99, len(concurrencies))]
+	profile.P50MS = milliseconds(durations[percentileIndex(50, len(durations))])
+	profile.P99MS = milliseconds(durations[percentileIndex(99, len(durations))])
+	profile.AllocatedBytes = l.allocatedBytes / l.operations
+
+	profile.SuggestedLimit = int(math.Ceil(profileHeadroom * float64(profile.P99Concurrent)))
+	profile.LimitedBy = "concurrency"
+	if available > 0 && profile.AllocatedBytes > 0 {
+		memoryLimit := int(available / float64(profile.AllocatedBytes))
+		if memoryLimit < 1 {
+			memoryLimit = 1
+		}
+		if memoryLimit < profile.SuggestedLimit {
+			profile.SuggestedLimit = memoryLimit
+			profile.LimitedBy = "memory"
+		}
+	}
+	return profile
+}
+
+// percentileIndex returns the index of the value in a sorted slice of length n that is larger than
+// or equal to percent of the values.
+func percentileIndex(percent float64, n int) int {
+	index := int(math.Ceil(percent/100*float64(n))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return index
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// allocatedBytes returns the number of bytes the process has allocated on the heap.
+func allocatedBytes() uint64 {
+	samples := []metrics.Sample{{Name: allocsMetric}}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return samples[0].Value.Uint64()
+}
+
+// Handler returns an http.Handler that reports Report as JSON. Like AdminHandler, it should only
+// be served on a private address.
+func (p *Profiler) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, p.Report())
+	})
+}
+
+// ProfileHandler returns an http.Handler that records each request to handler with profiler,
+// labeled by labelFunc. If labelFunc is nil, the label is the request's path, which should only be
+// used if the server has a small number of paths.
+func ProfileHandler(profiler *Profiler, labelFunc func(*http.Request) string, handler http.Handler) http.Handler {
+	if labelFunc == nil {
+		labelFunc = func(r *http.Request) string {
+			return r.URL.Path
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		end := profiler.Start(labelFunc(r))
+		defer end()
+		handler.ServeHTTP(w, r)
+	})
+}
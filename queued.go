@@ -0,0 +1,156 @@
+package concurrentlimit
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QueuedLimiter is a Limiter that can also queue operations that exceed the limit. Start never
+// waits, which is appropriate for servers that should reject excess requests. StartContext waits
+// for a running operation to complete, which is appropriate for callers that would otherwise
+// retry, such as database clients or message consumers. Waiting operations start in FIFO order.
+type QueuedLimiter struct {
+	approxStats
+	mu        sync.Mutex
+	max       int
+	maxQueued int
+	current   int
+	peak      int
+	clock     Clock
+	// waiters contains *queueWaiter, oldest first
+	waiters list.List
+}
+
+type queueWaiter struct {
+	ready    chan struct{}
+	granted  bool
+	queuedAt time.Time
+}
+
+// NewQueued returns a QueuedLimiter that permits limit concurrent operations, and permits up to
+// maxQueued operations to wait in StartContext. It will panic if limit <= 0 or maxQueued < 0.
+func NewQueued(limit int, maxQueued int) *QueuedLimiter {
+	if limit <= 0 {
+		panic(fmt.Sprintf("limit must be > 0: %d", limit))
+	}
+	if maxQueued < 0 {
+		panic(fmt.Sprintf("maxQueued must be >= 0: %d", maxQueued))
+	}
+	q := &QueuedLimiter{max: limit, maxQueued: maxQueued, clock: systemClock{}}
+	q.storeApprox(0, limit)
+	return q
+}
+
+// SetClock replaces the clock used to measure Stats.QueueDelay, which is the system clock by
+// default. It must be called before the limiter is used.
+func (q *QueuedLimiter) SetClock(clock Clock) {
+	q.clock = clock
+}
+
+// MaxQueued returns the maximum number of operations that can wait in StartContext.
+func (q *QueuedLimiter) MaxQueued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.maxQueued
+}
+
+// SetMaxQueued changes the maximum number of operations that can wait in StartContext. Lowering
+// it does not reject operations that are already waiting. It will panic if maxQueued < 0.
+func (q *QueuedLimiter) SetMaxQueued(maxQueued int) {
+	if maxQueued < 0 {
+		panic(fmt.Sprintf("maxQueued must be >= 0: %d", maxQueued))
+	}
+	q.mu.Lock()
+	q.maxQueued = maxQueued
+	q.mu.Unlock()
+}
+
+// Start begins a new operation without waiting. It returns ErrLimited if the limit is reached.
+func (q *QueuedLimiter) Start() (func(), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.current >= q.max {
+		return nil, ErrLimited
+	}
+	q.startLocked()
+	return q.end, nil
+}
+
+// StartContext begins a new operation, waiting for a running operation to complete if the limit
+// is reached. It returns ErrLimited if maxQueued operations are already waiting, or ctx.Err() if
+// ctx is done before the operation can start.
+func (q *QueuedLimiter) StartContext(ctx context.Context) (func(), error) {
+	done := ctx.Done()
+	q.mu.Lock()
+	select {
+	case <-done:
+		q.mu.Unlock()
+		return nil, ctx.Err()
+	default:
+	}
+
+	if q.current < q.max {
+		q.startLocked()
+		q.mu.Unlock()
+		return q.end, nil
+	}
+	if q.waiters.Len() >= q.maxQueued {
+		q.mu.Unlock()
+		return nil, ErrLimited
+	}
+	w := &queueWaiter{ready: make(chan struct{}), queuedAt: q.clock.Now()}
+	elem := q.waiters.PushBack(w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return q.end, nil
+
+	case <-done:
+		q.mu.Lock()
+		granted := w.granted
+		if !granted {
+			q.waiters.Remove(elem)
+		}
+		q.mu.Unlock()
+
+		if granted {
+			// end handed us the slot at the same time ctx was cancelled: give it back
+			q.end()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// startLocked counts a started operation. q.mu must be held.
+func (q *QueuedLimiter) startLocked() {
+	q.current++
+	if q.current > q.peak {
+		q.peak = q.current
+	}
+	q.storeApprox(q.current, q.max)
+}
+
+func (q *QueuedLimiter) end() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// hand the slot directly to the oldest waiter so new operations cannot jump the queue, unless
+	// SetLimit lowered the limit below the running operations
+	if front := q.waiters.Front(); front != nil && q.current <= q.max {
+		w := q.waiters.Remove(front).(*queueWaiter)
+		w.granted = true
+		close(w.ready)
+		return
+	}
+
+	q.current--
+	if q.current < 0 {
+		panic("bug: mismatched calls to start/end")
+	}
+	q.storeApprox(q.current, q.max)
+}
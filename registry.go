@@ -0,0 +1,155 @@
+package concurrentlimit
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// registry is the process-wide set of named limiters.
+var registry = struct {
+	mu       sync.Mutex
+	limiters map[string]Limiter
+	keyed    map[string]*KeyedLimiter
+}{limiters: map[string]Limiter{}, keyed: map[string]*KeyedLimiter{}}
+
+// Register adds limiter to the process-wide registry with name, so tooling can find it without
+// being passed every limiter: RegistryHandler reports and changes the registered limiters, and
+// RegistryMetricsHandler exports their metrics. Using the registry is optional. Like
+// expvar.Publish, it panics if name is empty or already registered.
+func Register(name string, limiter Limiter) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	checkRegisterLocked("Register", name)
+	registry.limiters[name] = limiter
+}
+
+// RegisterKeyed adds limiter to the process-wide registry with name, so SnapshotConfig and
+// ApplyConfig include its key limits (see KeyedLimiter.SetKeyLimit). Names are shared with
+// Register. Like Register, it panics if name is empty or already registered.
+func RegisterKeyed(name string, limiter *KeyedLimiter) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	checkRegisterLocked("RegisterKeyed", name)
+	registry.keyed[name] = limiter
+}
+
+// checkRegisterLocked panics if name cannot be registered. registry.mu must be held.
+func checkRegisterLocked(function string, name string) {
+	if name == "" {
+		panic(fmt.Sprintf("concurrentlimit: %s: name must not be empty", function))
+	}
+	_, exists := registry.limiters[name]
+	_, existsKeyed := registry.keyed[name]
+	if exists || existsKeyed {
+		panic(fmt.Sprintf("concurrentlimit: %s: name %#v is already registered", function, name))
+	}
+}
+
+// Unregister removes the limiter registered with name, if there is one.
+func Unregister(name string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.limiters, name)
+	delete(registry.keyed, name)
+}
+
+// Lookup returns the limiter registered with name.
+func Lookup(name string) (Limiter, bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	limiter, ok := registry.limiters[name]
+	return limiter, ok
+}
+
+// LookupKeyed returns the KeyedLimiter registered with name by RegisterKeyed.
+func LookupKeyed(name string) (*KeyedLimiter, bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	limiter, ok := registry.keyed[name]
+	return limiter, ok
+}
+
+// registeredKeyedNames returns the names of the KeyedLimiters registered by RegisterKeyed, sorted.
+func registeredKeyedNames() []string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	names := make([]string, 0, len(registry.keyed))
+	for name := range registry.keyed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RegisteredNames returns the names of the limiters registered by Register, sorted.
+func RegisteredNames() []string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	names := make([]string, 0, len(registry.limiters))
+	for name := range registry.limiters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RegistryHandler returns an http.Handler that serves AdminHandler for each registered limiter at
+// prefix followed by its name, e.g. /limit/http, and reports the state of all of them as a JSON
+// object at prefix. Limiters registered after it is created are included. See AdminHandler for
+// the security considerations.
+func RegistryHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		if name != "" {
+			limiter, ok := Lookup(name)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			AdminHandler(limiter).ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		statuses := map[string]limitStatus{}
+		for _, name := range RegisteredNames() {
+			if limiter, ok := Lookup(name); ok {
+				statuses[name] = statusOf(limiter)
+			}
+		}
+		writeJSON(w, statuses)
+	})
+}
+
+// RegistryMetricsHandler returns an http.Handler that reports the metrics of every registered
+// limiter and the Go runtime in the Prometheus text format, with the label limiter set to its
+// name. Operation counters and durations are only reported for MetricsLimiters; other limiters
+// that implement StatsReporter only report their current state.
+func RegistryMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshots := []metricsSnapshot{}
+		for _, name := range RegisteredNames() {
+			limiter, ok := Lookup(name)
+			if !ok {
+				continue
+			}
+			labels := fmt.Sprintf("limiter=%q", name)
+			if metrics, ok := limiter.(*MetricsLimiter); ok {
+				snapshots = append(snapshots, metrics.snapshot(labels))
+			} else if reporter, ok := limiter.(StatsReporter); ok {
+				snapshots = append(snapshots, metricsSnapshot{labels: labels, stats: reporter.Stats()})
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		// ignore errors: there is nothing we can do if writing the response fails
+		_ = writeLimiterMetrics(w, snapshots)
+		_ = writeRuntimeMetrics(w)
+	})
+}
@@ -0,0 +1,146 @@
+package concurrentlimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ShedCause is the reason a request was rejected.
+type ShedCause int
+
+const (
+	// ShedCapacity means the server is at capacity, such as its request limit or memory limit.
+	// Another server may be able to handle the request.
+	ShedCapacity ShedCause = iota
+	// ShedClient means the client exceeded its own limit, such as a KeyedLimiter limit. The client
+	// should send fewer requests.
+	ShedClient
+)
+
+// String returns "capacity" or "client", the Code of a Rejection.
+func (c ShedCause) String() string {
+	if c == ShedClient {
+		return "client"
+	}
+	return "capacity"
+}
+
+// RejectPolicy is the HTTP response for rejected requests, for each ShedCause. The defaults
+// follow the HTTP semantics that CDNs and load balancers use to decide whether to retry:
+// 503 Service Unavailable with Retry-After when the server is at capacity, and 429 Too Many
+// Requests when the client exceeded its limit.
+type RejectPolicy struct {
+	// CapacityStatus is the status for ShedCapacity. If zero, it is 503 Service Unavailable.
+	CapacityStatus int
+	// ClientStatus is the status for ShedClient. If zero, it is 429 Too Many Requests.
+	ClientStatus int
+	// RetryAfter is sent in the Retry-After header with CapacityStatus, rounded up to seconds. If
+	// zero, it is one second.
+	RetryAfter time.Duration
+	// LogRejections logs each rejected request with its request ID, to correlate it with the
+	// client's logs (see RequestIDHandler). During overload this can log many lines per second.
+	LogRejections bool
+	// JSON writes the body of rejections as a Rejection in JSON, instead of as text, so clients
+	// can parse it with the limitclient package.
+	JSON bool
+}
+
+var rejectPolicy atomic.Pointer[RejectPolicy]
+
+// SetRejectPolicy changes the responses for rejected requests of all handlers in this package.
+func SetRejectPolicy(policy RejectPolicy) {
+	rejectPolicy.Store(&policy)
+}
+
+// loadRejectPolicy returns the policy set by SetRejectPolicy.
+func loadRejectPolicy() RejectPolicy {
+	if p := rejectPolicy.Load(); p != nil {
+		return *p
+	}
+	return RejectPolicy{}
+}
+
+// Rejection is the machine-readable description of a rejected request. It is the JSON body of
+// HTTP rejections if RejectPolicy.JSON is set, and grpclimit adds it to the status details of gRPC
+// rejections. The limitclient package parses both, so clients can react to rejections the same
+// way for every server.
+type Rejection struct {
+	// Code is the ShedCause: "capacity" or "client".
+	Code string `json:"code"`
+	// Reason describes the rejection, such as the error returned by the limiter.
+	Reason string `json:"reason"`
+	// RetryAfterMS is how long the client should wait before retrying, in milliseconds, from
+	// RejectPolicy.RetryAfter. It is 0 for "client": the client should send fewer requests.
+	RetryAfterMS int64 `json:"retry_after_ms"`
+	// QueueDepth is the number of requests waiting in the limiter's queue, or 0 if it has none.
+	QueueDepth int `json:"queue_depth"`
+	// RequestID is the request's ID, set by RequestIDHandler, or is empty.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewRejection returns the Rejection for a request that was rejected because of cause with err,
+// using the policy set by SetRejectPolicy. QueueDepth is from limiter's Stats if it implements
+// StatsReporter; limiter may be nil.
+func NewRejection(cause ShedCause, err error, limiter Limiter) Rejection {
+	rejection := Rejection{Code: cause.String(), Reason: err.Error()}
+	if cause == ShedCapacity {
+		rejection.RetryAfterMS = retryAfter(loadRejectPolicy()).Milliseconds()
+	}
+	if reporter, ok := limiter.(StatsReporter); ok {
+		rejection.QueueDepth = reporter.Stats().Queued
+	}
+	return rejection
+}
+
+// retryAfter returns policy's RetryAfter, or its default.
+func retryAfter(policy RejectPolicy) time.Duration {
+	if policy.RetryAfter <= 0 {
+		return time.Second
+	}
+	return policy.RetryAfter
+}
+
+// WriteRejection writes the response for a request rejected because of cause, with err as the
+// body, or a Rejection in JSON if RejectPolicy.JSON is set, using the policy set by
+// SetRejectPolicy. If the response has an X-Request-ID header, set by RequestIDHandler, the body
+// includes the ID: see RejectionMessage.
+func WriteRejection(w http.ResponseWriter, cause ShedCause, err error) {
+	WriteLimiterRejection(w, nil, cause, err)
+}
+
+// WriteLimiterRejection is a version of WriteRejection for a request rejected by limiter, which
+// reports limiter's queue depth in the body if RejectPolicy.JSON is set. limiter may be nil.
+func WriteLimiterRejection(w http.ResponseWriter, limiter Limiter, cause ShedCause, err error) {
+	policy := loadRejectPolicy()
+	rejection := NewRejection(cause, err, limiter)
+	rejection.RequestID = w.Header().Get(RequestIDHeader)
+	message := RejectionMessage(rejection.RequestID, err)
+
+	var status int
+	if cause == ShedClient {
+		status = policy.ClientStatus
+		if status == 0 {
+			status = http.StatusTooManyRequests
+		}
+	} else {
+		status = policy.CapacityStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		seconds := (retryAfter(policy) + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	}
+
+	if !policy.JSON {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	// ignore the error: there is nothing we can do if writing the response fails
+	_ = json.NewEncoder(w).Encode(rejection)
+}
@@ -0,0 +1,81 @@
+package concurrentlimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// RequestIDHeader is the HTTP header that carries the ID of a request, to correlate the logs of
+// clients, load balancers, and servers. gRPC uses the same name in lower case as the metadata key.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID accepted from a client.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that carries the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID in ctx, or the empty string if it has none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random request ID of 32 hex digits.
+func NewRequestID() string {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// AcceptRequestID returns id if it can be used as a request ID, or a new ID from NewRequestID if
+// it is empty, longer than 128 bytes, or contains characters other than printable ASCII. Clients
+// choose request IDs, so this keeps them from injecting into logs or growing them without bound.
+func AcceptRequestID(id string) string {
+	if id == "" || len(id) > maxRequestIDLength {
+		return NewRequestID()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return NewRequestID()
+		}
+	}
+	return id
+}
+
+// RequestIDHandler returns an http.Handler that gives each request an ID: the client's
+// X-Request-ID header if it is valid (see AcceptRequestID), or a new ID. The ID is added to the
+// request's context for RequestIDFromContext and AuditHandler, and is returned in the response's
+// X-Request-ID header, which WriteRejection adds to the body of rejections. It must wrap the
+// limiting handlers, so rejected requests have an ID.
+func RequestIDHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := AcceptRequestID(r.Header.Get(RequestIDHeader))
+		w.Header().Set(RequestIDHeader, id)
+		handler.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// RejectionMessage returns the message for a request with requestID that was rejected with err:
+// the error, followed by the request ID if it is not empty. It logs the message if the policy set
+// by SetRejectPolicy has LogRejections. WriteRejection uses it for HTTP, and grpclimit for gRPC.
+func RejectionMessage(requestID string, err error) string {
+	message := err.Error()
+	if requestID != "" {
+		message += " (request_id=" + requestID + ")"
+	}
+	if loadRejectPolicy().LogRejections {
+		log.Println("concurrentlimit: rejected request: " + message)
+	}
+	return message
+}
@@ -0,0 +1,97 @@
+package concurrentlimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+// RolloutLimiter wraps a Limiter so only a fraction of the operations it rejects are actually
+// rejected. The rest run anyway. This permits gradually enabling a limit on a risky production
+// service: start with a small fraction, watch how many operations would have been rejected, and
+// increase the fraction with SetFraction.
+type RolloutLimiter struct {
+	limiter Limiter
+	// fraction is the float64 bits of the fraction of rejections that are enforced
+	fraction atomic.Uint64
+	// unenforced counts the operations that were permitted even though limiter rejected them
+	unenforced atomic.Uint64
+	// unenforcedCurrent is the number of running unenforced operations
+	unenforcedCurrent atomic.Int64
+}
+
+// NewRollout returns a RolloutLimiter that enforces fraction of limiter's rejections. It will
+// panic if fraction is not between 0 and 1.
+func NewRollout(limiter Limiter, fraction float64) *RolloutLimiter {
+	r := &RolloutLimiter{limiter: limiter}
+	r.SetFraction(fraction)
+	return r
+}
+
+// SetFraction changes the fraction of rejections that are enforced. 0 never rejects operations,
+// and 1 enforces the limit. It will panic if fraction is not between 0 and 1.
+func (r *RolloutLimiter) SetFraction(fraction float64) {
+	if !(0 <= fraction && fraction <= 1) {
+		panic(fmt.Sprintf("fraction must be between 0 and 1: %f", fraction))
+	}
+	r.fraction.Store(math.Float64bits(fraction))
+}
+
+// Fraction returns the fraction of rejections that are enforced.
+func (r *RolloutLimiter) Fraction() float64 {
+	return math.Float64frombits(r.fraction.Load())
+}
+
+// Unenforced returns the number of operations that were permitted, even though the wrapped
+// limiter rejected them.
+func (r *RolloutLimiter) Unenforced() uint64 {
+	return r.unenforced.Load()
+}
+
+// Start begins an operation with the wrapped limiter. If it rejects the operation, Start only
+// returns ErrLimited for Fraction of operations, and otherwise permits the operation without
+// counting it against the wrapped limiter. It implements Limiter.
+func (r *RolloutLimiter) Start() (func(), error) {
+	return r.enforce(r.limiter.Start())
+}
+
+// StartContext is a version of Start that calls the wrapped limiter's StartContext, so queued
+// operations can wait before they are rejected. It implements ContextLimiter.
+func (r *RolloutLimiter) StartContext(ctx context.Context) (func(), error) {
+	return r.enforce(WithContext(r.limiter).StartContext(ctx))
+}
+
+// enforce returns end and err from the wrapped limiter, unless it rejected the operation and the
+// rejection is not enforced.
+func (r *RolloutLimiter) enforce(end func(), err error) (func(), error) {
+	if err != ErrLimited || rand.Float64() < r.Fraction() {
+		return end, err
+	}
+
+	r.unenforced.Add(1)
+	r.unenforcedCurrent.Add(1)
+	return r.endUnenforced, nil
+}
+
+func (r *RolloutLimiter) endUnenforced() {
+	r.unenforcedCurrent.Add(-1)
+}
+
+// Stats returns the wrapped limiter's state if it implements StatsReporter, where Current also
+// includes the running unenforced operations.
+func (r *RolloutLimiter) Stats() Stats {
+	stats := Stats{}
+	if reporter, ok := r.limiter.(StatsReporter); ok {
+		stats = reporter.Stats()
+	}
+	stats.Current += int(r.unenforcedCurrent.Load())
+	return stats
+}
+
+// CurrentApprox is the ApproxReporter version of Stats.
+func (r *RolloutLimiter) CurrentApprox() (int, int) {
+	current, limit := currentApprox(r.limiter)
+	return current + int(r.unenforcedCurrent.Load()), limit
+}
@@ -0,0 +1,68 @@
+package concurrentlimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ShutdownOptions configures Shutdown.
+type ShutdownOptions struct {
+	// Health is marked as draining first, so readiness probes fail. It may be nil.
+	Health *HealthReporter
+	// DeregistrationDelay is how long to keep serving after readiness fails, before the servers
+	// stop accepting requests. Load balancers take time to notice that readiness fails: Kubernetes
+	// removes a pod from a Service's endpoints after its readiness probe fails, and cloud load
+	// balancers have their own delays. Until then they keep sending new requests, which fail if the
+	// servers have stopped. It should be longer than the probe's period times its failure
+	// threshold, plus the load balancer's delay.
+	DeregistrationDelay time.Duration
+	// Stops stop the servers from accepting requests, then wait for running requests to complete,
+	// or return when ctx is done. They are called at the same time. For example:
+	// http.Server.Shutdown, or a function that calls grpclimit.GracefulStop.
+	Stops []func(ctx context.Context) error
+	// Limiters are drained after Stops return, to wait for operations that outlive their
+	// requests, such as detached operations (see Detach).
+	Limiters []StatsReporter
+}
+
+// Shutdown stops a server without failing requests, in the order a load balanced deployment
+// needs: it fails readiness, waits DeregistrationDelay while still serving, stops the servers,
+// then drains the limiters. It returns the errors from each step, or ctx.Err() if ctx is done
+// before the operations complete. ctx's deadline should be shorter than the time the process has
+// to exit, e.g. Kubernetes's terminationGracePeriodSeconds, and includes DeregistrationDelay.
+func Shutdown(ctx context.Context, options ShutdownOptions) error {
+	if options.Health != nil {
+		options.Health.SetDraining()
+	}
+	if options.DeregistrationDelay > 0 {
+		timer := time.NewTimer(options.DeregistrationDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			// stop the servers anyway: they may still close idle connections
+			timer.Stop()
+		}
+	}
+
+	errs := make([]error, len(options.Stops))
+	var wg sync.WaitGroup
+	for i, stop := range options.Stops {
+		wg.Add(1)
+		go func(i int, stop func(ctx context.Context) error) {
+			defer wg.Done()
+			errs[i] = stop(ctx)
+		}(i, stop)
+	}
+	wg.Wait()
+
+	for _, limiter := range options.Limiters {
+		err := Drain(ctx, limiter)
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
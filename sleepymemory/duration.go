@@ -0,0 +1,24 @@
+package sleepymemory
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Duration returns d as a protobuf Duration for the duration fields of these messages.
+func Duration(d time.Duration) *durationpb.Duration {
+	return durationpb.New(d)
+}
+
+// AsDuration returns the value of a duration field, which is 0 if it is not set, or an error if
+// it is out of range or its seconds and nanos have different signs.
+func AsDuration(d *durationpb.Duration) (time.Duration, error) {
+	if d == nil {
+		return 0, nil
+	}
+	if err := d.CheckValid(); err != nil {
+		return 0, err
+	}
+	return d.AsDuration(), nil
+}
@@ -0,0 +1,23 @@
+package sleepymemory
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestDuration(t *testing.T) {
+	d, err := AsDuration(Duration(1500 * time.Millisecond))
+	if err != nil || d != 1500*time.Millisecond {
+		t.Error(d, err)
+	}
+	d, err = AsDuration(nil)
+	if err != nil || d != 0 {
+		t.Error("expected unset durations to be 0:", d, err)
+	}
+	_, err = AsDuration(&durationpb.Duration{Seconds: 1, Nanos: -1})
+	if err == nil {
+		t.Error("expected an invalid duration to return an error")
+	}
+}
@@ -30,6 +30,12 @@ type SleepRequest struct {
 	SleepDuration *durationpb.Duration `protobuf:"bytes,1,opt,name=sleep_duration,json=sleepDuration,proto3" json:"sleep_duration,omitempty"`
 	// Bytes of memory that will be allocated before sleeping to simulate requests that use lots of memory.
 	WasteBytes int64 `protobuf:"varint,2,opt,name=waste_bytes,json=wasteBytes,proto3" json:"waste_bytes,omitempty"`
+	// If true, the wasted memory is kept by the server after the request completes, to simulate a
+	// memory leak. The servers release it with a POST to /leak.
+	Leak bool `protobuf:"varint,3,opt,name=leak,proto3" json:"leak,omitempty"`
+	// Number of file descriptors that will be opened and held while sleeping, to simulate requests
+	// that exhaust the process's file descriptor limit (e.g. ulimit -n).
+	WasteFiles int64 `protobuf:"varint,4,opt,name=waste_files,json=wasteFiles,proto3" json:"waste_files,omitempty"`
 }
 
 func (x *SleepRequest) Reset() {
@@ -78,6 +84,20 @@ func (x *SleepRequest) GetWasteBytes() int64 {
 	return 0
 }
 
+func (x *SleepRequest) GetLeak() bool {
+	if x != nil {
+		return x.Leak
+	}
+	return false
+}
+
+func (x *SleepRequest) GetWasteFiles() int64 {
+	if x != nil {
+		return x.WasteFiles
+	}
+	return 0
+}
+
 type SleepResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -126,6 +146,129 @@ func (x *SleepResponse) GetIgnored() int64 {
 	return 0
 }
 
+type SleepStreamRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The duration the stream will last.
+	SleepDuration *durationpb.Duration `protobuf:"bytes,1,opt,name=sleep_duration,json=sleepDuration,proto3" json:"sleep_duration,omitempty"`
+	// Bytes of memory that will be allocated for the duration of the stream.
+	WasteBytes int64 `protobuf:"varint,2,opt,name=waste_bytes,json=wasteBytes,proto3" json:"waste_bytes,omitempty"`
+	// The time between responses. If not set, the default is one second.
+	TickInterval *durationpb.Duration `protobuf:"bytes,3,opt,name=tick_interval,json=tickInterval,proto3" json:"tick_interval,omitempty"`
+}
+
+func (x *SleepStreamRequest) Reset() {
+	*x = SleepStreamRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sleepymemory_sleepymemory_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SleepStreamRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SleepStreamRequest) ProtoMessage() {}
+
+func (x *SleepStreamRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sleepymemory_sleepymemory_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SleepStreamRequest.ProtoReflect.Descriptor instead.
+func (*SleepStreamRequest) Descriptor() ([]byte, []int) {
+	return file_sleepymemory_sleepymemory_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SleepStreamRequest) GetSleepDuration() *durationpb.Duration {
+	if x != nil {
+		return x.SleepDuration
+	}
+	return nil
+}
+
+func (x *SleepStreamRequest) GetWasteBytes() int64 {
+	if x != nil {
+		return x.WasteBytes
+	}
+	return 0
+}
+
+func (x *SleepStreamRequest) GetTickInterval() *durationpb.Duration {
+	if x != nil {
+		return x.TickInterval
+	}
+	return nil
+}
+
+type SleepStreamResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The time since the stream started.
+	Elapsed *durationpb.Duration `protobuf:"bytes,1,opt,name=elapsed,proto3" json:"elapsed,omitempty"`
+	// The value is ignored but exists to prevent garbage collection freeing the waste slice early.
+	Ignored int64 `protobuf:"varint,2,opt,name=ignored,proto3" json:"ignored,omitempty"`
+}
+
+func (x *SleepStreamResponse) Reset() {
+	*x = SleepStreamResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sleepymemory_sleepymemory_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SleepStreamResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SleepStreamResponse) ProtoMessage() {}
+
+func (x *SleepStreamResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_sleepymemory_sleepymemory_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SleepStreamResponse.ProtoReflect.Descriptor instead.
+func (*SleepStreamResponse) Descriptor() ([]byte, []int) {
+	return file_sleepymemory_sleepymemory_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *SleepStreamResponse) GetElapsed() *durationpb.Duration {
+	if x != nil {
+		return x.Elapsed
+	}
+	return nil
+}
+
+func (x *SleepStreamResponse) GetIgnored() int64 {
+	if x != nil {
+		return x.Ignored
+	}
+	return 0
+}
+
 var File_sleepymemory_sleepymemory_proto protoreflect.FileDescriptor
 
 var file_sleepymemory_sleepymemory_proto_rawDesc = []byte{
@@ -134,25 +277,51 @@ var file_sleepymemory_sleepymemory_proto_rawDesc = []byte{
 	0x6f, 0x12, 0x0c, 0x73, 0x6c, 0x65, 0x65, 0x70, 0x79, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x1a,
 	0x1e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
 	0x2f, 0x64, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22,
-	0x71, 0x0a, 0x0c, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
-	0x40, 0x0a, 0x0e, 0x73, 0x6c, 0x65, 0x65, 0x70, 0x5f, 0x64, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f,
-	0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
-	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69,
-	0x6f, 0x6e, 0x52, 0x0d, 0x73, 0x6c, 0x65, 0x65, 0x70, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f,
-	0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x77, 0x61, 0x73, 0x74, 0x65, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73,
-	0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x77, 0x61, 0x73, 0x74, 0x65, 0x42, 0x79, 0x74,
-	0x65, 0x73, 0x22, 0x29, 0x0a, 0x0d, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f,
-	0x6e, 0x73, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x69, 0x67, 0x6e, 0x6f, 0x72, 0x65, 0x64, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x69, 0x67, 0x6e, 0x6f, 0x72, 0x65, 0x64, 0x32, 0x4b, 0x0a,
-	0x07, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x65, 0x72, 0x12, 0x40, 0x0a, 0x05, 0x53, 0x6c, 0x65, 0x65,
-	0x70, 0x12, 0x1a, 0x2e, 0x73, 0x6c, 0x65, 0x65, 0x70, 0x79, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79,
-	0x2e, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e,
-	0x73, 0x6c, 0x65, 0x65, 0x70, 0x79, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x2e, 0x53, 0x6c, 0x65,
-	0x65, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x2f, 0x5a, 0x2d, 0x67, 0x69,
-	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x65, 0x76, 0x61, 0x6e, 0x6a, 0x2f, 0x63,
-	0x6f, 0x6e, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x2f, 0x73,
-	0x6c, 0x65, 0x65, 0x70, 0x79, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x62, 0x06, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x33,
+	0xa6, 0x01, 0x0a, 0x0c, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x12, 0x40, 0x0a, 0x0e, 0x73, 0x6c, 0x65, 0x65, 0x70, 0x5f, 0x64, 0x75, 0x72, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x52, 0x0d, 0x73, 0x6c, 0x65, 0x65, 0x70, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x77, 0x61, 0x73, 0x74, 0x65, 0x5f, 0x62, 0x79, 0x74, 0x65,
+	0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x77, 0x61, 0x73, 0x74, 0x65, 0x42, 0x79,
+	0x74, 0x65, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x6c, 0x65, 0x61, 0x6b, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x04, 0x6c, 0x65, 0x61, 0x6b, 0x12, 0x1f, 0x0a, 0x0b, 0x77, 0x61, 0x73, 0x74, 0x65,
+	0x5f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x77, 0x61,
+	0x73, 0x74, 0x65, 0x46, 0x69, 0x6c, 0x65, 0x73, 0x22, 0x29, 0x0a, 0x0d, 0x53, 0x6c, 0x65, 0x65,
+	0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x69, 0x67, 0x6e,
+	0x6f, 0x72, 0x65, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x69, 0x67, 0x6e, 0x6f,
+	0x72, 0x65, 0x64, 0x22, 0xb7, 0x01, 0x0a, 0x12, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x53, 0x74, 0x72,
+	0x65, 0x61, 0x6d, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x40, 0x0a, 0x0e, 0x73, 0x6c,
+	0x65, 0x65, 0x70, 0x5f, 0x64, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0d, 0x73,
+	0x6c, 0x65, 0x65, 0x70, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1f, 0x0a, 0x0b,
+	0x77, 0x61, 0x73, 0x74, 0x65, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x0a, 0x77, 0x61, 0x73, 0x74, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x3e, 0x0a,
+	0x0d, 0x74, 0x69, 0x63, 0x6b, 0x5f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52,
+	0x0c, 0x74, 0x69, 0x63, 0x6b, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x22, 0x64, 0x0a,
+	0x13, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x33, 0x0a, 0x07, 0x65, 0x6c, 0x61, 0x70, 0x73, 0x65, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x52, 0x07, 0x65, 0x6c, 0x61, 0x70, 0x73, 0x65, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x69, 0x67, 0x6e,
+	0x6f, 0x72, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x69, 0x67, 0x6e, 0x6f,
+	0x72, 0x65, 0x64, 0x32, 0xa1, 0x01, 0x0a, 0x07, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x65, 0x72, 0x12,
+	0x40, 0x0a, 0x05, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x12, 0x1a, 0x2e, 0x73, 0x6c, 0x65, 0x65, 0x70,
+	0x79, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x2e, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e, 0x73, 0x6c, 0x65, 0x65, 0x70, 0x79, 0x6d, 0x65, 0x6d,
+	0x6f, 0x72, 0x79, 0x2e, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x54, 0x0a, 0x0b, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d,
+	0x12, 0x20, 0x2e, 0x73, 0x6c, 0x65, 0x65, 0x70, 0x79, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x2e,
+	0x53, 0x6c, 0x65, 0x65, 0x70, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x1a, 0x21, 0x2e, 0x73, 0x6c, 0x65, 0x65, 0x70, 0x79, 0x6d, 0x65, 0x6d, 0x6f, 0x72,
+	0x79, 0x2e, 0x53, 0x6c, 0x65, 0x65, 0x70, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x30, 0x01, 0x42, 0x2f, 0x5a, 0x2d, 0x67, 0x69, 0x74, 0x68, 0x75,
+	0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x65, 0x76, 0x61, 0x6e, 0x6a, 0x2f, 0x63, 0x6f, 0x6e, 0x63,
+	0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x2f, 0x73, 0x6c, 0x65, 0x65,
+	0x70, 0x79, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -167,21 +336,28 @@ func file_sleepymemory_sleepymemory_proto_rawDescGZIP() []byte {
 	return file_sleepymemory_sleepymemory_proto_rawDescData
 }
 
-var file_sleepymemory_sleepymemory_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_sleepymemory_sleepymemory_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
 var file_sleepymemory_sleepymemory_proto_goTypes = []interface{}{
 	(*SleepRequest)(nil),        // 0: sleepymemory.SleepRequest
 	(*SleepResponse)(nil),       // 1: sleepymemory.SleepResponse
-	(*durationpb.Duration)(nil), // 2: google.protobuf.Duration
+	(*SleepStreamRequest)(nil),  // 2: sleepymemory.SleepStreamRequest
+	(*SleepStreamResponse)(nil), // 3: sleepymemory.SleepStreamResponse
+	(*durationpb.Duration)(nil), // 4: google.protobuf.Duration
 }
 var file_sleepymemory_sleepymemory_proto_depIdxs = []int32{
-	2, // 0: sleepymemory.SleepRequest.sleep_duration:type_name -> google.protobuf.Duration
-	0, // 1: sleepymemory.Sleeper.Sleep:input_type -> sleepymemory.SleepRequest
-	1, // 2: sleepymemory.Sleeper.Sleep:output_type -> sleepymemory.SleepResponse
-	2, // [2:3] is the sub-list for method output_type
-	1, // [1:2] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	4, // 0: sleepymemory.SleepRequest.sleep_duration:type_name -> google.protobuf.Duration
+	4, // 1: sleepymemory.SleepStreamRequest.sleep_duration:type_name -> google.protobuf.Duration
+	4, // 2: sleepymemory.SleepStreamRequest.tick_interval:type_name -> google.protobuf.Duration
+	4, // 3: sleepymemory.SleepStreamResponse.elapsed:type_name -> google.protobuf.Duration
+	0, // 4: sleepymemory.Sleeper.Sleep:input_type -> sleepymemory.SleepRequest
+	2, // 5: sleepymemory.Sleeper.SleepStream:input_type -> sleepymemory.SleepStreamRequest
+	1, // 6: sleepymemory.Sleeper.Sleep:output_type -> sleepymemory.SleepResponse
+	3, // 7: sleepymemory.Sleeper.SleepStream:output_type -> sleepymemory.SleepStreamResponse
+	6, // [6:8] is the sub-list for method output_type
+	4, // [4:6] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_sleepymemory_sleepymemory_proto_init() }
@@ -214,6 +390,30 @@ func file_sleepymemory_sleepymemory_proto_init() {
 				return nil
 			}
 		}
+		file_sleepymemory_sleepymemory_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SleepStreamRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sleepymemory_sleepymemory_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SleepStreamResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -221,7 +421,7 @@ func file_sleepymemory_sleepymemory_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_sleepymemory_sleepymemory_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
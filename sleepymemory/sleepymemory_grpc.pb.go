@@ -23,6 +23,8 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type SleeperClient interface {
 	Sleep(ctx context.Context, in *SleepRequest, opts ...grpc.CallOption) (*SleepResponse, error)
+	// SleepStream sends a response every tick interval until the sleep duration has passed.
+	SleepStream(ctx context.Context, in *SleepStreamRequest, opts ...grpc.CallOption) (Sleeper_SleepStreamClient, error)
 }
 
 type sleeperClient struct {
@@ -42,11 +44,45 @@ func (c *sleeperClient) Sleep(ctx context.Context, in *SleepRequest, opts ...grp
 	return out, nil
 }
 
+func (c *sleeperClient) SleepStream(ctx context.Context, in *SleepStreamRequest, opts ...grpc.CallOption) (Sleeper_SleepStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Sleeper_ServiceDesc.Streams[0], "/sleepymemory.Sleeper/SleepStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &sleeperSleepStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Sleeper_SleepStreamClient interface {
+	Recv() (*SleepStreamResponse, error)
+	grpc.ClientStream
+}
+
+type sleeperSleepStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *sleeperSleepStreamClient) Recv() (*SleepStreamResponse, error) {
+	m := new(SleepStreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // SleeperServer is the server API for Sleeper service.
 // All implementations must embed UnimplementedSleeperServer
 // for forward compatibility
 type SleeperServer interface {
 	Sleep(context.Context, *SleepRequest) (*SleepResponse, error)
+	// SleepStream sends a response every tick interval until the sleep duration has passed.
+	SleepStream(*SleepStreamRequest, Sleeper_SleepStreamServer) error
 	mustEmbedUnimplementedSleeperServer()
 }
 
@@ -57,6 +93,9 @@ type UnimplementedSleeperServer struct {
 func (UnimplementedSleeperServer) Sleep(context.Context, *SleepRequest) (*SleepResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Sleep not implemented")
 }
+func (UnimplementedSleeperServer) SleepStream(*SleepStreamRequest, Sleeper_SleepStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method SleepStream not implemented")
+}
 func (UnimplementedSleeperServer) mustEmbedUnimplementedSleeperServer() {}
 
 // UnsafeSleeperServer may be embedded to opt out of forward compatibility for this service.
@@ -88,6 +127,27 @@ func _Sleeper_Sleep_Handler(srv interface{}, ctx context.Context, dec func(inter
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Sleeper_SleepStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SleepStreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SleeperServer).SleepStream(m, &sleeperSleepStreamServer{stream})
+}
+
+type Sleeper_SleepStreamServer interface {
+	Send(*SleepStreamResponse) error
+	grpc.ServerStream
+}
+
+type sleeperSleepStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *sleeperSleepStreamServer) Send(m *SleepStreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // Sleeper_ServiceDesc is the grpc.ServiceDesc for Sleeper service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -100,6 +160,12 @@ var Sleeper_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _Sleeper_Sleep_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SleepStream",
+			Handler:       _Sleeper_SleepStream_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "sleepymemory/sleepymemory.proto",
 }
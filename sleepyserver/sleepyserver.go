@@ -1,3 +1,13 @@
+// Sleepyserver serves HTTP and gRPC requests that sleep and waste memory, to test how servers
+// behave when overloaded. The --limitMode flag selects how requests are limited:
+//
+//   - none: requests and connections are not limited, to show how the server fails.
+//   - manual: the handlers limit requests, and netutil.LimitListener limits connections. Both are
+//     off unless --concurrentRequests and --concurrentConnections are set.
+//   - queued: like manual, but requests over the limit wait in a queue of up to --queueDepth
+//     requests for up to --queueTimeout, using concurrentlimit.QueuedLimiter.
+//   - library: concurrentlimit and grpclimit limit HTTP and gRPC requests separately, and an admin
+//     API on --adminAddr can change the limits while running.
 package main
 
 import (
@@ -5,214 +15,366 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"os/signal"
 	"runtime"
-	"strconv"
-	"sync"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/evanj/concurrentlimit"
+	"github.com/evanj/concurrentlimit/grpclimit"
+	"github.com/evanj/concurrentlimit/internal/demoserver"
+	"github.com/evanj/concurrentlimit/limittest"
 	"github.com/evanj/concurrentlimit/sleepymemory"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/net/netutil"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/types/known/durationpb"
+	channelzservice "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
 )
 
-const sleepHTTPKey = "sleep"
-const wasteHTTPKey = "waste"
+const limitModeNone = "none"
+const limitModeManual = "manual"
+const limitModeQueued = "queued"
+const limitModeLibrary = "library"
 
-type server struct {
-	sleepymemory.UnimplementedSleeperServer
-	logger         concurrentMaxLogger
-	limiter        concurrentlimit.Limiter
-	logAllRequests bool
-}
+// apiKeyHeader identifies the tenant of a request for --apiKeyLimit, in HTTP headers and gRPC
+// metadata. The keys are not checked: this only demonstrates limiting each tenant.
+const apiKeyHeader = "X-API-Key"
 
-func newServer(limiter concurrentlimit.Limiter, logAllRequests bool) *server {
-	return &server{
-		logger:         concurrentMaxLogger{},
-		limiter:        limiter,
-		logAllRequests: logAllRequests,
-	}
-}
+// trustedIdentityHeader is the HTTP header and gRPC metadata with a signed identity for
+// --trustedIdentities. See --printTrustedIdentity.
+const trustedIdentityHeader = "X-Trusted-Identity"
 
-func (s *server) rawRootHandler(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
-		return
-	}
-	if r.Method != http.MethodGet {
-		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
-		return
-	}
+func main() {
+	httpAddr := flag.String("httpAddr", "localhost:8080", "Address to listen for HTTP requests")
+	grpcAddr := flag.String("grpcAddr", "localhost:8081", "Address to listen for gRPC requests")
+	limitMode := flag.String("limitMode", limitModeManual,
+		"How to limit requests: none, manual (in the handlers), queued (in the handlers, with a queue), or library (concurrentlimit and grpclimit)")
+	concurrentRequests := flag.Int("concurrentRequests", 0, "Limits the number of concurrent requests")
+	concurrentConnections := flag.Int("concurrentConnections", 0, "Limits the number of concurrent connections")
+	grpcConcurrentConnections := flag.Int("grpcConcurrentConnections", 0,
+		"Limits the number of concurrent gRPC connections, independently of HTTP (default --concurrentConnections)")
+	queueDepth := flag.Int("queueDepth", 0,
+		"With --limitMode=queued, the maximum number of requests waiting for a running request to complete")
+	queueTimeout := flag.Duration("queueTimeout", time.Second,
+		"With --limitMode=queued, the maximum time a request waits in the queue before it is rejected")
+	grpcConcurrentStreams := flag.Int("grpcConcurrentStreams", 0,
+		"Limits the number of concurrent streams per gRPC connection (default with --limitMode=library: --concurrentRequests)")
+	grpcMethodConfig := flag.String("grpcMethodConfig", "",
+		"If set, a JSON file of per-method gRPC limits and costs (costs share --concurrentRequests); see --printGRPCMethodConfig")
+	printGRPCMethodConfig := flag.Bool("printGRPCMethodConfig", false,
+		"Print a skeleton --grpcMethodConfig file with every gRPC method and exit")
+	printGRPCServiceConfig := flag.Bool("printGRPCServiceConfig", false,
+		"Print a skeleton --grpcMethodConfig file with every gRPC service and exit; methods can be added to override them")
+	grpcSlowStart := flag.Int("grpcSlowStart", 0,
+		"If set, new gRPC connections may only run this many concurrent streams, raised by one as each stream completes")
+	compress := flag.Bool("compress", false,
+		"Compress HTTP responses with gzip, except while the HTTP limit is at least 80% occupied")
+	logAll := flag.Bool("logAll", false, "Log all requests")
+	h2cEnabled := flag.Bool("h2c", false, "Accept HTTP/2 without TLS (h2c) on the HTTP address")
+	memLimit := flag.Int64("memLimit", 0,
+		"If set, the Go runtime's soft memory limit in bytes (see debug.SetMemoryLimit and GOMEMLIMIT)")
+	gcPercent := flag.String("gcPercent", "",
+		"If set, the Go runtime's GC percent: an integer or off (see debug.SetGCPercent and GOGC)")
+	tlsCert := flag.String("tlsCert", "", "If set, serve HTTPS and gRPC with TLS using this certificate file")
+	tlsKey := flag.String("tlsKey", "", "Private key file for --tlsCert")
+	tlsSelfSigned := flag.Bool("tlsSelfSigned", false,
+		"Serve HTTPS and gRPC with TLS using a generated self-signed certificate for localhost")
+	errorRate := flag.Float64("errorRate", 0, "Fraction of requests that fail after sleeping, from 0 to 1")
+	jitter := flag.Duration("jitter", 0, "Mean extra latency added to each request")
+	jitterDistribution := flag.String("jitterDistribution", demoserver.JitterUniform,
+		"Distribution of the extra latency: uniform (from 0 to twice --jitter) or exponential (a long tail)")
+	adminAddr := flag.String("adminAddr", "localhost:8082",
+		"With --limitMode=library or --profileWarmup, address to listen for admin requests to change the request limits; empty to disable")
+	apiKeyLimit := flag.Int("apiKeyLimit", 0,
+		"If set, limits the concurrent requests with each "+apiKeyHeader+" header or gRPC metadata value, in every --limitMode")
+	apiKeyCeiling := flag.Int("apiKeyCeiling", 0,
+		"If > --apiKeyLimit, each API key can borrow capacity not used by other keys up to this many requests, "+
+			"while fewer than --concurrentRequests are running")
+	maxConnectionAge := flag.Duration("maxConnectionAge", 0,
+		"If set, close HTTP and gRPC connections after they are open this long, so clients reconnect and rebalance")
+	headerConnections := flag.Int("headerConnections", 0,
+		"If set, limits the HTTP connections waiting for or reading request headers, separately from --concurrentRequests")
+	connDeadline := flag.Duration("connDeadline", 0,
+		"If set, the maximum time after a connection is accepted that it can read and write, to protect against slow clients")
+	bytesPerSecond := flag.Int64("bytesPerSecond", 0,
+		"If set, limits the bytes per second read and written by all HTTP and gRPC connections")
+	connBytesPerSecond := flag.Int64("connBytesPerSecond", 0,
+		"If set, limits the bytes per second read and written by each HTTP and gRPC connection")
+	allowIPs := flag.String("allowIPs", "",
+		"If set, comma-separated networks (CIDR or IP addresses) that may connect; others are closed before the connection limit")
+	denyIPs := flag.String("denyIPs", "",
+		"Comma-separated networks (CIDR or IP addresses) whose connections are closed before the connection limit")
+	apiKeyRejectionBudget := flag.Int("apiKeyRejectionBudget", 0,
+		"If set, the requests rejected immediately for each API key each second; after that, requests wait up to --apiKeyMaxWait")
+	apiKeyMaxWait := flag.Duration("apiKeyMaxWait", time.Second,
+		"With --apiKeyRejectionBudget, the maximum time a request waits before it is rejected")
+	apiKeyMaxKeys := flag.Int("apiKeyMaxKeys", 0,
+		"If set, the maximum number of API keys with running requests; requests with other keys share one --apiKeyLimit")
+	enforceFraction := flag.Float64("enforceFraction", 1,
+		"The fraction of requests over --concurrentRequests that are rejected; the others run anyway, to gradually roll out a limit")
+	admitSignals := flag.String("admitSignals", "",
+		"Comma-separated signals that also decide whether to admit requests: occupancy, memory, cpu, or queue_delay (over --queueTimeout)")
+	admitScore := flag.Float64("admitScore", 0,
+		"With --admitSignals, reject requests while the average of the signals is at least this fraction of their thresholds; 0 to reject while any signal is over its threshold")
+	autoLimits := flag.Bool("autoLimits", false,
+		"Compute the request, connection, and memory limits that are not set from the container's cgroup memory limit, and GOMAXPROCS from its CPU limit")
+	autoRequestBytes := flag.Int64("autoRequestBytes", 1<<20,
+		"With --autoLimits, the peak memory used by one request")
+	latencyTarget := flag.Duration("latencyTarget", 0,
+		"With --limitMode=library, adjust each request limit up to --concurrentRequests to hold the --latencyPercentile latency under this")
+	latencyPercentile := flag.Float64("latencyPercentile", 99, "The latency percentile held under --latencyTarget")
+	auditSize := flag.Int("auditSize", 0,
+		"With --limitMode=library, the number of sampled admission decisions kept for /audit on --adminAddr; 0 to disable")
+	auditFraction := flag.Float64("auditFraction", 0.01,
+		"With --auditSize, the fraction of admission decisions that are recorded")
+	trustedIdentities := flag.String("trustedIdentities", "",
+		"With --limitMode=library, comma-separated client certificate identities, or "+trustedIdentityHeader+" identities signed with --trustedSigningKey, whose requests can exceed the limits")
+	trustedReserve := flag.Int("trustedReserve", 0,
+		"With --trustedIdentities, the concurrent trusted requests permitted over each limit; 0 to not limit them")
+	trustedSigningKey := flag.String("trustedSigningKey", "",
+		"The key that signs "+trustedIdentityHeader+" values for --trustedIdentities; empty to only trust client certificates")
+	printTrustedIdentity := flag.String("printTrustedIdentity", "",
+		"Print the "+trustedIdentityHeader+" value for this identity signed with --trustedSigningKey and exit")
+	profileWarmup := flag.Duration("profileWarmup", 0,
+		"If set, profile the concurrency, latency, and memory of HTTP and gRPC requests after this warmup, and suggest limits at /profile on --adminAddr")
+	rejectJSON := flag.Bool("rejectJSON", false,
+		"Describe rejected HTTP requests with a JSON body that limitclient parses, instead of text")
+	requestIDs := flag.Bool("requestIDs", false,
+		"Give each request an ID from its "+concurrentlimit.RequestIDHeader+" header or metadata, or a new one, include it in rejections and audit records, and log rejections")
+	deregistrationDelay := flag.Duration("deregistrationDelay", 0,
+		"After SIGTERM or SIGINT, the time to keep serving with /readyz failing, so load balancers stop sending requests before the server stops")
+	shutdownTimeout := flag.Duration("shutdownTimeout", 30*time.Second,
+		"Time to wait for running requests to complete after SIGTERM or SIGINT, including --deregistrationDelay")
+	flag.Parse()
 
-	err := s.rootHandler(w, r)
-	if err != nil {
-		statusCode := http.StatusInternalServerError
-		if err == concurrentlimit.ErrLimited {
-			statusCode = http.StatusTooManyRequests
+	if *printTrustedIdentity != "" {
+		if *trustedSigningKey == "" {
+			panic("--printTrustedIdentity requires --trustedSigningKey")
 		}
-		http.Error(w, err.Error(), statusCode)
+		fmt.Println(concurrentlimit.SignIdentity([]byte(*trustedSigningKey), *printTrustedIdentity))
+		return
 	}
-}
-
-func humanBytes(bytes uint64) string {
-	megabytes := float64(bytes) / float64(1024*1024)
-	return fmt.Sprintf("%.1f", megabytes)
-}
-
-func (s *server) memstatsHandler(w http.ResponseWriter, r *http.Request) {
-	stats := &runtime.MemStats{}
-	runtime.ReadMemStats(stats)
-
-	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
-	fmt.Fprintf(w, "total bytes of memory obtained from the OS Sys=%d %s\n",
-		stats.Sys, humanBytes(stats.Sys))
-	fmt.Fprintf(w, "bytes of allocated heap objects HeapAlloc=%d %s\n",
-		stats.HeapAlloc, humanBytes(stats.HeapAlloc))
-}
-
-func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) error {
-	req := &sleepymemory.SleepRequest{}
-
-	sleepValue := r.FormValue(sleepHTTPKey)
-	if sleepValue != "" {
-		var sleepDuration time.Duration
-		// try to parse as integer seconds first
-		seconds, err := strconv.Atoi(sleepValue)
-		if err == nil {
-			// SUCCESS!
-			sleepDuration = time.Duration(seconds) * time.Second
-		} else {
-			// fall back to parsing duration, and return that error if it fails
-			sleepDuration, err = time.ParseDuration(sleepValue)
-			if err != nil {
-				return err
-			}
+	if *printGRPCMethodConfig || *printGRPCServiceConfig {
+		// the server is never started: it only lists the methods of the registered services
+		server := grpc.NewServer()
+		registerGRPCServices(server, &demoserver.Server{})
+		configs := grpclimit.MethodConfigs(server)
+		if *printGRPCServiceConfig {
+			configs = grpclimit.ServiceConfigs(server)
+		}
+		err := grpclimit.WriteMethodConfigs(os.Stdout, configs)
+		if err != nil {
+			panic(err)
 		}
-		req.SleepDuration = durationpb.New(sleepDuration)
+		return
 	}
 
-	wasteValue := r.FormValue(wasteHTTPKey)
-	if wasteValue != "" {
-		bytes, err := strconv.Atoi(wasteValue)
+	// stop on SIGTERM (e.g. docker stop) or SIGINT (Ctrl-C); a second signal kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *autoLimits {
+		err := configureAutoLimits(*autoRequestBytes, concurrentRequests, concurrentConnections, memLimit)
 		if err != nil {
-			return err
+			panic(err)
 		}
-		req.WasteBytes = int64(bytes)
 	}
 
-	resp, err := s.sleepImplementation(r.Context(), req)
+	err := demoserver.ConfigureRuntime(*memLimit, *gcPercent)
 	if err != nil {
-		return err
+		panic(err)
 	}
 
-	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
-	fmt.Fprintf(w, "slept for %s (pass ?sleep=x)\nwasted %d bytes (pass ?waste=y)\nignored response=%d\n",
-		req.SleepDuration.String(), req.WasteBytes, resp.Ignored)
-	return nil
-}
-
-func (s *server) Sleep(ctx context.Context, request *sleepymemory.SleepRequest) (*sleepymemory.SleepResponse, error) {
-	resp, err := s.sleepImplementation(ctx, request)
-	if err == concurrentlimit.ErrLimited {
-		err = status.Error(codes.ResourceExhausted, err.Error())
+	faults, err := demoserver.NewFaultInjector(*errorRate, *jitter, *jitterDistribution)
+	if err != nil {
+		panic(err)
 	}
-	return resp, err
-}
 
-func (s *server) sleepImplementation(ctx context.Context, request *sleepymemory.SleepRequest) (*sleepymemory.SleepResponse, error) {
-	// limit concurrent requests
-	end, err := s.limiter.Start()
+	tlsConfig, err := demoserver.LoadTLSConfig(*tlsCert, *tlsKey, *tlsSelfSigned)
 	if err != nil {
-		return nil, err
+		panic(err)
 	}
-	defer end()
 
-	defer s.logger.start()()
+	s := &demoserver.Server{LogAllRequests: *logAll, Faults: faults}
 
-	if s.logAllRequests {
-		md, ok := metadata.FromIncomingContext(ctx)
-		log.Printf("starting Sleep request=%s md=%v ok=%v", request.String(), md, ok)
+	// rollout only enforces --enforceFraction of the request limit's rejections
+	rollout := func(limiter concurrentlimit.Limiter) concurrentlimit.Limiter {
+		if *enforceFraction >= 1 {
+			return limiter
+		}
+		return concurrentlimit.NewRollout(limiter, *enforceFraction)
 	}
-
-	wasteSlice := make([]byte, request.WasteBytes)
-	// touch each page in the slice to ensure it is actually allocated
-	const pageSize = 4096
-	for i := 0; i < len(wasteSlice); i += pageSize {
-		wasteSlice[i] = 0xff
+	if *enforceFraction < 1 {
+		log.Printf("enforcing only %.3f of the request limit's rejections", *enforceFraction)
 	}
-
-	var duration time.Duration
-	if request.SleepDuration != nil {
-		if err := request.SleepDuration.CheckValid(); err != nil {
-			return nil, err
+	// admit only lets --admitSignals decide together with the request limit. It is wrapped by
+	// rollout, so --enforceFraction also applies to the signals' rejections.
+	admit := func(limiter concurrentlimit.Limiter) concurrentlimit.Limiter {
+		if *admitSignals == "" {
+			return limiter
 		}
-		duration = request.SleepDuration.AsDuration()
+		return newComposite(limiter, splitList(*admitSignals), *admitScore, *queueTimeout)
 	}
-	// TODO: use ctx for cancellation
-	time.Sleep(duration)
-
-	// read some of the memory and return it so it doesn't get garbage collected
-	total := 0
-	for i := 0; i < len(wasteSlice); i += 10 * pageSize {
-		total += int(wasteSlice[i])
+	if *admitSignals != "" {
+		log.Printf("admitting requests with signals %s (score threshold %g)", *admitSignals, *admitScore)
 	}
 
-	return &sleepymemory.SleepResponse{Ignored: int64(total)}, nil
-}
-
-type concurrentMaxLogger struct {
-	mu      sync.Mutex
-	max     int
-	current int
-}
+	// record metrics for requests that are permitted and rejected. In the none and manual modes,
+	// HTTP and gRPC share one limiter.
+	var httpLimiter, grpcLimiter *concurrentlimit.MetricsLimiter
+	switch *limitMode {
+	case limitModeNone:
+		*concurrentRequests = 0
+		*concurrentConnections = 0
+		*grpcConcurrentConnections = 0
+		*grpcConcurrentStreams = 0
+		httpLimiter = concurrentlimit.NewMetricsLimiter(concurrentlimit.NoLimit())
+		grpcLimiter = httpLimiter
+		s.RequestLimiter = httpLimiter
+
+	case limitModeManual:
+		var limiter concurrentlimit.Limiter = concurrentlimit.NoLimit()
+		if *concurrentRequests > 0 {
+			log.Printf("limiting the server to %d concurrent requests", *concurrentRequests)
+			limiter = concurrentlimit.New(*concurrentRequests)
+		}
+		httpLimiter = concurrentlimit.NewMetricsLimiter(rollout(admit(limiter)))
+		grpcLimiter = httpLimiter
+		s.RequestLimiter = httpLimiter
+
+	case limitModeQueued:
+		if *concurrentRequests <= 0 || *queueDepth <= 0 {
+			panic(fmt.Sprintf("concurrentRequests=%d and queueDepth=%d must be > 0",
+				*concurrentRequests, *queueDepth))
+		}
+		log.Printf("limiting the server to %d concurrent requests, queueing up to %d for up to %s",
+			*concurrentRequests, *queueDepth, *queueTimeout)
+		httpLimiter = concurrentlimit.NewMetricsLimiter(
+			rollout(admit(concurrentlimit.NewQueued(*concurrentRequests, *queueDepth))))
+		grpcLimiter = httpLimiter
+		s.RequestLimiter = httpLimiter
+		s.QueueTimeout = *queueTimeout
+
+	case limitModeLibrary:
+		if *concurrentRequests <= 0 {
+			panic(fmt.Sprintf("concurrentRequests=%d must be > 0", *concurrentRequests))
+		}
+		if *concurrentConnections < *concurrentRequests {
+			panic(fmt.Sprintf("concurrentConnections=%d must be >= concurrentRequests=%d",
+				*concurrentConnections, *concurrentRequests))
+		}
+		// separate limits for HTTP and gRPC, so the admin API can change each while running
+		newLimiter := func() concurrentlimit.Limiter {
+			return concurrentlimit.New(*concurrentRequests)
+		}
+		if *latencyTarget > 0 {
+			// the limits adjust themselves, so the admin API only reports them
+			log.Printf("adjusting the request limits up to %d to hold p%g latency under %s",
+				*concurrentRequests, *latencyPercentile, *latencyTarget)
+			newLimiter = func() concurrentlimit.Limiter {
+				return concurrentlimit.NewLatencyTarget(concurrentlimit.LatencyTargetOptions{
+					Target: *latencyTarget, Percentile: *latencyPercentile, MaxLimit: *concurrentRequests})
+			}
+		}
+		httpLimiter = concurrentlimit.NewMetricsLimiter(rollout(admit(newLimiter())))
+		grpcLimiter = concurrentlimit.NewMetricsLimiter(rollout(admit(newLimiter())))
+		if *grpcConcurrentStreams <= 0 {
+			// equivalent to grpclimit.NewServer: MaxConcurrentStreams tells clients the
+			// per-connection limit, so they wait instead of sending streams that will be rejected
+			*grpcConcurrentStreams = *concurrentRequests
+		}
 
-// start records the start of a concurrent request that is terminated when func is called.
-func (c *concurrentMaxLogger) start() func() {
-	c.mu.Lock()
-	c.current++
-	if c.current > c.max {
-		c.max = c.current
-		log.Printf("new max requests=%d", c.max)
+	default:
+		panic(fmt.Sprintf("limitMode=%#v must be one of %s, %s, %s, or %s",
+			*limitMode, limitModeNone, limitModeManual, limitModeQueued, limitModeLibrary))
 	}
-	c.mu.Unlock()
-
-	return c.end
-}
-
-func (c *concurrentMaxLogger) end() {
-	c.mu.Lock()
-	c.current--
-	if c.current < 0 {
-		panic("bug: mismatched calls to startRequest/endRequest")
+	if *grpcConcurrentConnections <= 0 {
+		*grpcConcurrentConnections = *concurrentConnections
+	}
+	var auditLog *concurrentlimit.AuditLog
+	if *auditSize > 0 {
+		if *limitMode != limitModeLibrary {
+			panic(fmt.Sprintf("--auditSize requires --limitMode=%s", limitModeLibrary))
+		}
+		log.Printf("recording %.3f of admission decisions; keeping the last %d", *auditFraction, *auditSize)
+		auditLog = concurrentlimit.NewAuditLog(*auditSize, *auditFraction)
+	}
+	// each protocol has its own limit, so it has its own reserve for trusted requests
+	var trustedHTTP, trustedGRPC *concurrentlimit.TrustedCallers
+	if *trustedIdentities != "" {
+		if *limitMode != limitModeLibrary || auditLog != nil {
+			panic(fmt.Sprintf("--trustedIdentities requires --limitMode=%s, and cannot be used with --auditSize",
+				limitModeLibrary))
+		}
+		log.Printf("requests from trustedIdentities=%s can exceed the limits by trustedReserve=%d (0 is unlimited)",
+			*trustedIdentities, *trustedReserve)
+		trustedHTTP = concurrentlimit.NewTrustedCallers(splitList(*trustedIdentities), *trustedReserve)
+		trustedGRPC = concurrentlimit.NewTrustedCallers(splitList(*trustedIdentities), *trustedReserve)
+	}
+	s.Limiters = []concurrentlimit.Limiter{httpLimiter}
+	concurrentlimit.Register("http", httpLimiter)
+	if grpcLimiter != httpLimiter {
+		s.Limiters = append(s.Limiters, grpcLimiter)
+		concurrentlimit.Register("grpc", grpcLimiter)
 	}
-	c.mu.Unlock()
-}
 
-func main() {
-	httpAddr := flag.String("httpAddr", "localhost:8080", "Address to listen for HTTP requests")
-	grpcAddr := flag.String("grpcAddr", "localhost:8081", "Address to listen for gRPC requests")
-	concurrentRequests := flag.Int("concurrentRequests", 0, "Limits the number of concurrent requests")
-	concurrentConnections := flag.Int("concurrentConnections", 0, "Limits the number of concurrent connections")
-	grpcConcurrentStreams := flag.Int("grpcConcurrentStreams", 0, "Limits the number of concurrent connections")
-	logAll := flag.Bool("logAll", false, "Log all requests")
-	flag.Parse()
+	var rootHandler http.Handler = http.HandlerFunc(s.RootHandler)
+	var apiKeyLimiter *concurrentlimit.KeyedLimiter
+	if *apiKeyLimit > 0 {
+		if *apiKeyCeiling > *apiKeyLimit {
+			log.Printf("limiting concurrent requests for each %s to %d, or %d while fewer than %d requests are running",
+				apiKeyHeader, *apiKeyLimit, *apiKeyCeiling, *concurrentRequests)
+			apiKeyLimiter = concurrentlimit.NewKeyedShared(*apiKeyLimit, *apiKeyCeiling, *concurrentRequests)
+		} else {
+			log.Printf("limiting concurrent requests for each %s to %d", apiKeyHeader, *apiKeyLimit)
+			apiKeyLimiter = concurrentlimit.NewKeyed(*apiKeyLimit)
+		}
+		if *apiKeyRejectionBudget > 0 {
+			apiKeyLimiter.SetRejectionBudget(concurrentlimit.RejectionBudget{
+				Rejections: *apiKeyRejectionBudget, Window: time.Second, MaxWait: *apiKeyMaxWait})
+		}
+		if *apiKeyMaxKeys > 0 {
+			apiKeyLimiter.SetMaxKeys(*apiKeyMaxKeys, concurrentlimit.OverflowShared)
+		}
+		concurrentlimit.RegisterKeyed("api_key", apiKeyLimiter)
+		rootHandler = concurrentlimit.KeyedHandler(apiKeyLimiter, concurrentlimit.HeaderKey(apiKeyHeader), rootHandler)
+	}
 
-	s := newServer(concurrentlimit.NoLimit(), *logAll)
-	if *concurrentRequests > 0 {
-		log.Printf("limiting the server to %d concurrent requests", *concurrentRequests)
-		s.limiter = concurrentlimit.New(*concurrentRequests)
+	if *compress {
+		rootHandler = concurrentlimit.CompressHandler(httpLimiter,
+			concurrentlimit.CompressOptions{ServerTiming: true}, rootHandler)
+	}
+	var profiler *concurrentlimit.Profiler
+	if *profileWarmup > 0 {
+		log.Printf("profiling requests after profileWarmup=%s", *profileWarmup)
+		profiler = concurrentlimit.NewProfiler(concurrentlimit.ProfileOptions{Warmup: *profileWarmup})
+		// the root handler serves every path, so they share one label
+		rootHandler = concurrentlimit.ProfileHandler(profiler, func(*http.Request) string {
+			return "/"
+		}, rootHandler)
 	}
 
 	mux := &http.ServeMux{}
-	mux.HandleFunc("/", s.rawRootHandler)
-	mux.HandleFunc("/stats", s.memstatsHandler)
+	mux.Handle("/", rootHandler)
+	mux.HandleFunc("/stats", s.StatsHandler)
+	mux.Handle("/leak", s.Leaks.Handler())
+	// readiness is checked over HTTP, so it reports the occupancy of the HTTP server
+	s.Health = concurrentlimit.NewHealthReporter(httpLimiter, concurrentlimit.OverloadOptions{})
+	mux.Handle("/healthz", s.Health.LivenessHandler())
+	mux.Handle("/readyz", s.Health.ReadinessHandler())
+	mux.Handle("/metrics", concurrentlimit.MetricsHandler(httpLimiter))
+	if grpcLimiter != httpLimiter {
+		mux.Handle("/metrics/grpc", concurrentlimit.MetricsHandler(grpcLimiter))
+	}
 
 	// copied from http/pprof
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -221,42 +383,391 @@ func main() {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	log.Printf("listening for HTTP on http://%s ...", *httpAddr)
-	httpListener, err := net.Listen("tcp", *httpAddr)
+	var handler http.Handler = mux
+	if *h2cEnabled {
+		log.Printf("accepting h2c (HTTP/2 without TLS) requests")
+		handler = h2c.NewHandler(mux, &http2.Server{})
+	}
+	httpServer := &http.Server{Addr: *httpAddr, Handler: handler, TLSConfig: tlsConfig}
+	if *headerConnections > 0 {
+		log.Printf("limiting HTTP connections reading headers to headerConnections=%d", *headerConnections)
+		httpServer.ConnState = concurrentlimit.NewHeaderLimiter(*headerConnections).ConnState
+	}
+	if *maxConnectionAge > 0 {
+		log.Printf("closing connections after maxConnectionAge=%s", *maxConnectionAge)
+		concurrentlimit.MaxConnectionAge(httpServer, *maxConnectionAge)
+	}
+
+	var ipFilter *concurrentlimit.IPFilter
+	if *allowIPs != "" || *denyIPs != "" {
+		log.Printf("closing connections not from allowIPs=%#v, or from denyIPs=%#v", *allowIPs, *denyIPs)
+		ipFilter, err = concurrentlimit.NewIPFilter(splitList(*allowIPs), splitList(*denyIPs))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	listenOptions := concurrentlimit.ListenOptions{ReadDeadline: *connDeadline, WriteDeadline: *connDeadline}
+	if *connDeadline > 0 {
+		log.Printf("limiting connections to read and write for connDeadline=%s", *connDeadline)
+	}
+	if *bytesPerSecond > 0 || *connBytesPerSecond > 0 {
+		log.Printf("limiting connections to bytesPerSecond=%d and connBytesPerSecond=%d each",
+			*bytesPerSecond, *connBytesPerSecond)
+		// shared by both listeners, so the total for HTTP and gRPC is limited
+		listenOptions.Bandwidth = concurrentlimit.NewBandwidthLimiter(*bytesPerSecond, *connBytesPerSecond)
+		s.Bandwidth = listenOptions.Bandwidth
+	}
+
+	if *concurrentRequests > 0 {
+		// net/http's HTTP/2 server permits 250 streams per connection
+		logLimitWarnings("HTTP", concurrentlimit.Limits{RequestLimit: *concurrentRequests,
+			ConnectionLimit: *concurrentConnections, StreamLimit: 250, HTTP1: true, HTTP2: *h2cEnabled || tlsConfig != nil})
+		logLimitWarnings("gRPC", concurrentlimit.Limits{RequestLimit: *concurrentRequests,
+			ConnectionLimit: *grpcConcurrentConnections, StreamLimit: *grpcConcurrentStreams, HTTP2: true})
+	}
+
+	httpScheme := "http"
+	if tlsConfig != nil {
+		httpScheme = "https"
+	}
+	log.Printf("listening for HTTP on %s://%s limitMode=%s ...", httpScheme, *httpAddr, *limitMode)
+	var httpListener net.Listener
+	if *limitMode == limitModeLibrary {
+		// equivalent to concurrentlimit.ListenAndServe, but with a limiter the admin API can change
+		httpListener, err = listen(*httpAddr, 0, listenOptions, ipFilter)
+		if err != nil {
+			panic(err)
+		}
+		var limiter concurrentlimit.Limiter = httpLimiter
+		if auditLog != nil {
+			// AuditHandler limits the requests instead of ListenerForServer, to record its decisions
+			httpServer.Handler = concurrentlimit.AuditHandler(
+				auditLog, httpLimiter, concurrentlimit.HeaderKey(apiKeyHeader), httpServer.Handler)
+			limiter = concurrentlimit.NoLimit()
+		} else if trustedHTTP != nil {
+			// TrustedHandler limits the requests instead of ListenerForServer, so trusted requests
+			// can exceed the limit
+			httpServer.Handler = concurrentlimit.TrustedHandler(trustedHTTP,
+				trustedHTTPIdentity([]byte(*trustedSigningKey)), httpLimiter, httpServer.Handler)
+			limiter = concurrentlimit.NoLimit()
+		}
+		httpListener, err = concurrentlimit.ListenerForServer(
+			httpServer, httpListener, limiter, *concurrentConnections)
+	} else {
+		httpListener, err = listen(*httpAddr, *concurrentConnections, listenOptions, ipFilter)
+	}
 	if err != nil {
 		panic(err)
 	}
-	if *concurrentConnections > 0 {
-		log.Printf("limiting the HTTP server to %d concurrent connections", *concurrentConnections)
-		httpListener = netutil.LimitListener(httpListener, *concurrentConnections)
+	concurrentlimit.SetRejectPolicy(concurrentlimit.RejectPolicy{LogRejections: *requestIDs, JSON: *rejectJSON})
+	if *requestIDs {
+		// wraps the limit, so rejected requests have IDs
+		httpServer.Handler = concurrentlimit.RequestIDHandler(httpServer.Handler)
 	}
-
+	httpListener = concurrentlimit.RegisterListener("http", s.HTTPConns.Listener(httpListener), *concurrentConnections)
 	go func() {
-		err := http.Serve(httpListener, mux)
-		if err != nil {
+		var err error
+		if tlsConfig != nil {
+			// the certificate is in TLSConfig
+			err = httpServer.ServeTLS(httpListener, "", "")
+		} else {
+			err = httpServer.Serve(httpListener)
+		}
+		if err != http.ErrServerClosed {
 			panic(err)
 		}
 	}()
 
+	if (*limitMode == limitModeLibrary || profiler != nil) && *adminAddr != "" {
+		// the admin server is not limited, so the limit can be raised during overload
+		log.Printf("listening for admin requests on http://%s/limit/http and /limit/grpc ...", *adminAddr)
+		adminMux := &http.ServeMux{}
+		adminMux.Handle("/limit/", concurrentlimit.RegistryHandler("/limit/"))
+		adminMux.Handle("/metrics", concurrentlimit.RegistryMetricsHandler())
+		adminMux.Handle("/config", concurrentlimit.ConfigHandler())
+		// grows the heap and causes garbage collections on demand, to test the limits that react
+		// to memory. It is not limited, so the memory can be released while requests are rejected.
+		adminMux.Handle("/pressure", (&limittest.MemoryPressure{}).Handler())
+		if auditLog != nil {
+			adminMux.Handle("/audit", auditLog.Handler())
+		}
+		if profiler != nil {
+			adminMux.Handle("/profile", profiler.Handler())
+		}
+		go func() {
+			err := http.ListenAndServe(*adminAddr, adminMux)
+			if err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	log.Printf("listening for gRPC on grpcAddr=%s ...", *grpcAddr)
-	grpcListener, err := net.Listen("tcp", *grpcAddr)
+	grpcListener, err := listen(*grpcAddr, *grpcConcurrentConnections, listenOptions, ipFilter)
 	if err != nil {
 		panic(err)
 	}
-	if *concurrentConnections > 0 {
-		log.Printf("limiting the gRPC server to %d concurrent connections", *concurrentConnections)
-		grpcListener = netutil.LimitListener(grpcListener, *concurrentConnections)
-	}
+	grpcListener = concurrentlimit.RegisterListener("grpc", s.GRPCConns.Listener(grpcListener), *grpcConcurrentConnections)
 
 	options := []grpc.ServerOption{}
 	if *grpcConcurrentStreams > 0 {
 		log.Printf("setting grpc MaxConcurrentStreams=%d", *grpcConcurrentStreams)
 		options = append(options, grpc.MaxConcurrentStreams(uint32(*grpcConcurrentStreams)))
 	}
-	grpcServer := grpc.NewServer(options...)
-	sleepymemory.RegisterSleeperServer(grpcServer, s)
-	err = grpcServer.Serve(grpcListener)
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if *maxConnectionAge > 0 {
+		// running requests get as long to complete as they do when shutting down
+		options = append(options, grpclimit.MaxConnectionAge(*maxConnectionAge, *shutdownTimeout))
+	}
+	if *grpcSlowStart > 0 {
+		// the ramp stops at the per-connection limit, if there is one
+		log.Printf("gRPC connections start with %d concurrent streams", *grpcSlowStart)
+		options = append(options, grpclimit.NewSlowStart(*grpcSlowStart, *grpcConcurrentStreams).ServerOptions()...)
+	}
+	if apiKeyLimiter != nil {
+		// chained interceptors run after the library's limit, so rejected requests use no key's slot
+		keyFunc := grpclimit.MetadataKey(apiKeyHeader)
+		options = append(options,
+			grpc.ChainUnaryInterceptor(grpclimit.KeyedUnaryInterceptor(apiKeyLimiter, keyFunc, nil)),
+			grpc.ChainStreamInterceptor(grpclimit.KeyedStreamInterceptor(apiKeyLimiter, keyFunc, nil)))
+	}
+	if *grpcMethodConfig != "" {
+		methodLimiter, err := loadMethodLimiter(*grpcMethodConfig, *concurrentRequests)
+		if err != nil {
+			panic(err)
+		}
+		options = append(options,
+			grpc.ChainUnaryInterceptor(methodLimiter.UnaryInterceptor(nil)),
+			grpc.ChainStreamInterceptor(methodLimiter.StreamInterceptor(nil)))
+	}
+	if profiler != nil {
+		// chained interceptors run after the library's limit, so only admitted requests are profiled
+		options = append(options,
+			grpc.ChainUnaryInterceptor(grpclimit.ProfileUnaryInterceptor(profiler, nil)),
+			grpc.ChainStreamInterceptor(grpclimit.ProfileStreamInterceptor(profiler, nil)))
+	}
+	var grpcServer *grpc.Server
+	if *limitMode == limitModeLibrary {
+		// report utilization so loadclient --grpcLeastLoaded can prefer less loaded servers. Do not
+		// limit reflection and channelz, so operators can inspect an overloaded server.
+		bypass := grpclimit.BypassMethods("/grpc.reflection.v1.ServerReflection/",
+			"/grpc.reflection.v1alpha.ServerReflection/", "/grpc.channelz.v1.Channelz/")
+		loadReporting := grpclimit.LoadReportingUnaryInterceptor(grpcLimiter, nil)
+		unaryLimit := grpclimit.UnaryInterceptor(grpcLimiter, nil)
+		streamLimit := grpclimit.StreamInterceptor(grpcLimiter, nil)
+		if auditLog != nil {
+			// the audit interceptors limit the requests, to record their decisions
+			keyFunc := grpclimit.MetadataKey(apiKeyHeader)
+			unaryLimit = grpclimit.AuditUnaryInterceptor(auditLog, grpcLimiter, keyFunc, nil)
+			streamLimit = grpclimit.AuditStreamInterceptor(auditLog, grpcLimiter, keyFunc, nil)
+		} else if trustedGRPC != nil {
+			// the trusted interceptors limit the requests, so trusted requests can exceed the limit
+			identityFunc := trustedGRPCIdentity([]byte(*trustedSigningKey))
+			unaryLimit = grpclimit.TrustedUnaryInterceptor(trustedGRPC, identityFunc, grpcLimiter, nil)
+			streamLimit = grpclimit.TrustedStreamInterceptor(trustedGRPC, identityFunc, grpcLimiter, nil)
+		}
+		unary := grpclimit.BypassUnary(bypass, unaryLimit, loadReporting)
+		stream := grpclimit.BypassStream(bypass, streamLimit, nil)
+		if *requestIDs {
+			// wraps the limit, so rejected requests have IDs
+			unary = grpclimit.RequestIDUnaryInterceptor(unary)
+			stream = grpclimit.RequestIDStreamInterceptor(stream)
+		}
+
+		// these interceptors limit the requests instead of NewServerWithBypass. The stream
+		// interceptor is first, so it runs before the other chained interceptors, like the
+		// library's limit.
+		options = append([]grpc.ServerOption{grpc.ChainStreamInterceptor(stream)}, options...)
+		grpcServer = grpclimit.NewServerWithBypass(concurrentlimit.NoLimit(), nil, unary, options...)
+	} else {
+		if *requestIDs {
+			// first, so they wrap the limits in the handlers and chained interceptors
+			options = append([]grpc.ServerOption{
+				grpc.ChainUnaryInterceptor(grpclimit.RequestIDUnaryInterceptor(nil)),
+				grpc.ChainStreamInterceptor(grpclimit.RequestIDStreamInterceptor(nil)),
+			}, options...)
+		}
+		grpcServer = grpc.NewServer(options...)
+	}
+	registerGRPCServices(grpcServer, s)
+	go func() {
+		err := grpcServer.Serve(grpcListener)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Printf("shutting down; waiting up to %s for running requests ...", *shutdownTimeout)
+	s.Shutdown(httpServer, grpcServer, *deregistrationDelay, *shutdownTimeout)
+}
+
+// logLimitWarnings logs the warnings from concurrentlimit.CheckLimits for the server's limits.
+func logLimitWarnings(protocol string, limits concurrentlimit.Limits) {
+	warnings, err := concurrentlimit.CheckLimits(limits)
 	if err != nil {
 		panic(err)
 	}
+	for _, warning := range warnings {
+		log.Printf("warning: %s limits: %s", protocol, warning)
+	}
+}
+
+// trustedHTTPIdentity returns the identity of an HTTP request for --trustedIdentities: the
+// identity of its verified client certificate, or of its signed header.
+func trustedHTTPIdentity(signingKey []byte) func(*http.Request) string {
+	signed := concurrentlimit.SignedHeaderIdentity(trustedIdentityHeader, signingKey)
+	return func(r *http.Request) string {
+		if identity := concurrentlimit.ClientCertKey(r); identity != "" {
+			return identity
+		}
+		return signed(r)
+	}
+}
+
+// trustedGRPCIdentity is the gRPC version of trustedHTTPIdentity.
+func trustedGRPCIdentity(signingKey []byte) func(context.Context) string {
+	signed := grpclimit.SignedMetadataIdentity(trustedIdentityHeader, signingKey)
+	return func(ctx context.Context) string {
+		if identity := grpclimit.ClientCertKey(ctx); identity != "" {
+			return identity
+		}
+		return signed(ctx)
+	}
+}
+
+// registerGRPCServices registers the services served by sleepyserver.
+func registerGRPCServices(server *grpc.Server, s *demoserver.Server) {
+	sleepymemory.RegisterSleeperServer(server, s)
+	// inspect the server with grpcurl, and its connections and streams with channelz
+	reflection.Register(server)
+	channelzservice.RegisterChannelzServiceToServer(server)
+}
+
+// loadMethodLimiter reads the gRPC method configs from path. Their costs share capacity
+// concurrentRequests, or are ignored if it is 0.
+func loadMethodLimiter(path string, concurrentRequests int) (*grpclimit.MethodLimiter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	configs, err := grpclimit.ReadMethodConfigs(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var weighted *concurrentlimit.WeightedLimiter
+	if concurrentRequests > 0 {
+		weighted = concurrentlimit.NewWeighted(concurrentRequests)
+	}
+	log.Printf("limiting %d gRPC methods and services from %s", len(configs), path)
+	return grpclimit.NewMethodLimiter(configs, weighted)
+}
+
+// configureAutoLimits sets the limits that are <= 0 from the cgroup's memory limit, using
+// concurrentlimit.AutoSize, and sets GOMAXPROCS from the cgroup's CPU limit.
+func configureAutoLimits(
+	requestBytes int64, concurrentRequests *int, concurrentConnections *int, memLimit *int64,
+) error {
+	limits, err := demoserver.ReadCgroupLimits(demoserver.DefaultCgroupRoot)
+	if err != nil {
+		return err
+	}
+	if limits.CPUs > 0 {
+		procs := int(math.Ceil(limits.CPUs))
+		log.Printf("cgroup CPU limit=%.2f; setting GOMAXPROCS=%d", limits.CPUs, procs)
+		runtime.GOMAXPROCS(procs)
+	}
+	if limits.MemoryBytes <= 0 {
+		log.Printf("no cgroup memory limit; not computing limits")
+		return nil
+	}
+
+	auto := concurrentlimit.AutoSize(concurrentlimit.AutoOptions{
+		MemoryBytes:  limits.MemoryBytes,
+		RequestBytes: requestBytes,
+	})
+	log.Printf("cgroup memory limit=%s MiB; computed concurrentRequests=%d concurrentConnections=%d",
+		demoserver.HumanBytes(uint64(limits.MemoryBytes)), auto.Requests, auto.Connections)
+	if *concurrentRequests <= 0 {
+		*concurrentRequests = auto.Requests
+	}
+	if *concurrentConnections <= 0 {
+		*concurrentConnections = auto.Connections
+	}
+	if *memLimit <= 0 {
+		// leave some headroom for memory the Go runtime does not manage, so the GC works harder
+		// before the container is killed
+		*memLimit = limits.MemoryBytes / 10 * 9
+	}
+	return nil
+}
+
+// splitList returns the comma-separated values in s, or nil if s is empty.
+// newComposite returns a CompositeLimiter that admits requests to limiter with the named signals
+// for --admitSignals. It rejects requests while any signal is over its threshold, or while their
+// average is at least score if it is > 0. The queue delay is relative to maxQueueDelay.
+func newComposite(
+	limiter concurrentlimit.Limiter, names []string, score float64, maxQueueDelay time.Duration,
+) *concurrentlimit.CompositeLimiter {
+	signals := []concurrentlimit.Signal{}
+	for _, name := range names {
+		switch name {
+		case "occupancy":
+			signals = append(signals, concurrentlimit.OccupancySignal(limiter))
+		case "memory":
+			signals = append(signals, concurrentlimit.MemorySignal(0))
+		case "cpu":
+			signals = append(signals, concurrentlimit.CPUSignal(0))
+		case "queue_delay":
+			reporter, ok := limiter.(concurrentlimit.StatsReporter)
+			if !ok || maxQueueDelay <= 0 {
+				panic("--admitSignals=queue_delay requires a limiter that reports its queue delay and --queueTimeout > 0")
+			}
+			signals = append(signals, concurrentlimit.QueueDelaySignal(reporter, maxQueueDelay))
+		default:
+			panic(fmt.Sprintf("--admitSignals: unknown signal %#v", name))
+		}
+	}
+
+	policy := concurrentlimit.AnyExceeds
+	if score > 0 {
+		policy = concurrentlimit.WeightedScore(score)
+	}
+	return concurrentlimit.NewComposite(limiter, policy, signals...)
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// listen returns a listener for addr that accepts at most connectionLimit connections, or any
+// number of connections if connectionLimit <= 0. The connections are configured with options,
+// except its ConnectionLimit. If filter is not nil, it closes the connections filter does not
+// permit before they count against the limit.
+func listen(
+	addr string, connectionLimit int, options concurrentlimit.ListenOptions, filter *concurrentlimit.IPFilter,
+) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		listener = filter.Listener(listener)
+	}
+	options.ConnectionLimit = 0
+	listener = concurrentlimit.LimitListener(listener, options)
+	if connectionLimit > 0 {
+		log.Printf("limiting %s to %d concurrent connections", addr, connectionLimit)
+		listener = netutil.LimitListener(listener, connectionLimit)
+	}
+	return listener, nil
 }
@@ -0,0 +1,151 @@
+// Package sqllimit limits the number of concurrent queries and transactions sent to a database
+// using database/sql. Many overloads start at the database: limiting the work sent to it protects
+// the database the same way the HTTP and gRPC limits protect the server.
+package sqllimit
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/evanj/concurrentlimit"
+)
+
+// DB wraps a *sql.DB so each query, statement, or transaction is an operation of a Limiter. If the
+// limiter is a concurrentlimit.ContextLimiter, such as concurrentlimit.QueuedLimiter, operations
+// wait for capacity until their context is done. Otherwise, operations over the limit fail
+// immediately with concurrentlimit.ErrLimited.
+type DB struct {
+	db      *sql.DB
+	limiter concurrentlimit.Limiter
+}
+
+// New returns a DB that uses limiter to limit the concurrent operations on db.
+func New(db *sql.DB, limiter concurrentlimit.Limiter) *DB {
+	return &DB{db, limiter}
+}
+
+func (d *DB) start(ctx context.Context) (func(), error) {
+	return concurrentlimit.WithContext(d.limiter).StartContext(ctx)
+}
+
+// ExecContext executes a query that does not return rows. See sql.DB.ExecContext.
+func (d *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	end, err := d.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	return d.db.ExecContext(ctx, query, args...)
+}
+
+// QueryContext executes a query that returns rows. The operation ends when the returned Rows is
+// closed, so Close must always be called. See sql.DB.QueryContext.
+func (d *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	end, err := d.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		end()
+		return nil, err
+	}
+	return &Rows{rows, onceFunc(end)}, nil
+}
+
+// QueryRowContext executes a query that is expected to return at most one row. The operation ends
+// when Scan is called, or when Err returns an error. See sql.DB.QueryRowContext.
+func (d *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	end, err := d.start(ctx)
+	if err != nil {
+		return &Row{err: err}
+	}
+	return &Row{row: d.db.QueryRowContext(ctx, query, args...), end: onceFunc(end)}
+}
+
+// BeginTx starts a transaction. The operation ends when the transaction is committed or rolled
+// back. See sql.DB.BeginTx.
+func (d *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	end, err := d.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := d.db.BeginTx(ctx, opts)
+	if err != nil {
+		end()
+		return nil, err
+	}
+	return &Tx{tx, onceFunc(end)}, nil
+}
+
+// Rows is a sql.Rows that ends the limiter operation when it is closed.
+type Rows struct {
+	*sql.Rows
+	end func()
+}
+
+// Close closes the rows and ends the operation.
+func (r *Rows) Close() error {
+	defer r.end()
+	return r.Rows.Close()
+}
+
+// Row is the result of QueryRowContext. It ends the limiter operation when Scan is called, or when
+// Err returns an error.
+type Row struct {
+	row *sql.Row
+	end func()
+	err error
+}
+
+// Scan copies the columns of the row into dest. See sql.Row.Scan.
+func (r *Row) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.end()
+	return r.row.Scan(dest...)
+}
+
+// Err returns the error from running the query, without calling Scan. If it returns an error, the
+// operation ends, since callers usually do not call Scan after an error. See sql.Row.Err.
+func (r *Row) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	err := r.row.Err()
+	if err != nil {
+		r.end()
+	}
+	return err
+}
+
+// Tx is a sql.Tx that ends the limiter operation when it is committed or rolled back.
+type Tx struct {
+	*sql.Tx
+	end func()
+}
+
+// Commit commits the transaction and ends the operation.
+func (t *Tx) Commit() error {
+	defer t.end()
+	return t.Tx.Commit()
+}
+
+// Rollback aborts the transaction and ends the operation. It is safe to call Rollback after Commit,
+// so it can be deferred.
+func (t *Tx) Rollback() error {
+	defer t.end()
+	return t.Tx.Rollback()
+}
+
+// onceFunc returns a function that only calls f the first time it is called. Transactions are
+// commonly committed with a deferred Rollback, which must not end the operation twice.
+func onceFunc(f func()) func() {
+	var once sync.Once
+	return func() { once.Do(f) }
+}
@@ -0,0 +1,204 @@
+package sqllimit
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/evanj/concurrentlimit"
+)
+
+// fakeDriver implements just enough of database/sql/driver to run queries that return one row
+// containing the integer 1.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{}, nil
+}
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{}, nil }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeRows{}, nil
+}
+
+// errQuery is returned by fakeConn for the query "fail".
+var errQuery = errors.New("fake query failure")
+
+func (fakeConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	if query == "fail" {
+		return nil, errQuery
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct {
+	done bool
+}
+
+func (r *fakeRows) Columns() []string { return []string{"value"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(1)
+	return nil
+}
+
+func init() {
+	sql.Register("sqllimitfake", fakeDriver{})
+}
+
+func openFake(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqllimitfake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestLimited(t *testing.T) {
+	ctx := context.Background()
+	db := New(openFake(t), concurrentlimit.New(1))
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the transaction is using the only slot
+	_, err = db.ExecContext(ctx, "exec")
+	if err != concurrentlimit.ErrLimited {
+		t.Fatal("expected ErrLimited:", err)
+	}
+	var value int
+	err = db.QueryRowContext(ctx, "query").Scan(&value)
+	if err != concurrentlimit.ErrLimited {
+		t.Fatal("expected ErrLimited:", err)
+	}
+
+	// the deferred Rollback after Commit must not end the operation twice
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if !errors.Is(err, sql.ErrTxDone) {
+		t.Fatal("expected ErrTxDone:", err)
+	}
+
+	rows, err := db.QueryContext(ctx, "query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		err = rows.Scan(&value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = rows.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 1 {
+		t.Error("unexpected value:", value)
+	}
+
+	err = db.QueryRowContext(ctx, "query").Scan(&value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueued(t *testing.T) {
+	ctx := context.Background()
+	db := New(openFake(t), concurrentlimit.NewQueued(1, 1))
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a waiting operation gives up when its context is done
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	_, err = db.ExecContext(timeoutCtx, "exec")
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatal("expected DeadlineExceeded:", err)
+	}
+
+	// a waiting operation starts when the transaction ends
+	execErr := make(chan error)
+	go func() {
+		_, err := db.ExecContext(ctx, "exec")
+		execErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-execErr
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRowErr(t *testing.T) {
+	ctx := context.Background()
+	db := New(openFake(t), concurrentlimit.New(1))
+
+	// a failed query ends the operation when Err is called, without calling Scan
+	err := db.QueryRowContext(ctx, "fail").Err()
+	if err != errQuery {
+		t.Fatal("expected errQuery:", err)
+	}
+	var value int
+	err = db.QueryRowContext(ctx, "query").Scan(&value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Err then Scan on a successful query ends the operation once
+	row := db.QueryRowContext(ctx, "query")
+	err = row.Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = row.Scan(&value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
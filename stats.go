@@ -0,0 +1,94 @@
+package concurrentlimit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes the state of a limiter at one point in time.
+type Stats struct {
+	// Current is the number of running operations. For WeightedLimiter, it is their total cost.
+	Current int
+	// Limit is the maximum value of Current.
+	Limit int
+	// Peak is the maximum value of Current since the limiter was created.
+	Peak int
+	// Queued is the number of operations waiting to start.
+	Queued int
+	// QueueDelay is how long the oldest queued operation has been waiting.
+	QueueDelay time.Duration
+}
+
+// StatsReporter is implemented by limiters that can report their state, including the limiters
+// returned by New, NewQueued, and NewWeighted.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// ApproxReporter is implemented by limiters that can report their occupancy without locking, for
+// code that reads it on every request, such as CompressHandler and load reporting, so reading it
+// does not contend with starting operations. Limiters that wrap another limiter implement it by
+// calling the wrapped limiter, which uses Stats if it does not implement it.
+type ApproxReporter interface {
+	// CurrentApprox returns the number of running operations and the limit, like Stats. They are
+	// read separately, so they may not be from exactly the same moment.
+	CurrentApprox() (current int, limit int)
+}
+
+// approxStats holds a copy of a limiter's running operations and limit in atomic variables. The
+// limiter updates it while holding its mutex, and CurrentApprox reads it without locking.
+type approxStats struct {
+	approxCurrent atomic.Int64
+	approxLimit   atomic.Int64
+}
+
+// storeApprox updates the copy of the running operations and limit.
+func (a *approxStats) storeApprox(current int, limit int) {
+	a.approxCurrent.Store(int64(current))
+	a.approxLimit.Store(int64(limit))
+}
+
+// CurrentApprox returns the number of running operations and the limit without locking. It
+// implements ApproxReporter.
+func (a *approxStats) CurrentApprox() (int, int) {
+	return int(a.approxCurrent.Load()), int(a.approxLimit.Load())
+}
+
+// currentApprox returns the running operations and limit of limiter with CurrentApprox, or Stats
+// if it does not implement ApproxReporter. It returns zeros if it implements neither.
+func currentApprox(limiter Limiter) (int, int) {
+	if approx, ok := limiter.(ApproxReporter); ok {
+		return approx.CurrentApprox()
+	}
+	if reporter, ok := limiter.(StatsReporter); ok {
+		stats := reporter.Stats()
+		return stats.Current, stats.Limit
+	}
+	return 0, 0
+}
+
+// Stats returns the current state of the limiter.
+func (s *syncLimiter) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{Current: s.current, Limit: s.max, Peak: s.peak}
+}
+
+// Stats returns the current state of the limiter.
+func (q *QueuedLimiter) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := Stats{Current: q.current, Limit: q.max, Peak: q.peak, Queued: q.waiters.Len()}
+	if front := q.waiters.Front(); front != nil {
+		stats.QueueDelay = q.clock.Now().Sub(front.Value.(*queueWaiter).queuedAt)
+	}
+	return stats
+}
+
+// Stats returns the current state of the limiter.
+func (w *WeightedLimiter) Stats() Stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Stats{Current: w.current, Limit: w.max, Peak: w.peak}
+}
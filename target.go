@@ -0,0 +1,186 @@
+package concurrentlimit
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyTargetMinSamples is the number of operations an interval needs for LatencyTargetLimiter
+// to change the limit. Fewer operations do not measure a high percentile.
+const latencyTargetMinSamples = 20
+
+// LatencyTargetOptions configures NewLatencyTarget. Target and MaxLimit are required.
+type LatencyTargetOptions struct {
+	// Target is the latency that Percentile of the operations must complete within, e.g. 250ms.
+	Target time.Duration
+	// Percentile is the percentile of operation durations that must be at most Target, from 0 to
+	// 100. If <= 0, the default is 99.
+	Percentile float64
+	// MinLimit and MaxLimit bound the limit. If MinLimit <= 0, the default is 1.
+	MinLimit int
+	MaxLimit int
+	// InitialLimit is the limit before the first adjustment. If <= 0, the default is MaxLimit, so
+	// a new limiter is never stricter than a fixed limit of MaxLimit.
+	InitialLimit int
+	// Interval is how often the limit is adjusted. If <= 0, the default is one second.
+	Interval time.Duration
+}
+
+// LatencyTargetLimiter is a Limiter that searches for the largest limit that keeps a percentile of
+// the operation durations under a target, such as keeping p99 under 250ms, instead of requiring
+// the limit to be configured. After each interval where the percentile was under the target and
+// the limit was reached, it raises the limit by 10% (at least 1); after each interval where the
+// percentile was over the target, it lowers the limit by 25%. Operations that were rejected are not
+// measured. Like the limiter returned by New, it does not queue operations.
+type LatencyTargetLimiter struct {
+	options LatencyTargetOptions
+	limiter *syncLimiter
+	clock   Clock
+
+	mu            sync.Mutex
+	intervalStart time.Time
+	durations     []time.Duration
+	// reached is true if the limit rejected an operation or was reached during the interval
+	reached bool
+	// observed is the percentile of the last interval that changed the limit
+	observed time.Duration
+}
+
+// NewLatencyTarget returns a LatencyTargetLimiter configured with options. It panics if
+// options.Target or options.MaxLimit are not set, or the limits are not consistent.
+func NewLatencyTarget(options LatencyTargetOptions) *LatencyTargetLimiter {
+	if options.Percentile <= 0 {
+		options.Percentile = 99
+	}
+	if options.MinLimit <= 0 {
+		options.MinLimit = 1
+	}
+	if options.InitialLimit <= 0 {
+		options.InitialLimit = options.MaxLimit
+	}
+	if options.Interval <= 0 {
+		options.Interval = time.Second
+	}
+	if options.Target <= 0 || options.Percentile > 100 {
+		panic(fmt.Sprintf("NewLatencyTarget: Target=%s must be > 0 and Percentile=%f must be <= 100",
+			options.Target, options.Percentile))
+	}
+	if !(options.MinLimit <= options.InitialLimit && options.InitialLimit <= options.MaxLimit) {
+		panic(fmt.Sprintf("NewLatencyTarget: must have MinLimit=%d <= InitialLimit=%d <= MaxLimit=%d",
+			options.MinLimit, options.InitialLimit, options.MaxLimit))
+	}
+
+	l := &LatencyTargetLimiter{
+		options: options,
+		limiter: New(options.InitialLimit).(*syncLimiter),
+		clock:   systemClock{},
+	}
+	l.intervalStart = l.clock.Now()
+	return l
+}
+
+// SetClock replaces the clock used to measure operations and intervals, which is the system clock
+// by default. It must be called before the limiter is used.
+func (l *LatencyTargetLimiter) SetClock(clock Clock) {
+	l.clock = clock
+	l.intervalStart = clock.Now()
+}
+
+// Start begins an operation if the current limit permits it. It implements Limiter.
+func (l *LatencyTargetLimiter) Start() (func(), error) {
+	end, err := l.limiter.Start()
+	if err != nil {
+		l.mu.Lock()
+		l.reached = true
+		l.mu.Unlock()
+		return nil, err
+	}
+
+	start := l.clock.Now()
+	if current, limit := l.limiter.CurrentApprox(); current >= limit {
+		l.mu.Lock()
+		l.reached = true
+		l.mu.Unlock()
+	}
+	return func() {
+		end()
+		l.end(l.clock.Now().Sub(start))
+	}, nil
+}
+
+// end records the duration of an operation, and adjusts the limit at the end of an interval.
+func (l *LatencyTargetLimiter) end(duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.durations = append(l.durations, duration)
+
+	now := l.clock.Now()
+	if now.Sub(l.intervalStart) < l.options.Interval || len(l.durations) < latencyTargetMinSamples {
+		return
+	}
+	l.adjustLocked()
+	l.intervalStart = now
+	l.durations = l.durations[:0]
+	l.reached = false
+}
+
+// adjustLocked changes the limit based on the durations of the interval that ended. l.mu must be
+// held.
+func (l *LatencyTargetLimiter) adjustLocked() {
+	sort.Slice(l.durations, func(i int, j int) bool {
+		return l.durations[i] < l.durations[j]
+	})
+	index := int(math.Ceil(l.options.Percentile/100*float64(len(l.durations)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	l.observed = l.durations[index]
+
+	limit := l.limiter.Stats().Limit
+	next := limit
+	if l.observed <= l.options.Target {
+		// only raise the limit if it was reached: otherwise this says nothing about a higher limit
+		if l.reached {
+			next += limit / 10
+			if next == limit {
+				next++
+			}
+		}
+	} else {
+		next -= limit / 4
+		if next == limit {
+			next--
+		}
+	}
+	if next > l.options.MaxLimit {
+		next = l.options.MaxLimit
+	}
+	if next < l.options.MinLimit {
+		next = l.options.MinLimit
+	}
+	if next != limit {
+		l.limiter.SetLimit(next)
+	}
+}
+
+// Observed returns the percentile of the operation durations in the last interval that was used
+// to adjust the limit, or 0 before the first adjustment.
+func (l *LatencyTargetLimiter) Observed() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.observed
+}
+
+// Stats returns the current state of the limiter, where Limit is the current limit.
+func (l *LatencyTargetLimiter) Stats() Stats {
+	return l.limiter.Stats()
+}
+
+// CurrentApprox returns the number of running operations and the current limit without locking.
+// It implements ApproxReporter.
+func (l *LatencyTargetLimiter) CurrentApprox() (int, int) {
+	return l.limiter.CurrentApprox()
+}
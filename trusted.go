@@ -0,0 +1,133 @@
+package concurrentlimit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// TrustedCallers identifies internal callers, such as control-plane services, whose requests must
+// not be shed with end-user traffic during overload. Trusted requests start on the server's
+// limiter like other requests while it has capacity, so they count toward its occupancy. When it
+// rejects them, they start on a separate reserve instead, so trusted callers get an elevated
+// limit of the server's limit plus the reserve. Without a reserve, they bypass the limit.
+//
+// Identities must be authenticated, for example with ClientCertKey, which returns the SPIFFE ID
+// or common name of a verified client certificate, or with SignedHeaderIdentity. Identities that
+// clients can choose, such as HeaderKey, let any client bypass the limit.
+type TrustedCallers struct {
+	identities map[string]bool
+	// reserve is nil if trusted requests bypass the limit
+	reserve Limiter
+}
+
+// NewTrustedCallers returns a TrustedCallers that trusts identities. Trusted requests rejected by
+// the server's limiter start on a reserve of reserve concurrent requests, or bypass the limit if
+// reserve is 0. It panics if an identity is empty or reserve < 0.
+func NewTrustedCallers(identities []string, reserve int) *TrustedCallers {
+	if reserve < 0 {
+		panic(fmt.Sprintf("NewTrustedCallers: reserve=%d must be >= 0", reserve))
+	}
+	t := &TrustedCallers{identities: map[string]bool{}}
+	for _, identity := range identities {
+		if identity == "" {
+			panic("NewTrustedCallers: identities must not be empty")
+		}
+		t.identities[identity] = true
+	}
+	if reserve > 0 {
+		t.reserve = New(reserve)
+	}
+	return t
+}
+
+// Trusted returns true if identity is trusted.
+func (t *TrustedCallers) Trusted(identity string) bool {
+	return t.identities[identity]
+}
+
+// Start begins an operation for a request from identity. Requests from other identities only
+// start on limiter. Trusted requests that limiter rejects start on the reserve, or bypass the
+// limit if there is no reserve.
+func (t *TrustedCallers) Start(limiter Limiter, identity string) (func(), error) {
+	end, err := limiter.Start()
+	if err != ErrLimited || !t.Trusted(identity) {
+		return end, err
+	}
+	if t.reserve == nil {
+		return func() {}, nil
+	}
+	return t.reserve.Start()
+}
+
+// Stats returns the state of the reserve. It is the zero Stats if trusted requests bypass the
+// limit.
+func (t *TrustedCallers) Stats() Stats {
+	if t.reserve == nil {
+		return Stats{}
+	}
+	return t.reserve.(StatsReporter).Stats()
+}
+
+// TrustedHandler is a version of Handler that lets requests from the trusted identities returned
+// by identityFunc, such as ClientCertKey, exceed the limit. See TrustedCallers.
+func TrustedHandler(
+	trusted *TrustedCallers, identityFunc func(*http.Request) string, limiter Limiter, handler http.Handler,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		end, err := trusted.Start(limiter, identityFunc(r))
+		if err == ErrLimited {
+			WriteLimiterRejection(w, limiter, ShedCapacity, err)
+			return
+		}
+		if err != nil {
+			// this should not happen, but if it does return a very generic 500 error
+			log.Println("concurrentlimit.TrustedHandler BUG: unexpected error: " + err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		ctx, release := WithOperation(r.Context(), end)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+		release()
+	})
+}
+
+// SignIdentity returns a value for SignedHeaderIdentity that proves a caller is identity to
+// servers that share key: identity, a period, and the base64 encoded HMAC-SHA256 of identity. The
+// value does not expire, so it must only be sent over TLS, and key must be rotated if it leaks.
+func SignIdentity(key []byte, identity string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(identity))
+	return identity + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignedIdentity returns the identity in a value created by SignIdentity with key, or false
+// if the value is not signed with key. Nothing is verified with an empty key, since anyone can
+// sign with it.
+func VerifySignedIdentity(key []byte, value string) (string, bool) {
+	// the identity may contain periods, but the signature does not
+	separator := strings.LastIndexByte(value, '.')
+	if len(key) == 0 || separator <= 0 {
+		return "", false
+	}
+	identity := value[:separator]
+	if !hmac.Equal([]byte(SignIdentity(key, identity)), []byte(value)) {
+		return "", false
+	}
+	return identity, true
+}
+
+// SignedHeaderIdentity returns an identity function for TrustedHandler that returns the identity
+// in the request header name, if it was signed with key by SignIdentity. Requests without a valid
+// signature return the empty string.
+func SignedHeaderIdentity(name string, key []byte) func(*http.Request) string {
+	return func(r *http.Request) string {
+		identity, _ := VerifySignedIdentity(key, r.Header.Get(name))
+		return identity
+	}
+}
@@ -0,0 +1,143 @@
+package concurrentlimit
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// DefaultCostHeader is the HTTP header (or gRPC metadata key, in lower case) that CostPolicy
+// reads when Header is not set.
+const DefaultCostHeader = "X-Request-Cost"
+
+// WeightedLimiter limits the total cost of concurrent operations, where expensive operations can
+// use more than one unit of capacity.
+type WeightedLimiter struct {
+	approxStats
+	mu      sync.Mutex
+	max     int
+	current int
+	peak    int
+}
+
+// NewWeighted returns a WeightedLimiter that permits concurrent operations with a total cost of
+// capacity. It will panic if capacity <= 0.
+func NewWeighted(capacity int) *WeightedLimiter {
+	if capacity <= 0 {
+		panic(fmt.Sprintf("capacity must be > 0: %d", capacity))
+	}
+	w := &WeightedLimiter{max: capacity}
+	w.storeApprox(0, capacity)
+	return w
+}
+
+// Start begins a new operation with a cost of 1. It implements Limiter.
+func (w *WeightedLimiter) Start() (func(), error) {
+	return w.StartN(1)
+}
+
+// StartN begins a new operation with a cost of n. It returns a completion function that must be
+// called when the operation completes, or it returns ErrLimited if there is not enough capacity.
+// It will panic if n <= 0.
+func (w *WeightedLimiter) StartN(n int) (func(), error) {
+	if n <= 0 {
+		panic(fmt.Sprintf("n must be > 0: %d", n))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next := w.current + n
+	if next > w.max {
+		return nil, ErrLimited
+	}
+	w.current = next
+	if w.current > w.peak {
+		w.peak = w.current
+	}
+	w.storeApprox(w.current, w.max)
+
+	return func() { w.end(n) }, nil
+}
+
+func (w *WeightedLimiter) end(n int) {
+	w.mu.Lock()
+	w.current -= n
+	if w.current < 0 {
+		panic("bug: mismatched calls to start/end")
+	}
+	w.storeApprox(w.current, w.max)
+	w.mu.Unlock()
+}
+
+// CostPolicy describes how to determine the cost of a request from a value declared by the
+// client, such as the X-Request-Cost header.
+type CostPolicy struct {
+	// Header is the name of the HTTP header or gRPC metadata key containing the cost. If empty,
+	// DefaultCostHeader is used.
+	Header string
+	// Default is the cost of requests that do not declare a cost. If <= 0, the default is 1.
+	Default int
+	// Max is the maximum cost. Larger declared costs are reduced to Max. If <= 0, there is no
+	// maximum other than the capacity of the limiter. This should be <= the limiter's capacity,
+	// otherwise requests with large costs will always be rejected.
+	Max int
+}
+
+// HeaderName returns the header or metadata key containing the declared cost.
+func (c CostPolicy) HeaderName() string {
+	if c.Header == "" {
+		return DefaultCostHeader
+	}
+	return c.Header
+}
+
+// Cost returns the cost of a request that declared value, which may be empty. It returns an
+// error if value is not a positive integer.
+func (c CostPolicy) Cost(value string) (int, error) {
+	if value == "" {
+		if c.Default <= 0 {
+			return 1, nil
+		}
+		return c.Default, nil
+	}
+
+	cost, err := strconv.Atoi(value)
+	if err != nil || cost <= 0 {
+		return 0, fmt.Errorf("invalid %s=%#v: must be an integer > 0", c.HeaderName(), value)
+	}
+	if c.Max > 0 && cost > c.Max {
+		cost = c.Max
+	}
+	return cost, nil
+}
+
+// WeightedHandler returns an http.Handler that starts an operation on limiter with the cost
+// declared by each request, as described by policy. Requests with an invalid cost are rejected
+// with http.StatusBadRequest.
+func WeightedHandler(limiter *WeightedLimiter, policy CostPolicy, handler http.Handler) http.Handler {
+	header := policy.HeaderName()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cost, err := policy.Cost(r.Header.Get(header))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		end, err := limiter.StartN(cost)
+		if err == ErrLimited {
+			WriteLimiterRejection(w, limiter, ShedCapacity, err)
+			return
+		}
+		if err != nil {
+			log.Println("concurrentlimit.WeightedHandler BUG: unexpected error: " + err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer end()
+
+		handler.ServeHTTP(w, r)
+	})
+}